@@ -19,15 +19,15 @@ package main
 
 import (
 	"bufio"
-	"context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"golang.org/x/crypto/ssh/terminal"
 
-	"github.com/ljanyst/peroxide/pkg/bridge"
-	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/admin"
 )
 
 func askPass(prompt string) ([]byte, error) {
@@ -48,84 +48,68 @@ func askPass(prompt string) ([]byte, error) {
 	return b, err
 }
 
-func listAccounts(b *bridge.Bridge) {
-	for idx, user := range b.Users.GetUsers() {
-		fmt.Printf("%3d: %s ", idx, user.Username())
+func listAccounts(c *admin.Client) error {
+	accounts, err := c.ListAccounts()
+	if err != nil {
+		return err
+	}
+
+	for idx, account := range accounts {
+		fmt.Printf("%3d: %s ", idx, account.Username)
 
 		fmt.Printf("| addresses: ")
-		for _, address := range user.GetAddresses() {
+		for _, address := range account.Addresses {
 			fmt.Printf("%s ", address)
 		}
 
+		fmt.Printf("| mode: %s ", account.AddressMode)
+
+		if account.SyncMonths != 0 {
+			fmt.Printf("| sync: last %d months ", account.SyncMonths)
+		}
+		if len(account.SyncLabels) != 0 {
+			fmt.Printf("| sync labels: %s ", strings.Join(account.SyncLabels, ", "))
+		}
+
 		fmt.Printf("| keys: ")
-		slots, _ := user.ListKeySlots()
-		for _, slot := range slots {
+		for _, slot := range account.Keys {
 			fmt.Printf("%s ", slot)
 		}
 
+		if account.Offline {
+			fmt.Printf("| offline ")
+		}
+		if account.PendingChanges != 0 {
+			fmt.Printf("| %d pending changes ", account.PendingChanges)
+		}
+
+		if !account.Connected {
+			fmt.Printf("| logged out")
+		}
+
 		fmt.Println()
 	}
+
+	return nil
 }
 
-func deleteAccount(b *bridge.Bridge, accountName string) error {
+func deleteAccount(c *admin.Client, accountName string) error {
 	if accountName == "" {
 		return fmt.Errorf("Missing account name")
 	}
 
-	userArr := b.Users.GetUsers()
-	if len(userArr) == 0 {
-		return fmt.Errorf("No registered user accounts")
-	}
-
-	var user *users.User
-
-	for _, u := range userArr {
-		if u.Username() == accountName {
-			user = u
-			break
-		}
-	}
-
-	if user == nil {
-		return fmt.Errorf("Account %s not found", accountName)
-	}
-
-	if err := user.Logout(); err != nil {
-		return fmt.Errorf("Logout of account %s failed: %s", accountName, err)
-	}
-
-	if err := b.Users.DeleteUser(user.ID(), true); err != nil {
+	if err := c.DeleteAccount(accountName); err != nil {
 		return fmt.Errorf("Deletion of account %s failed: %s", accountName, err)
 	}
 
 	return nil
 }
 
-func loginAccount(b *bridge.Bridge, accountName string) error {
+func loginAccount(c *admin.Client, accountName string) error {
 	if accountName == "" {
 		return fmt.Errorf("Missing account name")
 	}
 
-	user, _ := b.Users.GetUser(accountName)
-	if user != nil {
-		mainKey, err := askPass("Main key")
-		if err != nil {
-			return fmt.Errorf("The main key is required to modify an existing user: %s", err)
-		}
-
-		if len(mainKey) == 0 {
-			return fmt.Errorf("The main key is required to modify an existing user")
-		}
-
-		if err := user.UnlockCredentials("main", string(mainKey)); err != nil {
-			return fmt.Errorf("Unable to unlock credentials: %s", err)
-		}
-
-		if err := user.Logout(); err != nil {
-			return fmt.Errorf("Unable to logout previous session: %s", err)
-		}
-	}
-
 	password, err := askPass("Password")
 	if err != nil {
 		return fmt.Errorf("Unable to read password: %s", err)
@@ -136,12 +120,26 @@ func loginAccount(b *bridge.Bridge, accountName string) error {
 	}
 
 	fmt.Printf("Authenticating %s...\n", accountName)
-	client, auth, err := b.Users.Login(accountName, password)
-	if err != nil {
+	state, err := c.Login(accountName, password, "")
+	if err == admin.ErrMainKeyRequired {
+		mainKey, err := askPass("Main key")
+		if err != nil {
+			return fmt.Errorf("The main key is required to modify an existing user: %s", err)
+		}
+
+		if len(mainKey) == 0 {
+			return fmt.Errorf("The main key is required to modify an existing user")
+		}
+
+		state, err = c.Login(accountName, password, string(mainKey))
+		if err != nil {
+			return fmt.Errorf("Login of account %s failed: %s", accountName, err)
+		}
+	} else if err != nil {
 		return fmt.Errorf("Login of account %s failed: %s", accountName, err)
 	}
 
-	if auth.HasTwoFactor() {
+	if state.TwoFactor {
 		scanner := bufio.NewScanner(os.Stdin)
 		fmt.Printf("2FA TOTP code: ")
 		scanner.Scan()
@@ -151,48 +149,43 @@ func loginAccount(b *bridge.Bridge, accountName string) error {
 			return fmt.Errorf("Empty 2FA TOTP code")
 		}
 
-		err = client.Auth2FA(context.Background(), code)
+		state, err = c.SubmitTwoFactor(state.ID, code)
 		if err != nil {
 			return fmt.Errorf("2FA of account %s failed: %s", accountName, err)
 		}
 	}
 
-	mailboxPassword := password
-	if auth.HasMailboxPassword() {
-		mailboxPassword, err = askPass("Mailbox password: ")
+	var mailboxPassword []byte
+	if state.MailboxPassword {
+		mailboxPassword, err = askPass("Mailbox password")
 		if err != nil {
 			return fmt.Errorf("Unable to read mailbox password: %s", err)
 		}
-	}
 
-	if len(mailboxPassword) == 0 {
-		return fmt.Errorf("Empty mailbox password")
+		if len(mailboxPassword) == 0 {
+			return fmt.Errorf("Empty mailbox password")
+		}
 	}
 
-	user, key, err := b.Users.FinishLogin(client, auth, mailboxPassword, "")
+	res, err := c.FinishLogin(state.ID, mailboxPassword)
 	if err != nil {
 		return fmt.Errorf("Login of account %s failed: %s", accountName, err)
 	}
 
-	fmt.Printf("Account %s has been added successfully.\n", user.Username())
-	if len(key) != 0 {
-		fmt.Printf("Main key: %s\n", key)
+	fmt.Printf("Account %s has been added successfully.\n", res.Username)
+	if len(res.MainKey) != 0 {
+		fmt.Printf("Main key: %s\n", res.MainKey)
 		fmt.Printf("PLEASE MAKE SURE TO NOTE THE KEY. IT'S NOT STORED ANYWHERE.\n")
 	}
 
 	return nil
 }
 
-func addKey(b *bridge.Bridge, accountName, keyName string) error {
+func addKey(c *admin.Client, accountName, keyName string) error {
 	if accountName == "" || keyName == "" {
 		return fmt.Errorf("Key name or account name empty")
 	}
 
-	user, err := b.Users.GetUser(accountName)
-	if err != nil {
-		return fmt.Errorf("Cannot get user data: %s", err)
-	}
-
 	mainKey, err := askPass("Main key")
 	if err != nil {
 		return fmt.Errorf("The main key is required to add a new key: %s", err)
@@ -202,7 +195,7 @@ func addKey(b *bridge.Bridge, accountName, keyName string) error {
 		return fmt.Errorf("The main key is required to add a new key")
 	}
 
-	key, err := user.AddKeySlot(keyName, string(mainKey))
+	key, err := c.AddKey(accountName, keyName, string(mainKey))
 	if err != nil {
 		return fmt.Errorf("Cannot add key slot: %s", err)
 	}
@@ -213,15 +206,150 @@ func addKey(b *bridge.Bridge, accountName, keyName string) error {
 	return nil
 }
 
-func removeKey(b *bridge.Bridge, accountName, keyName string) error {
+func removeKey(c *admin.Client, accountName, keyName string) error {
+	if accountName == "" || keyName == "" {
+		return fmt.Errorf("Key name or account name empty")
+	}
+
+	return c.RemoveKey(accountName, keyName)
+}
+
+func resyncAccount(c *admin.Client, accountName string) error {
+	if accountName == "" {
+		return fmt.Errorf("Missing account name")
+	}
+
+	return c.Resync(accountName)
+}
+
+func syncStatus(c *admin.Client, accountName string) error {
+	if accountName == "" {
+		return fmt.Errorf("Missing account name")
+	}
+
+	status, err := c.SyncStatus(accountName)
+	if err != nil {
+		return err
+	}
+
+	if !status.Running {
+		fmt.Println("No sync is running")
+		return nil
+	}
+
+	fmt.Printf("Synced %d of %d messages", status.Fetched, status.Total)
+	if status.Total > 0 {
+		fmt.Printf(" (%.0f%%)", 100*float64(status.Fetched)/float64(status.Total))
+	}
+	fmt.Printf(", started %s", status.Started.Format(time.RFC1123))
+	if status.ETA > 0 {
+		fmt.Printf(", about %s left", status.ETA.Round(time.Second))
+	}
+	fmt.Println()
+
+	if status.StartID != "" || status.StopID != "" {
+		fmt.Printf("Fetching IDs from %q to %q\n", status.StartID, status.StopID)
+	}
+
+	return nil
+}
+
+func listOutbox(c *admin.Client, accountName string) error {
+	if accountName == "" {
+		return fmt.Errorf("Missing account name")
+	}
+
+	messages, err := c.ListOutbox(accountName)
+	if err != nil {
+		return err
+	}
+
+	if len(messages) == 0 {
+		fmt.Println("The outbox is empty")
+		return nil
+	}
+
+	for _, msg := range messages {
+		fmt.Printf("%s | %s -> %s | queued %s", msg.ID, msg.From, strings.Join(msg.To, ", "), msg.Queued.Format(time.RFC1123))
+		if msg.Attempts > 0 {
+			fmt.Printf(" | %d attempts, next %s", msg.Attempts, msg.NextAttempt.Format(time.RFC1123))
+		}
+		fmt.Println()
+
+		if msg.LastError != "" {
+			fmt.Printf("    %s\n", msg.LastError)
+		}
+	}
+
+	return nil
+}
+
+func flushOutbox(c *admin.Client, accountName string) error {
+	if accountName == "" {
+		return fmt.Errorf("Missing account name")
+	}
+
+	flushed, err := c.FlushOutbox(accountName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Sending %d queued messages\n", flushed)
+	return nil
+}
+
+func verifyCache(c *admin.Client, accountName, keyName string) error {
 	if accountName == "" || keyName == "" {
 		return fmt.Errorf("Key name or account name empty")
 	}
 
-	user, err := b.Users.GetUser(accountName)
+	key, err := askPass("Key")
 	if err != nil {
-		return fmt.Errorf("Cannot get user data: %s", err)
+		return fmt.Errorf("The key is required to read the cache: %s", err)
+	}
+
+	if len(key) == 0 {
+		return fmt.Errorf("The key is required to read the cache")
+	}
+
+	res, err := c.VerifyCache(accountName, keyName, string(key))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Checked %d cached messages, %d corrupted and queued to be cached again\n", res.Checked, res.Corrupted)
+	fmt.Printf("Removed %d cached messages of deleted messages\n", res.Orphans)
+
+	return nil
+}
+
+func setAddressMode(c *admin.Client, accountName, mode string) error {
+	if accountName == "" {
+		return fmt.Errorf("Missing account name")
+	}
+
+	if mode != admin.CombinedMode && mode != admin.SplitMode {
+		return fmt.Errorf("Address mode must be either %s or %s", admin.CombinedMode, admin.SplitMode)
+	}
+
+	return c.SetAddressMode(accountName, mode)
+}
+
+func setSyncPolicy(c *admin.Client, accountName string, months int, labels string) error {
+	if accountName == "" {
+		return fmt.Errorf("Missing account name")
+	}
+
+	if months < 0 {
+		return fmt.Errorf("The number of months must not be negative")
+	}
+
+	var labelList []string
+	for _, label := range strings.Split(labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labelList = append(labelList, label)
+		}
 	}
 
-	return user.RemoveKeySlot(keyName)
+	return c.SetSyncPolicy(accountName, months, labelList)
 }
@@ -22,18 +22,22 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/ljanyst/peroxide/pkg/bridge"
+	"github.com/ljanyst/peroxide/pkg/admin"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
 	"github.com/ljanyst/peroxide/pkg/logging"
 )
 
 var config = flag.String("config", "/etc/peroxide.conf", "configuration file")
-var action = flag.String("action", "", "one of: gen-x509, list-accounts, delete-account, login-account, add-key, remove-key")
+var action = flag.String("action", "", "one of: gen-x509, list-accounts, delete-account, login-account, add-key, remove-key, resync-account, sync-status, set-address-mode, set-sync-policy, list-outbox, flush-outbox, verify-cache, reload")
 var x509Org = flag.String("x509-org", "", "organization name to be used in X509 certificate")
 var x509Cn = flag.String("x509-cn", "", "common name to be used in X509 certificate")
 var x509KeyFile = flag.String("x509-key", "key.pem", "output file for the RSA key")
 var x509CertFile = flag.String("x509-cert", "cert.pem", "output file for the X509 certificate")
 var accountName = flag.String("account-name", "", "account name")
 var keyName = flag.String("key-name", "", "key name")
+var addressMode = flag.String("address-mode", "", "address mode: combined or split")
+var syncMonths = flag.Int("sync-months", 0, "sync only the messages of the last months, 0 for all")
+var syncLabels = flag.String("sync-labels", "", "comma separated mailboxes to sync, empty for all")
 var logLevel = flag.String("log-level", "Warning", "account name")
 
 func main() {
@@ -42,27 +46,45 @@ func main() {
 
 	logging.SetLevel(*logLevel)
 
-	b := &bridge.Bridge{}
+	var err error
+	var c *admin.Client
 
-	err := b.Configure(*config)
-	if err != nil {
-		fmt.Printf("Failed to configure the bridge: %s\n", err)
-		os.Exit(1)
+	if *action != "gen-x509" {
+		if c, err = newClient(*config); err != nil {
+			fmt.Printf("Failed to configure the admin client: %s\n", err)
+			os.Exit(1)
+		}
 	}
 
 	switch *action {
 	case "gen-x509":
 		err = generateX509(*x509Org, *x509Cn, *x509CertFile, *x509KeyFile)
 	case "list-accounts":
-		listAccounts(b)
+		err = listAccounts(c)
 	case "delete-account":
-		err = deleteAccount(b, *accountName)
+		err = deleteAccount(c, *accountName)
 	case "login-account":
-		err = loginAccount(b, *accountName)
+		err = loginAccount(c, *accountName)
 	case "add-key":
-		err = addKey(b, *accountName, *keyName)
+		err = addKey(c, *accountName, *keyName)
 	case "remove-key":
-		err = removeKey(b, *accountName, *keyName)
+		err = removeKey(c, *accountName, *keyName)
+	case "resync-account":
+		err = resyncAccount(c, *accountName)
+	case "sync-status":
+		err = syncStatus(c, *accountName)
+	case "set-address-mode":
+		err = setAddressMode(c, *accountName, *addressMode)
+	case "set-sync-policy":
+		err = setSyncPolicy(c, *accountName, *syncMonths, *syncLabels)
+	case "list-outbox":
+		err = listOutbox(c, *accountName)
+	case "flush-outbox":
+		err = flushOutbox(c, *accountName)
+	case "verify-cache":
+		err = verifyCache(c, *accountName, *keyName)
+	case "reload":
+		err = c.Reload()
 	default:
 		done = false
 	}
@@ -78,3 +100,17 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newClient connects to the admin API of the server using the same
+// configuration file.
+func newClient(configFile string) (*admin.Client, error) {
+	settingsObj := settings.New(configFile)
+
+	token, err := admin.LoadToken(settingsObj.Get(settings.AdminTokenKey))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the admin token: %s", err)
+	}
+
+	network, address := admin.Endpoint(settingsObj)
+	return admin.NewClient(network, address, token), nil
+}
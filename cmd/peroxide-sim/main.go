@@ -0,0 +1,95 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/logging"
+	"github.com/ljanyst/peroxide/pkg/pmapi/simulator"
+	"github.com/sirupsen/logrus"
+)
+
+// userList collects the users given on the command line as
+// name:password:email[,email...].
+type userList [][]string
+
+func (l *userList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *userList) Set(value string) error {
+	fields := strings.SplitN(value, ":", 3)
+	if len(fields) != 3 || fields[0] == "" || fields[2] == "" {
+		return fmt.Errorf("expected name:password:email[,email...]")
+	}
+
+	*l = append(*l, append(fields[:2], strings.Split(fields[2], ",")...))
+	return nil
+}
+
+var listen = flag.String("listen", "127.0.0.1:8080", "address to serve the API on")
+var logLevel = flag.String("log-level", "Warning", "log level")
+var fixtures = flag.String("fixtures", "pkg/pmapi/testdata", "directory of the pmapi test fixtures to create the default user from")
+var users userList
+
+// fixturesWanted returns whether to create the user of the fixtures: when
+// asked for explicitly or when no users are given.
+func fixturesWanted() bool {
+	wanted := len(users) == 0
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "fixtures" {
+			wanted = true
+		}
+	})
+	return wanted
+}
+
+func main() {
+	flag.Var(&users, "user", "user to create as name:password:email[,email...], may be repeated")
+	flag.Parse()
+
+	logging.SetLevel(*logLevel)
+
+	sim := simulator.New()
+
+	if fixturesWanted() {
+		if _, err := sim.AddFixtures(*fixtures); err != nil {
+			logrus.WithError(err).Fatal("Failed to create the user of the fixtures")
+			os.Exit(1)
+		}
+	}
+
+	for _, u := range users {
+		if _, err := sim.AddUser(u[0], u[1], u[2:]...); err != nil {
+			logrus.WithError(err).Fatal("Failed to create the user")
+			os.Exit(1)
+		}
+	}
+
+	logrus.WithField("address", *listen).Info("Serving the simulated API")
+
+	if err := http.ListenAndServe(*listen, sim); err != nil {
+		logrus.WithError(err).Fatal("Simulator exited with error")
+		os.Exit(1)
+	}
+}
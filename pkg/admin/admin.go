@@ -0,0 +1,229 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package admin implements the administrative API served by the running
+// bridge and the client used by peroxide-cfg to talk to it.
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	log = logrus.WithField("pkg", "admin") //nolint:gochecknoglobals
+
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrNotFound         = errors.New("not found")
+	ErrMainKeyRequired  = errors.New("the main key is required to modify an existing account")
+	ErrAccountOffline   = errors.New("account is not online")
+	ErrNoSuchLogin      = errors.New("no such login in progress")
+	ErrTwoFactorPending = errors.New("two-factor authentication has not been completed")
+	ErrBadAddressMode   = errors.New("address mode must be either combined or split")
+	ErrBadSyncPolicy    = errors.New("the sync window must not be negative")
+)
+
+// Address modes of an account.
+const (
+	CombinedMode = "combined"
+	SplitMode    = "split"
+)
+
+// Account describes a user account known to the bridge.
+type Account struct {
+	ID          string   `json:"id"`
+	Username    string   `json:"username"`
+	Connected   bool     `json:"connected"`
+	AddressMode string   `json:"addressMode"`
+	Addresses   []string `json:"addresses"`
+	Keys        []string `json:"keys"`
+	SyncMonths  int      `json:"syncMonths,omitempty"`
+	SyncLabels  []string `json:"syncLabels,omitempty"`
+
+	// Offline accounts serve the local data only and journal the changes
+	// until the server is reachable again.
+	Offline        bool `json:"offline,omitempty"`
+	PendingChanges int  `json:"pendingChanges,omitempty"`
+}
+
+// AddKeyRequest asks for a new key slot sealed by the main key.
+type AddKeyRequest struct {
+	Name    string `json:"name"`
+	MainKey string `json:"mainKey"`
+}
+
+// AddressModeRequest switches the account between the combined and the split
+// address mode.
+type AddressModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+// SyncStatus describes the progress of the full sync of an account. StartID
+// and StopID delimit one of the ID ranges currently being fetched.
+type SyncStatus struct {
+	Running bool          `json:"running"`
+	Total   int           `json:"total"`
+	Fetched int           `json:"fetched"`
+	StartID string        `json:"startID,omitempty"`
+	StopID  string        `json:"stopID,omitempty"`
+	Started time.Time     `json:"started"`
+	ETA     time.Duration `json:"eta"`
+}
+
+// SyncPolicyRequest limits the sync of the account to the messages of the
+// last months and to the labels, given by their mailbox names. Zero months
+// and no labels sync everything.
+type SyncPolicyRequest struct {
+	Months int      `json:"months"`
+	Labels []string `json:"labels"`
+}
+
+// QueuedMessage describes a message accepted over SMTP which waits in the
+// outbox of an account to be sent.
+type QueuedMessage struct {
+	ID          string    `json:"id"`
+	From        string    `json:"from"`
+	To          []string  `json:"to"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// FlushResponse tells how many queued messages are going to be sent now.
+type FlushResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+// VerifyCacheRequest carries the key of a key slot of the account, which is
+// needed to read its cached messages.
+type VerifyCacheRequest struct {
+	KeyName string `json:"keyName"`
+	Key     string `json:"key"`
+}
+
+// VerifyCacheResponse tells how many cached messages were read, how many of
+// them were corrupted and queued to be cached again, and how many cached
+// messages of deleted messages were removed.
+type VerifyCacheResponse struct {
+	Checked   int `json:"checked"`
+	Corrupted int `json:"corrupted"`
+	Orphans   int `json:"orphans"`
+}
+
+// KeyResponse carries a newly generated key.
+type KeyResponse struct {
+	Key string `json:"key"`
+}
+
+// LoginRequest starts an interactive login. The main key is only needed when
+// logging in an account that already exists.
+type LoginRequest struct {
+	Account  string `json:"account"`
+	Password []byte `json:"password"`
+	MainKey  string `json:"mainKey,omitempty"`
+}
+
+// LoginState tells the client what the login in progress needs next.
+type LoginState struct {
+	ID              string `json:"id"`
+	TwoFactor       bool   `json:"twoFactor"`
+	MailboxPassword bool   `json:"mailboxPassword"`
+}
+
+// TwoFactorRequest carries the TOTP code of a login in progress.
+type TwoFactorRequest struct {
+	Code string `json:"code"`
+}
+
+// FinishLoginRequest finishes a login in progress. The mailbox password is
+// only needed if the login state asked for it.
+type FinishLoginRequest struct {
+	MailboxPassword []byte `json:"mailboxPassword,omitempty"`
+}
+
+// FinishLoginResponse describes the logged in account. The main key is only
+// returned for newly added accounts.
+type FinishLoginResponse struct {
+	Username string `json:"username"`
+	MainKey  string `json:"mainKey,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Endpoint returns the network and the address the admin API is served at:
+// the unix socket if one is configured, the API port on localhost otherwise.
+func Endpoint(s *settings.Settings) (network, address string) {
+	if socket := s.Get(settings.AdminSocketKey); socket != "" {
+		return "unix", socket
+	}
+	return "tcp", fmt.Sprintf("127.0.0.1:%d", s.GetInt(settings.APIPortKey))
+}
+
+// LoadToken reads the admin API token from path.
+func LoadToken(path string) (string, error) {
+	token, err := ioutil.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// LoadOrCreateToken reads the admin API token from path, generating it first
+// if it does not exist. Only the owner can read the file.
+func LoadOrCreateToken(path string) (string, error) {
+	token, err := LoadToken(path)
+	if err == nil {
+		return token, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if token, err = generateID(); err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		return "", err
+	}
+
+	log.WithField("path", path).Info("Generated new admin token")
+
+	return token, nil
+}
+
+func generateID() (string, error) {
+	id := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
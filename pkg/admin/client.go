@@ -0,0 +1,237 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// Client talks to the admin API of a running bridge.
+type Client struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewClient returns a client of the admin API served at address of the given
+// network (unix or tcp).
+func NewClient(network, address, token string) *Client {
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+
+	return &Client{
+		baseURL: "http://peroxide",
+		token:   token,
+		client:  &http.Client{Transport: transport},
+	}
+}
+
+func (c *Client) do(method string, in, out interface{}, path ...string) error {
+	u := c.baseURL
+	for _, p := range path {
+		u += "/" + url.PathEscape(p)
+	}
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "cannot reach the admin API, is peroxide running?")
+	}
+	defer res.Body.Close() //nolint:errcheck
+
+	if res.StatusCode >= http.StatusBadRequest {
+		var errRes errorResponse
+		if err := json.NewDecoder(res.Body).Decode(&errRes); err != nil || errRes.Error == "" {
+			return fmt.Errorf("admin request failed: %s", res.Status)
+		}
+		return decodeError(errRes.Error)
+	}
+
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// decodeError maps the error message back to the error the server returned
+// so that the callers can check for it.
+func decodeError(msg string) error {
+	for _, err := range []error{
+		ErrUnauthorized,
+		ErrNotFound,
+		ErrMainKeyRequired,
+		ErrAccountOffline,
+		ErrNoSuchLogin,
+		ErrTwoFactorPending,
+		ErrBadAddressMode,
+		ErrBadSyncPolicy,
+	} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// ListAccounts lists the accounts known to the bridge.
+func (c *Client) ListAccounts() ([]Account, error) {
+	var accounts []Account
+	if err := c.do(http.MethodGet, nil, &accounts, "accounts"); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// DeleteAccount logs out and removes the account including its local data.
+func (c *Client) DeleteAccount(account string) error {
+	return c.do(http.MethodDelete, nil, nil, "accounts", account)
+}
+
+// AddKey adds a new key slot to the account and returns the generated key.
+func (c *Client) AddKey(account, keyName, mainKey string) (string, error) {
+	var res KeyResponse
+	req := AddKeyRequest{Name: keyName, MainKey: mainKey}
+	if err := c.do(http.MethodPost, req, &res, "accounts", account, "keys"); err != nil {
+		return "", err
+	}
+	return res.Key, nil
+}
+
+// RemoveKey removes the key slot from the account.
+func (c *Client) RemoveKey(account, keyName string) error {
+	return c.do(http.MethodDelete, nil, nil, "accounts", account, "keys", keyName)
+}
+
+// Resync triggers a full sync of the account.
+func (c *Client) Resync(account string) error {
+	return c.do(http.MethodPost, nil, nil, "accounts", account, "resync")
+}
+
+// SyncStatus returns the progress of the full sync of the account.
+func (c *Client) SyncStatus(account string) (*SyncStatus, error) {
+	var status SyncStatus
+	if err := c.do(http.MethodGet, nil, &status, "accounts", account, "sync"); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// SetAddressMode switches the account to the combined or the split address mode.
+func (c *Client) SetAddressMode(account, mode string) error {
+	req := AddressModeRequest{Mode: mode}
+	return c.do(http.MethodPut, req, nil, "accounts", account, "address-mode")
+}
+
+// SetSyncPolicy limits the sync of the account to the messages of the last
+// months and to the labels. Zero months and no labels sync everything.
+func (c *Client) SetSyncPolicy(account string, months int, labels []string) error {
+	req := SyncPolicyRequest{Months: months, Labels: labels}
+	return c.do(http.MethodPut, req, nil, "accounts", account, "sync-policy")
+}
+
+// ListOutbox lists the messages waiting in the outbox of the account.
+func (c *Client) ListOutbox(account string) ([]QueuedMessage, error) {
+	var messages []QueuedMessage
+	if err := c.do(http.MethodGet, nil, &messages, "accounts", account, "outbox"); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// FlushOutbox sends all the messages waiting in the outbox of the account now
+// and returns how many there are.
+func (c *Client) FlushOutbox(account string) (int, error) {
+	var res FlushResponse
+	if err := c.do(http.MethodPost, nil, &res, "accounts", account, "outbox", "flush"); err != nil {
+		return 0, err
+	}
+	return res.Flushed, nil
+}
+
+// VerifyCache reads the cached messages of the account, which the key of the
+// key slot unlocks. The corrupted ones are cached again, the ones of deleted
+// messages are removed.
+func (c *Client) VerifyCache(account, keyName, key string) (*VerifyCacheResponse, error) {
+	var res VerifyCacheResponse
+	req := VerifyCacheRequest{KeyName: keyName, Key: key}
+	if err := c.do(http.MethodPost, req, &res, "accounts", account, "verify-cache"); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Login starts an interactive login of the account. ErrMainKeyRequired is
+// returned if the account exists and no main key was given.
+func (c *Client) Login(account string, password []byte, mainKey string) (*LoginState, error) {
+	var state LoginState
+	req := LoginRequest{Account: account, Password: password, MainKey: mainKey}
+	if err := c.do(http.MethodPost, req, &state, "logins"); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// SubmitTwoFactor submits the TOTP code of the login in progress.
+func (c *Client) SubmitTwoFactor(id, code string) (*LoginState, error) {
+	var state LoginState
+	if err := c.do(http.MethodPost, TwoFactorRequest{Code: code}, &state, "logins", id, "2fa"); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// FinishLogin finishes the login in progress and adds or reconnects the account.
+func (c *Client) FinishLogin(id string, mailboxPassword []byte) (*FinishLoginResponse, error) {
+	var res FinishLoginResponse
+	req := FinishLoginRequest{MailboxPassword: mailboxPassword}
+	if err := c.do(http.MethodPost, req, &res, "logins", id, "finish"); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Reload makes the bridge read its configuration file again.
+func (c *Client) Reload() error {
+	return c.do(http.MethodPost, nil, nil, "reload")
+}
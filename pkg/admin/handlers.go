@@ -0,0 +1,482 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/pkg/errors"
+)
+
+func (s *Server) getUser(account string) (*users.User, error) {
+	user, err := s.users.GetUser(account)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *Server) listAccounts(w http.ResponseWriter, r *http.Request) {
+	accounts := []Account{}
+	for _, user := range s.users.GetUsers() {
+		keys, err := user.ListKeySlots()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		mode := SplitMode
+		if user.IsCombinedAddressMode() {
+			mode = CombinedMode
+		}
+
+		account := Account{
+			ID:          user.ID(),
+			Username:    user.Username(),
+			Connected:   user.IsConnected(),
+			AddressMode: mode,
+			Addresses:   user.GetAddresses(),
+			Keys:        keys,
+		}
+
+		if userStore := user.GetStore(); userStore != nil {
+			policy := userStore.SyncPolicy()
+			account.SyncMonths = policy.Months
+			if len(policy.LabelIDs) != 0 {
+				account.SyncLabels = userStore.LabelNames(policy.LabelIDs)
+			}
+
+			account.Offline = userStore.IsOffline()
+			account.PendingChanges = userStore.PendingChanges()
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	writeJSON(w, http.StatusOK, accounts)
+}
+
+func (s *Server) deleteAccount(w http.ResponseWriter, r *http.Request, account string) {
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := s.users.DeleteUser(user.ID(), true); err != nil {
+		writeError(w, errors.Wrapf(err, "deletion of account %s failed", account))
+		return
+	}
+
+	log.WithField("account", account).Info("Account deleted")
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) addKey(w http.ResponseWriter, r *http.Request, account string) {
+	var req AddKeyRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Name == "" || req.MainKey == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "key name and main key are required"})
+		return
+	}
+
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	key, err := user.AddKeySlot(req.Name, req.MainKey)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.WithField("account", account).WithField("key", req.Name).Info("Key added")
+	writeJSON(w, http.StatusOK, KeyResponse{Key: key})
+}
+
+func (s *Server) removeKey(w http.ResponseWriter, r *http.Request, account, keyName string) {
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := user.RemoveKeySlot(keyName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.WithField("account", account).WithField("key", keyName).Info("Key removed")
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) resync(w http.ResponseWriter, r *http.Request, account string) {
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	store := user.GetStore()
+	if store == nil || !user.IsConnected() {
+		writeError(w, ErrAccountOffline)
+		return
+	}
+
+	store.TriggerSync()
+
+	log.WithField("account", account).Info("Resync triggered")
+	writeJSON(w, http.StatusAccepted, nil)
+}
+
+func (s *Server) syncStatus(w http.ResponseWriter, r *http.Request, account string) {
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	store := user.GetStore()
+	if store == nil {
+		writeError(w, ErrAccountOffline)
+		return
+	}
+
+	progress := store.SyncProgress()
+	writeJSON(w, http.StatusOK, SyncStatus{
+		Running: progress.Running,
+		Total:   progress.Total,
+		Fetched: progress.Fetched,
+		StartID: progress.StartID,
+		StopID:  progress.StopID,
+		Started: progress.Started,
+		ETA:     progress.ETA,
+	})
+}
+
+func (s *Server) listOutbox(w http.ResponseWriter, r *http.Request, account string) {
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	store := user.GetStore()
+	if store == nil {
+		writeError(w, ErrAccountOffline)
+		return
+	}
+
+	queued, err := store.QueuedMessages()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	messages := []QueuedMessage{}
+	for _, msg := range queued {
+		messages = append(messages, QueuedMessage{
+			ID:          msg.ID,
+			From:        msg.ReturnPath,
+			To:          msg.To,
+			Queued:      msg.Queued,
+			Attempts:    msg.Attempts,
+			NextAttempt: msg.NextAttempt,
+			LastError:   msg.LastError,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func (s *Server) flushOutbox(w http.ResponseWriter, r *http.Request, account string) {
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	store := user.GetStore()
+	if store == nil || !user.IsConnected() {
+		writeError(w, ErrAccountOffline)
+		return
+	}
+
+	flushed, err := store.FlushOutbox()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.WithField("account", account).WithField("messages", flushed).Info("Outbox flushed")
+	writeJSON(w, http.StatusAccepted, FlushResponse{Flushed: flushed})
+}
+
+func (s *Server) setAddressMode(w http.ResponseWriter, r *http.Request, account string) {
+	var req AddressModeRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Mode != CombinedMode && req.Mode != SplitMode {
+		writeError(w, ErrBadAddressMode)
+		return
+	}
+
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := user.SetAddressMode(req.Mode == CombinedMode); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.WithField("account", account).WithField("mode", req.Mode).Info("Address mode changed")
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) setSyncPolicy(w http.ResponseWriter, r *http.Request, account string) {
+	var req SyncPolicyRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Months < 0 {
+		writeError(w, ErrBadSyncPolicy)
+		return
+	}
+
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	userStore := user.GetStore()
+	if userStore == nil || !user.IsConnected() {
+		writeError(w, ErrAccountOffline)
+		return
+	}
+
+	labelIDs, err := userStore.ResolveLabelIDs(req.Labels)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := userStore.SetSyncPolicy(store.SyncPolicy{Months: req.Months, LabelIDs: labelIDs}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	log.WithField("account", account).WithField("months", req.Months).WithField("labels", req.Labels).Info("Sync policy changed")
+	writeJSON(w, http.StatusNoContent, nil)
+}
+
+func (s *Server) verifyCache(w http.ResponseWriter, r *http.Request, account string) {
+	var req VerifyCacheRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.KeyName == "" || req.Key == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "key name and key are required"})
+		return
+	}
+
+	user, err := s.getUser(account)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := user.CheckCredentials(req.KeyName, req.Key); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := user.BringOnline(req.KeyName, req.Key); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	userStore := user.GetStore()
+	if userStore == nil {
+		writeError(w, ErrAccountOffline)
+		return
+	}
+
+	report, err := userStore.VerifyCache()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, VerifyCacheResponse{
+		Checked:   report.Checked,
+		Corrupted: len(report.Corrupted),
+		Orphans:   report.Orphans,
+	})
+}
+
+func (s *Server) startLogin(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Account == "" || len(req.Password) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "account name and password are required"})
+		return
+	}
+
+	// Logging in an existing account replaces its API session.
+	if user, _ := s.users.GetUser(req.Account); user != nil {
+		if req.MainKey == "" {
+			writeError(w, ErrMainKeyRequired)
+			return
+		}
+
+		if err := user.UnlockCredentials("main", req.MainKey); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if err := user.Logout(); err != nil {
+			writeError(w, errors.Wrap(err, "unable to logout previous session"))
+			return
+		}
+	}
+
+	client, auth, err := s.users.Login(req.Account, req.Password)
+	if err != nil {
+		writeError(w, errors.Wrapf(err, "login of account %s failed", req.Account))
+		return
+	}
+
+	session := &loginSession{
+		account:  req.Account,
+		client:   client,
+		auth:     auth,
+		password: req.Password,
+		mainKey:  req.MainKey,
+	}
+
+	id, err := s.logins.add(session)
+	if err != nil {
+		session.abort()
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, session.state(id))
+}
+
+func (s *Server) twoFactor(w http.ResponseWriter, r *http.Request, id string) {
+	var req TwoFactorRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	session, err := s.logins.get(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if req.Code == "" {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "empty 2FA TOTP code"})
+		return
+	}
+
+	if err := session.client.Auth2FA(context.Background(), req.Code); err != nil {
+		writeError(w, errors.Wrapf(err, "2FA of account %s failed", session.account))
+		return
+	}
+
+	session.twoFactorDone = true
+	writeJSON(w, http.StatusOK, session.state(id))
+}
+
+func (s *Server) finishLogin(w http.ResponseWriter, r *http.Request, id string) {
+	var req FinishLoginRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	session, err := s.logins.get(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if session.state(id).TwoFactor {
+		writeError(w, ErrTwoFactorPending)
+		return
+	}
+
+	mailboxPassword := session.password
+	if session.auth.HasMailboxPassword() {
+		mailboxPassword = req.MailboxPassword
+	}
+
+	if len(mailboxPassword) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "empty mailbox password"})
+		return
+	}
+
+	s.logins.remove(id)
+
+	user, key, err := s.users.FinishLogin(session.client, session.auth, mailboxPassword, session.mainKey)
+	session.clear()
+	if err != nil {
+		writeError(w, errors.Wrapf(err, "login of account %s failed", session.account))
+		return
+	}
+
+	// Existing accounts are still holding the client of the previous session.
+	if key == "" {
+		if err := user.Connect(session.client); err != nil {
+			writeError(w, errors.Wrapf(err, "connecting account %s failed", session.account))
+			return
+		}
+	}
+
+	log.WithField("account", user.Username()).Info("Account logged in")
+	writeJSON(w, http.StatusOK, FinishLoginResponse{Username: user.Username(), MainKey: key})
+}
+
+func (s *Server) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if err := s.reload(); err != nil {
+		writeError(w, errors.Wrap(err, "reload failed"))
+		return
+	}
+
+	writeJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+// loginTimeout is how long an interactive login may stay unfinished.
+const loginTimeout = 10 * time.Minute
+
+// loginSession is an interactive login in progress.
+type loginSession struct {
+	account       string
+	client        pmapi.Client
+	auth          *pmapi.Auth
+	password      []byte
+	mainKey       string
+	twoFactorDone bool
+	expires       time.Time
+}
+
+func (s *loginSession) state(id string) *LoginState {
+	return &LoginState{
+		ID:              id,
+		TwoFactor:       s.auth.HasTwoFactor() && !s.twoFactorDone,
+		MailboxPassword: s.auth.HasMailboxPassword(),
+	}
+}
+
+// abort deletes the API session and clears the password.
+func (s *loginSession) abort() {
+	if err := s.client.AuthDelete(context.Background()); err != nil {
+		log.WithError(err).Warn("Failed to delete auth of an abandoned login")
+	}
+	s.clear()
+}
+
+func (s *loginSession) clear() {
+	for i := range s.password {
+		s.password[i] = 0
+	}
+}
+
+type loginSessions struct {
+	lock     sync.Mutex
+	sessions map[string]*loginSession
+}
+
+func newLoginSessions() *loginSessions {
+	return &loginSessions{sessions: make(map[string]*loginSession)}
+}
+
+func (l *loginSessions) add(session *loginSession) (string, error) {
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+
+	session.expires = time.Now().Add(loginTimeout)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.removeExpired()
+	l.sessions[id] = session
+
+	return id, nil
+}
+
+func (l *loginSessions) get(id string) (*loginSession, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.removeExpired()
+
+	session, ok := l.sessions[id]
+	if !ok {
+		return nil, ErrNoSuchLogin
+	}
+	return session, nil
+}
+
+func (l *loginSessions) remove(id string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.sessions, id)
+}
+
+// removeExpired must be called with the lock held.
+func (l *loginSessions) removeExpired() {
+	now := time.Now()
+	for id, session := range l.sessions {
+		if now.After(session.expires) {
+			delete(l.sessions, id)
+			go session.abort()
+		}
+	}
+}
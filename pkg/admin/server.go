@@ -0,0 +1,246 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/store/cache"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Server serves the admin API of a running bridge. Every request needs to
+// carry the admin token as a bearer token.
+type Server struct {
+	network string
+	address string
+	token   string
+	users   *users.Users
+	reload  func() error
+	logins  *loginSessions
+
+	server *http.Server
+}
+
+// NewServer returns an admin server listening at address of the given network
+// (unix or tcp), managing users and reloading the configuration with reload.
+func NewServer(network, address, token string, users *users.Users, reload func() error) *Server {
+	server := &Server{
+		network: network,
+		address: address,
+		token:   token,
+		users:   users,
+		reload:  reload,
+		logins:  newLoginSessions(),
+	}
+
+	server.server = &http.Server{
+		Handler:  server,
+		ErrorLog: stdlog.New(log.WriterLevel(logrus.ErrorLevel), "", 0),
+	}
+	return server
+}
+
+// ListenAndServe listens on the configured address and serves the requests
+// until the server is closed.
+func (s *Server) ListenAndServe() {
+	l := log.WithField("network", s.network).WithField("address", s.address)
+
+	if s.network == "unix" {
+		// A socket left behind by a process that did not exit cleanly.
+		if err := os.Remove(s.address); err != nil && !os.IsNotExist(err) {
+			l.WithError(err).Error("Cannot remove stale socket")
+			return
+		}
+	}
+
+	listener, err := net.Listen(s.network, s.address)
+	if err != nil {
+		l.WithError(err).Error("Cannot start listener")
+		return
+	}
+
+	if s.network == "unix" {
+		if err := os.Chmod(s.address, 0o600); err != nil {
+			l.WithError(err).Error("Cannot restrict access to the socket")
+			_ = listener.Close()
+			return
+		}
+	}
+
+	l.Info("Starting admin server")
+	err = s.server.Serve(listener)
+	l.WithError(err).Debug("Admin server not serving")
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	if err := s.server.Close(); err != nil {
+		log.WithError(err).Error("Issue when closing admin server")
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(header, prefix))
+	return subtle.ConstantTimeCompare(token, []byte(s.token)) == 1
+}
+
+// ServeHTTP routes the requests:
+//
+//	GET    /accounts
+//	DELETE /accounts/{account}
+//	POST   /accounts/{account}/keys
+//	DELETE /accounts/{account}/keys/{key}
+//	POST   /accounts/{account}/resync
+//	GET    /accounts/{account}/sync
+//	PUT    /accounts/{account}/address-mode
+//	PUT    /accounts/{account}/sync-policy
+//	GET    /accounts/{account}/outbox
+//	POST   /accounts/{account}/outbox/flush
+//	POST   /accounts/{account}/verify-cache
+//	POST   /logins
+//	POST   /logins/{id}/2fa
+//	POST   /logins/{id}/finish
+//	POST   /reload
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, ErrUnauthorized)
+		return
+	}
+
+	path, err := splitPath(r.URL.EscapedPath())
+	if err != nil {
+		writeError(w, ErrNotFound)
+		return
+	}
+
+	route := func(method string, segments int, prefix ...string) bool {
+		if r.Method != method || len(path) != segments {
+			return false
+		}
+		for i, p := range prefix {
+			if p != "" && path[i] != p {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch {
+	case route(http.MethodGet, 1, "accounts"):
+		s.listAccounts(w, r)
+	case route(http.MethodDelete, 2, "accounts"):
+		s.deleteAccount(w, r, path[1])
+	case route(http.MethodPost, 3, "accounts", "", "keys"):
+		s.addKey(w, r, path[1])
+	case route(http.MethodDelete, 4, "accounts", "", "keys"):
+		s.removeKey(w, r, path[1], path[3])
+	case route(http.MethodPost, 3, "accounts", "", "resync"):
+		s.resync(w, r, path[1])
+	case route(http.MethodGet, 3, "accounts", "", "sync"):
+		s.syncStatus(w, r, path[1])
+	case route(http.MethodPut, 3, "accounts", "", "address-mode"):
+		s.setAddressMode(w, r, path[1])
+	case route(http.MethodPut, 3, "accounts", "", "sync-policy"):
+		s.setSyncPolicy(w, r, path[1])
+	case route(http.MethodGet, 3, "accounts", "", "outbox"):
+		s.listOutbox(w, r, path[1])
+	case route(http.MethodPost, 4, "accounts", "", "outbox", "flush"):
+		s.flushOutbox(w, r, path[1])
+	case route(http.MethodPost, 3, "accounts", "", "verify-cache"):
+		s.verifyCache(w, r, path[1])
+	case route(http.MethodPost, 1, "logins"):
+		s.startLogin(w, r)
+	case route(http.MethodPost, 3, "logins", "", "2fa"):
+		s.twoFactor(w, r, path[1])
+	case route(http.MethodPost, 3, "logins", "", "finish"):
+		s.finishLogin(w, r, path[1])
+	case route(http.MethodPost, 1, "reload"):
+		s.reloadConfig(w, r)
+	default:
+		writeError(w, ErrNotFound)
+	}
+}
+
+func splitPath(path string) ([]string, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		var err error
+		if segments[i], err = url.PathUnescape(segment); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Failed to write the response")
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch errors.Cause(err) {
+	case ErrUnauthorized:
+		status = http.StatusUnauthorized
+	case credentials.ErrUnauthorized:
+		status = http.StatusForbidden
+	case ErrBadAddressMode, ErrBadSyncPolicy, store.ErrUnknownLabel:
+		status = http.StatusBadRequest
+	case ErrNotFound, ErrNoSuchLogin, credentials.ErrNotFound:
+		status = http.StatusNotFound
+	case ErrMainKeyRequired, ErrAccountOffline, ErrTwoFactorPending,
+		credentials.ErrAlreadyExists, credentials.ErrCantRemoveMainSlot,
+		users.ErrUserAlreadyConnected, users.ErrLoggedOutUser,
+		cache.ErrCacheNeedsUnlock, cache.ErrNotVerifiable:
+		status = http.StatusConflict
+	default:
+		log.WithError(err).Warn("Admin request failed")
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return false
+	}
+	return true
+}
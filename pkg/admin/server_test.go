@@ -0,0 +1,123 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/users"
+	r "github.com/stretchr/testify/require"
+)
+
+func TestLoadOrCreateToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.token")
+
+	_, err := LoadToken(path)
+	r.Error(t, err)
+
+	token, err := LoadOrCreateToken(path)
+	r.NoError(t, err)
+	r.NotEmpty(t, token)
+
+	loaded, err := LoadToken(path)
+	r.NoError(t, err)
+	r.Equal(t, token, loaded)
+
+	again, err := LoadOrCreateToken(path)
+	r.NoError(t, err)
+	r.Equal(t, token, again)
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	reload := func() error { return errors.New("broken config") }
+	s := NewServer("tcp", "", "secret", users.New(nil, nil, nil, nil), reload)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := NewClient("tcp", ts.Listener.Addr().String(), "wrong")
+	_, err := c.ListAccounts()
+	r.Equal(t, ErrUnauthorized, err)
+}
+
+func TestClientAccounts(t *testing.T) {
+	ts := newTestServer(t)
+	c := NewClient("tcp", ts.Listener.Addr().String(), "secret")
+
+	accounts, err := c.ListAccounts()
+	r.NoError(t, err)
+	r.Empty(t, accounts)
+
+	r.Equal(t, ErrNotFound, c.DeleteAccount("foo"))
+	r.Equal(t, ErrNotFound, c.RemoveKey("foo", "phone"))
+	r.Equal(t, ErrNotFound, c.Resync("foo@bar.com"))
+	r.Equal(t, ErrNotFound, c.SetAddressMode("foo@bar.com", SplitMode))
+	r.Equal(t, ErrBadAddressMode, c.SetAddressMode("foo@bar.com", "mixed"))
+
+	_, err = c.SyncStatus("foo@bar.com")
+	r.Equal(t, ErrNotFound, err)
+
+	r.Equal(t, ErrNotFound, c.SetSyncPolicy("foo@bar.com", 6, []string{"INBOX"}))
+	r.Equal(t, ErrBadSyncPolicy, c.SetSyncPolicy("foo@bar.com", -1, nil))
+
+	_, err = c.ListOutbox("foo@bar.com")
+	r.Equal(t, ErrNotFound, err)
+	_, err = c.FlushOutbox("foo@bar.com")
+	r.Equal(t, ErrNotFound, err)
+
+	_, err = c.AddKey("foo", "phone", "key")
+	r.Equal(t, ErrNotFound, err)
+
+	_, err = c.VerifyCache("foo", "phone", "key")
+	r.Equal(t, ErrNotFound, err)
+	_, err = c.VerifyCache("foo", "", "")
+	r.EqualError(t, err, "key name and key are required")
+}
+
+func TestClientLoginInProgress(t *testing.T) {
+	ts := newTestServer(t)
+	c := NewClient("tcp", ts.Listener.Addr().String(), "secret")
+
+	_, err := c.SubmitTwoFactor("nope", "123456")
+	r.Equal(t, ErrNoSuchLogin, err)
+
+	_, err = c.FinishLogin("nope", []byte("password"))
+	r.Equal(t, ErrNoSuchLogin, err)
+}
+
+func TestSplitPath(t *testing.T) {
+	path, err := splitPath("/accounts/foo%40bar.com/keys/my%2Fphone")
+	r.NoError(t, err)
+	r.Equal(t, []string{"accounts", "foo@bar.com", "keys", "my/phone"}, path)
+}
+
+func TestClientReload(t *testing.T) {
+	ts := newTestServer(t)
+	c := NewClient("tcp", ts.Listener.Addr().String(), "secret")
+
+	err := c.Reload()
+	r.Error(t, err)
+	r.Contains(t, err.Error(), "broken config")
+}
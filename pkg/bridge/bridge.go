@@ -23,9 +23,12 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/ljanyst/peroxide/pkg/admin"
 	"github.com/ljanyst/peroxide/pkg/config/settings"
 	"github.com/ljanyst/peroxide/pkg/cookies"
 	"github.com/ljanyst/peroxide/pkg/events"
@@ -33,6 +36,7 @@ import (
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/logging"
 	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/oauth"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/smtp"
 	"github.com/ljanyst/peroxide/pkg/store"
@@ -40,6 +44,7 @@ import (
 	"github.com/ljanyst/peroxide/pkg/users"
 	"github.com/ljanyst/peroxide/pkg/users/credentials"
 
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	logrus "github.com/sirupsen/logrus"
 )
 
@@ -50,8 +55,26 @@ var ErrLocalCacheUnavailable = errors.New("local cache is unavailable")
 type Bridge struct {
 	Users *users.Users
 
-	settings *settings.Settings
+	configFile string
+
+	// settingsLock guards settings and serialises reloads.
+	settingsLock sync.Mutex
+	settings     *settings.Settings
+
 	listener listener.Listener
+	tokens   *oauth.TokenStore
+	cache    cache.Cache
+	builder  *message.Builder
+	tls      *tlsStore
+
+	outboxReady <-chan struct{}
+
+	imapBackend   optionSetter
+	smtpBackend   smtpBackend
+	imapServer    *imap.Server
+	smtpServer    *smtp.Server
+	oauthServer   *oauth.Server
+	metricsServer *metrics.Server
 }
 
 func (b *Bridge) Configure(configFile string) error {
@@ -63,6 +86,10 @@ func (b *Bridge) Configure(configFile string) error {
 
 	settingsObj := settings.New(configFile)
 
+	if level := settingsObj.Get(settings.LogLevelKey); level != "" {
+		logging.SetLevel(level)
+	}
+
 	if err := store.ClearIncompatibleStore(settingsObj.Get(settings.CacheDir)); err != nil {
 		return err
 	}
@@ -71,6 +98,12 @@ func (b *Bridge) Configure(configFile string) error {
 	events.SetupEvents(listener)
 
 	cfg := pmapi.NewConfig()
+	if hostURL := settingsObj.Get(settings.HostURLKey); hostURL != "" {
+		if err := pmapi.CheckHostURL(hostURL); err != nil {
+			return err
+		}
+		cfg.HostURL = strings.TrimSuffix(hostURL, "/")
+	}
 	cfg.UpgradeApplicationHandler = func() {
 		log.Error("Application needs to be upgraded")
 	}
@@ -78,6 +111,13 @@ func (b *Bridge) Configure(configFile string) error {
 		log.Error("TLS Certificate Issue")
 	}
 
+	cfg.ProxyURL = settingsObj.Get(settings.ProxyURLKey)
+	if err := pmapi.CheckProxyURL(cfg.ProxyURL); err != nil {
+		return err
+	}
+
+	cfg.DoHProviders = settingsObj.GetList(settings.DoHProvidersKey)
+
 	cm := pmapi.New(cfg)
 	jar, err := cookies.NewCookieJar(settingsObj.Get(settings.CookieJar))
 	if err != nil {
@@ -105,27 +145,59 @@ func (b *Bridge) Configure(configFile string) error {
 		return err
 	}
 
+	storeFactory := store.NewStoreFactory(settingsObj, listener, cache, builder)
+
+	// The stores switch to the offline mode when the API is unreachable.
+	connectivity := storeFactory.Connectivity()
+	cm.AddConnectionObserver(pmapi.NewConnectionObserver(
+		func() { connectivity.SetOffline(true) },
+		func() { connectivity.SetOffline(false) },
+	))
+
 	u := users.New(
 		listener,
 		cm,
 		credStore,
-		store.NewStoreFactory(settingsObj, listener, cache, builder),
+		storeFactory,
 	)
 
 	b.Users = u
+	b.configFile = configFile
 	b.settings = settingsObj
 	b.listener = listener
+	b.cache = cache
+	b.builder = builder
+	b.outboxReady = storeFactory.OutboxReady()
+
+	if settingsObj.GetBool(settings.OAuthEnabledKey) {
+		lifetime := time.Duration(settingsObj.GetInt(settings.OAuthTokenLifetime)) * time.Second
+		b.tokens = oauth.NewTokenStore(b.checkLogin, lifetime)
+	}
 	return nil
 }
 
+// checkLogin verifies that the key unlocks the key slot selected by login.
+func (b *Bridge) checkLogin(login, key string) error {
+	username, slot := users.DecodeLogin(strings.ToLower(login))
+
+	user, err := b.Users.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	return user.CheckCredentials(slot, key)
+}
+
 func (b *Bridge) Run() error {
-	tlsConfig, err := loadTlsConfig(
+	var err error
+	b.tls, err = newTLSStore(
 		b.settings.Get(settings.X509Cert),
 		b.settings.Get(settings.X509Key),
 	)
 	if err != nil {
 		return err
 	}
+	tlsConfig := b.tls.config()
 
 	bccSelf := b.settings.GetBool(settings.BCCSelf)
 	isAllMailVisible := b.settings.GetBool(settings.IsAllMailVisible)
@@ -133,29 +205,69 @@ func (b *Bridge) Run() error {
 	smtpBackend := smtp.NewSMTPBackend(b.listener, b.Users, bccSelf)
 	serverAddress := b.settings.Get(settings.ServerAddress)
 
-	go func() {
-		imapPort := b.settings.GetInt(settings.IMAPPortKey)
-		imap.NewIMAPServer(
-			false, // log client
-			false, // log server
-			serverAddress, imapPort, tlsConfig,
-			imapBackend, b.listener).ListenAndServe()
-	}()
-
-	go func() {
-		smtpPort := b.settings.GetInt(settings.SMTPPortKey)
-		useSSL := false
-		smtp.NewSMTPServer(
-			false,
-			serverAddress, smtpPort, useSSL, tlsConfig,
-			smtpBackend, b.listener).ListenAndServe()
-	}()
+	b.imapBackend = imapBackend
+	b.smtpBackend = smtpBackend
+
+	imapPort := b.settings.GetInt(settings.IMAPPortKey)
+	b.imapServer = imap.NewIMAPServer(
+		false, // log client
+		false, // log server
+		serverAddress, imapPort, tlsConfig,
+		imapBackend, b.tokens, b.listener)
+	go b.imapServer.ListenAndServe()
+
+	smtpPort := b.settings.GetInt(settings.SMTPPortKey)
+	useSSL := false
+	b.smtpServer = smtp.NewSMTPServer(
+		false,
+		serverAddress, smtpPort, useSSL, tlsConfig,
+		smtpBackend, b.tokens, b.listener)
+	go b.smtpServer.ListenAndServe()
+	go smtpBackend.RunOutbox(b.outboxReady)
+
+	if b.tokens != nil {
+		oauthPort := b.settings.GetInt(settings.OAuthPortKey)
+		b.oauthServer = oauth.NewServer(
+			serverAddress, oauthPort, tlsConfig,
+			b.tokens, b.listener)
+		go b.oauthServer.ListenAndServe()
+	}
+
+	if b.settings.GetBool(settings.MetricsEnabledKey) {
+		metrics.RegisterQueue("fetch", func() int { fetch, _ := b.builder.Pending(); return fetch })
+		metrics.RegisterQueue("attach", func() int { _, attach := b.builder.Pending(); return attach })
+
+		metricsPort := b.settings.GetInt(settings.MetricsPortKey)
+		b.metricsServer = metrics.NewServer(serverAddress, metricsPort, b.listener)
+		go b.metricsServer.ListenAndServe()
+	}
+
+	adminToken, err := admin.LoadOrCreateToken(b.settings.Get(settings.AdminTokenKey))
+	if err != nil {
+		return err
+	}
+
+	adminNetwork, adminAddress := admin.Endpoint(b.settings)
+	adminServer := admin.NewServer(adminNetwork, adminAddress, adminToken, b.Users, b.Reload)
+	go adminServer.ListenAndServe()
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
-	<-done
 
-	return nil
+	for {
+		select {
+		case <-reload:
+			if err := b.Reload(); err != nil {
+				log.WithError(err).Error("Failed to reload the configuration")
+			}
+		case <-done:
+			b.shutdown(adminServer)
+			return nil
+		}
+	}
 }
 
 // FactoryReset will remove all local cache and settings.
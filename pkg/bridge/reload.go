@@ -0,0 +1,126 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/logging"
+	"github.com/ljanyst/peroxide/pkg/store/cache"
+)
+
+// optionSetter is implemented by the IMAP backend.
+type optionSetter interface {
+	SetOptions(listWorkers int, bccSelf, isAllMailVisible bool)
+}
+
+// smtpBackend is implemented by the SMTP backend.
+type smtpBackend interface {
+	SetBCCSelf(bccSelf bool)
+	Drain(timeout time.Duration) bool
+}
+
+// restartKeys are the settings that only take effect after a restart.
+var restartKeys = []string{ //nolint:gochecknoglobals
+	settings.HostURLKey,
+	settings.AllowProxyKey,
+	settings.ProxyURLKey,
+	settings.DoHProvidersKey,
+	settings.CacheEnabledKey,
+	settings.CacheCompressionKey,
+	settings.CacheCompressorKey,
+	settings.CacheDictionaryKey,
+	settings.CacheDir,
+	settings.CacheBackendKey,
+	settings.CacheFrontSizeKey,
+	settings.CacheS3EndpointKey,
+	settings.CacheS3RegionKey,
+	settings.CacheS3BucketKey,
+	settings.CacheS3PrefixKey,
+	settings.CacheS3AccessKeyKey,
+	settings.CacheS3SecretKeyKey,
+	settings.CookieJar,
+	settings.CredentialsStore,
+	settings.OAuthEnabledKey,
+	settings.OAuthTokenLifetime,
+	settings.MetricsEnabledKey,
+	settings.AdminSocketKey,
+	settings.AdminTokenKey,
+	settings.APIPortKey,
+}
+
+// Reload reads the configuration file again and applies the changes that can
+// be applied while running: log level, worker counts, cache limits, BCCSelf,
+// IsAllMailVisible, the TLS certificate, and the server addresses and ports.
+// Changing the address of a server makes it listen on the new one while
+// keeping the connections it has already accepted.
+func (b *Bridge) Reload() error {
+	b.settingsLock.Lock()
+	defer b.settingsLock.Unlock()
+
+	s := settings.New(b.configFile)
+	old := b.settings
+
+	log.Info("Reloading configuration")
+
+	if level := s.Get(settings.LogLevelKey); level != "" {
+		logging.SetLevel(level)
+	}
+
+	if err := b.tls.reload(s.Get(settings.X509Cert), s.Get(settings.X509Key)); err != nil {
+		return err
+	}
+
+	b.builder.SetWorkers(s.GetInt(settings.FetchWorkers), s.GetInt(settings.AttachmentWorkers))
+	cache.UpdateOptions(b.cache, s)
+
+	bccSelf := s.GetBool(settings.BCCSelf)
+	b.imapBackend.SetOptions(s.GetInt(settings.IMAPWorkers), bccSelf, s.GetBool(settings.IsAllMailVisible))
+	b.smtpBackend.SetBCCSelf(bccSelf)
+
+	serverAddress := s.Get(settings.ServerAddress)
+	addressChanged := serverAddress != old.Get(settings.ServerAddress)
+
+	if addressChanged || s.Get(settings.IMAPPortKey) != old.Get(settings.IMAPPortKey) {
+		b.imapServer.Rebind(serverAddress, s.GetInt(settings.IMAPPortKey))
+	}
+
+	if addressChanged || s.Get(settings.SMTPPortKey) != old.Get(settings.SMTPPortKey) {
+		b.smtpServer.Rebind(serverAddress, s.GetInt(settings.SMTPPortKey))
+	}
+
+	if b.oauthServer != nil && (addressChanged || s.Get(settings.OAuthPortKey) != old.Get(settings.OAuthPortKey)) {
+		b.oauthServer.Rebind(serverAddress, s.GetInt(settings.OAuthPortKey))
+	}
+
+	if b.metricsServer != nil && (addressChanged || s.Get(settings.MetricsPortKey) != old.Get(settings.MetricsPortKey)) {
+		b.metricsServer.Rebind(serverAddress, s.GetInt(settings.MetricsPortKey))
+	}
+
+	for _, key := range restartKeys {
+		if s.Get(key) != old.Get(key) {
+			log.WithField("key", key).Warn("Changing this setting requires a restart")
+		}
+	}
+
+	b.settings = s
+
+	log.Info("Configuration reloaded")
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/admin"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+)
+
+// shutdown stops the bridge in order: it stops accepting connections, says
+// BYE to the IMAP clients, waits for the messages being sent over SMTP, and
+// finally stops the event loops and cache workers and closes the stores.
+func (b *Bridge) shutdown(adminServer *admin.Server) {
+	log.Info("Shutting down")
+
+	b.settingsLock.Lock()
+	timeout := time.Duration(b.settings.GetInt(settings.ShutdownTimeoutKey)) * time.Second
+	b.settingsLock.Unlock()
+
+	if b.oauthServer != nil {
+		b.oauthServer.Close()
+	}
+
+	b.smtpServer.StopListening()
+	b.imapServer.Shutdown()
+
+	if !b.smtpBackend.Drain(timeout) {
+		log.Warn("Timed out waiting for messages being sent")
+	}
+	b.smtpServer.Close()
+
+	adminServer.Close()
+
+	b.Users.Close()
+	b.builder.Done()
+
+	if b.metricsServer != nil {
+		b.metricsServer.Close()
+	}
+
+	log.Info("Shutdown finished")
+}
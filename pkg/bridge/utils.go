@@ -21,6 +21,7 @@ package bridge
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -53,3 +54,46 @@ func loadTlsConfig(certPath, keyPath string) (*tls.Config, error) {
 		ClientCAs:    caCertPool,
 	}, nil
 }
+
+// tlsStore holds the current TLS configuration so that the certificate can be
+// replaced without restarting the listeners.
+type tlsStore struct {
+	lock    sync.RWMutex
+	current *tls.Config
+}
+
+func newTLSStore(certPath, keyPath string) (*tlsStore, error) {
+	store := &tlsStore{}
+	if err := store.reload(certPath, keyPath); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reload loads the certificate and the key. The previous configuration stays
+// in use if they cannot be loaded.
+func (s *tlsStore) reload(certPath, keyPath string) error {
+	config, err := loadTlsConfig(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.current = config
+	return nil
+}
+
+// config returns the configuration to give to the servers. It resolves to the
+// current configuration for each new TLS connection.
+func (s *tlsStore) config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.lock.RLock()
+			defer s.lock.RUnlock()
+
+			return s.current, nil
+		},
+	}
+}
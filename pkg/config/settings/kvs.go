@@ -20,6 +20,7 @@ package settings
 import (
 	"io/ioutil"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/ghodss/yaml"
@@ -109,6 +110,20 @@ func (p *keyValueStore) GetFloat64(key string) float64 {
 	return value
 }
 
+// GetList returns the comma-separated values of the key without the
+// surrounding spaces and the empty ones.
+func (p *keyValueStore) GetList(key string) []string {
+	var values []string
+
+	for _, value := range strings.Split(p.Get(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
 func (p *keyValueStore) set(key, value string) {
 	p.lock.Lock()
 	p.cache[key] = value
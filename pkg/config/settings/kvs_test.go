@@ -76,6 +76,17 @@ func TestKeyValueStoreGetBool(t *testing.T) {
 	r.Equal(false, pref.GetBool("falseBool"))
 }
 
+func TestKeyValueStoreGetList(t *testing.T) {
+	r := require.New(t)
+	pref, clean := newTestEmptyKeyValueStore(r)
+	defer clean()
+
+	r.Empty(pref.GetList("key"))
+
+	pref.set("key", " first, second,,third ")
+	r.Equal([]string{"first", "second", "third"}, pref.GetList("key"))
+}
+
 func TestKeyValueStoreSetDefault(t *testing.T) {
 	r := require.New(t)
 	pref, clean := newTestEmptyKeyValueStore(r)
@@ -27,17 +27,32 @@ const (
 	APIPortKey            = "UserPortApi"
 	IMAPPortKey           = "UserPortImap"
 	SMTPPortKey           = "UserPortSmtp"
+	HostURLKey            = "HostURL"
 	AllowProxyKey         = "AllowProxy"
+	ProxyURLKey           = "ProxyURL"
+	DoHProvidersKey       = "DoHProviders"
 	CacheEnabledKey       = "CacheEnabled"
 	CacheCompressionKey   = "CacheCompression"
+	CacheCompressorKey    = "CacheCompressor"
+	CacheDictionaryKey    = "CacheDictionary"
 	CacheMinFreeAbsKey    = "CacheMinFreeAbs"
 	CacheMinFreeRatKey    = "CacheMinFreeRat"
 	CacheConcurrencyRead  = "CacheConcurrentRead"
 	CacheConcurrencyWrite = "CacheConcurrentWrite"
+	CacheUserQuotaKey     = "CacheUserQuota"
+	CacheQuotaKey         = "CacheQuota"
 	IMAPWorkers           = "ImapWorkers"
 	FetchWorkers          = "FetchWorkers"
 	AttachmentWorkers     = "AttachmentWorkers"
 	CacheDir              = "CacheDir"
+	CacheBackendKey       = "CacheBackend"
+	CacheFrontSizeKey     = "CacheFrontSize"
+	CacheS3EndpointKey    = "CacheS3Endpoint"
+	CacheS3RegionKey      = "CacheS3Region"
+	CacheS3BucketKey      = "CacheS3Bucket"
+	CacheS3PrefixKey      = "CacheS3Prefix"
+	CacheS3AccessKeyKey   = "CacheS3AccessKey"
+	CacheS3SecretKeyKey   = "CacheS3SecretKey"
 	X509Key               = "X509Key"
 	X509Cert              = "X509Cert"
 	CookieJar             = "CookieJar"
@@ -45,6 +60,15 @@ const (
 	CredentialsStore      = "CredentialsStore"
 	BCCSelf               = "BCCSelf"
 	IsAllMailVisible      = "IsAllMailVisible"
+	OAuthEnabledKey       = "OAuthEnabled"
+	OAuthPortKey          = "UserPortOAuth"
+	OAuthTokenLifetime    = "OAuthTokenLifetime"
+	AdminSocketKey        = "AdminSocket"
+	AdminTokenKey         = "AdminToken"
+	LogLevelKey           = "LogLevel"
+	ShutdownTimeoutKey    = "ShutdownTimeout"
+	MetricsEnabledKey     = "MetricsEnabled"
+	MetricsPortKey        = "UserPortMetrics"
 )
 
 type Settings struct {
@@ -62,19 +86,27 @@ func New(settingsPath string) *Settings {
 }
 
 const (
-	DefaultIMAPPort = "1143"
-	DefaultSMTPPort = "1025"
-	DefaultAPIPort  = "1042"
+	DefaultIMAPPort    = "1143"
+	DefaultSMTPPort    = "1025"
+	DefaultAPIPort     = "1042"
+	DefaultOAuthPort   = "1044"
+	DefaultMetricsPort = "1045"
 )
 
 func (s *Settings) setDefaultValues() {
 	s.setDefault(AllowProxyKey, "false")
 	s.setDefault(CacheEnabledKey, "true")
 	s.setDefault(CacheCompressionKey, "true")
+	s.setDefault(CacheCompressorKey, "gzip")
 	s.setDefault(CacheMinFreeAbsKey, "250000000")
 	s.setDefault(CacheMinFreeRatKey, "")
 	s.setDefault(CacheConcurrencyRead, "16")
 	s.setDefault(CacheConcurrencyWrite, "16")
+	s.setDefault(CacheUserQuotaKey, "0")
+	s.setDefault(CacheQuotaKey, "0")
+	s.setDefault(CacheBackendKey, "disk")
+	s.setDefault(CacheFrontSizeKey, "104857600")
+	s.setDefault(CacheS3RegionKey, "us-east-1")
 	s.setDefault(IMAPWorkers, "16")
 	s.setDefault(FetchWorkers, "16")
 	s.setDefault(AttachmentWorkers, "16")
@@ -83,6 +115,12 @@ func (s *Settings) setDefaultValues() {
 	s.setDefault(SMTPPortKey, DefaultSMTPPort)
 	s.setDefault(BCCSelf, "false")
 	s.setDefault(IsAllMailVisible, "true")
+	s.setDefault(OAuthEnabledKey, "false")
+	s.setDefault(OAuthPortKey, DefaultOAuthPort)
+	s.setDefault(OAuthTokenLifetime, "3600")
+	s.setDefault(ShutdownTimeoutKey, "60")
+	s.setDefault(MetricsEnabledKey, "false")
+	s.setDefault(MetricsPortKey, DefaultMetricsPort)
 
 	settingsDir := "/etc/peroxide"
 	s.setDefault(CacheDir, "/var/cache/peroxide/cache")
@@ -91,4 +129,6 @@ func (s *Settings) setDefaultValues() {
 	s.setDefault(CookieJar, filepath.Join(settingsDir, "cookies.json"))
 	s.setDefault(CredentialsStore, filepath.Join(settingsDir, "credentials.json"))
 	s.setDefault(ServerAddress, "127.0.0.1")
+	s.setDefault(AdminSocketKey, "/run/peroxide/admin.sock")
+	s.setDefault(AdminTokenKey, filepath.Join(settingsDir, "admin.token"))
 }
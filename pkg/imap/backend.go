@@ -43,6 +43,7 @@ import (
 	"github.com/ljanyst/peroxide/pkg/config/settings"
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/users"
 )
 
@@ -50,6 +51,7 @@ type imapBackend struct {
 	usersMgr         *users.Users
 	updates          *imapUpdates
 	eventListener    listener.Listener
+	optionsLock      sync.RWMutex
 	listWorkers      int
 	bccSelf          bool
 	isAllMailVisible bool
@@ -95,6 +97,37 @@ func NewIMAPBackend(
 	return backend
 }
 
+// SetOptions changes the options that can be changed while serving.
+func (ib *imapBackend) SetOptions(listWorkers int, bccSelf, isAllMailVisible bool) {
+	ib.optionsLock.Lock()
+	defer ib.optionsLock.Unlock()
+
+	ib.listWorkers = listWorkers
+	ib.bccSelf = bccSelf
+	ib.isAllMailVisible = isAllMailVisible
+}
+
+func (ib *imapBackend) getListWorkers() int {
+	ib.optionsLock.RLock()
+	defer ib.optionsLock.RUnlock()
+
+	return ib.listWorkers
+}
+
+func (ib *imapBackend) isBCCSelf() bool {
+	ib.optionsLock.RLock()
+	defer ib.optionsLock.RUnlock()
+
+	return ib.bccSelf
+}
+
+func (ib *imapBackend) allMailVisible() bool {
+	ib.optionsLock.RLock()
+	defer ib.optionsLock.RUnlock()
+
+	return ib.isAllMailVisible
+}
+
 func (ib *imapBackend) getUser(address, slot, password string) (*imapUser, error) {
 	ib.usersLocker.Lock()
 	defer ib.usersLocker.Unlock()
@@ -121,9 +154,12 @@ func (ib *imapBackend) createUser(address, slot, password string) (*imapUser, er
 	}
 
 	// Make sure you return the same user for all valid addresses when in combined mode.
-	address = strings.ToLower(user.GetPrimaryAddress())
-	if combinedUser, ok := ib.users[address]; ok {
-		return combinedUser, nil
+	// In split mode, every address has its own user with its own mailboxes.
+	if user.IsCombinedAddressMode() {
+		address = strings.ToLower(user.GetPrimaryAddress())
+		if combinedUser, ok := ib.users[address]; ok {
+			return combinedUser, nil
+		}
 	}
 
 	// Client can log in only using address so we can properly close all IMAP connections.
@@ -164,6 +200,10 @@ func (ib *imapBackend) Login(_ *imap.ConnInfo, username, password string) (goIMA
 		return nil, err
 	}
 
+	// Logout is called for every user returned by getUser, including the
+	// failed login below.
+	metrics.Connected("imap", imapUser.user.ID())
+
 	if err := imapUser.user.CheckCredentials(slot, password); err != nil {
 		log.WithError(err).Errorf("Could not check bridge password: %s %s", username, slot)
 		if err := imapUser.Logout(); err != nil {
@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package imap
+
+import (
+	"sync"
+
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// fetchExtension replaces the FETCH command to close the message literals
+// opened for its response once the command is done, also when the client
+// goes away before reading them. It adds no capability.
+type fetchExtension struct{}
+
+func (ext *fetchExtension) Capabilities(c imapserver.Conn) []string {
+	return nil
+}
+
+func (ext *fetchExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "FETCH" {
+		return nil
+	}
+
+	return func() imapserver.Handler { return &trackedFetch{} }
+}
+
+type trackedFetch struct {
+	imapserver.Fetch
+}
+
+func (cmd *trackedFetch) Handle(conn imapserver.Conn) error {
+	return trackFetchLiterals(conn, cmd.Fetch.Handle)
+}
+
+func (cmd *trackedFetch) UidHandle(conn imapserver.Conn) error { //nolint:revive,stylecheck
+	return trackFetchLiterals(conn, cmd.Fetch.UidHandle)
+}
+
+// trackFetchLiterals runs the FETCH handler, which returns once the response
+// is written or has failed, and then closes the literals opened for it.
+func trackFetchLiterals(conn imapserver.Conn, handle func(imapserver.Conn) error) error {
+	mailbox, ok := conn.Context().Mailbox.(*imapMailbox)
+	if !ok {
+		return handle(conn)
+	}
+
+	literals := &fetchLiterals{}
+
+	mailbox.fetchLiterals = literals
+	defer func() {
+		mailbox.fetchLiterals = nil
+		literals.close()
+	}()
+
+	return handle(conn)
+}
+
+// fetchLiterals are the section literals opened for a FETCH response.
+type fetchLiterals struct {
+	lock     sync.Mutex
+	literals []*sectionLiteral
+	closed   bool
+}
+
+// add tracks the literal. The literal is closed right away if the command is
+// already done.
+func (l *fetchLiterals) add(literal *sectionLiteral) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		literal.close()
+		return
+	}
+
+	l.literals = append(l.literals, literal)
+}
+
+func (l *fetchLiterals) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, literal := range l.literals {
+		literal.close()
+	}
+
+	l.literals = nil
+	l.closed = true
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package imap
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchExtensionCommands(t *testing.T) {
+	ext := &fetchExtension{}
+
+	_, ok := ext.Command("FETCH")().(*trackedFetch)
+	require.True(t, ok)
+
+	require.Nil(t, ext.Command("SELECT"))
+	require.Empty(t, ext.Capabilities(nil))
+}
+
+func TestFetchLiteralsCloseUnreadLiterals(t *testing.T) {
+	body, err := message.NewLiteral(strings.NewReader("Subject: hello\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+
+	literals := &fetchLiterals{}
+	literals.add(newSectionLiteral(body, io.NewSectionReader(body, 18, 4)))
+
+	// The client never read the literal.
+	literals.close()
+
+	_, err = body.ReadAt(make([]byte, 1), 0)
+	require.Error(t, err)
+
+	// A literal opened after the command is done is closed right away.
+	late, err := message.NewLiteral(strings.NewReader("Subject: hello\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+
+	literals.add(newSectionLiteral(late, io.NewSectionReader(late, 18, 4)))
+
+	_, err = late.ReadAt(make([]byte, 1), 0)
+	require.Error(t, err)
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/store"
 	"github.com/sirupsen/logrus"
@@ -37,6 +38,9 @@ type imapMailbox struct {
 	storeUser    *store.Store
 	storeAddress *store.Address
 	storeMailbox *store.Mailbox
+
+	// fetchLiterals are the literals of the FETCH command being answered.
+	fetchLiterals *fetchLiterals
 }
 
 // newIMAPMailbox returns struct implementing go-imap/mailbox interface.
@@ -64,6 +68,7 @@ func newIMAPMailbox(user *imapUser, storeMailbox *store.Mailbox) *imapMailbox {
 func (im *imapMailbox) logCommand(callback func() error, cmd string, params ...interface{}) error {
 	start := time.Now()
 	err := callback()
+	metrics.ObserveIMAPCommand(cmd, time.Since(start))
 	// Not using im.log to not include addressID which is not needed in this case.
 	log.WithFields(logrus.Fields{
 		"userID":   im.storeUser.UserID(),
@@ -75,6 +80,14 @@ func (im *imapMailbox) logCommand(callback func() error, cmd string, params ...i
 	return err
 }
 
+// fetchOutsideSyncPolicy fetches the messages of the mailbox which are not
+// older than since but were excluded by the sync policy of the account.
+func (im *imapMailbox) fetchOutsideSyncPolicy(since time.Time) {
+	if err := im.storeMailbox.FetchOutsideSyncPolicy(since); err != nil {
+		im.log.WithError(err).Warn("Cannot fetch messages outside of the sync policy")
+	}
+}
+
 // Name returns this mailbox name.
 func (im *imapMailbox) Name() string {
 	return im.name
@@ -19,9 +19,7 @@ package imap
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
-	"io/ioutil"
 	"net/mail"
 	"strings"
 	"time"
@@ -53,10 +51,11 @@ func (im *imapMailbox) createMessage(imapFlags []string, date time.Time, r imap.
 	im.user.appendExpungeLock.Lock()
 	defer im.user.appendExpungeLock.Unlock()
 
-	body, err := ioutil.ReadAll(r)
+	body, err := message.NewLiteral(r)
 	if err != nil {
 		return err
 	}
+	defer body.Close() //nolint:errcheck
 
 	addr := im.storeAddress.APIAddress()
 	if addr == nil {
@@ -73,7 +72,7 @@ func (im *imapMailbox) createMessage(imapFlags []string, date time.Time, r imap.
 	}
 
 	if im.storeMailbox.LabelID() == pmapi.SentLabel {
-		m, _, _, _, err := message.Parse(bytes.NewReader(body))
+		m, _, _, _, err := message.Parse(body.NewReader())
 		if err != nil {
 			return err
 		}
@@ -94,7 +93,7 @@ func (im *imapMailbox) createMessage(imapFlags []string, date time.Time, r imap.
 		}
 	}
 
-	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body)))
+	hdr, err := textproto.ReadHeader(bufio.NewReader(body.NewReader()))
 	if err != nil {
 		return err
 	}
@@ -120,10 +119,10 @@ func (im *imapMailbox) createMessage(imapFlags []string, date time.Time, r imap.
 	return im.importMessage(kr, hdr, body, imapFlags, date)
 }
 
-func (im *imapMailbox) createDraftMessage(kr *crypto.KeyRing, email string, body []byte) error {
+func (im *imapMailbox) createDraftMessage(kr *crypto.KeyRing, email string, body *message.Literal) error {
 	im.log.Info("Creating draft message")
 
-	m, _, _, readers, err := message.Parse(bytes.NewReader(body))
+	m, _, _, readers, err := message.Parse(body.NewReader())
 	if err != nil {
 		return err
 	}
@@ -192,7 +191,7 @@ func (im *imapMailbox) labelExistingMessage(msg *store.Message) error { //nolint
 	return uidplus.AppendResponse(im.storeMailbox.UIDValidity(), im.storeMailbox.GetUIDList([]string{msg.ID()}))
 }
 
-func (im *imapMailbox) importMessage(kr *crypto.KeyRing, hdr textproto.Header, body []byte, imapFlags []string, date time.Time) error { //nolint[funlen]
+func (im *imapMailbox) importMessage(kr *crypto.KeyRing, hdr textproto.Header, body *message.Literal, imapFlags []string, date time.Time) error { //nolint[funlen]
 	im.log.Info("Importing external message")
 
 	var (
@@ -229,7 +228,7 @@ func (im *imapMailbox) importMessage(kr *crypto.KeyRing, hdr textproto.Header, b
 		time = date.Unix()
 	}
 
-	enc, err := message.EncryptRFC822(kr, bytes.NewReader(body))
+	enc, err := message.EncryptRFC822(kr, body.NewReader())
 	if err != nil {
 		return err
 	}
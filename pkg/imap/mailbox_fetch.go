@@ -19,6 +19,8 @@ package imap
 
 import (
 	"bytes"
+	"io"
+	"sync"
 
 	"github.com/emersion/go-imap"
 	"github.com/ljanyst/peroxide/pkg/message"
@@ -117,25 +119,62 @@ func (im *imapMailbox) getBodyStructure(storeMessage *store.Message) (bs *messag
 		// be sure if seeing 1st or 2nd sync is all right or not.
 		// Therefore, it's better to exclude first body structure fetch
 		// from the counting and see build count as real message build.
-		if bs, _, err = im.getBodyAndStructure(storeMessage); err != nil {
+		var literal *message.Literal
+		if bs, literal, err = im.getBodyAndStructure(storeMessage); err != nil {
 			return
 		}
+		_ = literal.Close()
 	}
 	return
 }
 
-func (im *imapMailbox) getBodyAndStructure(storeMessage *store.Message) (*message.BodyStructure, *bytes.Reader, error) {
-	rfc822, err := storeMessage.GetRFC822()
+// getBodyAndStructure returns the message literal and its structure. The
+// literal must be closed after use.
+func (im *imapMailbox) getBodyAndStructure(storeMessage *store.Message) (*message.BodyStructure, *message.Literal, error) {
+	literal, err := storeMessage.GetRFC822()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	structure, err := storeMessage.GetBodyStructure()
+	return literalStructure(literal)
+}
+
+// getBodyAndStructureForSection returns the literal and the structure needed
+// to read the given section. When the message is not cached, the attachments
+// which are not within the section are not downloaded. Headers need none of
+// them and the whole message needs all. The literal must be closed after use.
+func (im *imapMailbox) getBodyAndStructureForSection(storeMessage *store.Message, section *imap.BodySectionName) (*message.BodyStructure, *message.Literal, error) {
+	var sections [][]int
+
+	switch {
+	case section.Specifier == imap.HeaderSpecifier || section.Specifier == imap.MIMESpecifier:
+		sections = [][]int{}
+	case len(section.Path) != 0:
+		sections = [][]int{section.Path}
+	default:
+		return im.getBodyAndStructure(storeMessage)
+	}
+
+	// The offsets in a partial literal differ from the ones in the whole
+	// message, so the structure always comes from the literal itself.
+	literal, _, err := storeMessage.GetRFC822Sections(sections)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return literalStructure(literal)
+}
+
+// literalStructure returns the structure computed while the literal was
+// written. The literal is closed if there is none.
+func literalStructure(literal *message.Literal) (*message.BodyStructure, *message.Literal, error) {
+	structure, err := literal.Structure()
 	if err != nil {
+		_ = literal.Close()
 		return nil, nil, err
 	}
 
-	return structure, bytes.NewReader(rfc822), nil
+	return structure, literal, nil
 }
 
 // This will download message (or read from cache) and pick up the section,
@@ -151,9 +190,10 @@ func (im *imapMailbox) getBodyAndStructure(storeMessage *store.Message) (*messag
 // For all other cases it is necessary to download and decrypt the message
 // and drop the header which was obtained from cache. The header will
 // will be stored in DB once successfully built. Check `getBodyAndStructure`.
+// Only the attachments within the requested section are downloaded unless
+// the message is cached.
 func (im *imapMailbox) getMessageBodySection(storeMessage *store.Message, section *imap.BodySectionName) (imap.Literal, error) {
 	var header []byte
-	var response []byte
 
 	im.log.WithField("msgID", storeMessage.ID()).Trace("Getting message body")
 
@@ -164,19 +204,21 @@ func (im *imapMailbox) getMessageBodySection(storeMessage *store.Message, sectio
 			return nil, err
 		}
 	} else {
-		structure, bodyReader, err := im.getBodyAndStructure(storeMessage)
+		structure, body, err := im.getBodyAndStructureForSection(storeMessage, section)
 		if err != nil {
 			return nil, err
 		}
 
+		var response *io.SectionReader
+
 		switch {
 		case section.Specifier == imap.EntireSpecifier && len(section.Path) == 0:
 			//  An empty section specification refers to the entire message, including the header.
-			response, err = structure.GetSection(bodyReader, section.Path)
+			response, err = structure.GetSectionReader(body, section.Path)
 		case section.Specifier == imap.TextSpecifier || (section.Specifier == imap.EntireSpecifier && len(section.Path) != 0):
 			// The TEXT specifier refers to the content of the message (or section), omitting the [RFC-2822] header.
 			// Non-empty section with no specifier (imap.EntireSpecifier) refers to section content without header.
-			response, err = structure.GetSectionContent(bodyReader, section.Path)
+			response, err = structure.GetSectionContentReader(body, section.Path)
 		case section.Specifier == imap.MIMESpecifier: // The MIME part specifier refers to the [MIME-IMB] header for this part.
 			fallthrough
 		case section.Specifier == imap.HeaderSpecifier:
@@ -185,11 +227,22 @@ func (im *imapMailbox) getMessageBodySection(storeMessage *store.Message, sectio
 			err = errors.New("Unknown specifier " + string(section.Specifier))
 		}
 
+		if err != nil || response == nil {
+			_ = body.Close()
+		}
+
 		if err != nil {
 			return nil, err
 		}
+
+		if response != nil {
+			literal := newSectionLiteral(body, extractPartial(section, response))
+			im.fetchLiterals.add(literal)
+			return literal, nil
+		}
 	}
 
+	var response []byte
 	if header != nil {
 		response = filterHeader(header, section)
 	}
@@ -197,3 +250,62 @@ func (im *imapMailbox) getMessageBodySection(storeMessage *store.Message, sectio
 	// Trim any output if requested.
 	return bytes.NewBuffer(section.ExtractPartial(response)), nil
 }
+
+// extractPartial returns the part of the section requested by the client.
+// It is the streamed counterpart of imap.BodySectionName.ExtractPartial.
+func extractPartial(section *imap.BodySectionName, r *io.SectionReader) *io.SectionReader {
+	if len(section.Partial) != 2 {
+		return r
+	}
+
+	from := int64(section.Partial[0])
+	to := from + int64(section.Partial[1])
+
+	if from > r.Size() {
+		from = r.Size()
+	}
+
+	if to > r.Size() {
+		to = r.Size()
+	}
+
+	return io.NewSectionReader(r, from, to-from)
+}
+
+// sectionLiteral streams a section of the message literal to the client. The
+// message literal is closed once the section has been read to the end or,
+// at the latest, when the FETCH command is done.
+type sectionLiteral struct {
+	*io.SectionReader
+
+	body *message.Literal
+	once sync.Once
+}
+
+func newSectionLiteral(body *message.Literal, r *io.SectionReader) *sectionLiteral {
+	l := &sectionLiteral{SectionReader: r, body: body}
+
+	// The client may not be sent an empty literal at all.
+	if r.Size() == 0 {
+		l.close()
+	}
+
+	return l
+}
+
+func (l *sectionLiteral) Len() int {
+	return int(l.Size())
+}
+
+func (l *sectionLiteral) Read(p []byte) (int, error) {
+	n, err := l.SectionReader.Read(p)
+	if err != nil {
+		l.close()
+	}
+
+	return n, err
+}
+
+func (l *sectionLiteral) close() {
+	l.once.Do(func() { _ = l.body.Close() })
+}
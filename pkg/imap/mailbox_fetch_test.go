@@ -18,10 +18,15 @@
 package imap
 
 import (
+	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
 
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/message"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFilterHeader(t *testing.T) {
@@ -65,3 +70,32 @@ func TestFilterHeaderNoNewline(t *testing.T) {
 		return strings.EqualFold(field, "Subject")
 	})))
 }
+
+func TestExtractPartial(t *testing.T) {
+	const body = "0123456789"
+
+	for _, partial := range [][]int{nil, {0, 4}, {3, 4}, {8, 4}, {10, 4}, {12, 4}, {0, 0}} {
+		section := &imap.BodySectionName{Partial: partial}
+
+		b, err := ioutil.ReadAll(extractPartial(section, io.NewSectionReader(strings.NewReader(body), 0, int64(len(body)))))
+		require.NoError(t, err)
+
+		assert.Equal(t, string(section.ExtractPartial([]byte(body))), string(b), partial)
+	}
+}
+
+func TestSectionLiteralClosesBody(t *testing.T) {
+	body, err := message.NewLiteral(strings.NewReader("Subject: hello\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+
+	literal := newSectionLiteral(body, io.NewSectionReader(body, 18, 4))
+	assert.Equal(t, 4, literal.Len())
+
+	b, err := ioutil.ReadAll(literal)
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(b))
+
+	// The body was closed by the section literal.
+	_, err = body.ReadAt(make([]byte, 1), 0)
+	assert.Error(t, err)
+}
@@ -321,6 +321,23 @@ func (im *imapMailbox) labelMessages(uid bool, seqSet *imap.SeqSet, targetLabel
 	return uidplus.CopyResponse(targetStoreMailbox.UIDValidity(), sourceSeqSet, targetSeqSet)
 }
 
+// searchSince returns the oldest date the search criteria can match and
+// whether they have any date criterion at all. Zero time means no limit.
+func searchSince(criteria *imap.SearchCriteria) (since time.Time, ok bool) {
+	for _, date := range []time.Time{criteria.Since, criteria.SentSince} {
+		if !date.IsZero() && (since.IsZero() || date.Before(since)) {
+			since = date
+		}
+	}
+
+	if !since.IsZero() {
+		return since, true
+	}
+
+	// Only an upper bound, all older messages can match.
+	return time.Time{}, !criteria.Before.IsZero() || !criteria.SentBefore.IsZero()
+}
+
 // SearchMessages searches messages. The returned list must contain UIDs if
 // uid is set to true, or sequence numbers otherwise.
 func (im *imapMailbox) SearchMessages(isUID bool, criteria *imap.SearchCriteria) (ids []uint32, err error) { //nolint[gocyclo]
@@ -332,6 +349,11 @@ func (im *imapMailbox) SearchMessages(isUID bool, criteria *imap.SearchCriteria)
 		log.Warn("Body and Text criteria not applied")
 	}
 
+	// Searches reaching beyond the sync window need the older messages.
+	if since, ok := searchSince(criteria); ok {
+		im.fetchOutsideSyncPolicy(since)
+	}
+
 	var apiIDs []string
 	if criteria.SeqNum != nil {
 		apiIDs, err = im.apiIDsFromSeqSet(false, criteria.SeqNum)
@@ -533,7 +555,7 @@ func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []ima
 
 	// We always report the sent folder as empty in the BCC self mode because
 	// the sent messages will appear in different folders
-	if im.user.backend.bccSelf && im.storeMailbox.LabelID() == pmapi.SentLabel {
+	if im.user.backend.isBCCSelf() && im.storeMailbox.LabelID() == pmapi.SentLabel {
 		return nil
 	}
 
@@ -602,7 +624,7 @@ func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []ima
 		return nil
 	}
 
-	err = parallel.RunParallel(im.user.backend.listWorkers, input, processCallback, collectCallback)
+	err = parallel.RunParallel(im.user.backend.getListWorkers(), input, processCallback, collectCallback)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package imap
+
+import (
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// prefetchExtension replaces the SELECT and EXAMINE commands to prefetch the
+// messages of the selected mailbox into the cache before those of the other
+// mailboxes and to fetch its messages excluded by the sync policy. It adds no
+// capability.
+type prefetchExtension struct{}
+
+func (ext *prefetchExtension) Capabilities(c imapserver.Conn) []string {
+	return nil
+}
+
+func (ext *prefetchExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "SELECT":
+		return func() imapserver.Handler { return &prefetchSelect{} }
+
+	case "EXAMINE":
+		return func() imapserver.Handler {
+			handler := &prefetchSelect{}
+			handler.ReadOnly = true
+			return handler
+		}
+
+	default:
+		return nil
+	}
+}
+
+type prefetchSelect struct {
+	imapserver.Select
+}
+
+func (cmd *prefetchSelect) Handle(conn imapserver.Conn) error {
+	if err := cmd.Select.Handle(conn); err != nil {
+		return err
+	}
+
+	if mailbox, ok := conn.Context().Mailbox.(*imapMailbox); ok {
+		mailbox.storeMailbox.PrefetchMessages()
+
+		// Opening a mailbox excluded by the sync policy fetches its messages
+		// within the sync window. They are announced to the client as they come.
+		go mailbox.fetchOutsideSyncPolicy(mailbox.storeMailbox.SyncWindowStart())
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package imap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetchExtensionCommands(t *testing.T) {
+	ext := &prefetchExtension{}
+
+	sel, ok := ext.Command("SELECT")().(*prefetchSelect)
+	require.True(t, ok)
+	require.False(t, sel.ReadOnly)
+
+	examine, ok := ext.Command("EXAMINE")().(*prefetchSelect)
+	require.True(t, ok)
+	require.True(t, examine.ReadOnly)
+
+	require.Nil(t, ext.Command("FETCH"))
+	require.Empty(t, ext.Capabilities(nil))
+}
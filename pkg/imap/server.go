@@ -23,6 +23,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap"
@@ -36,13 +37,18 @@ import (
 	"github.com/ljanyst/peroxide/pkg/imap/idle"
 	"github.com/ljanyst/peroxide/pkg/imap/uidplus"
 	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/oauth"
 	"github.com/ljanyst/peroxide/pkg/serverutil"
 )
 
+// byeTimeout limits how long the shutdown waits for BYE to be sent to a client.
+const byeTimeout = 5 * time.Second
+
 // Server takes care of IMAP listening serving. It implements serverutil.Server.
 type Server struct {
 	debugClient bool
 	debugServer bool
+	addressLock sync.RWMutex
 	address     string
 	port        int
 
@@ -57,6 +63,7 @@ func NewIMAPServer(
 	port int,
 	tls *tls.Config,
 	imapBackend backend.Backend,
+	tokens *oauth.TokenStore,
 	eventListener listener.Listener,
 ) *Server {
 	server := &Server{
@@ -66,12 +73,12 @@ func NewIMAPServer(
 		port:        port,
 	}
 
-	server.server = newGoIMAPServer(tls, imapBackend, server.Address())
+	server.server = newGoIMAPServer(tls, imapBackend, server.Address(), tokens)
 	server.controller = serverutil.NewController(server, eventListener)
 	return server
 }
 
-func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *imapserver.Server {
+func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string, tokens *oauth.TokenStore) *imapserver.Server {
 	server := imapserver.New(backend)
 	server.TLSConfig = tls
 	server.AllowInsecureAuth = true
@@ -79,8 +86,8 @@ func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *
 	server.AutoLogout = 30 * time.Minute
 	server.Addr = address
 
-	server.EnableAuth(sasl.Login, func(conn imapserver.Conn) sasl.Server {
-		return sasl.NewLoginServer(func(address, password string) error {
+	login := func(conn imapserver.Conn) func(address, password string) error {
+		return func(address, password string) error {
 			user, err := conn.Server().Backend.Login(nil, address, password)
 			if err != nil {
 				return err
@@ -90,9 +97,31 @@ func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *
 			ctx.State = imap.AuthenticatedState
 			ctx.User = user
 			return nil
-		})
+		}
+	}
+
+	server.EnableAuth(sasl.Login, func(conn imapserver.Conn) sasl.Server {
+		return sasl.NewLoginServer(login(conn))
 	})
 
+	if tokens != nil {
+		server.EnableAuth(sasl.OAuthBearer, func(conn imapserver.Conn) sasl.Server {
+			return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+				if err := tokens.Authenticate(opts.Username, opts.Token, login(conn)); err != nil {
+					log.WithError(err).Warn("OAUTHBEARER authentication failed")
+					return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+				}
+				return nil
+			})
+		})
+
+		server.EnableAuth(oauth.XOAuth2, func(conn imapserver.Conn) sasl.Server {
+			return oauth.NewXOAuth2Server(func(username, token string) error {
+				return tokens.Authenticate(username, token, login(conn))
+			})
+		})
+	}
+
 	server.Enable(
 		idle.NewExtension(),
 		imapmove.NewExtension(),
@@ -100,6 +129,9 @@ func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *
 		imapappendlimit.NewExtension(),
 		imapunselect.NewExtension(),
 		uidplus.NewExtension(),
+		&prefetchExtension{},
+		&fetchExtension{},
+		&syncProgressExtension{},
 	)
 
 	return server
@@ -111,12 +143,75 @@ func (s *Server) ListenAndServe() { s.controller.ListenAndServe() }
 // Close turns off server and monitors.
 func (s *Server) Close() { s.controller.Close() }
 
+// Shutdown stops accepting connections, says BYE to the connected clients and
+// closes the server.
+func (s *Server) Shutdown() {
+	s.controller.StopListening()
+
+	var conns []imapserver.Conn
+	s.server.ForEachConn(func(conn imapserver.Conn) {
+		conns = append(conns, conn)
+	})
+
+	log.WithField("connections", len(conns)).Info("Closing IMAP connections")
+
+	bye := &imap.StatusResp{
+		Type: imap.StatusRespBye,
+		Info: "Server is shutting down",
+	}
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn imapserver.Conn) {
+			defer wg.Done()
+
+			// Do not wait for connections that are no longer sending responses.
+			written := make(chan struct{})
+			go func() {
+				_ = conn.WriteResp(bye)
+				close(written)
+			}()
+
+			select {
+			case <-written:
+			case <-time.After(byeTimeout):
+			}
+
+			if err := conn.Close(); err != nil {
+				log.WithError(err).Debug("Failed to close the connection")
+			}
+		}(conn)
+	}
+	wg.Wait()
+
+	s.controller.Close()
+}
+
+// Rebind makes the server listen on a new address without closing the
+// connections it has already accepted.
+func (s *Server) Rebind(address string, port int) {
+	s.addressLock.Lock()
+	s.address = address
+	s.port = port
+	s.addressLock.Unlock()
+
+	s.controller.Rebind()
+}
+
+// Address returns the address the server listens on.
+func (s *Server) Address() string {
+	s.addressLock.RLock()
+	defer s.addressLock.RUnlock()
+
+	return fmt.Sprintf("%s:%d", s.address, s.port)
+}
+
 // Implements serverutil.Server interface.
 
-func (Server) Protocol() serverutil.Protocol { return serverutil.IMAP }
-func (s *Server) UseSSL() bool               { return false }
-func (s *Server) Address() string            { return fmt.Sprintf("%s:%d", s.address, s.port) }
-func (s *Server) TLSConfig() *tls.Config     { return s.server.TLSConfig }
+func (*Server) Protocol() serverutil.Protocol { return serverutil.IMAP }
+func (s *Server) UseSSL() bool                { return false }
+func (s *Server) TLSConfig() *tls.Config      { return s.server.TLSConfig }
 
 func (s *Server) DebugServer() bool { return s.debugServer }
 func (s *Server) DebugClient() bool { return s.debugClient }
@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// syncProgressExtension replaces the LOGIN and AUTHENTICATE commands to alert
+// the client that the mailbox is not complete yet when the user logs in while
+// the initial sync is still running. It adds no capability.
+type syncProgressExtension struct{}
+
+func (ext *syncProgressExtension) Capabilities(c imapserver.Conn) []string {
+	return nil
+}
+
+func (ext *syncProgressExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "LOGIN":
+		return func() imapserver.Handler {
+			return &syncProgressAlert{Handler: &imapserver.Login{}}
+		}
+
+	case "AUTHENTICATE":
+		return func() imapserver.Handler {
+			return &syncProgressAlert{Handler: &imapserver.Authenticate{}}
+		}
+
+	default:
+		return nil
+	}
+}
+
+// syncProgressAlert sends the alert once the wrapped command authenticated
+// the user.
+type syncProgressAlert struct {
+	imapserver.Handler
+}
+
+func (cmd *syncProgressAlert) Handle(conn imapserver.Conn) error {
+	if err := cmd.Handler.Handle(conn); err != nil {
+		return err
+	}
+
+	alertSyncProgress(conn)
+	return nil
+}
+
+func alertSyncProgress(conn imapserver.Conn) {
+	imapUser, ok := conn.Context().User.(*imapUser)
+	if !ok || imapUser.storeUser == nil {
+		return
+	}
+
+	progress := imapUser.storeUser.SyncProgress()
+	if !progress.Running {
+		return
+	}
+
+	if err := conn.WriteResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: imap.CodeAlert,
+		Info: "Synchronization in progress: " + progress.String(),
+	}); err != nil {
+		log.WithError(err).Warn("Cannot send sync progress alert")
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package imap
+
+import (
+	"testing"
+
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncProgressExtensionCommands(t *testing.T) {
+	ext := &syncProgressExtension{}
+
+	login, ok := ext.Command("LOGIN")().(*syncProgressAlert)
+	require.True(t, ok)
+	require.IsType(t, &imapserver.Login{}, login.Handler)
+
+	authenticate, ok := ext.Command("AUTHENTICATE")().(*syncProgressAlert)
+	require.True(t, ok)
+	require.IsType(t, &imapserver.Authenticate{}, authenticate.Handler)
+
+	require.Nil(t, ext.Command("SELECT"))
+	require.Empty(t, ext.Capabilities(nil))
+}
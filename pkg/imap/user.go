@@ -24,6 +24,7 @@ import (
 
 	imapquota "github.com/emersion/go-imap-quota"
 	goIMAPBackend "github.com/emersion/go-imap/backend"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/store"
 	"github.com/ljanyst/peroxide/pkg/users"
@@ -121,7 +122,7 @@ func (iu *imapUser) Username() string {
 func (iu *imapUser) ListMailboxes(showOnlySubcribed bool) ([]goIMAPBackend.Mailbox, error) {
 	mailboxes := []goIMAPBackend.Mailbox{}
 	for _, storeMailbox := range iu.storeAddress.ListMailboxes() {
-		if storeMailbox.LabelID() == pmapi.AllMailLabel && !iu.backend.isAllMailVisible {
+		if storeMailbox.LabelID() == pmapi.AllMailLabel && !iu.backend.allMailVisible() {
 			continue
 		}
 
@@ -195,6 +196,7 @@ func (iu *imapUser) Logout() (err error) {
 	log.Debug("IMAP client logged out address ", iu.storeAddress.AddressID())
 
 	iu.backend.deleteUser(iu.currentAddressLowercase)
+	metrics.Disconnected("imap", iu.user.ID())
 
 	return nil
 }
@@ -20,7 +20,9 @@ package message
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 )
 
 type boundaryReader struct {
@@ -50,53 +52,121 @@ func newBoundaryReader(r *bufio.Reader, boundary string) (br *boundaryReader, er
 	return
 }
 
+// errPartEnd tells that the current part was ended by a boundary.
+var errPartEnd = errors.New("end of part")
+
 // writeNextPartTo will copy the the bytes of next part and write them to
 // writer. Will return EOF if the underlying reader is empty.
-func (br *boundaryReader) writeNextPartTo(part io.Writer) (err error) {
+func (br *boundaryReader) writeNextPartTo(part io.Writer) error {
+	br.skipped = 0
+
+	for {
+		line, err := br.nextLine()
+		if err == errPartEnd {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if part != nil {
+			if _, err := part.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// nextPart returns a reader of the next part which does not need to hold the
+// part in memory.
+func (br *boundaryReader) nextPart() *partReader {
+	br.skipped = 0
+
+	return &partReader{br: br}
+}
+
+// nextLine returns the next line of the current part. It returns errPartEnd
+// once the part is ended by a boundary.
+func (br *boundaryReader) nextLine() ([]byte, error) {
 	if br.closed {
-		return io.EOF
+		return nil, io.EOF
 	}
 
 	var line, slice []byte
-	br.skipped = 0
+	var err error
 
 	for {
 		slice, err = br.reader.ReadSlice('\n')
 		line = append(line, slice...)
-		if err == bufio.ErrBufferFull {
-			continue
+		if err != bufio.ErrBufferFull {
+			break
 		}
+	}
 
-		br.skipped += len(line)
+	br.skipped += len(line)
 
-		if err == io.EOF && br.isFinalBoundary(line) {
-			err = nil
-			br.closed = true
-			return
-		}
+	if err == io.EOF && br.isFinalBoundary(line) {
+		br.closed = true
+		return nil, errPartEnd
+	}
 
-		if err != nil {
-			return
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		if br.isBoundaryDelimiterLine(line) {
-			br.first = false
-			return
-		}
+	if br.isBoundaryDelimiterLine(line) {
+		br.first = false
+		return nil, errPartEnd
+	}
 
-		if br.isFinalBoundary(line) {
-			br.closed = true
-			return
+	if br.isFinalBoundary(line) {
+		br.closed = true
+		return nil, errPartEnd
+	}
+
+	return line, nil
+}
+
+// partReader reads the current part of a boundaryReader line by line. It
+// returns EOF at the end of the part whatever ended it.
+type partReader struct {
+	br    *boundaryReader
+	line  []byte
+	err   error
+	ended bool
+}
+
+func (pr *partReader) Read(p []byte) (int, error) {
+	for len(pr.line) == 0 {
+		if pr.ended {
+			return 0, io.EOF
 		}
 
-		if part != nil {
-			if _, err = part.Write(line); err != nil {
-				return
-			}
+		if pr.line, pr.err = pr.br.nextLine(); pr.err != nil {
+			pr.ended = true
 		}
+	}
+
+	n := copy(p, pr.line)
+	pr.line = pr.line[n:]
 
-		line = []byte{}
+	return n, nil
+}
+
+// finish skips the rest of the part. It returns nil when the part was ended
+// by a boundary and the error of the underlying reader otherwise, which is
+// EOF when the part is not ended at all.
+func (pr *partReader) finish() error {
+	if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+		return err
 	}
+
+	if pr.err == errPartEnd {
+		return nil
+	}
+
+	return pr.err
 }
 
 func (br *boundaryReader) isFinalBoundary(line []byte) bool {
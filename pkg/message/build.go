@@ -19,6 +19,7 @@ package message
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"sync"
@@ -40,9 +41,10 @@ const (
 )
 
 type Builder struct {
-	pool *pool.Pool
-	jobs map[string]*Job
-	lock sync.Mutex
+	pool           *pool.Pool
+	attachmentPool *pool.Pool
+	jobs           map[string]*Job
+	lock           sync.Mutex
 }
 
 type Fetcher interface {
@@ -64,11 +66,24 @@ func NewBuilder(fetchWorkers, attachmentWorkers int) *Builder {
 	fetcherPool := pool.New(fetchWorkers, newFetcherWorkFunc(attachmentPool))
 
 	return &Builder{
-		pool: fetcherPool,
-		jobs: make(map[string]*Job),
+		pool:           fetcherPool,
+		attachmentPool: attachmentPool,
+		jobs:           make(map[string]*Job),
 	}
 }
 
+// SetWorkers changes the number of fetch and attachment workers.
+func (builder *Builder) SetWorkers(fetchWorkers, attachmentWorkers int) {
+	builder.pool.Resize(fetchWorkers)
+	builder.attachmentPool.Resize(attachmentWorkers)
+}
+
+// Pending returns the number of message fetch jobs and attachment fetch jobs
+// waiting for a worker.
+func (builder *Builder) Pending() (fetch, attach int) {
+	return builder.pool.Pending(), builder.attachmentPool.Pending()
+}
+
 func (builder *Builder) NewJob(ctx context.Context, fetcher Fetcher, messageID string, prio int) (*Job, pool.DoneFunc) {
 	return builder.NewJobWithOptions(ctx, fetcher, messageID, JobOptions{}, prio)
 }
@@ -77,12 +92,20 @@ func (builder *Builder) NewJobWithOptions(ctx context.Context, fetcher Fetcher,
 	builder.lock.Lock()
 	defer builder.lock.Unlock()
 
-	if job, ok := builder.jobs[messageID]; ok {
+	// Partial builds are not interchangeable with full ones.
+	jobID := messageID
+	if opts.Sections != nil {
+		jobID += fmt.Sprintf("%v", opts.Sections)
+	}
+
+	if job, ok := builder.jobs[jobID]; ok {
 		if job.GetPriority() < prio {
 			job.SetPriority(prio)
 		}
 
-		return job, job.done
+		job.users++
+
+		return job, builder.jobDone(jobID, job)
 	}
 
 	job, done := builder.pool.NewJob(
@@ -95,25 +118,39 @@ func (builder *Builder) NewJobWithOptions(ctx context.Context, fetcher Fetcher,
 		prio,
 	)
 
-	buildDone := func() {
-		builder.lock.Lock()
-		defer builder.lock.Unlock()
+	buildJob := &Job{
+		Job:   job,
+		done:  done,
+		users: 1,
+	}
 
-		// Remove the job from the builder.
-		delete(builder.jobs, messageID)
+	builder.jobs[jobID] = buildJob
 
-		// And mark it as done.
-		done()
-	}
+	return buildJob, builder.jobDone(jobID, buildJob)
+}
 
-	buildJob := &Job{
-		Job:  job,
-		done: buildDone,
-	}
+// jobDone returns the done function of one user of the job. The job is
+// removed from the builder and its literal released once all of them are
+// done; the users which got the literal keep it until they close it.
+func (builder *Builder) jobDone(jobID string, job *Job) pool.DoneFunc {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			builder.lock.Lock()
+			defer builder.lock.Unlock()
+
+			if job.users--; job.users > 0 {
+				return
+			}
+
+			delete(builder.jobs, jobID)
 
-	builder.jobs[messageID] = buildJob
+			job.done()
 
-	return buildJob, buildDone
+			go job.release()
+		})
+	}
 }
 
 func (builder *Builder) Done() {
@@ -136,16 +173,32 @@ type attachReq struct {
 type Job struct {
 	*pool.Job
 
-	done pool.DoneFunc
+	done  pool.DoneFunc
+	users int
 }
 
-func (job *Job) GetResult() ([]byte, error) {
+// GetResult waits for the message to be built and returns its literal. It
+// must be called before the job is done and the literal must be closed
+// after use.
+func (job *Job) GetResult() (*Literal, error) {
 	res, err := job.Job.GetResult()
 	if err != nil {
 		return nil, err
 	}
 
-	return res.([]byte), nil //nolint:forcetypeassert
+	lit := res.(*Literal) //nolint:forcetypeassert
+
+	lit.retain()
+
+	return lit, nil
+}
+
+// release waits for the message to be built and releases the job's
+// reference to its literal.
+func (job *Job) release() {
+	if res, err := job.Job.GetResult(); err == nil {
+		_ = res.(*Literal).Close() //nolint:forcetypeassert
+	}
 }
 
 // NOTE: This is not used because it is actually not doing what was expected: It
@@ -195,38 +248,33 @@ func newFetcherWorkFunc(attachmentPool *pool.Pool) pool.WorkFunc {
 			return nil, err
 		}
 
-		attData := make(map[string][]byte)
-
-		for _, att := range msg.Attachments {
-			// NOTE: Potential place for optimization:
-			// Use attachmentPool to download each attachment in
-			// separate parallel job. It is not straightforward
-			// because we need to make sure we call attachment-job-done
-			// function in case of any error or after we collect all
-			// attachment bytes asynchronously.
-			rc, err := req.fetcher.GetAttachment(req.ctx, att.ID)
-			if err != nil {
-				return nil, err
-			}
+		kr, err := req.fetcher.KeyRingForAddressID(msg.AddressID)
+		if err != nil {
+			return nil, ErrNoSuchKeyRing
+		}
 
-			b, err := ioutil.ReadAll(rc)
-			if err != nil {
-				_ = rc.Close()
-				return nil, err
-			}
+		paths := attachmentPaths(msg)
 
-			if err := rc.Close(); err != nil {
-				return nil, err
+		// The attachments are downloaded one by one while the message is
+		// being written so that only one of them is in flight at a time.
+		getAttachment := func(att *pmapi.Attachment) (io.ReadCloser, error) {
+			if !isInSections(paths[att.ID], req.options.Sections) {
+				return nil, nil
 			}
 
-			attData[att.ID] = b
+			return req.fetcher.GetAttachment(req.ctx, att.ID)
 		}
 
-		kr, err := req.fetcher.KeyRingForAddressID(msg.AddressID)
+		w, err := newLiteralWriter()
 		if err != nil {
-			return nil, ErrNoSuchKeyRing
+			return nil, err
+		}
+
+		if err := buildRFC822(kr, msg, getAttachment, req.options, w); err != nil {
+			w.abort(err)
+			return nil, err
 		}
 
-		return buildRFC822(kr, msg, attData, req.options)
+		return w.finish()
 	}
 }
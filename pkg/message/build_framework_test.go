@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
 	"time"
@@ -127,15 +128,26 @@ type testSection struct {
 	raw  []byte
 }
 
+func newTestLiteral(t *testing.T, b []byte) *Literal {
+	lit, err := NewLiteral(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	return lit
+}
+
 // NOTE: Each section is parsed individually --> cleaner test code but slower... improve this one day?
-func section(t *testing.T, b []byte, section ...int) *testSection {
+func section(t *testing.T, lit *Literal, section ...int) *testSection {
+	b, err := ioutil.ReadAll(lit.NewReader())
+	require.NoError(t, err)
+
 	p, err := parser.New(bytes.NewReader(b))
 	assert.NoError(t, err)
 
 	part, err := p.Section(section)
 	require.NoError(t, err)
 
-	bs, err := NewBodyStructure(bytes.NewReader(b))
+	// The structure is the one computed while the literal was written.
+	bs, err := lit.Structure()
 	require.NoError(t, err)
 
 	raw, err := bs.GetSection(bytes.NewReader(b), section)
@@ -24,4 +24,13 @@ type JobOptions struct {
 	AddExternalID          bool // Whether to include ExternalID as X-Pm-External-Id.
 	AddMessageDate         bool // Whether to include message time as X-Pm-Date.
 	AddMessageIDReference  bool // Whether to include the MessageID in References.
+
+	// Headers are set on the built message in addition to those from the API.
+	Headers map[string]string
+
+	// Sections, when not nil, limits the attachments which are downloaded to
+	// those within the given section paths. The other attachment parts are
+	// left empty, so the result is only good for reading these sections and
+	// the MIME headers; it must not be cached.
+	Sections [][]int
 }
@@ -20,6 +20,8 @@ package message
 import (
 	"bytes"
 	"encoding/base64"
+	"io"
+	"io/ioutil"
 	"mime"
 	"net/mail"
 	"strings"
@@ -34,104 +36,150 @@ import (
 	"github.com/pkg/errors"
 )
 
-func buildRFC822(kr *crypto.KeyRing, msg *pmapi.Message, attData map[string][]byte, opts JobOptions) ([]byte, error) {
+// attachmentFunc opens the encrypted data packet of the given attachment. It
+// returns a nil reader when the content of the attachment is not needed.
+type attachmentFunc func(*pmapi.Attachment) (io.ReadCloser, error)
+
+// attachmentPaths returns the section path of each attachment of the message
+// as laid out by buildMultipartRFC822.
+func attachmentPaths(msg *pmapi.Message) map[string][]int {
+	paths := make(map[string][]int)
+
+	var inline, attach int
+
+	for _, att := range msg.Attachments {
+		if att.Disposition == pmapi.DispositionInline {
+			// The text part comes first in the multipart/related part.
+			paths[att.ID] = []int{1, inline + 2}
+			inline++
+		} else {
+			// The text or the multipart/related part comes first.
+			paths[att.ID] = []int{attach + 2}
+			attach++
+		}
+	}
+
+	return paths
+}
+
+// isInSections returns whether the part with the given path is within or
+// contains one of the sections; nil sections contain every part.
+func isInSections(path []int, sections [][]int) bool {
+	if sections == nil {
+		return true
+	}
+
+	for _, section := range sections {
+		n := len(section)
+		if len(path) < n {
+			n = len(path)
+		}
+
+		if equalPaths(path[:n], section[:n]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equalPaths(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// buildRFC822 writes the message to out as it is built. Nothing is written
+// before the message body is decrypted, but an attachment failing half way
+// through leaves a partial message behind.
+func buildRFC822(kr *crypto.KeyRing, msg *pmapi.Message, getAttachment attachmentFunc, opts JobOptions, out io.Writer) error {
 	switch {
 	case len(msg.Attachments) > 0:
-		return buildMultipartRFC822(kr, msg, attData, opts)
+		return buildMultipartRFC822(kr, msg, getAttachment, opts, out)
 
 	case msg.MIMEType == "multipart/mixed":
-		return buildPGPRFC822(kr, msg, opts)
+		return buildPGPRFC822(kr, msg, opts, out)
 
 	default:
-		return buildSimpleRFC822(kr, msg, opts)
+		return buildSimpleRFC822(kr, msg, opts, out)
 	}
 }
 
-func buildSimpleRFC822(kr *crypto.KeyRing, msg *pmapi.Message, opts JobOptions) ([]byte, error) {
+func buildSimpleRFC822(kr *crypto.KeyRing, msg *pmapi.Message, opts JobOptions, out io.Writer) error {
 	dec, err := msg.Decrypt(kr)
 	if err != nil {
 		if !opts.IgnoreDecryptionErrors {
-			return nil, errors.Wrap(ErrDecryptionFailed, err.Error())
+			return errors.Wrap(ErrDecryptionFailed, err.Error())
 		}
 
-		return buildMultipartRFC822(kr, msg, nil, opts)
+		return buildMultipartRFC822(kr, msg, nil, opts, out)
 	}
 
 	hdr := getTextPartHeader(getMessageHeader(msg, opts), dec, msg.MIMEType)
 
-	buf := new(bytes.Buffer)
-
-	w, err := message.CreateWriter(buf, hdr)
+	w, err := message.CreateWriter(out, hdr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if _, err := w.Write(dec); err != nil {
-		return nil, err
-	}
-
-	if err := w.Close(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return buf.Bytes(), nil
+	return w.Close()
 }
 
 func buildMultipartRFC822(
 	kr *crypto.KeyRing,
 	msg *pmapi.Message,
-	attData map[string][]byte,
+	getAttachment attachmentFunc,
 	opts JobOptions,
-) ([]byte, error) {
+	out io.Writer,
+) error {
 	boundary := newBoundary(msg.ID)
 
 	hdr := getMessageHeader(msg, opts)
 
 	hdr.SetContentType("multipart/mixed", map[string]string{"boundary": boundary.gen()})
 
-	buf := new(bytes.Buffer)
-
-	w, err := message.CreateWriter(buf, hdr)
+	w, err := message.CreateWriter(out, hdr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var (
-		inlineAtts []*pmapi.Attachment
-		inlineData [][]byte
-		attachAtts []*pmapi.Attachment
-		attachData [][]byte
-	)
+	var inlineAtts, attachAtts []*pmapi.Attachment
 
 	for _, att := range msg.Attachments {
 		if att.Disposition == pmapi.DispositionInline {
 			inlineAtts = append(inlineAtts, att)
-			inlineData = append(inlineData, attData[att.ID])
 		} else {
 			attachAtts = append(attachAtts, att)
-			attachData = append(attachData, attData[att.ID])
 		}
 	}
 
 	if len(inlineAtts) > 0 {
-		if err := writeRelatedParts(w, kr, boundary, msg, inlineAtts, inlineData, opts); err != nil {
-			return nil, err
+		if err := writeRelatedParts(w, kr, boundary, msg, inlineAtts, getAttachment, opts); err != nil {
+			return err
 		}
 	} else if err := writeTextPart(w, kr, msg, opts); err != nil {
-		return nil, err
+		return err
 	}
 
-	for i, att := range attachAtts {
-		if err := writeAttachmentPart(w, kr, att, attachData[i], opts); err != nil {
-			return nil, err
+	for _, att := range attachAtts {
+		if err := writeAttachmentPart(w, kr, att, getAttachment, opts); err != nil {
+			return err
 		}
 	}
 
-	if err := w.Close(); err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
+	return w.Close()
 }
 
 func writeTextPart(
@@ -152,11 +200,15 @@ func writeTextPart(
 	return writePart(w, getTextPartHeader(message.Header{}, dec, msg.MIMEType), dec)
 }
 
+// writeAttachmentPart decrypts the attachment while it is being downloaded
+// and writes it to the part as it goes. If the data turns out to be corrupted
+// half way through, the part has already been written so the job fails even
+// when decryption errors are to be ignored.
 func writeAttachmentPart(
 	w *message.Writer,
 	kr *crypto.KeyRing,
 	att *pmapi.Attachment,
-	attData []byte,
+	getAttachment attachmentFunc,
 	opts JobOptions,
 ) error {
 	kps, err := base64.StdEncoding.DecodeString(att.KeyPackets)
@@ -164,9 +216,20 @@ func writeAttachmentPart(
 		return err
 	}
 
-	msg := crypto.NewPGPSplitMessage(kps, attData).GetPGPMessage()
+	rc, err := getAttachment(att)
+	if err != nil {
+		return err
+	}
+
+	if rc == nil {
+		return writeEmptyAttachmentPart(w, kr, att, kps, opts)
+	}
+
+	defer func() { _ = rc.Close() }()
 
-	dec, err := kr.Decrypt(msg, nil, crypto.GetUnixTime())
+	data := &replayReader{r: rc, buf: new(bytes.Buffer)}
+
+	dec, err := kr.DecryptSplitStream(kps, data, nil, crypto.GetUnixTime())
 	if err != nil {
 		if !opts.IgnoreDecryptionErrors {
 			return errors.Wrap(ErrDecryptionFailed, err.Error())
@@ -178,10 +241,70 @@ func writeAttachmentPart(
 			WithError(err).
 			Warn("Attachment decryption failed")
 
-		return writeCustomAttachmentPart(w, att, msg, err)
+		enc, readErr := ioutil.ReadAll(data.replay())
+		if readErr != nil {
+			return readErr
+		}
+
+		return writeCustomAttachmentPart(w, att, crypto.NewPGPSplitMessage(kps, enc).GetPGPMessage(), err)
 	}
 
-	return writePart(w, getAttachmentPartHeader(att), dec.GetBinary())
+	data.forget()
+
+	return createPart(w, getAttachmentPartHeader(att), func(part *message.Writer) error {
+		if _, err := io.Copy(part, dec); err != nil {
+			return errors.Wrap(ErrDecryptionFailed, err.Error())
+		}
+
+		return nil
+	})
+}
+
+// writeEmptyAttachmentPart writes the part of an attachment which is not
+// downloaded with the same header the full attachment would get.
+func writeEmptyAttachmentPart(
+	w *message.Writer,
+	kr *crypto.KeyRing,
+	att *pmapi.Attachment,
+	kps []byte,
+	opts JobOptions,
+) error {
+	hdr := getAttachmentPartHeader(att)
+
+	if _, err := kr.DecryptSessionKey(kps); err != nil {
+		if !opts.IgnoreDecryptionErrors {
+			return errors.Wrap(ErrDecryptionFailed, err.Error())
+		}
+
+		hdr = getCustomAttachmentPartHeader(att)
+	}
+
+	return writePart(w, hdr, nil)
+}
+
+// replayReader remembers what has been read from the underlying reader until
+// forget is called so that the data can be read again from the start.
+type replayReader struct {
+	r   io.Reader
+	buf *bytes.Buffer
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+
+	if rr.buf != nil {
+		rr.buf.Write(p[:n])
+	}
+
+	return n, err
+}
+
+func (rr *replayReader) replay() io.Reader {
+	return io.MultiReader(rr.buf, rr.r)
+}
+
+func (rr *replayReader) forget() {
+	rr.buf = nil
 }
 
 func writeRelatedParts(
@@ -190,7 +313,7 @@ func writeRelatedParts(
 	boundary *boundary,
 	msg *pmapi.Message,
 	atts []*pmapi.Attachment,
-	attData [][]byte,
+	getAttachment attachmentFunc,
 	opts JobOptions,
 ) error {
 	hdr := message.Header{}
@@ -202,8 +325,8 @@ func writeRelatedParts(
 			return err
 		}
 
-		for i, att := range atts {
-			if err := writeAttachmentPart(rel, kr, att, attData[i], opts); err != nil {
+		for _, att := range atts {
+			if err := writeAttachmentPart(rel, kr, att, getAttachment, opts); err != nil {
 				return err
 			}
 		}
@@ -212,14 +335,14 @@ func writeRelatedParts(
 	})
 }
 
-func buildPGPRFC822(kr *crypto.KeyRing, msg *pmapi.Message, opts JobOptions) ([]byte, error) {
+func buildPGPRFC822(kr *crypto.KeyRing, msg *pmapi.Message, opts JobOptions, out io.Writer) error {
 	dec, err := msg.Decrypt(kr)
 	if err != nil {
 		if !opts.IgnoreDecryptionErrors {
-			return nil, errors.Wrap(ErrDecryptionFailed, err.Error())
+			return errors.Wrap(ErrDecryptionFailed, err.Error())
 		}
 
-		return buildPGPMIMEFallbackRFC822(msg, opts)
+		return buildPGPMIMEFallbackRFC822(msg, opts, out)
 	}
 
 	hdr := getMessageHeader(msg, opts)
@@ -230,13 +353,13 @@ func buildPGPRFC822(kr *crypto.KeyRing, msg *pmapi.Message, opts JobOptions) ([]
 	}
 
 	if len(sigs) > 0 {
-		return writeMultipartSignedRFC822(hdr, dec, sigs[0])
+		return writeMultipartSignedRFC822(hdr, dec, sigs[0], out)
 	}
 
-	return writeMultipartEncryptedRFC822(hdr, dec)
+	return writeMultipartEncryptedRFC822(hdr, dec, out)
 }
 
-func buildPGPMIMEFallbackRFC822(msg *pmapi.Message, opts JobOptions) ([]byte, error) {
+func buildPGPMIMEFallbackRFC822(msg *pmapi.Message, opts JobOptions, out io.Writer) error {
 	hdr := getMessageHeader(msg, opts)
 
 	hdr.SetContentType("multipart/encrypted", map[string]string{
@@ -244,11 +367,9 @@ func buildPGPMIMEFallbackRFC822(msg *pmapi.Message, opts JobOptions) ([]byte, er
 		"protocol": "application/pgp-encrypted",
 	})
 
-	buf := new(bytes.Buffer)
-
-	w, err := message.CreateWriter(buf, hdr)
+	w, err := message.CreateWriter(out, hdr)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	var encHdr message.Header
@@ -257,7 +378,7 @@ func buildPGPMIMEFallbackRFC822(msg *pmapi.Message, opts JobOptions) ([]byte, er
 	encHdr.Set("Content-Description", "PGP/MIME version identification")
 
 	if err := writePart(w, encHdr, []byte("Version: 1")); err != nil {
-		return nil, err
+		return err
 	}
 
 	var dataHdr message.Header
@@ -267,19 +388,13 @@ func buildPGPMIMEFallbackRFC822(msg *pmapi.Message, opts JobOptions) ([]byte, er
 	dataHdr.Set("Content-Description", "OpenPGP encrypted message")
 
 	if err := writePart(w, dataHdr, []byte(msg.Body)); err != nil {
-		return nil, err
-	}
-
-	if err := w.Close(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return buf.Bytes(), nil
+	return w.Close()
 }
 
-func writeMultipartSignedRFC822(header message.Header, body []byte, sig pmapi.Signature) ([]byte, error) { //nolint:funlen
-	buf := new(bytes.Buffer)
-
+func writeMultipartSignedRFC822(header message.Header, body []byte, sig pmapi.Signature, out io.Writer) error { //nolint:funlen
 	boundary := newBoundary("").gen()
 
 	header.SetContentType("multipart/signed", map[string]string{
@@ -288,28 +403,28 @@ func writeMultipartSignedRFC822(header message.Header, body []byte, sig pmapi.Si
 		"boundary": boundary,
 	})
 
-	if err := textproto.WriteHeader(buf, header.Header); err != nil {
-		return nil, err
+	if err := textproto.WriteHeader(out, header.Header); err != nil {
+		return err
 	}
 
-	mw := textproto.NewMultipartWriter(buf)
+	mw := textproto.NewMultipartWriter(out)
 
 	if err := mw.SetBoundary(boundary); err != nil {
-		return nil, err
+		return err
 	}
 
 	bodyHeader, bodyData, err := readHeaderBody(body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	bodyPart, err := mw.CreatePart(*bodyHeader)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if _, err := bodyPart.Write(bodyData); err != nil {
-		return nil, err
+		return err
 	}
 
 	var sigHeader message.Header
@@ -320,31 +435,25 @@ func writeMultipartSignedRFC822(header message.Header, body []byte, sig pmapi.Si
 
 	sigPart, err := mw.CreatePart(sigHeader.Header)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	sigData, err := crypto.NewPGPSignature(sig.Data).GetArmored()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	if _, err := sigPart.Write([]byte(sigData)); err != nil {
-		return nil, err
-	}
-
-	if err := mw.Close(); err != nil {
-		return nil, err
+		return err
 	}
 
-	return buf.Bytes(), nil
+	return mw.Close()
 }
 
-func writeMultipartEncryptedRFC822(header message.Header, body []byte) ([]byte, error) {
-	buf := new(bytes.Buffer)
-
+func writeMultipartEncryptedRFC822(header message.Header, body []byte, out io.Writer) error {
 	bodyHeader, bodyData, err := readHeaderBody(body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// If parsed header is empty then either it is malformed or it is missing.
@@ -359,15 +468,13 @@ func writeMultipartEncryptedRFC822(header message.Header, body []byte) ([]byte,
 		header.Set(entFields.Key(), entFields.Value())
 	}
 
-	if err := textproto.WriteHeader(buf, header.Header); err != nil {
-		return nil, err
+	if err := textproto.WriteHeader(out, header.Header); err != nil {
+		return err
 	}
 
-	if _, err := buf.Write(bodyData); err != nil {
-		return nil, err
-	}
+	_, err = out.Write(bodyData)
 
-	return buf.Bytes(), nil
+	return err
 }
 
 func getMessageHeader(msg *pmapi.Message, opts JobOptions) message.Header { //nolint:funlen
@@ -436,6 +543,10 @@ func getMessageHeader(msg *pmapi.Message, opts JobOptions) message.Header { //no
 		}
 	}
 
+	for key, value := range opts.Headers {
+		hdr.Set(key, value)
+	}
+
 	return hdr
 }
 
@@ -77,14 +77,7 @@ func writeCustomAttachmentPart(
 		return err
 	}
 
-	filename := mime.QEncoding.Encode("utf-8", att.Name+".pgp")
-
-	var hdr message.Header
-
-	hdr.SetContentType("application/octet-stream", map[string]string{"name": filename})
-	hdr.SetContentDisposition(att.Disposition, map[string]string{"filename": filename})
-
-	part, err := w.CreatePart(hdr)
+	part, err := w.CreatePart(getCustomAttachmentPartHeader(att))
 	if err != nil {
 		return err
 	}
@@ -95,3 +88,14 @@ func writeCustomAttachmentPart(
 
 	return part.Close()
 }
+
+func getCustomAttachmentPartHeader(att *pmapi.Attachment) message.Header {
+	filename := mime.QEncoding.Encode("utf-8", att.Name+".pgp")
+
+	var hdr message.Header
+
+	hdr.SetContentType("application/octet-stream", map[string]string{"name": filename})
+	hdr.SetContentDisposition(att.Disposition, map[string]string{"filename": filename})
+
+	return hdr
+}
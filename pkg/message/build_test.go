@@ -19,6 +19,7 @@ package message
 
 import (
 	"context"
+	"io/ioutil"
 	"errors"
 	"net/mail"
 	"strings"
@@ -1168,6 +1169,30 @@ func TestBuildIncludeMessageIDReference(t *testing.T) {
 	section(t, resRef).expectHeader(`References`, is(`<myreference@domain.com> <messageID@protonmail.internalid>`))
 }
 
+func TestBuildMessageExtraHeaders(t *testing.T) {
+	m := gomock.NewController(t)
+	defer m.Finish()
+
+	b := NewBuilder(2, 2)
+	defer b.Done()
+
+	kr := testutil.MakeKeyRing(t)
+	msg := newTestMessage(t, kr, "messageID", "addressID", "text/plain", "body", time.Now())
+
+	job, done := b.NewJobWithOptions(
+		context.Background(),
+		newTestFetcher(m, kr, msg),
+		msg.ID,
+		JobOptions{Headers: map[string]string{"X-Peroxide-Identity": "catchall@example.com"}},
+		ForegroundPriority,
+	)
+	res, err := job.GetResult()
+	require.NoError(t, err)
+	done()
+
+	section(t, res).expectHeader(`X-Peroxide-Identity`, is(`catchall@example.com`))
+}
+
 func TestBuildMessageIsDeterministic(t *testing.T) {
 	m := gomock.NewController(t)
 	defer m.Finish()
@@ -1190,7 +1215,14 @@ func TestBuildMessageIsDeterministic(t *testing.T) {
 	require.NoError(t, err)
 	done()
 
-	assert.Equal(t, res1, res2)
+	// The literals outlive the jobs.
+	b1, err := ioutil.ReadAll(res1.NewReader())
+	require.NoError(t, err)
+
+	b2, err := ioutil.ReadAll(res2.NewReader())
+	require.NoError(t, err)
+
+	assert.Equal(t, b1, b2)
 }
 
 func TestBuildParallel(t *testing.T) {
@@ -1290,6 +1322,161 @@ func TestBuildUndecryptableAttachment(t *testing.T) {
 	assert.True(t, errors.Is(err, ErrDecryptionFailed))
 }
 
+func TestBuildLargeAttachment(t *testing.T) {
+	m := gomock.NewController(t)
+	defer m.Finish()
+
+	b := NewBuilder(2, 2)
+	defer b.Done()
+
+	kr := testutil.MakeKeyRing(t)
+	msg := newTestMessage(t, kr, "messageID", "addressID", "text/plain", "body", time.Now())
+
+	// The attachment is decrypted over many reads.
+	data := strings.Repeat("attachment ", 1<<17) + "end"
+	att := addTestAttachment(t, kr, msg, "attachID", "file.bin", "application/octet-stream", "attachment", data)
+
+	job, done := b.NewJob(context.Background(), newTestFetcher(m, kr, msg, att), msg.ID, ForegroundPriority)
+	defer done()
+
+	res, err := job.GetResult()
+	require.NoError(t, err)
+
+	section(t, res, 2).
+		expectBody(is(data)).
+		expectTransferEncoding(is(`base64`))
+}
+
+func TestBuildCorruptedAttachment(t *testing.T) {
+	m := gomock.NewController(t)
+	defer m.Finish()
+
+	b := NewBuilder(2, 2)
+	defer b.Done()
+
+	kr := testutil.MakeKeyRing(t)
+	msg := newTestMessage(t, kr, "messageID", "addressID", "text/plain", "body", time.Now())
+	att := addTestAttachment(t, kr, msg, "attachID", "file.txt", "text/plain", "attachment", strings.Repeat("attachment ", 1<<10))
+
+	// The corruption is only detected once the attachment has been read.
+	att[len(att)/2] ^= 0xff
+
+	job, done := b.NewJobWithOptions(
+		context.Background(),
+		newTestFetcher(m, kr, msg, att),
+		msg.ID,
+		JobOptions{IgnoreDecryptionErrors: true},
+		ForegroundPriority,
+	)
+	defer done()
+
+	_, err := job.GetResult()
+	assert.True(t, errors.Is(err, ErrDecryptionFailed))
+}
+
+func TestBuildPartialMessage(t *testing.T) {
+	m := gomock.NewController(t)
+	defer m.Finish()
+
+	b := NewBuilder(2, 2)
+	defer b.Done()
+
+	kr := testutil.MakeKeyRing(t)
+	msg := newTestMessage(t, kr, "messageID", "addressID", "text/html", "<html><body>body</body></html>", time.Now())
+	inl := addTestAttachment(t, kr, msg, "inlineID", "inline.png", "image/png", "inline", "inline")
+	att1 := addTestAttachment(t, kr, msg, "attachID1", "file1.png", "image/png", "attachment", "attachment1")
+	att2 := addTestAttachment(t, kr, msg, "attachID2", "file2.png", "image/png", "attachment", "attachment2")
+
+	job, done := b.NewJob(context.Background(), newTestFetcher(m, kr, msg, inl, att1, att2), msg.ID, ForegroundPriority)
+	defer done()
+
+	full, err := job.GetResult()
+	require.NoError(t, err)
+
+	// Only the attachment in the requested section is downloaded.
+	f := mocks.NewMockFetcher(m)
+	f.EXPECT().GetMessage(gomock.Any(), msg.ID).Return(msg, nil)
+	f.EXPECT().KeyRingForAddressID(msg.AddressID).Return(kr, nil)
+	f.EXPECT().GetAttachment(gomock.Any(), "attachID2").Return(newTestReadCloser(att2), nil)
+
+	job, done = b.NewJobWithOptions(context.Background(), f, msg.ID, JobOptions{Sections: [][]int{{3}}}, ForegroundPriority)
+	defer done()
+
+	partial, err := job.GetResult()
+	require.NoError(t, err)
+
+	fullBS, err := full.Structure()
+	require.NoError(t, err)
+
+	partialBS, err := partial.Structure()
+	require.NoError(t, err)
+
+	// The headers of all parts are the same as in the full message.
+	for _, path := range [][]int{{}, {1}, {1, 1}, {1, 2}, {2}, {3}} {
+		want, err := fullBS.GetSectionHeaderBytes(path)
+		require.NoError(t, err)
+
+		have, err := partialBS.GetSectionHeaderBytes(path)
+		require.NoError(t, err)
+
+		assert.Equal(t, string(want), string(have), "path %v", path)
+	}
+
+	// So is the content of the text part and of the requested attachment.
+	for _, path := range [][]int{{1, 1}, {3}} {
+		wr, err := fullBS.GetSectionContentReader(full, path)
+		require.NoError(t, err)
+
+		want, err := ioutil.ReadAll(wr)
+		require.NoError(t, err)
+
+		hr, err := partialBS.GetSectionContentReader(partial, path)
+		require.NoError(t, err)
+
+		have, err := ioutil.ReadAll(hr)
+		require.NoError(t, err)
+
+		assert.Equal(t, string(want), string(have), "path %v", path)
+	}
+
+	section(t, partial, 2).
+		expectBody(is(``)).
+		expectContentType(is(`image/png`))
+}
+
+func TestBuildPartialMessageUndecryptableAttachment(t *testing.T) {
+	m := gomock.NewController(t)
+	defer m.Finish()
+
+	b := NewBuilder(2, 2)
+	defer b.Done()
+
+	kr := testutil.MakeKeyRing(t)
+	msg := newTestMessage(t, kr, "messageID", "addressID", "text/plain", "body", time.Now())
+	_ = addTestAttachment(t, testutil.MakeKeyRing(t), msg, "attachID", "file.png", "image/png", "attachment", "attachment")
+
+	// The attachment is not downloaded, but its part gets the custom header.
+	f := mocks.NewMockFetcher(m)
+	f.EXPECT().GetMessage(gomock.Any(), msg.ID).Return(msg, nil)
+	f.EXPECT().KeyRingForAddressID(msg.AddressID).Return(kr, nil)
+
+	job, done := b.NewJobWithOptions(
+		context.Background(),
+		f,
+		msg.ID,
+		JobOptions{IgnoreDecryptionErrors: true, Sections: [][]int{}},
+		ForegroundPriority,
+	)
+	defer done()
+
+	res, err := job.GetResult()
+	require.NoError(t, err)
+
+	section(t, res, 2).
+		expectContentType(is(`application/octet-stream`)).
+		expectContentTypeParam(`name`, is(`file.png.pgp`))
+}
+
 func TestBuildCustomMessagePlain(t *testing.T) {
 	m := gomock.NewController(t)
 	defer m.Finish()
@@ -1629,6 +1816,7 @@ func TestBuildFetchAttachmentFail(t *testing.T) {
 	// Pretend the attachment cannot be fetched.
 	f := mocks.NewMockFetcher(m)
 	f.EXPECT().GetMessage(gomock.Any(), msg.ID).Return(msg, nil)
+	f.EXPECT().KeyRingForAddressID(msg.AddressID).Return(kr, nil)
 	f.EXPECT().GetAttachment(gomock.Any(), msg.Attachments[0].ID).Return(nil, errors.New("oops"))
 
 	// The job should fail, returning an error and a nil result.
@@ -39,7 +39,7 @@ func TestEncryptRFC822(t *testing.T) {
 	enc, err := EncryptRFC822(kr, bytes.NewReader(literal))
 	require.NoError(t, err)
 
-	section(t, enc).
+	section(t, newTestLiteral(t, enc)).
 		expectContentType(is(`text/plain`)).
 		expectContentTypeParam(`charset`, is(`utf-8`)).
 		expectBody(decryptsTo(kr, `ééééééé`))
@@ -58,17 +58,17 @@ func TestEncryptRFC822Multipart(t *testing.T) {
 	enc, err := EncryptRFC822(kr, bytes.NewReader(literal))
 	require.NoError(t, err)
 
-	section(t, enc).
+	section(t, newTestLiteral(t, enc)).
 		expectContentType(is(`multipart/alternative`))
 
-	section(t, enc, 1).
+	section(t, newTestLiteral(t, enc), 1).
 		expectContentType(is(`multipart/alternative`))
 
-	section(t, enc, 1, 1).
+	section(t, newTestLiteral(t, enc), 1, 1).
 		expectContentType(is(`text/plain`)).
 		expectBody(decryptsTo(kr, "*multipart 1.1*\n\n"))
 
-	section(t, enc, 1, 2).
+	section(t, newTestLiteral(t, enc), 1, 2).
 		expectContentType(is(`text/html`)).
 		expectBody(decryptsTo(kr, `<html>
   <head>
@@ -80,14 +80,14 @@ func TestEncryptRFC822Multipart(t *testing.T) {
 </html>
 `))
 
-	section(t, enc, 2).
+	section(t, newTestLiteral(t, enc), 2).
 		expectContentType(is(`multipart/alternative`))
 
-	section(t, enc, 2, 1).
+	section(t, newTestLiteral(t, enc), 2, 1).
 		expectContentType(is(`text/plain`)).
 		expectBody(decryptsTo(kr, "*multipart 2.1*\n\n"))
 
-	section(t, enc, 2, 2).
+	section(t, newTestLiteral(t, enc), 2, 2).
 		expectContentType(is(`text/html`)).
 		expectBody(decryptsTo(kr, `<html>
   <head>
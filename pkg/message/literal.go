@@ -0,0 +1,353 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package message
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Literal is a message literal kept in a temporary file instead of memory.
+// The file is encrypted with a key which only exists in memory so that no
+// message reaches the disk in plain text. The body structure of the literal
+// is computed while it is written.
+//
+// A literal can also be streamed from a source, such as the message cache,
+// which already holds the message and knows its body structure. Nothing is
+// written to disk then; reading backwards opens the source again.
+//
+// A literal is shared by its readers: each of them closes it when done and
+// the file is removed once the last one does.
+type Literal struct {
+	source *literalSource
+
+	file  *os.File
+	name  string
+	block cipher.Block
+	iv    []byte
+	size  int64
+	refs  int32
+
+	structure    *BodyStructure
+	structureErr error
+}
+
+// NewLiteral spools the literal read from r.
+func NewLiteral(r io.Reader) (*Literal, error) {
+	w, err := newLiteralWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.abort(err)
+		return nil, err
+	}
+
+	return w.finish()
+}
+
+// NewStreamedLiteral returns a literal of the given size and body structure
+// which is read from r as it is needed. The source is opened again with open
+// when the literal is read backwards. The literal closes r.
+func NewStreamedLiteral(r io.ReadCloser, open func() (io.ReadCloser, error), size int64, structure *BodyStructure) *Literal {
+	return &Literal{
+		source:    &literalSource{r: r, open: open},
+		size:      size,
+		refs:      1,
+		structure: structure,
+	}
+}
+
+// Size returns the size of the literal.
+func (l *Literal) Size() int64 {
+	return l.size
+}
+
+// ReadAt reads the literal at the given offset.
+func (l *Literal) ReadAt(p []byte, off int64) (int, error) {
+	if off >= l.size {
+		return 0, io.EOF
+	}
+
+	if l.source != nil {
+		return l.source.readAt(p, off, l.size)
+	}
+
+	n, err := l.file.ReadAt(p, off)
+
+	l.streamAt(off).XORKeyStream(p[:n], p[:n])
+
+	return n, err
+}
+
+// NewReader returns a reader of the whole literal.
+func (l *Literal) NewReader() io.Reader {
+	return io.NewSectionReader(l, 0, l.size)
+}
+
+// Structure returns the body structure of the literal.
+func (l *Literal) Structure() (*BodyStructure, error) {
+	return l.structure, l.structureErr
+}
+
+// Close releases the literal.
+func (l *Literal) Close() error {
+	if atomic.AddInt32(&l.refs, -1) > 0 {
+		return nil
+	}
+
+	if l.source != nil {
+		return l.source.close()
+	}
+
+	err := l.file.Close()
+
+	if l.name != "" {
+		_ = os.Remove(l.name)
+	}
+
+	return err
+}
+
+// retain adds a reader which has to close the literal as well.
+func (l *Literal) retain() {
+	atomic.AddInt32(&l.refs, 1)
+}
+
+// streamAt returns the key stream starting at the given offset.
+func (l *Literal) streamAt(off int64) cipher.Stream {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, l.iv)
+
+	// Add the number of blocks to the big endian counter.
+	blocks := uint64(off / aes.BlockSize)
+	lo := binary.BigEndian.Uint64(iv[8:])
+	binary.BigEndian.PutUint64(iv[8:], lo+blocks)
+	if lo+blocks < lo {
+		binary.BigEndian.PutUint64(iv[:8], binary.BigEndian.Uint64(iv[:8])+1)
+	}
+
+	stream := cipher.NewCTR(l.block, iv)
+
+	if skip := off % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+
+	return stream
+}
+
+// literalSource reads a streamed literal. Reads at increasing offsets are
+// served from the same reader.
+type literalSource struct {
+	lock sync.Mutex
+
+	r      io.ReadCloser
+	off    int64
+	open   func() (io.ReadCloser, error)
+	closed bool
+}
+
+func (s *literalSource) readAt(p []byte, off, size int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return 0, os.ErrClosed
+	}
+
+	if s.r == nil || off < s.off {
+		if s.r != nil {
+			_ = s.r.Close()
+			s.r = nil
+		}
+
+		r, err := s.open()
+		if err != nil {
+			return 0, err
+		}
+
+		s.r, s.off = r, 0
+	}
+
+	skipped, err := io.CopyN(ioutil.Discard, s.r, off-s.off)
+	s.off += skipped
+
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+
+	n, err := io.ReadFull(s.r, p)
+	s.off += int64(n)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// The source must hold as many bytes as announced to the client.
+		if s.off < size {
+			return n, io.ErrUnexpectedEOF
+		}
+
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+func (s *literalSource) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+
+	if s.r == nil {
+		return nil
+	}
+
+	err := s.r.Close()
+	s.r = nil
+
+	return err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// literalWriter writes a new literal and parses its body structure as it
+// goes.
+type literalWriter struct {
+	lit    *Literal
+	buf    *bufio.Writer
+	stream cipher.Stream
+	enc    []byte
+
+	pw   *io.PipeWriter
+	done chan struct{}
+}
+
+func newLiteralWriter() (*literalWriter, error) {
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile("", "peroxide-literal-")
+	if err != nil {
+		return nil, err
+	}
+
+	lit := &Literal{
+		file:  file,
+		name:  file.Name(),
+		block: block,
+		iv:    iv,
+		refs:  1,
+	}
+
+	// Where possible, the file is gone as soon as it is closed, even if the
+	// process is not around to remove it.
+	if err := os.Remove(lit.name); err == nil {
+		lit.name = ""
+	}
+
+	pr, pw := io.Pipe()
+
+	w := &literalWriter{
+		lit:    lit,
+		buf:    bufio.NewWriter(file),
+		stream: cipher.NewCTR(block, iv),
+		pw:     pw,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		lit.structure, lit.structureErr = NewBodyStructure(pr)
+
+		// The parser may stop before the end of the literal.
+		_, _ = io.Copy(ioutil.Discard, pr)
+	}()
+
+	return w, nil
+}
+
+func (w *literalWriter) Write(p []byte) (int, error) {
+	if cap(w.enc) < len(p) {
+		w.enc = make([]byte, len(p))
+	}
+
+	enc := w.enc[:len(p)]
+
+	w.stream.XORKeyStream(enc, p)
+
+	n, err := w.buf.Write(enc)
+	w.lit.size += int64(n)
+
+	if err != nil {
+		return n, err
+	}
+
+	return w.pw.Write(p)
+}
+
+// finish returns the written literal.
+func (w *literalWriter) finish() (*Literal, error) {
+	err := w.buf.Flush()
+
+	_ = w.pw.Close()
+	<-w.done
+
+	if err != nil {
+		_ = w.lit.Close()
+		return nil, err
+	}
+
+	return w.lit, nil
+}
+
+// abort removes the literal after a failed write.
+func (w *literalWriter) abort(err error) {
+	_ = w.pw.CloseWithError(err)
+	<-w.done
+
+	_ = w.lit.Close()
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package message
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiteralReadAt(t *testing.T) {
+	want := []byte(strings.Repeat("Subject: literal\r\n", 1000))
+
+	lit, err := NewLiteral(bytes.NewReader(want))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lit.Close()) }()
+
+	require.Equal(t, int64(len(want)), lit.Size())
+
+	// Nothing is written in plain text.
+	raw := make([]byte, len(want))
+	_, err = lit.file.ReadAt(raw, 0)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "Subject")
+
+	// The literal can be read from any offset.
+	for _, off := range []int{0, 1, 15, 16, 17, 4095, len(want) - 3} {
+		have, err := ioutil.ReadAll(io.NewSectionReader(lit, int64(off), lit.Size()))
+		require.NoError(t, err)
+		require.Equal(t, want[off:], have)
+	}
+}
+
+func TestLiteralStructure(t *testing.T) {
+	lit, err := NewLiteral(strings.NewReader(sampleMail))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, lit.Close()) }()
+
+	want, err := NewBodyStructure(strings.NewReader(sampleMail))
+	require.NoError(t, err)
+
+	have, err := lit.Structure()
+	require.NoError(t, err)
+	require.Equal(t, want, have)
+}
+
+func TestLiteralClosedByLastReader(t *testing.T) {
+	lit, err := NewLiteral(strings.NewReader("literal"))
+	require.NoError(t, err)
+
+	lit.retain()
+
+	require.NoError(t, lit.Close())
+	have, err := ioutil.ReadAll(lit.NewReader())
+	require.NoError(t, err)
+	require.Equal(t, "literal", string(have))
+
+	require.NoError(t, lit.Close())
+	_, err = lit.ReadAt(make([]byte, 1), 0)
+	require.Error(t, err)
+}
+
+func TestStreamedLiteral(t *testing.T) {
+	want := []byte(strings.Repeat("Subject: literal\r\n", 1000))
+
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(bytes.NewReader(want)), nil
+	}
+
+	r, err := open()
+	require.NoError(t, err)
+
+	lit := NewStreamedLiteral(r, open, int64(len(want)), nil)
+	defer func() { require.NoError(t, lit.Close()) }()
+
+	// Reading forwards does not open the source again.
+	for _, off := range []int{15, 4095, len(want) - 3} {
+		have, err := ioutil.ReadAll(io.NewSectionReader(lit, int64(off), 2))
+		require.NoError(t, err)
+		require.Equal(t, want[off:off+2], have)
+	}
+	require.Equal(t, 1, opened)
+
+	// Reading backwards does.
+	have, err := ioutil.ReadAll(lit.NewReader())
+	require.NoError(t, err)
+	require.Equal(t, want, have)
+	require.Equal(t, 2, opened)
+}
+
+func TestStreamedLiteralTooShort(t *testing.T) {
+	open := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader("literal")), nil
+	}
+
+	r, err := open()
+	require.NoError(t, err)
+
+	lit := NewStreamedLiteral(r, open, 10, nil)
+	defer func() { require.NoError(t, lit.Close()) }()
+
+	_, err = ioutil.ReadAll(lit.NewReader())
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -48,9 +48,9 @@ type SectionInfo struct {
 func (si *SectionInfo) Read(p []byte) (n int, err error) {
 	n, err = si.reader.Read(p)
 	si.Size += n
-	si.Lines += bytes.Count(p, []byte("\n"))
+	si.Lines += bytes.Count(p[:n], []byte("\n"))
 
-	si.readHeader(p)
+	si.readHeader(p[:n])
 	return
 }
 
@@ -145,15 +145,20 @@ func (bs *BodyStructure) parseAllChildSections(r io.Reader, currentPath []int, s
 			return
 		}
 
+		// The parts are parsed while they are read. A part which is not
+		// ended by a boundary is dropped so it is parsed on its own first.
 		for err == nil {
 			start += br.skipped
-			part := &bytes.Buffer{}
-			err = br.writeNextPartTo(part)
-			if err != nil {
+			part := br.nextPart()
+			sub := &BodyStructure{}
+			subErr := sub.parseAllChildSections(part, nextPath, start)
+			if err = part.finish(); err != nil {
 				break
 			}
-			err = bs.parseAllChildSections(part, nextPath, start)
-			part.Reset()
+			for path, info := range *sub {
+				(*bs)[path] = info
+			}
+			err = subErr
 			nextPath[len(nextPath)-1]++
 		}
 		br.reader = nil
@@ -164,6 +169,9 @@ func (bs *BodyStructure) parseAllChildSections(r io.Reader, currentPath []int, s
 		if err != nil {
 			return
 		}
+
+		// Count the epilogue as well.
+		_, _ = bodyReader.WriteTo(ioutil.Discard)
 	} else {
 		// Count length.
 		_, _ = bodyReader.WriteTo(ioutil.Discard)
@@ -285,6 +293,31 @@ func (bs *BodyStructure) GetSectionContent(wholeMail io.ReadSeeker, sectionPath
 	return goToOffsetAndReadNBytes(wholeMail, info.Start+info.Size-info.BSize, info.BSize)
 }
 
+// SizedReaderAt is the whole mail from which sections are read.
+type SizedReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// GetSectionReader returns a reader of the section including MIME header.
+func (bs *BodyStructure) GetSectionReader(wholeMail SizedReaderAt, sectionPath []int) (*io.SectionReader, error) {
+	info, err := bs.getInfoCheckSection(sectionPath)
+	if err != nil {
+		return nil, err
+	}
+	return sectionReader(wholeMail, info.Start, info.Size)
+}
+
+// GetSectionContentReader returns a reader of the section content (excluding
+// MIME header).
+func (bs *BodyStructure) GetSectionContentReader(wholeMail SizedReaderAt, sectionPath []int) (*io.SectionReader, error) {
+	info, err := bs.getInfoCheckSection(sectionPath)
+	if err != nil {
+		return nil, err
+	}
+	return sectionReader(wholeMail, info.Start+info.Size-info.BSize, info.BSize)
+}
+
 // GetMailHeader returns the main header of mail.
 func (bs *BodyStructure) GetMailHeader() (header textproto.MIMEHeader, err error) {
 	return bs.GetSectionHeader([]int{})
@@ -313,6 +346,21 @@ func goToOffsetAndReadNBytes(wholeMail io.ReadSeeker, offset, length int) ([]byt
 	return out, err
 }
 
+func sectionReader(wholeMail SizedReaderAt, offset, length int) (*io.SectionReader, error) {
+	if length < 0 {
+		return nil, errors.New("requested negative length")
+	}
+	// Like reading past the end, a section which does not fit is truncated.
+	start, end := int64(offset), int64(offset+length)
+	if start > wholeMail.Size() {
+		start = wholeMail.Size()
+	}
+	if end > wholeMail.Size() {
+		end = wholeMail.Size()
+	}
+	return io.NewSectionReader(wholeMail, start, end-start), nil
+}
+
 // GetSectionHeader returns the mime header of specified section.
 func (bs *BodyStructure) GetSectionHeader(sectionPath []int) (textproto.MIMEHeader, error) {
 	info, err := bs.getInfoCheckSection(sectionPath)
@@ -145,6 +145,20 @@ func TestGetSection(t *testing.T) {
 
 		require.True(t, string(section) == try.expectedBody, "not same as expected:\n___\n%s\n‾‾‾", try.expectedBody)
 	}
+	// Readers of the whole mail.
+	for _, try := range testPaths {
+		sr, err := bs.GetSectionReader(strings.NewReader(sampleMail), try.path)
+		require.NoError(t, err)
+		section, err := ioutil.ReadAll(sr)
+		require.NoError(t, err)
+		require.Equal(t, try.expectedSection, string(section))
+
+		cr, err := bs.GetSectionContentReader(strings.NewReader(sampleMail), try.path)
+		require.NoError(t, err)
+		content, err := ioutil.ReadAll(cr)
+		require.NoError(t, err)
+		require.Equal(t, try.expectedBody, string(content))
+	}
 }
 
 func TestGetSecionNoMIMEParts(t *testing.T) {
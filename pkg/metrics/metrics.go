@@ -0,0 +1,264 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package metrics collects the Prometheus metrics of the server and exposes
+// them over HTTP.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Path is where the metrics are served.
+const Path = "/metrics"
+
+const namespace = "peroxide"
+
+var (
+	registry = prometheus.NewRegistry() //nolint:gochecknoglobals
+
+	connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "connections",
+		Help:      "Number of authenticated connections per protocol and account.",
+	}, []string{"protocol", "account"})
+
+	imapCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "imap_command_duration_seconds",
+		Help:      "Duration of the IMAP mailbox commands.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"command"})
+
+	apiRequests = prometheus.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Number of requests sent to the Proton API.",
+	})
+
+	apiErrors = prometheus.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Number of requests to the Proton API that failed.",
+	})
+
+	apiTooManyRequests = prometheus.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "api_too_many_requests_total",
+		Help:      "Number of responses of the Proton API with the status 429.",
+	})
+
+	syncRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "sync_running",
+		Help:      "Whether a full sync of the account is running.",
+	}, []string{"account"})
+
+	syncMessages = prometheus.NewCounterVec(prometheus.CounterOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "sync_messages_total",
+		Help:      "Number of messages stored by the full syncs of the account.",
+	}, []string{"account"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "message_cache_requests_total",
+		Help:      "Number of message cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	cacheDiskSize = prometheus.NewGauge(prometheus.GaugeOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "message_cache_disk_size_bytes",
+		Help:      "Size of the file system holding the on-disk message cache.",
+	})
+
+	cacheDiskFree = prometheus.NewGauge(prometheus.GaugeOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "message_cache_disk_free_bytes",
+		Help:      "Free space of the file system holding the on-disk message cache.",
+	})
+
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{ //nolint:gochecknoglobals
+		Namespace: namespace,
+		Name:      "message_cache_evictions_total",
+		Help:      "Number of messages evicted from the on-disk message cache to make room.",
+	})
+
+	eventLoops = newLagCollector() //nolint:gochecknoglobals
+)
+
+func init() { //nolint:gochecknoinits
+	registry.MustRegister(
+		connections,
+		imapCommandDuration,
+		apiRequests,
+		apiErrors,
+		apiTooManyRequests,
+		syncRunning,
+		syncMessages,
+		cacheRequests,
+		cacheDiskSize,
+		cacheDiskFree,
+		cacheEvictions,
+		eventLoops,
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Connected records a new authenticated connection of the account.
+func Connected(protocol, account string) {
+	connections.WithLabelValues(protocol, account).Inc()
+}
+
+// Disconnected records that an authenticated connection of the account ended.
+func Disconnected(protocol, account string) {
+	connections.WithLabelValues(protocol, account).Dec()
+}
+
+// ObserveIMAPCommand records how long an IMAP command took.
+func ObserveIMAPCommand(command string, duration time.Duration) {
+	imapCommandDuration.WithLabelValues(command).Observe(duration.Seconds())
+}
+
+// APIRequest records a request sent to the API and whether it failed.
+func APIRequest(failed bool) {
+	apiRequests.Inc()
+	if failed {
+		apiErrors.Inc()
+	}
+}
+
+// APITooManyRequests records a response telling us to slow down.
+func APITooManyRequests() {
+	apiTooManyRequests.Inc()
+}
+
+// EventPolled records that the event loop of the account is up to date.
+func EventPolled(account string) {
+	eventLoops.polled(account)
+}
+
+// SyncStarted records that a full sync of the account started.
+func SyncStarted(account string) {
+	syncRunning.WithLabelValues(account).Set(1)
+}
+
+// SyncFinished records that a full sync of the account ended.
+func SyncFinished(account string) {
+	syncRunning.WithLabelValues(account).Set(0)
+}
+
+// MessagesSynced records that a full sync stored the given number of messages.
+func MessagesSynced(account string, count int) {
+	syncMessages.WithLabelValues(account).Add(float64(count))
+}
+
+// CacheHit records a message found in the message cache.
+func CacheHit() {
+	cacheRequests.WithLabelValues("hit").Inc()
+}
+
+// CacheMiss records a message that had to be built because it was not cached.
+func CacheMiss() {
+	cacheRequests.WithLabelValues("miss").Inc()
+}
+
+// CacheDisk records the size and the free space of the file system holding
+// the on-disk message cache.
+func CacheDisk(size, free uint64) {
+	cacheDiskSize.Set(float64(size))
+	cacheDiskFree.Set(float64(free))
+}
+
+// CacheEvicted records messages evicted from the on-disk message cache.
+func CacheEvicted(count int) {
+	cacheEvictions.Add(float64(count))
+}
+
+// RegisterQueue exposes the number of jobs waiting in the named queue.
+func RegisterQueue(name string, depth func() int) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "queue_depth",
+		Help:        "Number of jobs waiting in the queue.",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 { return float64(depth()) }))
+}
+
+// ForgetAccount drops the event loop and sync series of the account when its
+// store is closed. The connection gauges drop to zero on their own.
+func ForgetAccount(account string) {
+	eventLoops.forget(account)
+	syncRunning.DeleteLabelValues(account)
+	syncMessages.DeleteLabelValues(account)
+}
+
+// lagCollector reports for every account how long ago its event loop last
+// processed an event successfully. The lag grows while the loop is stuck, so
+// it is computed on every scrape rather than when the loop polls.
+type lagCollector struct {
+	lock sync.Mutex
+	last map[string]time.Time
+	desc *prometheus.Desc
+}
+
+func newLagCollector() *lagCollector {
+	return &lagCollector{
+		last: make(map[string]time.Time),
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "event_loop_lag_seconds"),
+			"Time since the event loop of the account last polled the API successfully.",
+			[]string{"account"}, nil,
+		),
+	}
+}
+
+func (c *lagCollector) polled(account string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.last[account] = time.Now()
+}
+
+func (c *lagCollector) forget(account string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.last, account)
+}
+
+func (c *lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lagCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for account, last := range c.last {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(last).Seconds(), account)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T) string {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", Path, nil))
+
+	body, err := ioutil.ReadAll(rec.Body)
+	r.NoError(t, err)
+	return string(body)
+}
+
+func TestMetricsConnections(t *testing.T) {
+	Connected("imap", "conn-user")
+	Connected("imap", "conn-user")
+	Disconnected("imap", "conn-user")
+
+	r.Contains(t, scrape(t), `peroxide_connections{account="conn-user",protocol="imap"} 1`)
+}
+
+func TestMetricsEventLoopLag(t *testing.T) {
+	EventPolled("lag-user")
+	time.Sleep(10 * time.Millisecond)
+
+	body := scrape(t)
+	r.Contains(t, body, `peroxide_event_loop_lag_seconds{account="lag-user"}`)
+	r.NotContains(t, body, `peroxide_event_loop_lag_seconds{account="lag-user"} 0`+"\n")
+
+	ForgetAccount("lag-user")
+	r.NotContains(t, scrape(t), `account="lag-user"`)
+}
+
+func TestMetricsQueue(t *testing.T) {
+	depth := 3
+	RegisterQueue("test", func() int { return depth })
+
+	r.Contains(t, scrape(t), `peroxide_queue_depth{queue="test"} 3`)
+
+	depth = 1
+	r.Contains(t, scrape(t), `peroxide_queue_depth{queue="test"} 1`)
+}
+
+func TestMetricsCache(t *testing.T) {
+	CacheHit()
+	CacheMiss()
+	CacheMiss()
+	CacheEvicted(2)
+
+	body := scrape(t)
+	r.Contains(t, body, `peroxide_message_cache_requests_total{result="hit"}`)
+	r.Contains(t, body, `peroxide_message_cache_requests_total{result="miss"}`)
+	r.Contains(t, body, `peroxide_message_cache_evictions_total`)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/serverutil"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("pkg", "metrics") //nolint:gochecknoglobals
+
+// Server serves the metrics over plain HTTP.
+type Server struct {
+	addressLock sync.RWMutex
+	address     string
+	port        int
+
+	server     *http.Server
+	controller serverutil.Controller
+}
+
+// NewServer returns a metrics server listening on the given address and port.
+func NewServer(address string, port int, eventListener listener.Listener) *Server {
+	server := &Server{
+		address: address,
+		port:    port,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(Path, Handler())
+
+	server.server = &http.Server{
+		Addr:     server.Address(),
+		Handler:  mux,
+		ErrorLog: stdlog.New(log.WriterLevel(logrus.ErrorLevel), "", 0),
+	}
+	server.controller = serverutil.NewController(server, eventListener)
+	return server
+}
+
+// ListenAndServe will run server and all monitors.
+func (s *Server) ListenAndServe() { s.controller.ListenAndServe() }
+
+// Close turns off server and monitors.
+func (s *Server) Close() { s.controller.Close() }
+
+// Rebind makes the server listen on a new address without closing the
+// connections it has already accepted.
+func (s *Server) Rebind(address string, port int) {
+	s.addressLock.Lock()
+	s.address = address
+	s.port = port
+	s.addressLock.Unlock()
+
+	s.controller.Rebind()
+}
+
+// Address returns the address the server listens on.
+func (s *Server) Address() string {
+	s.addressLock.RLock()
+	defer s.addressLock.RUnlock()
+
+	return fmt.Sprintf("%s:%d", s.address, s.port)
+}
+
+// Implements servertutil.Server interface.
+
+func (*Server) Protocol() serverutil.Protocol { return serverutil.HTTP }
+func (s *Server) UseSSL() bool                { return false }
+func (s *Server) TLSConfig() *tls.Config      { return nil }
+
+func (s *Server) DebugServer() bool { return false }
+func (s *Server) DebugClient() bool { return false }
+
+func (s *Server) SetLoggers(localDebug, remoteDebug io.Writer) {}
+
+func (s *Server) DisconnectUser(address string) {}
+
+func (s *Server) Serve(l net.Listener) error { return s.server.Serve(l) }
+func (s *Server) StopServe() error           { return s.server.Close() }
@@ -0,0 +1,113 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// XOAuth2 is the name of the XOAUTH2 SASL mechanism used by Google and
+// Microsoft and supported by most mail clients.
+const XOAuth2 = "XOAUTH2"
+
+// XOAuth2Authenticator validates the token presented for username.
+type XOAuth2Authenticator func(username, token string) error
+
+// xoauth2Error is the JSON challenge sent to the client on failure.
+type xoauth2Error struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+}
+
+type xoauth2Server struct {
+	done         bool
+	failErr      error
+	authenticate XOAuth2Authenticator
+}
+
+// NewXOAuth2Server creates a SASL server for the XOAUTH2 mechanism.
+func NewXOAuth2Server(auth XOAuth2Authenticator) sasl.Server {
+	return &xoauth2Server{authenticate: auth}
+}
+
+func (a *xoauth2Server) fail(err error) ([]byte, bool, error) {
+	blob, jsonErr := json.Marshal(xoauth2Error{Status: "401", Schemes: "bearer"})
+	if jsonErr != nil {
+		panic(jsonErr)
+	}
+	a.failErr = err
+	return blob, false, nil
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	// As with OAUTHBEARER, the failure is reported as a JSON challenge and the
+	// exchange ends with an error after the client's (empty) response.
+	if a.failErr != nil {
+		return nil, true, a.failErr
+	}
+
+	if a.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+
+	// user=...\x01auth=Bearer ...\x01\x01
+	var username, token string
+	for _, p := range bytes.Split(response, []byte{0x01}) {
+		if len(p) == 0 {
+			continue
+		}
+
+		kv := bytes.SplitN(p, []byte{'='}, 2)
+		if len(kv) != 2 {
+			return a.fail(errors.New("invalid response, missing '='"))
+		}
+
+		switch string(kv[0]) {
+		case "user":
+			username = string(kv[1])
+		case "auth":
+			const prefix = "bearer "
+			value := string(kv[1])
+			if !strings.HasPrefix(strings.ToLower(value), prefix) {
+				return a.fail(errors.New("unsupported token type"))
+			}
+			token = value[len(prefix):]
+		}
+	}
+
+	if token == "" {
+		return a.fail(errors.New("invalid response, missing 'auth'"))
+	}
+
+	if err := a.authenticate(username, token); err != nil {
+		return a.fail(err)
+	}
+
+	return nil, true, nil
+}
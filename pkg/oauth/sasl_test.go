@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth
+
+import (
+	"errors"
+	"testing"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func TestXOAuth2Server(t *testing.T) {
+	var gotUser, gotToken string
+	s := NewXOAuth2Server(func(username, token string) error {
+		gotUser, gotToken = username, token
+		if token != "tok" {
+			return errors.New("bad token")
+		}
+		return nil
+	})
+
+	challenge, done, err := s.Next([]byte("user=foo@bar.com\x01auth=Bearer tok\x01\x01"))
+	r.NoError(t, err)
+	r.True(t, done)
+	r.Nil(t, challenge)
+	r.Equal(t, "foo@bar.com", gotUser)
+	r.Equal(t, "tok", gotToken)
+}
+
+func TestXOAuth2ServerNoInitialResponse(t *testing.T) {
+	s := NewXOAuth2Server(func(username, token string) error { return nil })
+
+	challenge, done, err := s.Next(nil)
+	r.NoError(t, err)
+	r.False(t, done)
+	r.Empty(t, challenge)
+
+	_, done, err = s.Next([]byte("user=foo@bar.com\x01auth=bearer tok\x01\x01"))
+	r.NoError(t, err)
+	r.True(t, done)
+}
+
+func TestXOAuth2ServerFailure(t *testing.T) {
+	test := func(response string) {
+		s := NewXOAuth2Server(func(username, token string) error { return errors.New("bad token") })
+
+		challenge, done, err := s.Next([]byte(response))
+		r.NoError(t, err)
+		r.False(t, done)
+		r.JSONEq(t, `{"status":"401","schemes":"bearer"}`, string(challenge))
+
+		_, done, err = s.Next([]byte{})
+		r.Error(t, err)
+		r.True(t, done)
+	}
+
+	test("user=foo@bar.com\x01auth=Bearer tok\x01\x01")
+	test("user=foo@bar.com\x01auth=Basic tok\x01\x01")
+	test("user=foo@bar.com\x01\x01")
+	test("garbage")
+}
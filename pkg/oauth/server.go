@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/serverutil"
+	"github.com/sirupsen/logrus"
+)
+
+// TokenPath is where the token endpoint is served.
+const TokenPath = "/oauth2/token"
+
+// Server is the token endpoint of the local OAuth2 authorization server. It
+// supports the resource owner password credentials grant, where the username
+// is the login selecting a key slot and the password is the slot key, and the
+// refresh token grant.
+type Server struct {
+	addressLock sync.RWMutex
+	address     string
+	port        int
+	tls         *tls.Config
+	tokens      *TokenStore
+
+	server     *http.Server
+	controller serverutil.Controller
+}
+
+// NewServer returns an OAuth2 token server configured with the given options.
+func NewServer(
+	address string,
+	port int,
+	tls *tls.Config,
+	tokens *TokenStore,
+	eventListener listener.Listener,
+) *Server {
+	server := &Server{
+		address: address,
+		port:    port,
+		tls:     tls,
+		tokens:  tokens,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(TokenPath, server.handleToken)
+
+	server.server = &http.Server{
+		Addr:     server.Address(),
+		Handler:  mux,
+		ErrorLog: stdlog.New(log.WriterLevel(logrus.ErrorLevel), "", 0),
+	}
+	server.controller = serverutil.NewController(server, eventListener)
+	return server
+}
+
+// tokenError is the error response as defined in RFC 6749, section 5.2.
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Failed to write the response")
+	}
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, tokenError{Error: "invalid_request"})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, tokenError{Error: "invalid_request", Description: err.Error()})
+		return
+	}
+
+	var token *Token
+	var err error
+
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "password":
+		username := r.PostForm.Get("username")
+		password := r.PostForm.Get("password")
+		if username == "" || password == "" {
+			writeJSON(w, http.StatusBadRequest, tokenError{Error: "invalid_request", Description: "missing credentials"})
+			return
+		}
+		token, err = s.tokens.Issue(username, password)
+
+	case "refresh_token":
+		refreshToken := r.PostForm.Get("refresh_token")
+		if refreshToken == "" {
+			writeJSON(w, http.StatusBadRequest, tokenError{Error: "invalid_request", Description: "missing refresh token"})
+			return
+		}
+		token, err = s.tokens.Refresh(refreshToken)
+
+	default:
+		writeJSON(w, http.StatusBadRequest, tokenError{Error: "unsupported_grant_type"})
+		return
+	}
+
+	if err != nil {
+		log.WithError(err).Warn("Token request rejected")
+		writeJSON(w, http.StatusBadRequest, tokenError{Error: "invalid_grant"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, token)
+}
+
+// ListenAndServe will run server and all monitors.
+func (s *Server) ListenAndServe() { s.controller.ListenAndServe() }
+
+// Close turns off server and monitors.
+func (s *Server) Close() { s.controller.Close() }
+
+// Rebind makes the server listen on a new address without closing the
+// connections it has already accepted.
+func (s *Server) Rebind(address string, port int) {
+	s.addressLock.Lock()
+	s.address = address
+	s.port = port
+	s.addressLock.Unlock()
+
+	s.controller.Rebind()
+}
+
+// Address returns the address the server listens on.
+func (s *Server) Address() string {
+	s.addressLock.RLock()
+	defer s.addressLock.RUnlock()
+
+	return fmt.Sprintf("%s:%d", s.address, s.port)
+}
+
+// Implements servertutil.Server interface.
+
+func (*Server) Protocol() serverutil.Protocol { return serverutil.HTTP }
+func (s *Server) UseSSL() bool                { return true }
+func (s *Server) TLSConfig() *tls.Config      { return s.tls }
+
+func (s *Server) DebugServer() bool { return false }
+func (s *Server) DebugClient() bool { return false }
+
+func (s *Server) SetLoggers(localDebug, remoteDebug io.Writer) {}
+
+func (s *Server) DisconnectUser(address string) {}
+
+func (s *Server) Serve(l net.Listener) error { return s.server.Serve(l) }
+func (s *Server) StopServe() error           { return s.server.Close() }
@@ -0,0 +1,73 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func postToken(t *testing.T, s *Server, form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, TokenPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleToken(rec, req)
+
+	body := map[string]interface{}{}
+	r.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return rec, body
+}
+
+func TestTokenEndpoint(t *testing.T) {
+	s := &Server{tokens: NewTokenStore(testAuthenticator, time.Minute)}
+
+	rec, body := postToken(t, s, url.Values{
+		"grant_type": {"password"},
+		"username":   {"foo..test@bar.com"},
+		"password":   {"secret"},
+	})
+	r.Equal(t, http.StatusOK, rec.Code)
+	r.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	r.Equal(t, "Bearer", body["token_type"])
+
+	rec, body = postToken(t, s, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {body["refresh_token"].(string)},
+	})
+	r.Equal(t, http.StatusOK, rec.Code)
+	r.NotEmpty(t, body["access_token"])
+
+	rec, body = postToken(t, s, url.Values{
+		"grant_type": {"password"},
+		"username":   {"foo..test@bar.com"},
+		"password":   {"wrong"},
+	})
+	r.Equal(t, http.StatusBadRequest, rec.Code)
+	r.Equal(t, "invalid_grant", body["error"])
+
+	rec, body = postToken(t, s, url.Values{"grant_type": {"client_credentials"}})
+	r.Equal(t, http.StatusBadRequest, rec.Code)
+	r.Equal(t, "unsupported_grant_type", body["error"])
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package oauth implements a minimal, local OAuth2 authorization server
+// issuing bearer tokens bound to the key slots of peroxide accounts, and the
+// SASL mechanisms (OAUTHBEARER and XOAUTH2) accepting those tokens.
+package oauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultTokenLifetime is the validity of an access token unless configured otherwise.
+const DefaultTokenLifetime = time.Hour
+
+// refreshTokenLifetime is the validity of a refresh token. Tokens live in
+// memory only so they do not survive a restart anyway; a client that lost its
+// refresh token needs to present the slot key again.
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+var (
+	log = logrus.WithField("pkg", "oauth") //nolint:gochecknoglobals
+
+	ErrInvalidToken = errors.New("invalid or expired token")
+	ErrUserMismatch = errors.New("token was not issued for this user")
+)
+
+// Authenticator checks that the key unlocks the key slot selected by login.
+type Authenticator func(login, key string) error
+
+// Token is the token endpoint response as defined in RFC 6749, section 5.1.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// grant is what a token stands for: a login selecting a key slot and the key
+// unlocking it.
+type grant struct {
+	login   string
+	key     string
+	expires time.Time
+}
+
+// TokenStore issues and validates the tokens. It does not persist anything.
+type TokenStore struct {
+	lock     sync.Mutex
+	access   map[string]*grant
+	refresh  map[string]*grant
+	lifetime time.Duration
+	auth     Authenticator
+}
+
+// NewTokenStore creates a token store verifying the slot keys with auth and
+// issuing access tokens valid for lifetime.
+func NewTokenStore(auth Authenticator, lifetime time.Duration) *TokenStore {
+	if lifetime <= 0 {
+		lifetime = DefaultTokenLifetime
+	}
+
+	return &TokenStore{
+		access:   make(map[string]*grant),
+		refresh:  make(map[string]*grant),
+		lifetime: lifetime,
+		auth:     auth,
+	}
+}
+
+// Issue verifies the key of the slot selected by login and returns a new
+// access token and refresh token pair.
+func (s *TokenStore) Issue(login, key string) (*Token, error) {
+	if err := s.auth(login, key); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.newToken(login, key)
+}
+
+// Refresh exchanges a refresh token for a new token pair. The slot key is
+// verified again so that tokens of removed slots cannot be refreshed.
+func (s *TokenStore) Refresh(refreshToken string) (*Token, error) {
+	s.lock.Lock()
+	g, ok := s.refresh[refreshToken]
+	if ok {
+		delete(s.refresh, refreshToken)
+	}
+	s.lock.Unlock()
+
+	if !ok || time.Now().After(g.expires) {
+		return nil, ErrInvalidToken
+	}
+
+	return s.Issue(g.login, g.key)
+}
+
+// Lookup returns the login and slot key an unexpired access token stands for.
+func (s *TokenStore) Lookup(accessToken string) (login, key string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	g, ok := s.access[accessToken]
+	if !ok {
+		return "", "", ErrInvalidToken
+	}
+
+	if time.Now().After(g.expires) {
+		delete(s.access, accessToken)
+		return "", "", ErrInvalidToken
+	}
+
+	return g.login, g.key, nil
+}
+
+// Authenticate resolves the access token and calls login with the login and
+// slot key it stands for. If the client also named the user, it must be the
+// user the token was issued for.
+func (s *TokenStore) Authenticate(username, accessToken string, login Authenticator) error {
+	tokenLogin, key, err := s.Lookup(accessToken)
+	if err != nil {
+		return err
+	}
+
+	if username != "" {
+		tokenUser, _ := users.DecodeLogin(tokenLogin)
+		user, _ := users.DecodeLogin(username)
+		if !strings.EqualFold(tokenUser, user) {
+			return ErrUserMismatch
+		}
+	}
+
+	return login(tokenLogin, key)
+}
+
+// newToken must be called with the lock held.
+func (s *TokenStore) newToken(login, key string) (*Token, error) {
+	s.removeExpired()
+
+	accessToken, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s.access[accessToken] = &grant{login: login, key: key, expires: now.Add(s.lifetime)}
+	s.refresh[refreshToken] = &grant{login: login, key: key, expires: now.Add(refreshTokenLifetime)}
+
+	log.WithField("login", login).Debug("Issued new token")
+
+	return &Token{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.lifetime.Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (s *TokenStore) removeExpired() {
+	now := time.Now()
+
+	for token, g := range s.access {
+		if now.After(g.expires) {
+			delete(s.access, token)
+		}
+	}
+
+	for token, g := range s.refresh {
+		if now.After(g.expires) {
+			delete(s.refresh, token)
+		}
+	}
+}
+
+func generateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
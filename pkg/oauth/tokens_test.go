@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package oauth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	r "github.com/stretchr/testify/require"
+)
+
+func testAuthenticator(login, key string) error {
+	if key != "secret" {
+		return errors.New("bad key")
+	}
+	return nil
+}
+
+func TestTokenIssueAndLookup(t *testing.T) {
+	s := NewTokenStore(testAuthenticator, time.Minute)
+
+	_, err := s.Issue("foo..phone@bar.com", "wrong")
+	r.Error(t, err)
+
+	token, err := s.Issue("foo..phone@bar.com", "secret")
+	r.NoError(t, err)
+	r.Equal(t, "Bearer", token.TokenType)
+	r.Equal(t, 60, token.ExpiresIn)
+	r.NotEmpty(t, token.RefreshToken)
+
+	login, key, err := s.Lookup(token.AccessToken)
+	r.NoError(t, err)
+	r.Equal(t, "foo..phone@bar.com", login)
+	r.Equal(t, "secret", key)
+
+	_, _, err = s.Lookup(token.RefreshToken)
+	r.Equal(t, ErrInvalidToken, err)
+}
+
+func TestTokenExpiry(t *testing.T) {
+	s := NewTokenStore(testAuthenticator, time.Millisecond)
+
+	token, err := s.Issue("foo@bar.com", "secret")
+	r.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, err = s.Lookup(token.AccessToken)
+	r.Equal(t, ErrInvalidToken, err)
+}
+
+func TestTokenRefresh(t *testing.T) {
+	s := NewTokenStore(testAuthenticator, time.Minute)
+
+	token, err := s.Issue("foo..phone@bar.com", "secret")
+	r.NoError(t, err)
+
+	refreshed, err := s.Refresh(token.RefreshToken)
+	r.NoError(t, err)
+	r.NotEqual(t, token.AccessToken, refreshed.AccessToken)
+
+	login, _, err := s.Lookup(refreshed.AccessToken)
+	r.NoError(t, err)
+	r.Equal(t, "foo..phone@bar.com", login)
+
+	// Refresh tokens are single use.
+	_, err = s.Refresh(token.RefreshToken)
+	r.Equal(t, ErrInvalidToken, err)
+}
+
+func TestTokenAuthenticate(t *testing.T) {
+	s := NewTokenStore(testAuthenticator, time.Minute)
+
+	token, err := s.Issue("foo..phone@bar.com", "secret")
+	r.NoError(t, err)
+
+	var gotLogin, gotKey string
+	login := func(login, key string) error {
+		gotLogin, gotKey = login, key
+		return nil
+	}
+
+	r.NoError(t, s.Authenticate("", token.AccessToken, login))
+	r.NoError(t, s.Authenticate("Foo@bar.com", token.AccessToken, login))
+	r.NoError(t, s.Authenticate("foo..phone@bar.com", token.AccessToken, login))
+	r.Equal(t, "foo..phone@bar.com", gotLogin)
+	r.Equal(t, "secret", gotKey)
+
+	r.Equal(t, ErrUserMismatch, s.Authenticate("baz@bar.com", token.AccessToken, login))
+	r.Equal(t, ErrInvalidToken, s.Authenticate("foo@bar.com", "nope", login))
+}
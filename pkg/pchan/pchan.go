@@ -18,22 +18,25 @@
 package pchan
 
 import (
-	"sort"
+	"container/heap"
 	"sync"
 )
 
 type PChan struct {
 	lock        sync.Mutex
-	items       []*Item
+	items       itemHeap
+	seq         uint64
 	ready, done chan struct{}
 	once        sync.Once
 }
 
 type Item struct {
-	ch   *PChan
-	val  interface{}
-	prio int
-	done sync.WaitGroup
+	ch    *PChan
+	val   interface{}
+	prio  int
+	seq   uint64
+	index int
+	done  sync.WaitGroup
 }
 
 func (item *Item) Wait() {
@@ -53,9 +56,10 @@ func (item *Item) SetPriority(priority int) {
 
 	item.prio = priority
 
-	sort.Slice(item.ch.items, func(i, j int) bool {
-		return item.ch.items[i].prio < item.ch.items[j].prio
-	})
+	// The item may have been popped already.
+	if item.index >= 0 {
+		heap.Fix(&item.ch.items, item.index)
+	}
 }
 
 func New() *PChan {
@@ -65,6 +69,8 @@ func New() *PChan {
 	}
 }
 
+// Push adds the value with the given priority. The values of higher priority
+// are popped first; those of equal priority in the order they were pushed.
 func (ch *PChan) Push(val interface{}, prio int) *Item {
 	defer ch.notify()
 
@@ -82,6 +88,14 @@ func (ch *PChan) Pop() (interface{}, int, bool) {
 	}
 }
 
+// Len returns the number of items waiting to be popped.
+func (ch *PChan) Len() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	return len(ch.items)
+}
+
 func (ch *PChan) Close() {
 	ch.once.Do(func() { close(ch.done) })
 }
@@ -90,15 +104,18 @@ func (ch *PChan) push(val interface{}, prio int) *Item {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
 
+	ch.seq++
+
 	item := &Item{
 		ch:   ch,
 		val:  val,
 		prio: prio,
+		seq:  ch.seq,
 	}
 
 	item.done.Add(1)
 
-	ch.items = append(ch.items, item)
+	heap.Push(&ch.items, item)
 
 	return item
 }
@@ -107,13 +124,7 @@ func (ch *PChan) pop() (interface{}, int) {
 	ch.lock.Lock()
 	defer ch.lock.Unlock()
 
-	sort.Slice(ch.items, func(i, j int) bool {
-		return ch.items[i].prio < ch.items[j].prio
-	})
-
-	var item *Item
-
-	item, ch.items = ch.items[len(ch.items)-1], ch.items[:len(ch.items)-1]
+	item := heap.Pop(&ch.items).(*Item) //nolint:forcetypeassert
 
 	defer item.done.Done()
 
@@ -123,3 +134,40 @@ func (ch *PChan) pop() (interface{}, int) {
 func (ch *PChan) notify() {
 	go func() { ch.ready <- struct{}{} }()
 }
+
+// itemHeap keeps the item to be popped next at the top.
+type itemHeap []*Item
+
+func (h itemHeap) Len() int {
+	return len(h)
+}
+
+func (h itemHeap) Less(i, j int) bool {
+	if h[i].prio != h[j].prio {
+		return h[i].prio > h[j].prio
+	}
+
+	return h[i].seq < h[j].seq
+}
+
+func (h itemHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *itemHeap) Push(x interface{}) {
+	item := x.(*Item) //nolint:forcetypeassert
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	item.index = -1
+	*h = old[:len(old)-1]
+
+	return item
+}
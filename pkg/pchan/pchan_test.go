@@ -102,6 +102,51 @@ func TestPChanClose(t *testing.T) {
 	assert.Nil(t, valClose)
 }
 
+func TestPChanLen(t *testing.T) {
+	ch := New()
+
+	assert.Equal(t, 0, ch.Len())
+
+	ch.Push(1, 1)
+	ch.Push(2, 2)
+	assert.Equal(t, 2, ch.Len())
+
+	assert.Equal(t, 2, getValue(t, ch))
+	assert.Equal(t, 1, ch.Len())
+}
+
+func TestPChanEqualPriorityInPushOrder(t *testing.T) {
+	ch := New()
+
+	ch.Push(1, 1)
+	ch.Push(2, 1)
+	ch.Push(3, 2)
+	ch.Push(4, 1)
+
+	assert.Equal(t, 3, getValue(t, ch))
+	assert.Equal(t, 1, getValue(t, ch))
+	assert.Equal(t, 2, getValue(t, ch))
+	assert.Equal(t, 4, getValue(t, ch))
+}
+
+func TestPChanSetPriority(t *testing.T) {
+	ch := New()
+
+	ch.Push(1, 1)
+	item := ch.Push(2, 1)
+	ch.Push(3, 2)
+
+	item.SetPriority(3)
+	assert.Equal(t, 3, item.GetPriority())
+
+	assert.Equal(t, 2, getValue(t, ch))
+	assert.Equal(t, 3, getValue(t, ch))
+
+	// Popped items can still be changed.
+	item.SetPriority(1)
+	assert.Equal(t, 1, getValue(t, ch))
+}
+
 type list struct {
 	items []int
 	mut   sync.Mutex
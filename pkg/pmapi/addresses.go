@@ -64,6 +64,7 @@ type Address struct {
 	Status      int
 	Order       int `json:",omitempty"`
 	Type        int
+	CatchAll    Boolean
 	DisplayName string
 	Signature   string
 	MemberID    string `json:",omitempty"`
@@ -125,6 +126,50 @@ func (l AddressList) ByEmail(email string) *Address {
 	return nil
 }
 
+// ByEmailOrCatchAll gets the address to send as email: the address itself if
+// the user owns it, otherwise the enabled catch-all address of the custom
+// domain of email. Returns nil if no address is found.
+func (l AddressList) ByEmailOrCatchAll(email string) *Address {
+	if addr := l.ByEmail(email); addr != nil {
+		return addr
+	}
+
+	domain := emailDomain(email)
+	if domain == "" {
+		return nil
+	}
+
+	for _, addr := range l {
+		if addr.Type != CustomAddress || !addr.CatchAll {
+			continue
+		}
+
+		if addr.Status != EnabledAddress || addr.Send == NoSendAddress {
+			continue
+		}
+
+		if strings.EqualFold(emailDomain(addr.Email), domain) {
+			return addr
+		}
+	}
+
+	return nil
+}
+
+// IsCatchAllFor returns whether the address is only standing in for email as
+// the catch-all address of its domain, rather than being email itself.
+func (a *Address) IsCatchAllFor(email string) bool {
+	return !strings.EqualFold(a.Email, SanitizeEmail(email))
+}
+
+func emailDomain(email string) string {
+	splitAt := strings.Split(email, "@")
+	if len(splitAt) != 2 {
+		return ""
+	}
+	return splitAt[1]
+}
+
 func SanitizeEmail(email string) string {
 	splitAt := strings.Split(email, "@")
 	if len(splitAt) != 2 {
@@ -18,6 +18,7 @@
 package pmapi
 
 import (
+	"encoding/json"
 	"net/http"
 	"testing"
 
@@ -74,3 +75,46 @@ func TestAddressList(t *testing.T) {
 	addr = testAddressList.Main()
 	r.Equal(t, testAddressList[1], addr)
 }
+
+func TestAddressListCatchAll(t *testing.T) {
+	catchAll := &Address{
+		ID:       "4",
+		Email:    "me@example.com",
+		Send:     SecondarySendAddress,
+		Status:   EnabledAddress,
+		Type:     CustomAddress,
+		CatchAll: true,
+	}
+	list := append(AddressList{}, testAddressList...)
+	list = append(list, catchAll)
+
+	// Owned addresses are returned as they are.
+	addr := list.ByEmailOrCatchAll("root@nsa.gov")
+	r.Equal(t, testAddressList[0], addr)
+	r.False(t, addr.IsCatchAllFor("root@nsa.gov"))
+
+	addr = list.ByEmailOrCatchAll("me+tag@example.com")
+	r.Equal(t, catchAll, addr)
+	r.False(t, addr.IsCatchAllFor("me+tag@example.com"))
+
+	// Any other local part of the custom domain goes through the catch-all address.
+	addr = list.ByEmailOrCatchAll("shop@EXAMPLE.com")
+	r.Equal(t, catchAll, addr)
+	r.True(t, addr.IsCatchAllFor("shop@EXAMPLE.com"))
+
+	r.Nil(t, list.ByEmailOrCatchAll("shop@nsa.gov"))
+	r.Nil(t, list.ByEmailOrCatchAll("not an email"))
+
+	catchAll.Status = DisabledAddress
+	r.Nil(t, list.ByEmailOrCatchAll("shop@example.com"))
+}
+
+func TestAddressCatchAllJSON(t *testing.T) {
+	var addrs []Address
+	r.NoError(t, json.Unmarshal([]byte(`[{"CatchAll": 1}, {"CatchAll": true}, {"CatchAll": false}, {}]`), &addrs))
+
+	r.True(t, bool(addrs[0].CatchAll))
+	r.True(t, bool(addrs[1].CatchAll))
+	r.False(t, bool(addrs[2].CatchAll))
+	r.False(t, bool(addrs[3].CatchAll))
+}
@@ -171,6 +171,20 @@ func (c *client) AuthSalt(ctx context.Context) (string, error) {
 	return "", errors.New("no matching salt found")
 }
 
+// GetAuthModulus returns a fresh signed SRP modulus, which is needed to set
+// up a new password verifier.
+func (c *client) GetAuthModulus(ctx context.Context) (*AuthModulus, error) {
+	var res AuthModulus
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetResult(&res).Get("/auth/modulus")
+	}); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
 func (c *client) AddAuthRefreshHandler(handler AuthRefreshHandler) {
 	c.authHandlers = append(c.authHandlers, handler)
 }
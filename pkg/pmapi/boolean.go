@@ -22,6 +22,13 @@ import "encoding/json"
 type Boolean bool
 
 func (boolean *Boolean) UnmarshalJSON(b []byte) error {
+	// Some newer fields are sent as JSON booleans rather than integers.
+	var flag bool
+	if err := json.Unmarshal(b, &flag); err == nil {
+		*boolean = Boolean(flag)
+		return nil
+	}
+
 	var value int
 	err := json.Unmarshal(b, &value)
 	if err != nil {
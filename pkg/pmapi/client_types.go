@@ -29,6 +29,7 @@ import (
 type Client interface {
 	Auth2FA(context.Context, string) error
 	AuthSalt(ctx context.Context) (string, error)
+	GetAuthModulus(ctx context.Context) (*AuthModulus, error)
 	AuthDelete(context.Context) error
 	AddAuthRefreshHandler(AuthRefreshHandler)
 
@@ -46,6 +47,7 @@ type Client interface {
 	GetEvent(ctx context.Context, eventID string) (*Event, error)
 
 	SendMessage(context.Context, string, *SendMessageReq) (sent, parent *Message, err error)
+	CancelSend(ctx context.Context, messageID string) error
 	CreateDraft(ctx context.Context, m *Message, parent string, action int) (created *Message, err error)
 	Import(context.Context, ImportMsgReqs) ([]*ImportMsgRes, error)
 
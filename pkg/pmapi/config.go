@@ -17,6 +17,12 @@
 
 package pmapi
 
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
 type Config struct {
 	// HostURL is the base URL of API.
 	HostURL string
@@ -29,6 +35,14 @@ type Config struct {
 
 	// TLSIssueHandler is used to notify when there is a TLS issue.
 	TLSIssueHandler func()
+
+	// ProxyURL is the http, socks5 or socks5h URL of the proxy which all the
+	// connections go through. If empty, the connections are direct.
+	ProxyURL string
+
+	// DoHProviders are the DNS-over-HTTPS resolvers used to discover the
+	// alternative routes. If empty, the built-in ones are used.
+	DoHProviders []string
 }
 
 func NewConfig() Config {
@@ -38,6 +52,25 @@ func NewConfig() Config {
 	}
 }
 
+// CheckHostURL returns an error if the given URL cannot be the base URL of
+// the API.
+func CheckHostURL(rawURL string) error {
+	hostURL, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid host URL")
+	}
+
+	if hostURL.Scheme != "http" && hostURL.Scheme != "https" {
+		return errors.Errorf("unsupported host URL scheme %q", hostURL.Scheme)
+	}
+
+	if hostURL.Host == "" {
+		return errors.New("host URL has no host")
+	}
+
+	return nil
+}
+
 func (c *Config) getUserAgent() string {
 	return "UnknownClient/0.0.1"
 }
@@ -32,5 +32,5 @@ func newProxyDialerAndTransport(cfg Config) (*ProxyTLSDialer, http.RoundTripper)
 	basicDialer := NewBasicTLSDialer(cfg)
 	pinningDialer := NewPinningTLSDialer(cfg, basicDialer)
 	proxyDialer := NewProxyTLSDialer(cfg, pinningDialer)
-	return proxyDialer, CreateTransportWithDialer(proxyDialer)
+	return proxyDialer, createTransport(cfg, proxyDialer)
 }
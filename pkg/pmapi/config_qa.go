@@ -40,7 +40,7 @@ func getRootURL() string {
 }
 
 func newProxyDialerAndTransport(cfg Config) (*ProxyTLSDialer, http.RoundTripper) {
-	transport := CreateTransportWithDialer(NewBasicTLSDialer(cfg))
+	transport := createTransport(cfg, NewBasicTLSDialer(cfg))
 
 	// TLS certificate of testing environment might be self-signed.
 	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
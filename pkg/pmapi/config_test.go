@@ -0,0 +1,42 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package pmapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckHostURL(t *testing.T) {
+	for rawURL, valid := range map[string]bool{
+		"https://api.protonmail.ch": true,
+		"http://127.0.0.1:8080/":    true,
+		"https://example.com/api":   true,
+		"ftp://api.protonmail.ch":   false,
+		"api.protonmail.ch":         false,
+		"https://":                  false,
+		"http://[::1":               false,
+	} {
+		if valid {
+			require.NoError(t, CheckHostURL(rawURL), rawURL)
+		} else {
+			require.Error(t, CheckHostURL(rawURL), rawURL)
+		}
+	}
+}
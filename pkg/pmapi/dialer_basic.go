@@ -18,6 +18,7 @@
 package pmapi
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
 	"net/http"
@@ -54,19 +55,24 @@ func CreateTransportWithDialer(dialer TLSDialer) *http.Transport {
 // BasicTLSDialer implements TLSDialer.
 type BasicTLSDialer struct {
 	cfg Config
+
+	dial    contextDialer
+	dialErr error
 }
 
 // NewBasicTLSDialer returns a new BasicTLSDialer.
 func NewBasicTLSDialer(cfg Config) *BasicTLSDialer {
+	dial, err := newContextDialer(cfg.ProxyURL)
+
 	return &BasicTLSDialer{
-		cfg: cfg,
+		cfg:     cfg,
+		dial:    dial,
+		dialErr: err,
 	}
 }
 
 // DialTLS returns a connection to the given address using the given network.
 func (d *BasicTLSDialer) DialTLS(network, address string) (conn net.Conn, err error) {
-	dialer := &net.Dialer{Timeout: 30 * time.Second} // Alternative Routes spec says this should be a 30s timeout.
-
 	var tlsConfig *tls.Config
 
 	// If we are not dialing the standard API then we should skip cert verification checks.
@@ -74,5 +80,71 @@ func (d *BasicTLSDialer) DialTLS(network, address string) (conn net.Conn, err er
 		tlsConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
 	}
 
-	return tls.DialWithDialer(dialer, network, address, tlsConfig)
+	if d.cfg.ProxyURL == "" {
+		return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, network, address, tlsConfig)
+	}
+
+	return d.dialTLSThroughProxy(network, address, tlsConfig)
+}
+
+// dialTLSThroughProxy makes the TLS handshake with the server itself over
+// the tunnel through the proxy, so the proxy cannot see the traffic and the
+// pinning dialer still checks the certificate of the server.
+func (d *BasicTLSDialer) dialTLSThroughProxy(network, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	if d.dialErr != nil {
+		return nil, d.dialErr
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	rawConn, err := d.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{} //nolint:gosec
+	}
+
+	tlsConfig.ServerName = host
+
+	conn := tls.Client(rawConn, tlsConfig)
+
+	_ = rawConn.SetDeadline(time.Now().Add(dialTimeout))
+
+	if err := conn.Handshake(); err != nil {
+		_ = rawConn.Close()
+		return nil, err
+	}
+
+	_ = rawConn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// createTransport creates the transport for the given dialer. The configured
+// proxy replaces the one from the environment: the TLS connections are made
+// by the dialer and the plain ones, to an http:// host URL, go through the
+// proxy as well.
+func createTransport(cfg Config, dialer TLSDialer) *http.Transport {
+	transport := CreateTransportWithDialer(dialer)
+
+	if cfg.ProxyURL != "" {
+		transport.Proxy = nil
+
+		dial, err := newContextDialer(cfg.ProxyURL)
+		if err != nil {
+			dial = func(context.Context, string, string) (net.Conn, error) { return nil, err }
+		}
+
+		transport.DialContext = dial
+	}
+
+	return transport
 }
@@ -0,0 +1,180 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package pmapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// ErrUnsupportedProxy is returned when the scheme of the proxy URL is not one
+// of http, socks5 and socks5h.
+var ErrUnsupportedProxy = errors.New("unsupported proxy scheme")
+
+// dialTimeout is the time allowed to establish a connection; Alternative
+// Routes spec says this should be a 30s timeout.
+const dialTimeout = 30 * time.Second
+
+// contextDialer makes the TCP connections to the API.
+type contextDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+// CheckProxyURL returns an error if the connections cannot go through the
+// proxy with the given URL.
+func CheckProxyURL(rawURL string) error {
+	_, err := newContextDialer(rawURL)
+	return err
+}
+
+// newContextDialer returns a dialer connecting directly if the proxy URL is
+// empty or through the proxy otherwise. The socks5 scheme resolves the host
+// names locally while socks5h leaves it to the proxy.
+func newContextDialer(rawURL string) (contextDialer, error) {
+	direct := &net.Dialer{Timeout: dialTimeout}
+
+	if rawURL == "" {
+		return direct.DialContext, nil
+	}
+
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy URL")
+	}
+
+	switch proxyURL.Scheme {
+	case "http":
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialHTTPProxy(ctx, direct, proxyURL, network, address)
+		}, nil
+
+	case "socks5", "socks5h":
+		dialer, err := proxy.FromURL(proxyURL, direct)
+		if err != nil {
+			return nil, err
+		}
+
+		socks, ok := dialer.(proxy.ContextDialer)
+		if !ok {
+			return nil, ErrUnsupportedProxy
+		}
+
+		if proxyURL.Scheme == "socks5h" {
+			return socks.DialContext, nil
+		}
+
+		return func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address, err = resolveAddress(ctx, address); err != nil {
+				return nil, err
+			}
+
+			return socks.DialContext(ctx, network, address)
+		}, nil
+
+	default:
+		return nil, errors.Wrap(ErrUnsupportedProxy, proxyURL.Scheme)
+	}
+}
+
+// resolveAddress replaces the host name in the address with its first IP.
+func resolveAddress(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no address found for %v", host)
+	}
+
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// dialHTTPProxy opens a tunnel to the address through the HTTP proxy with the
+// CONNECT method.
+func dialHTTPProxy(ctx context.Context, direct *net.Dialer, proxyURL *url.URL, network, address string) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	conn, err := direct.DialContext(ctx, network, proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused the connection: %v", res.Status)
+	}
+
+	// Nothing is expected before the TLS handshake and anything read ahead
+	// would be lost.
+	if br.Buffered() > 0 {
+		_ = conn.Close()
+		return nil, errors.New("unexpected data from proxy")
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
@@ -127,7 +127,7 @@ func (r tlsReport) sendReport(cfg Config, uri string) {
 	req.Header.Set("x-pm-appversion", r.AppVersion)
 
 	logrus.WithField("request", req).Warn("Reporting TLS mismatch")
-	res, err := (&http.Client{Transport: CreateTransportWithDialer(NewBasicTLSDialer(cfg))}).Do(req)
+	res, err := (&http.Client{Transport: createTransport(cfg, NewBasicTLSDialer(cfg))}).Do(req)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to report TLS mismatch")
 		return
@@ -46,7 +46,7 @@ func NewProxyTLSDialer(cfg Config, dialer TLSDialer) *ProxyTLSDialer {
 		locker:           sync.RWMutex{},
 		directAddress:    formatAsAddress(cfg.HostURL),
 		proxyAddress:     formatAsAddress(cfg.HostURL),
-		proxyProvider:    newProxyProvider(cfg, dohProviders, proxyQuery),
+		proxyProvider:    newProxyProvider(cfg, getDoHProviders(cfg), proxyQuery),
 		proxyUseDuration: proxyUseDuration,
 	}
 }
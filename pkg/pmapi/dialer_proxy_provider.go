@@ -20,6 +20,7 @@ package pmapi
 import (
 	"context"
 	"encoding/base64"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -48,6 +49,15 @@ var dohProviders = []string{ //nolint:gochecknoglobals
 	GoogleProvider,
 }
 
+// getDoHProviders returns the configured DoH providers or the built-in ones.
+func getDoHProviders(cfg Config) []string {
+	if len(cfg.DoHProviders) > 0 {
+		return cfg.DoHProviders
+	}
+
+	return dohProviders
+}
+
 // proxyProvider manages known proxies.
 type proxyProvider struct {
 	cfg Config
@@ -55,6 +65,11 @@ type proxyProvider struct {
 	// dohLookup is used to look up the given query at the given DoH provider, returning the TXT records>
 	dohLookup func(ctx context.Context, query, provider string) (urls []string, err error)
 
+	// doh is the client of the DoH providers, created on the first lookup.
+	doh     *resty.Client
+	dohErr  error
+	dohOnce sync.Once
+
 	providers  []string // List of known doh providers.
 	query      string   // The query string used to find proxies.
 	proxyCache []string // All known proxies, cached in case DoH providers are unreachable.
@@ -180,7 +195,7 @@ func (p *proxyProvider) canReach(url string) bool {
 	pinger := resty.New().
 		SetHostURL(url).
 		SetTimeout(p.canReachTimeout).
-		SetTransport(CreateTransportWithDialer(dialer))
+		SetTransport(createTransport(p.cfg, dialer))
 
 	if _, err := pinger.R().Get("/tests/ping"); err != nil {
 		log.WithField("proxy", url).WithError(err).Warn("Failed to ping proxy")
@@ -190,6 +205,42 @@ func (p *proxyProvider) canReach(url string) bool {
 	return true
 }
 
+// newDoHTransport returns the transport for the DoH queries which goes
+// through the configured proxy.
+func newDoHTransport(cfg Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+
+	if cfg.ProxyURL == "" {
+		return transport, nil
+	}
+
+	dial, err := newContextDialer(cfg.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport.Proxy = nil
+	transport.DialContext = dial
+
+	return transport, nil
+}
+
+// getDoHClient returns the client of the DoH providers. All the lookups share
+// it and its connections.
+func (p *proxyProvider) getDoHClient() (*resty.Client, error) {
+	p.dohOnce.Do(func() {
+		transport, err := newDoHTransport(p.cfg)
+		if err != nil {
+			p.dohErr = err
+			return
+		}
+
+		p.doh = resty.New().SetTransport(transport)
+	})
+
+	return p.doh, p.dohErr
+}
+
 // defaultDoHLookup is the default implementation of the proxy manager's DoH lookup.
 // It looks up DNS TXT records for the given query URL using the given DoH provider.
 // It returns a list of all found TXT records.
@@ -198,6 +249,11 @@ func (p *proxyProvider) defaultDoHLookup(ctx context.Context, query, dohProvider
 	ctx, cancel := context.WithTimeout(ctx, p.dohTimeout)
 	defer cancel()
 
+	client, err := p.getDoHClient()
+	if err != nil {
+		return nil, err
+	}
+
 	dataChan, errChan := make(chan []string), make(chan error)
 
 	go func() {
@@ -215,7 +271,7 @@ func (p *proxyProvider) defaultDoHLookup(ctx context.Context, query, dohProvider
 		encodedRequest := base64.RawURLEncoding.EncodeToString(rawRequest)
 
 		// Make DoH request to the given DoH provider.
-		rawResponse, err := resty.New().R().SetContext(ctx).SetQueryParam("dns", encodedRequest).Get(dohProvider)
+		rawResponse, err := client.R().SetContext(ctx).SetQueryParam("dns", encodedRequest).Get(dohProvider)
 		if err != nil {
 			errChan <- errors.Wrap(err, "failed to make DoH request")
 			return
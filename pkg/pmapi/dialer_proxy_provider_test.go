@@ -135,6 +135,18 @@ func TestProxyProvider_FindProxy_CanReachTimeout(t *testing.T) {
 	r.Error(t, err)
 }
 
+func TestProxyProvider_DoHClientIsShared(t *testing.T) {
+	p := newProxyProvider(Config{}, []string{}, "")
+
+	first, err := p.getDoHClient()
+	r.NoError(t, err)
+
+	second, err := p.getDoHClient()
+	r.NoError(t, err)
+
+	r.Same(t, first, second)
+}
+
 func TestProxyProvider_DoHLookup_Quad9(t *testing.T) {
 	p := newProxyProvider(Config{}, []string{Quad9Provider, GoogleProvider}, proxyQuery)
 
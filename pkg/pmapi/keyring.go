@@ -305,6 +305,28 @@ func encryptAndEncodeSessionKeys(
 	return
 }
 
+func encryptAndEncodeSessionKeysWithPassword(
+	password []byte,
+	bodyKey *crypto.SessionKey,
+	attkeys map[string]*crypto.SessionKey,
+) (bodyPacket string, attachmentPackets map[string]string, err error) {
+	packetBytes, err := crypto.EncryptSessionKeyWithPassword(bodyKey, password)
+	if err != nil {
+		return
+	}
+	bodyPacket = base64.StdEncoding.EncodeToString(packetBytes)
+
+	attachmentPackets = make(map[string]string)
+	for id, attkey := range attkeys {
+		var packets []byte
+		if packets, err = crypto.EncryptSessionKeyWithPassword(attkey, password); err != nil {
+			return
+		}
+		attachmentPackets[id] = base64.StdEncoding.EncodeToString(packets)
+	}
+	return
+}
+
 func encryptSymmDecryptKey(
 	kr *crypto.KeyRing,
 	textToEncrypt string,
@@ -37,6 +37,7 @@ const (
 	SentLabel      = "7"
 	DraftLabel     = "8"
 	StarredLabel   = "10"
+	ScheduledLabel = "12"
 
 	LabelTypeMailBox      = 1
 	LabelTypeContactGroup = 2
@@ -45,7 +46,7 @@ const (
 // IsSystemLabel checks if a label is a pre-defined system label.
 func IsSystemLabel(label string) bool {
 	switch label {
-	case InboxLabel, DraftLabel, SentLabel, TrashLabel, SpamLabel, ArchiveLabel, StarredLabel, AllMailLabel, AllSentLabel, AllDraftsLabel:
+	case InboxLabel, DraftLabel, SentLabel, TrashLabel, SpamLabel, ArchiveLabel, StarredLabel, AllMailLabel, AllSentLabel, AllDraftsLabel, ScheduledLabel:
 		return true
 	}
 	return false
@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 )
 
 type manager struct {
@@ -120,6 +121,8 @@ func (m *manager) r(ctx context.Context) *resty.Request {
 }
 
 func (m *manager) handleRequestSuccess(_ *resty.Client, res *resty.Response) error {
+	metrics.APIRequest(false)
+
 	m.locker.Lock()
 	defer m.locker.Unlock()
 
@@ -139,6 +142,8 @@ func (m *manager) handleRequestSuccess(_ *resty.Client, res *resty.Response) err
 }
 
 func (m *manager) handleRequestFailure(req *resty.Request, err error) {
+	metrics.APIRequest(true)
+
 	m.locker.Lock()
 	defer m.locker.Unlock()
 
@@ -104,6 +104,12 @@ type MessageAddress struct {
 	EncryptedBodyKeyPacket        string `json:"BodyKeyPacket,omitempty"` // base64-encoded key packet.
 	Signature                     SignatureFlag
 	EncryptedAttachmentKeyPackets map[string]string `json:"AttachmentKeyPackets,omitempty"`
+
+	// Only for encrypted outside packages.
+	Token        string        `json:",omitempty"` // base64-encoded random token.
+	EncToken     string        `json:",omitempty"` // armored token encrypted with the password.
+	Auth         *PasswordAuth `json:",omitempty"`
+	PasswordHint string        `json:",omitempty"`
 }
 
 type MessagePackage struct {
@@ -151,6 +157,8 @@ type sendData struct {
 
 type SendMessageReq struct {
 	ExpirationTime int64 `json:",omitempty"`
+	ExpiresIn      int64 `json:",omitempty"` // Seconds after which the message is deleted.
+	DeliveryTime   int64 `json:",omitempty"` // Unix time of the scheduled delivery.
 	// AutoSaveContacts int `json:",omitempty"`
 
 	// Data for encrypted recipients.
@@ -159,6 +167,16 @@ type SendMessageReq struct {
 	mime, plain, rich sendData
 	attKeys           map[string]*crypto.SessionKey
 	kr                *crypto.KeyRing
+	outside           *outsideData
+}
+
+// outsideData holds what is needed to encrypt the message with a password
+// for the recipients of encrypted outside packages.
+type outsideData struct {
+	password        []byte
+	hint            string
+	auth            *PasswordAuth
+	token, encToken string
 }
 
 func NewSendMessageReq(
@@ -182,20 +200,51 @@ func NewSendMessageReq(
 	return req
 }
 
+// SetOutsidePassword lets the message be sent in encrypted outside packages,
+// which the recipients open with the password in the ProtonMail web client.
+func (req *SendMessageReq) SetOutsidePassword(password []byte, hint string, auth *PasswordAuth) error {
+	token, err := crypto.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	encodedToken := base64.StdEncoding.EncodeToString(token)
+
+	encToken, err := crypto.EncryptMessageWithPassword(crypto.NewPlainMessageFromString(encodedToken), password)
+	if err != nil {
+		return err
+	}
+
+	armoredToken, err := encToken.GetArmored()
+	if err != nil {
+		return err
+	}
+
+	req.outside = &outsideData{
+		password: password,
+		hint:     hint,
+		auth:     auth,
+		token:    encodedToken,
+		encToken: armoredToken,
+	}
+
+	return nil
+}
+
 var (
-	errUnknownContentType           = errors.New("unknown content type")
-	errMultipartInNonMIME           = errors.New("multipart mixed not allowed in this scheme")
-	errAttSignNotSupported          = errors.New("attached signature not supported")
-	errEncryptMustSign              = errors.New("encrypted package must be signed")
-	errEncryptedOutsideNotSupported = errors.New("encrypted outside is not supported")
-	errWrongSendScheme              = errors.New("wrong send scheme")
-	errInternalMustEncrypt          = errors.New("internal package must be encrypted")
-	errInlineMustBePlain            = errors.New("PGP Inline package must be plain text")
-	errMissingPubkey                = errors.New("cannot encrypt body key packet: missing pubkey")
-	errClearSignMustNotBeHTML       = errors.New("clear signed packet must be multipart or plain")
-	errMIMEMustBeMultipart          = errors.New("MIME packet must be multipart")
-	errClearMIMEMustSign            = errors.New("clear MIME must be signed")
-	errClearSignMustNotBePGPInline  = errors.New("clear sign must not be PGP inline")
+	errUnknownContentType          = errors.New("unknown content type")
+	errMultipartInNonMIME          = errors.New("multipart mixed not allowed in this scheme")
+	errAttSignNotSupported         = errors.New("attached signature not supported")
+	errEncryptMustSign             = errors.New("encrypted package must be signed")
+	errEncryptedOutsideNoPassword  = errors.New("encrypted outside package needs a password")
+	errWrongSendScheme             = errors.New("wrong send scheme")
+	errInternalMustEncrypt         = errors.New("internal package must be encrypted")
+	errInlineMustBePlain           = errors.New("PGP Inline package must be plain text")
+	errMissingPubkey               = errors.New("cannot encrypt body key packet: missing pubkey")
+	errClearSignMustNotBeHTML      = errors.New("clear signed packet must be multipart or plain")
+	errMIMEMustBeMultipart         = errors.New("MIME packet must be multipart")
+	errClearMIMEMustSign           = errors.New("clear MIME must be signed")
+	errClearSignMustNotBePGPInline = errors.New("clear sign must not be PGP inline")
 )
 
 func (req *SendMessageReq) AddRecipient(
@@ -223,7 +272,13 @@ func (req *SendMessageReq) AddRecipient(
 		}
 		return req.addNonMIMERecipient(email, sendScheme, pubkey, signature, contentType, doEncrypt)
 	case EncryptedOutsidePackage:
-		return errEncryptedOutsideNotSupported
+		if req.outside == nil {
+			return errEncryptedOutsideNoPassword
+		}
+		if contentType == ContentTypeMultipartMixed {
+			return errMultipartInNonMIME
+		}
+		return req.addNonMIMERecipient(email, sendScheme, pubkey, signature, contentType, doEncrypt)
 	default:
 		return errWrongSendScheme
 	}
@@ -268,14 +323,23 @@ func (req *SendMessageReq) addNonMIMERecipient(
 	if sendScheme.Is(PGPInlinePackage) && contentType == ContentTypeHTML {
 		return errInlineMustBePlain
 	}
-	if sendScheme.Is(InternalPackage) && !doEncrypt {
+	if (sendScheme.Is(InternalPackage) || sendScheme.Is(EncryptedOutsidePackage)) && !doEncrypt {
 		return errInternalMustEncrypt
 	}
-	if doEncrypt && pubkey == nil {
-		return errMissingPubkey
-	}
 
-	if doEncrypt {
+	if sendScheme.Is(EncryptedOutsidePackage) {
+		newAddress.EncryptedBodyKeyPacket, newAddress.EncryptedAttachmentKeyPackets, err = encryptAndEncodeSessionKeysWithPassword(req.outside.password, send.decryptedBodyKey, req.attKeys)
+		if err != nil {
+			return err
+		}
+		newAddress.Token = req.outside.token
+		newAddress.EncToken = req.outside.encToken
+		newAddress.Auth = req.outside.auth
+		newAddress.PasswordHint = req.outside.hint
+	} else if doEncrypt {
+		if pubkey == nil {
+			return errMissingPubkey
+		}
 		newAddress.EncryptedBodyKeyPacket, newAddress.EncryptedAttachmentKeyPackets, err = encryptAndEncodeSessionKeys(pubkey, send.decryptedBodyKey, req.attKeys)
 		if err != nil {
 			return err
@@ -361,3 +425,15 @@ func (c *client) SendMessage(ctx context.Context, draftID string, req *SendMessa
 
 	return res.Sent, res.Parent, nil
 }
+
+// CancelSend cancels the scheduled delivery of the message and turns it back
+// into a draft.
+func (c *client) CancelSend(ctx context.Context, messageID string) error {
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.Put("/mail/v4/messages/" + messageID + "/cancel_send")
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
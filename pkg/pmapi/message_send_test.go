@@ -200,7 +200,7 @@ func TestSendReq(t *testing.T) {
 		"mime@gpg.com":  {"", PGPMIMEPackage, testPublicKeyRing, SignatureDetached, ContentTypeMultipartMixed, true, nil},
 		"plain@gpg.com": {"", PGPInlinePackage, testPublicKeyRing, SignatureDetached, ContentTypePlainText, true, nil},
 		// External Encryption bad
-		"eo@gpg.com":           {"", EncryptedOutsidePackage, testPublicKeyRing, SignatureDetached, ContentTypeHTML, true, errEncryptedOutsideNotSupported},
+		"eo@gpg.com":           {"", EncryptedOutsidePackage, testPublicKeyRing, SignatureDetached, ContentTypeHTML, true, errEncryptedOutsideNoPassword},
 		"inline-html@gpg.com":  {"", PGPInlinePackage, testPublicKeyRing, SignatureDetached, ContentTypeHTML, true, errInlineMustBePlain},
 		"inline-mixed@gpg.com": {"", PGPInlinePackage, testPublicKeyRing, SignatureDetached, ContentTypeMultipartMixed, true, errMultipartInNonMIME},
 		"mime-plain@gpg.com":   {"", PGPMIMEPackage, nil, SignatureDetached, ContentTypePlainText, true, errMIMEMustBeMultipart},
@@ -630,3 +630,53 @@ func TestSendReq(t *testing.T) {
 		t.Run("Att"+name, test.prepareAndCheck)
 	}
 }
+
+func TestSendReqOutsidePassword(t *testing.T) {
+	r := require.New(t)
+
+	attKey, err := crypto.GenerateSessionKey()
+	r.NoError(err)
+
+	auth := &PasswordAuth{Version: 4, ModulusID: "modulusID", Salt: "salt", Verifier: "verifier"}
+
+	req := NewSendMessageReq(testPrivateKeyRing, "Mime body", "Plain body", "HTML body", map[string]*crypto.SessionKey{"attID": attKey})
+	r.NoError(req.SetOutsidePassword([]byte("secret"), "the usual", auth))
+	r.NoError(req.AddRecipient("eo@email.com", EncryptedOutsidePackage, nil, SignatureDetached, ContentTypeHTML, true))
+	r.Equal(errMultipartInNonMIME, req.AddRecipient("eo-mime@email.com", EncryptedOutsidePackage, nil, SignatureDetached, ContentTypeMultipartMixed, true))
+	req.PreparePackages()
+
+	r.Len(req.Packages, 1)
+	r.Equal(EncryptedOutsidePackage, req.Packages[0].Type)
+	r.Nil(req.Packages[0].DecryptedBodyKey)
+
+	address := req.Packages[0].Addresses["eo@email.com"]
+	r.Equal(auth, address.Auth)
+	r.Equal("the usual", address.PasswordHint)
+
+	// The recipient unlocks the body, the attachments and the token with the password.
+	bodyKeyPacket, err := base64.StdEncoding.DecodeString(address.EncryptedBodyKeyPacket)
+	r.NoError(err)
+	bodyKey, err := crypto.DecryptSessionKeyWithPassword(bodyKeyPacket, []byte("secret"))
+	r.NoError(err)
+
+	encryptedBody, err := base64.StdEncoding.DecodeString(req.Packages[0].EncryptedBody)
+	r.NoError(err)
+	body, err := bodyKey.Decrypt(encryptedBody)
+	r.NoError(err)
+	r.Equal("HTML body", body.GetString())
+
+	attKeyPacket, err := base64.StdEncoding.DecodeString(address.EncryptedAttachmentKeyPackets["attID"])
+	r.NoError(err)
+	haveAttKey, err := crypto.DecryptSessionKeyWithPassword(attKeyPacket, []byte("secret"))
+	r.NoError(err)
+	r.Equal(attKey.Key, haveAttKey.Key)
+
+	encToken, err := crypto.NewPGPMessageFromArmored(address.EncToken)
+	r.NoError(err)
+	token, err := crypto.DecryptMessageWithPassword(encToken, []byte("secret"))
+	r.NoError(err)
+	r.Equal(address.Token, token.GetString())
+
+	_, err = crypto.DecryptSessionKeyWithPassword(bodyKeyPacket, []byte("wrong"))
+	r.Error(err)
+}
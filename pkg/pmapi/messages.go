@@ -167,6 +167,7 @@ type Message struct {
 	CCList         []*mail.Address
 	BCCList        []*mail.Address
 	Time           int64 // Unix time
+	Size           int64 `json:",omitempty"`
 	NumAttachments int
 	ExpirationTime int64 // Unix time
 	SpamScore      int
@@ -109,6 +109,20 @@ func (mr *MockClientMockRecorder) AuthSalt(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AuthSalt", reflect.TypeOf((*MockClient)(nil).AuthSalt), arg0)
 }
 
+// CancelSend mocks base method.
+func (m *MockClient) CancelSend(arg0 context.Context, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CancelSend", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CancelSend indicates an expected call of CancelSend.
+func (mr *MockClientMockRecorder) CancelSend(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CancelSend", reflect.TypeOf((*MockClient)(nil).CancelSend), arg0, arg1)
+}
+
 // CountMessages mocks base method.
 func (m *MockClient) CountMessages(arg0 context.Context, arg1 string) ([]*pmapi.MessagesCount, error) {
 	m.ctrl.T.Helper()
@@ -301,6 +315,21 @@ func (mr *MockClientMockRecorder) GetAttachment(arg0, arg1 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttachment", reflect.TypeOf((*MockClient)(nil).GetAttachment), arg0, arg1)
 }
 
+// GetAuthModulus mocks base method.
+func (m *MockClient) GetAuthModulus(arg0 context.Context) (*pmapi.AuthModulus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAuthModulus", arg0)
+	ret0, _ := ret[0].(*pmapi.AuthModulus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAuthModulus indicates an expected call of GetAuthModulus.
+func (mr *MockClientMockRecorder) GetAuthModulus(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuthModulus", reflect.TypeOf((*MockClient)(nil).GetAuthModulus), arg0)
+}
+
 // GetContactByID mocks base method.
 func (m *MockClient) GetContactByID(arg0 context.Context, arg1 string) (pmapi.Contact, error) {
 	m.ctrl.T.Helper()
@@ -42,3 +42,38 @@ func HashMailboxPassword(password []byte, salt string) ([]byte, error) {
 
 	return hash[len(hash)-31:], nil
 }
+
+// PasswordAuth lets somebody prove to the server that they know a password
+// without the server ever learning it.
+type PasswordAuth struct {
+	Version   int
+	ModulusID string
+	Salt      string
+	Verifier  string
+}
+
+// NewPasswordAuth creates an SRP verifier of the password using the given
+// modulus and a random salt.
+func NewPasswordAuth(modulus *AuthModulus, password []byte) (*PasswordAuth, error) {
+	salt, err := srp.RandomBytes(10)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate salt")
+	}
+
+	auth, err := srp.NewAuthForVerifier(password, modulus.Modulus, salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to hash password")
+	}
+
+	verifier, err := auth.GenerateVerifier(2048)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate verifier")
+	}
+
+	return &PasswordAuth{
+		Version:   auth.Version,
+		ModulusID: modulus.ModulusID,
+		Salt:      base64.StdEncoding.EncodeToString(salt),
+		Verifier:  base64.StdEncoding.EncodeToString(verifier),
+	}, nil
+}
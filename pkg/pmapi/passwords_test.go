@@ -18,11 +18,27 @@
 package pmapi
 
 import (
+	"encoding/base64"
 	"testing"
 
+	"github.com/ProtonMail/go-srp"
 	"github.com/stretchr/testify/require"
 )
 
+const testSignedModulus = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+W2z5HBi8RvsfYzZTS7qBaUxxPhsfHJFZpu3Kd6s1JafNrCCH9rfvPLrfuqocxWPgWDH2R8neK7PkNvjxto9TStuY5z7jAzWRvFWN9cQhAKkdWgy0JY6ywVn22+HFpF4cYesHrqFIKUPDMSSIlWjBVmEJZ/MusD44ZT29xcPrOqeZvwtCffKtGAIjLYPZIEbZKnDM1Dm3q2K/xS5h+xdhjnndhsrkwm9U9oyA2wxzSXFL+pdfj2fOdRwuR5nW0J2NFrq3kJjkRmpO/Genq1UW+TEknIWAb6VzJJJA244K/H8cnSx2+nSNZO3bbo6Ys228ruV9A8m6DhxmS+bihN3ttQ==
+-----BEGIN PGP SIGNATURE-----
+Version: ProtonMail
+Comment: https://protonmail.com
+
+wl4EARYIABAFAlwB1j0JEDUFhcTpUY8mAAD8CgEAnsFnF4cF0uSHKkXa1GIa
+GO86yMV4zDZEZcDSJo0fgr8A/AlupGN9EdHlsrZLmTA1vhIx+rOgxdEff28N
+kvNM7qIK
+=q6vu
+-----END PGP SIGNATURE-----`
+
 func TestMailboxPassword(t *testing.T) {
 	// wantHash was generated with passprase and salt defined below. It
 	// should not change when changing implementation of the function.
@@ -42,3 +58,37 @@ func TestMailboxPassword(t *testing.T) {
 	r.NoError(err)
 	r.Equal(wantHash, haveHash)
 }
+
+func TestNewPasswordAuth(t *testing.T) {
+	r := require.New(t)
+
+	auth, err := NewPasswordAuth(&AuthModulus{Modulus: testSignedModulus, ModulusID: "modulusID"}, []byte("secret"))
+	r.NoError(err)
+	r.Equal(4, auth.Version)
+	r.Equal("modulusID", auth.ModulusID)
+
+	verifier, err := base64.StdEncoding.DecodeString(auth.Verifier)
+	r.NoError(err)
+
+	server, err := srp.NewServerFromSigned(testSignedModulus, verifier, 2048)
+	r.NoError(err)
+
+	challenge, err := server.GenerateChallenge()
+	r.NoError(err)
+
+	// Only the right password proves the knowledge of the password.
+	for password, valid := range map[string]bool{"secret": true, "wrong": false} {
+		client, err := srp.NewAuth(auth.Version, "", []byte(password), auth.Salt, testSignedModulus, base64.StdEncoding.EncodeToString(challenge))
+		r.NoError(err)
+
+		proofs, err := client.GenerateProofs(2048)
+		r.NoError(err)
+
+		_, err = server.VerifyProofs(proofs.ClientEphemeral, proofs.ClientProof)
+		if valid {
+			r.NoError(err)
+		} else {
+			r.Error(err)
+		}
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/go-resty/resty/v2"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -50,6 +51,10 @@ func (m *manager) catchAPIError(_ *resty.Client, res *resty.Response) error {
 		return nil
 	}
 
+	if isTooManyRequest(res) {
+		metrics.APITooManyRequests()
+	}
+
 	if res.StatusCode() == http.StatusUnauthorized {
 		return ErrUnauthorized
 	}
@@ -0,0 +1,217 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-srp"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+// signedModulus is the SRP modulus of the pmapi test fixtures; the clients
+// only accept a modulus signed by Proton.
+const signedModulus = `-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA256
+
+W2z5HBi8RvsfYzZTS7qBaUxxPhsfHJFZpu3Kd6s1JafNrCCH9rfvPLrfuqocxWPgWDH2R8neK7PkNvjxto9TStuY5z7jAzWRvFWN9cQhAKkdWgy0JY6ywVn22+HFpF4cYesHrqFIKUPDMSSIlWjBVmEJZ/MusD44ZT29xcPrOqeZvwtCffKtGAIjLYPZIEbZKnDM1Dm3q2K/xS5h+xdhjnndhsrkwm9U9oyA2wxzSXFL+pdfj2fOdRwuR5nW0J2NFrq3kJjkRmpO/Genq1UW+TEknIWAb6VzJJJA244K/H8cnSx2+nSNZO3bbo6Ys228ruV9A8m6DhxmS+bihN3ttQ==
+-----BEGIN PGP SIGNATURE-----
+Version: ProtonMail
+Comment: https://protonmail.com
+
+wl4EARYIABAFAlwB1j0JEDUFhcTpUY8mAAD8CgEAnsFnF4cF0uSHKkXa1GIa
+GO86yMV4zDZEZcDSJo0fgr8A/AlupGN9EdHlsrZLmTA1vhIx+rOgxdEff28N
+kvNM7qIK
+=q6vu
+-----END PGP SIGNATURE-----
+`
+
+const (
+	modulusID = "modulus"
+
+	// tokenLifetime is the number of seconds the access tokens are said to
+	// be valid for; the server does not expire them.
+	tokenLifetime = 3600
+
+	// loginLifetime is how long an exchange started by /auth/info may be
+	// finished by /auth.
+	loginLifetime = time.Minute
+)
+
+var scopes = []string{"full", "self", "user", "loggedin", "mail", "verified"} //nolint:gochecknoglobals
+
+// login is an SRP exchange started by /auth/info and finished by /auth.
+type login struct {
+	user    *user
+	server  *srp.Server
+	expires time.Time
+}
+
+// session is an authenticated client of a user.
+type session struct {
+	uid, accessToken, refreshToken string
+	user                           *user
+}
+
+func (s *Server) authorize(r *http.Request) *session {
+	sess, ok := s.sessions[r.Header.Get("x-pm-uid")]
+	if !ok {
+		return nil
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+sess.accessToken {
+		return nil
+	}
+
+	return sess
+}
+
+func (s *Server) authInfo(w http.ResponseWriter, r *request) {
+	var req pmapi.GetAuthInfoReq
+	if !decode(w, r, &req) {
+		return
+	}
+
+	u := s.userByName(req.Username)
+	if u == nil {
+		writeError(w, http.StatusUnprocessableEntity, codePasswordWrong, "Incorrect login credentials")
+		return
+	}
+
+	server, err := srp.NewServerFromSigned(signedModulus, u.verifier, 2048)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInvalidValue, err.Error())
+		return
+	}
+
+	challenge, err := server.GenerateChallenge()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInvalidValue, err.Error())
+		return
+	}
+
+	s.expireLogins()
+
+	id := s.newToken()
+	s.logins[id] = &login{user: u, server: server, expires: s.now().Add(loginLifetime)}
+
+	writeJSON(w, response{
+		"Version":         u.auth.Version,
+		"Modulus":         signedModulus,
+		"ServerEphemeral": base64.StdEncoding.EncodeToString(challenge),
+		"Salt":            u.auth.Salt,
+		"SRPSession":      id,
+	})
+}
+
+// expireLogins forgets the exchanges which were never finished.
+func (s *Server) expireLogins() {
+	now := s.now()
+
+	for id, l := range s.logins {
+		if !now.Before(l.expires) {
+			delete(s.logins, id)
+		}
+	}
+}
+
+func (s *Server) auth(w http.ResponseWriter, r *request) {
+	var req pmapi.AuthReq
+	if !decode(w, r, &req) {
+		return
+	}
+
+	// Each exchange can be tried only once.
+	l, ok := s.logins[req.SRPSession]
+	delete(s.logins, req.SRPSession)
+
+	if !ok || !l.user.hasName(req.Username) || !s.now().Before(l.expires) {
+		writeError(w, http.StatusUnprocessableEntity, codePasswordWrong, "Incorrect login credentials")
+		return
+	}
+
+	clientEphemeral, err := base64.StdEncoding.DecodeString(req.ClientEphemeral)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Invalid client ephemeral")
+		return
+	}
+
+	clientProof, err := base64.StdEncoding.DecodeString(req.ClientProof)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Invalid client proof")
+		return
+	}
+
+	serverProof, err := l.server.VerifyProofs(clientEphemeral, clientProof)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, codePasswordWrong, "Incorrect login credentials")
+		return
+	}
+
+	sess := &session{
+		uid:          s.newToken(),
+		accessToken:  s.newToken(),
+		refreshToken: s.newToken(),
+		user:         l.user,
+	}
+	s.sessions[sess.uid] = sess
+
+	res := sess.toAPI()
+	res["UserID"] = l.user.id
+	res["ServerProof"] = base64.StdEncoding.EncodeToString(serverProof)
+	res["PasswordMode"] = pmapi.OnePasswordMode
+	res["2FA"] = pmapi.TwoFAInfo{Enabled: pmapi.TwoFADisabled}
+
+	writeJSON(w, res)
+}
+
+func (s *Server) authRefresh(w http.ResponseWriter, r *request) {
+	var req struct {
+		UID          string
+		RefreshToken string
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	sess, ok := s.sessions[req.UID]
+	if !ok || sess.refreshToken != req.RefreshToken {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidRefresh, "Invalid refresh token")
+		return
+	}
+
+	sess.accessToken = s.newToken()
+	sess.refreshToken = s.newToken()
+
+	writeJSON(w, sess.toAPI())
+}
+
+func (sess *session) toAPI() response {
+	return response{
+		"UID":          sess.uid,
+		"AccessToken":  sess.accessToken,
+		"RefreshToken": sess.refreshToken,
+		"ExpiresIn":    tokenLifetime,
+		"TokenType":    "Bearer",
+		"Scopes":       scopes,
+		"Scope":        strings.Join(scopes, " "),
+	}
+}
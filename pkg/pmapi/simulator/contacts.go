@@ -0,0 +1,116 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+// AddContact adds a contact with a single email address and a clear text
+// vCard to the address book of the user.
+func (s *Server) AddContact(userID, name, email string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok {
+		return errors.Errorf("user %s does not exist", userID)
+	}
+
+	now := time.Now().Unix()
+
+	c := &pmapi.Contact{
+		ID:         s.newID("contact"),
+		Name:       name,
+		UID:        s.newToken(),
+		CreateTime: now,
+		ModifyTime: now,
+		LabelIDs:   []string{},
+		Cards: []pmapi.Card{{
+			Data: fmt.Sprintf("BEGIN:VCARD\r\nVERSION:4.0\r\nFN:%s\r\nitem1.EMAIL:%s\r\nEND:VCARD\r\n", name, email),
+		}},
+	}
+
+	c.ContactEmails = []pmapi.ContactEmail{{
+		ID:        s.newID("contact-email"),
+		Name:      name,
+		Email:     email,
+		Type:      []string{},
+		Defaults:  1,
+		ContactID: c.ID,
+		LabelIDs:  []string{},
+	}}
+
+	c.Size = int64(len(c.Cards[0].Data))
+	u.contacts = append(u.contacts, c)
+
+	return nil
+}
+
+func (s *Server) getContactEmails(w http.ResponseWriter, r *request, u *user) {
+	q := r.URL.Query()
+
+	emails := []pmapi.ContactEmail{}
+
+	for _, c := range u.contacts {
+		for _, email := range c.ContactEmails {
+			if q.Get("Email") == "" || strings.EqualFold(email.Email, q.Get("Email")) {
+				emails = append(emails, email)
+			}
+		}
+	}
+
+	total := len(emails)
+
+	page, _ := strconv.Atoi(q.Get("Page"))
+	pageSize, _ := strconv.Atoi(q.Get("PageSize"))
+
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+
+	if start := page * pageSize; start < len(emails) {
+		emails = emails[start:]
+	} else {
+		emails = emails[:0]
+	}
+
+	if len(emails) > pageSize {
+		emails = emails[:pageSize]
+	}
+
+	writeJSON(w, response{"ContactEmails": emails, "Total": total})
+}
+
+func (s *Server) getContact(w http.ResponseWriter, u *user, contactID string) {
+	for _, c := range u.contacts {
+		if c.ID == contactID {
+			writeJSON(w, response{"Contact": c})
+			return
+		}
+	}
+
+	writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Contact does not exist")
+}
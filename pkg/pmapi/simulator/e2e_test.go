@@ -0,0 +1,184 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	goIMAP "github.com/emersion/go-imap"
+	goIMAPBackend "github.com/emersion/go-imap/backend"
+	goSMTPBackend "github.com/emersion/go-smtp"
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/imap"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/smtp"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/store/cache"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+// TestEndToEnd runs the store, IMAP and SMTP backends of peroxide against
+// the simulator: the fixture user is added, the mailbox synced, the fixture
+// message fetched over IMAP and a message sent over SMTP.
+func TestEndToEnd(t *testing.T) { //nolint:funlen
+	r := require.New(t)
+
+	sim := New()
+
+	_, err := sim.AddFixtures(fixturesDir)
+	r.NoError(err)
+
+	_, err = sim.AddUser("alice", "alice-password", "alice@example.com")
+	r.NoError(err)
+
+	const fixtureUser, fixtureEmail = "jason", "jason@protonmail.com"
+
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	dir := t.TempDir()
+
+	r.NoError(ioutil.WriteFile(filepath.Join(dir, "peroxide.conf"), []byte(
+		"CacheEnabled: \"false\"\n"+
+			"CacheDir: "+dir+"\n"+
+			"CredentialsStore: "+filepath.Join(dir, "credentials.json")+"\n",
+	), 0o600))
+
+	settingsObj := settings.New(filepath.Join(dir, "peroxide.conf"))
+	eventListener := listener.New()
+
+	cfg := pmapi.NewConfig()
+	cfg.HostURL = server.URL
+	cm := pmapi.New(cfg)
+
+	messageCache, err := cache.LoadMessageCache(settingsObj)
+	r.NoError(err)
+
+	credStore, err := credentials.NewStore(settingsObj.Get(settings.CredentialsStore))
+	r.NoError(err)
+
+	storeFactory := store.NewStoreFactory(settingsObj, eventListener, messageCache, message.NewBuilder(2, 2))
+
+	u := users.New(eventListener, cm, credStore, storeFactory)
+	defer u.Close()
+
+	// Add the account the way peroxide-cfg does.
+	client, auth, err := u.Login(fixtureUser, []byte(FixturePassword))
+	r.NoError(err)
+
+	_, mainKey, err := u.FinishLogin(client, auth, []byte(FixturePassword), "")
+	r.NoError(err)
+
+	imapBackend := imap.NewIMAPBackend(eventListener, settingsObj, u, false, true)
+
+	// There is no IMAP server to send the updates to the clients.
+	go func() {
+		for update := range imapBackend.Updates() {
+			close(update.Done())
+		}
+	}()
+
+	imapUser, err := imapBackend.Login(nil, fixtureUser, mainKey)
+	r.NoError(err)
+
+	inbox, err := imapUser.GetMailbox("INBOX")
+	r.NoError(err)
+
+	r.Eventually(func() bool {
+		status, err := inbox.Status([]goIMAP.StatusItem{goIMAP.StatusMessages})
+		return err == nil && status.Messages == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	body := fetchBody(t, inbox, 1)
+	r.Contains(body, "Subject: Welcome to ProtonMail!")
+	r.Contains(body, "X-Mailer: CroutonMail")
+	r.Contains(body, "jeej saas")
+
+	// Send a message to the other user of the simulator.
+	smtpBackend := smtp.NewSMTPBackend(eventListener, u, false)
+	go smtpBackend.RunOutbox(storeFactory.OutboxReady())
+
+	session, err := smtpBackend.NewSession(nil)
+	r.NoError(err)
+
+	r.NoError(session.AuthPlain(fixtureUser, mainKey))
+	r.NoError(session.Mail(fixtureEmail, &goSMTPBackend.MailOptions{}))
+	r.NoError(session.Rcpt("alice@example.com", &goSMTPBackend.RcptOptions{}))
+	r.NoError(session.Data(strings.NewReader(
+		"From: " + fixtureEmail + "\r\n" +
+			"To: alice@example.com\r\n" +
+			"Subject: Lunch\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"Noon?\r\n",
+	)))
+
+	// The message arrives in the inbox of the recipient.
+	alice, _, err := cm.NewClientWithLogin(context.Background(), "alice", []byte("alice-password"))
+	r.NoError(err)
+
+	r.Eventually(func() bool {
+		msgs, _, err := alice.ListMessages(context.Background(), &pmapi.MessagesFilter{LabelID: pmapi.InboxLabel})
+		return err == nil && len(msgs) == 1 && msgs[0].Subject == "Lunch"
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// The sent message is synced back to the sender.
+	sent, err := imapUser.GetMailbox("Sent")
+	r.NoError(err)
+
+	r.Eventually(func() bool {
+		status, err := sent.Status([]goIMAP.StatusItem{goIMAP.StatusMessages})
+		return err == nil && status.Messages == 1
+	}, 10*time.Second, 50*time.Millisecond)
+
+	r.Contains(fetchBody(t, sent, 1), "Noon?")
+}
+
+// fetchBody returns the whole message with the given sequence number.
+func fetchBody(t *testing.T, mailbox goIMAPBackend.Mailbox, seqNum uint32) string {
+	section := &goIMAP.BodySectionName{Peek: true}
+
+	seqSet := new(goIMAP.SeqSet)
+	seqSet.AddNum(seqNum)
+
+	ch := make(chan *goIMAP.Message, 1)
+	require.NoError(t, mailbox.ListMessages(false, seqSet, []goIMAP.FetchItem{section.FetchItem()}, ch))
+
+	msg := <-ch
+	require.NotNil(t, msg)
+	require.Len(t, msg.Body, 1)
+
+	for _, literal := range msg.Body {
+		b, err := ioutil.ReadAll(literal)
+		require.NoError(t, err)
+
+		return string(b)
+	}
+
+	return ""
+}
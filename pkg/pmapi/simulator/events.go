@@ -0,0 +1,84 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"net/http"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+// event is a change of the state of a user. It is serialized the way
+// pmapi.Event reads it, with the keys of the addresses armored.
+type event struct {
+	Code          int
+	EventID       string
+	Refresh       int
+	More          pmapi.Boolean
+	Messages      []*pmapi.EventMessage
+	MessageCounts []*pmapi.MessagesCount
+	Labels        []*pmapi.EventLabel
+	Addresses     []*eventAddress
+}
+
+type eventAddress struct {
+	pmapi.EventItem
+	Address response
+}
+
+// pushEvent records the changes made by a request as the newest event of the
+// user.
+func (s *Server) pushEvent(u *user, ev *event) {
+	ev.Code = codeOK
+	ev.EventID = s.newID("event")
+
+	if len(ev.Messages) != 0 {
+		ev.MessageCounts = u.countMessages("")
+	}
+
+	u.events = append(u.events, ev)
+}
+
+// getEvent returns the event following the one with the given ID. Clients
+// which are too far behind are told to refresh.
+func (s *Server) getEvent(w http.ResponseWriter, u *user, eventID string) {
+	last := u.events[len(u.events)-1]
+
+	if eventID == "latest" {
+		encode(w, http.StatusOK, &event{Code: codeOK, EventID: last.EventID})
+		return
+	}
+
+	for i, ev := range u.events {
+		if ev.EventID != eventID {
+			continue
+		}
+
+		if i == len(u.events)-1 {
+			encode(w, http.StatusOK, &event{Code: codeOK, EventID: eventID})
+			return
+		}
+
+		next := *u.events[i+1]
+		next.More = pmapi.Boolean(i+2 < len(u.events))
+		encode(w, http.StatusOK, &next)
+		return
+	}
+
+	encode(w, http.StatusOK, &event{Code: codeOK, EventID: last.EventID, Refresh: pmapi.EventRefreshMail})
+}
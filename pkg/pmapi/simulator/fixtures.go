@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+// FixturePassword is the password of the user of the pmapi test fixtures in
+// pkg/pmapi/testdata; it locks the key of the fixtures.
+const FixturePassword = "apple"
+
+// readFixture decodes the response of the fixtures of the given route.
+func readFixture(dir, route string, v interface{}) error {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "routes", route, "get_response.json"))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// AddFixtures creates the user of the pmapi test fixtures found in dir,
+// normally pkg/pmapi/testdata, with the message of the fixtures in the inbox
+// and returns the ID of the user. The user has no key salt, so
+// FixturePassword is also the passphrase of the key.
+func (s *Server) AddFixtures(dir string) (string, error) {
+	armored, err := ioutil.ReadFile(filepath.Join(dir, "testPrivateKey"))
+	if err != nil {
+		return "", err
+	}
+
+	var userRes struct{ User struct{ Name string } }
+	if err := readFixture(dir, "users", &userRes); err != nil {
+		return "", errors.Wrap(err, "cannot read the user fixture")
+	}
+
+	var addressRes struct{ Addresses []struct{ Email string } }
+	if err := readFixture(dir, "addresses", &addressRes); err != nil {
+		return "", errors.Wrap(err, "cannot read the address fixtures")
+	}
+
+	var messageRes struct{ Message *pmapi.Message }
+	if err := readFixture(dir, "messages", &messageRes); err != nil {
+		return "", errors.Wrap(err, "cannot read the message fixture")
+	}
+
+	emails := make([]string, 0, len(addressRes.Addresses))
+	for _, addr := range addressRes.Addresses {
+		emails = append(emails, addr.Email)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	u, err := s.addUser(userRes.User.Name, FixturePassword, "", func(string) (*key, error) {
+		return s.armoredKey(string(armored))
+	}, emails...)
+	if err != nil {
+		return "", err
+	}
+
+	if m := messageRes.Message; m != nil {
+		if err := s.addFixtureMessage(u, m); err != nil {
+			return "", err
+		}
+	}
+
+	return u.id, nil
+}
+
+// addFixtureMessage puts the message of the fixtures in the inbox of the
+// first address. The attachments of the fixture have no data, so they are
+// left out.
+func (s *Server) addFixtureMessage(u *user, m *pmapi.Message) error {
+	addr := u.addresses[0]
+
+	m.ID = s.newID("message")
+	m.AddressID = addr.id
+	m.Attachments = nil
+	m.NumAttachments = 0
+	m.LabelIDs = []string{pmapi.AllMailLabel, pmapi.InboxLabel}
+	if len(m.ReplyTos) == 0 && m.Sender != nil {
+		m.ReplyTos = []*mail.Address{m.Sender}
+	}
+	if m.MIMEType == "" {
+		m.MIMEType = "text/html"
+	}
+
+	if err := m.Encrypt(addr.key.keyRing, nil); err != nil {
+		return err
+	}
+
+	m.Size = int64(len(m.Body))
+	u.messages[m.ID] = m
+
+	return nil
+}
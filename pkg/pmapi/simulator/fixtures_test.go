@@ -0,0 +1,76 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+const fixturesDir = "../testdata"
+
+func TestFixtureUser(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	sim, m, done := newTestManager(t)
+	defer done()
+
+	_, err := sim.AddFixtures(fixturesDir)
+	r.NoError(err)
+
+	var user struct{ User struct{ Name string } }
+	r.NoError(readFixture(fixturesDir, "users", &user))
+
+	var addresses struct{ Addresses []struct{ Email string } }
+	r.NoError(readFixture(fixturesDir, "addresses", &addresses))
+
+	var fixture struct{ Message *pmapi.Message }
+	r.NoError(readFixture(fixturesDir, "messages", &fixture))
+
+	c, _ := loginUser(t, m, user.User.Name, FixturePassword)
+	r.Len(c.Addresses().ActiveEmails(), len(addresses.Addresses))
+	r.Equal(addresses.Addresses[0].Email, c.Addresses().ActiveEmails()[0])
+
+	msgs, total, err := c.ListMessages(ctx, &pmapi.MessagesFilter{LabelID: pmapi.InboxLabel})
+	r.NoError(err)
+	r.Equal(1, total)
+	r.Equal(fixture.Message.Subject, msgs[0].Subject)
+
+	msg, err := c.GetMessage(ctx, msgs[0].ID)
+	r.NoError(err)
+	r.Equal("CroutonMail", msg.Header.Get("X-Mailer"))
+
+	kr, err := c.KeyRingForAddressID(msg.AddressID)
+	r.NoError(err)
+
+	body, err := msg.Decrypt(kr)
+	r.NoError(err)
+	r.Equal(fixture.Message.Body, string(body))
+
+	_, err = sim.AddFixtures(fixturesDir)
+	r.Error(err)
+}
+
+func TestFixturesMissing(t *testing.T) {
+	_, err := New().AddFixtures(t.TempDir())
+	require.Error(t, err)
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/emersion/go-message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+func (s *Server) importMessages(w http.ResponseWriter, r *request, u *user) {
+	if err := r.ParseMultipartForm(pmapi.MaxImportMessageRequestSize); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Invalid request body")
+		return
+	}
+
+	var metadata map[string]*pmapi.ImportMetadata
+	if values := r.MultipartForm.Value["Metadata"]; len(values) != 1 || json.Unmarshal([]byte(values[0]), &metadata) != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Invalid metadata")
+		return
+	}
+
+	names := make([]string, 0, len(r.MultipartForm.File))
+	for name := range r.MultipartForm.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ev := &event{}
+	responses := []response{}
+
+	for _, name := range names {
+		m, err := s.importMessage(u, metadata[name], r.MultipartForm.File[name][0])
+		if err != nil {
+			responses = append(responses, response{"Name": name, "Response": response{"Code": codeInvalidValue, "Error": err.Error()}})
+			continue
+		}
+
+		ev.Messages = append(ev.Messages, messageCreated(m))
+		responses = append(responses, response{"Name": name, "Response": response{"Code": codeOK, "MessageID": m.ID}})
+	}
+
+	if len(ev.Messages) != 0 {
+		s.pushEvent(u, ev)
+	}
+
+	writeJSON(w, response{"Code": codeMultiOK, "Responses": responses})
+}
+
+func (s *Server) importMessage(u *user, md *pmapi.ImportMetadata, fh *multipart.FileHeader) (*pmapi.Message, error) { //nolint:funlen
+	if md == nil {
+		return nil, errors.New("missing metadata")
+	}
+
+	addr := u.addressByID(md.AddressID)
+	if addr == nil {
+		return nil, errors.New("unknown address")
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	literal, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	m, atts, err := parseMessage(literal, addr.key.keyRing)
+	if err != nil {
+		return nil, err
+	}
+
+	m.ID = s.newID("message")
+	m.AddressID = addr.id
+	m.Unread = md.Unread
+	m.Flags = md.Flags | pmapi.FlagImported
+	m.Time = md.Time
+
+	if m.Time == 0 {
+		m.Time = time.Now().Unix()
+	}
+
+	for flag, set := range map[int64]pmapi.Boolean{
+		pmapi.FlagReplied:    md.IsReplied,
+		pmapi.FlagRepliedAll: md.IsRepliedAll,
+		pmapi.FlagForwarded:  md.IsForwarded,
+	} {
+		if set {
+			m.Flags |= flag
+		}
+	}
+
+	m.LabelIDs = []string{pmapi.AllMailLabel}
+
+	for _, labelID := range md.LabelIDs {
+		if !u.isLabel(labelID) {
+			return nil, errors.Errorf("unknown label %s", labelID)
+		}
+		m.LabelIDs = addLabel(m.LabelIDs, labelID)
+	}
+
+	switch {
+	case m.Flags&pmapi.FlagSent != 0:
+		m.LabelIDs = addLabel(m.LabelIDs, pmapi.AllSentLabel)
+	case m.IsDraft():
+		m.LabelIDs = addLabel(m.LabelIDs, pmapi.AllDraftsLabel)
+	}
+
+	m.Size = int64(len(m.Body))
+
+	for _, att := range atts {
+		att.ID = s.newID("attachment")
+		att.MessageID = m.ID
+
+		s.attachments[att.ID] = &storedAttachment{user: u, data: att.data}
+
+		m.Attachments = append(m.Attachments, att.Attachment)
+		m.Size += att.Size
+	}
+
+	m.NumAttachments = len(m.Attachments)
+	u.messages[m.ID] = m
+
+	return m, nil
+}
+
+// parsedAttachment is an attachment of a message with its data packet.
+type parsedAttachment struct {
+	*pmapi.Attachment
+	data []byte
+}
+
+// parseMessage splits a message whose parts are encrypted one by one into the
+// body and the attachments the way the API stores them. A message without a
+// text part gets an empty body encrypted with the keyring.
+func parseMessage(literal []byte, kr *crypto.KeyRing) (*pmapi.Message, []*parsedAttachment, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(literal))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &pmapi.Message{
+		Header:     msg.Header,
+		ToList:     addressList(msg.Header, "To"),
+		CCList:     addressList(msg.Header, "Cc"),
+		BCCList:    addressList(msg.Header, "Bcc"),
+		ReplyTos:   addressList(msg.Header, "Reply-To"),
+		ExternalID: strings.Trim(msg.Header.Get("Message-Id"), "<>"),
+	}
+
+	if m.Subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); err != nil {
+		m.Subject = msg.Header.Get("Subject")
+	}
+
+	if from := addressList(msg.Header, "From"); len(from) != 0 {
+		m.Sender = from[0]
+	}
+
+	ent, err := message.Read(bytes.NewReader(literal))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, nil, err
+	}
+
+	p := &parser{}
+	if err := p.walk(ent, false); err != nil {
+		return nil, nil, err
+	}
+
+	if p.body == "" {
+		enc, err := kr.Encrypt(crypto.NewPlainMessageFromString(""), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if p.body, err = enc.GetArmored(); err != nil {
+			return nil, nil, err
+		}
+
+		p.mimeType = "text/plain"
+	}
+
+	m.Body = p.body
+	m.MIMEType = p.mimeType
+
+	return m, p.attachments, nil
+}
+
+func addressList(header mail.Header, key string) []*mail.Address {
+	addrs, err := header.AddressList(key)
+	if err != nil {
+		return []*mail.Address{}
+	}
+	return addrs
+}
+
+type parser struct {
+	body        string
+	mimeType    string
+	alternative bool
+	attachments []*parsedAttachment
+}
+
+// walk looks for the body, which is the first text part or the last one of
+// an alternative, while taking the other parts as attachments.
+func (p *parser) walk(e *message.Entity, alternative bool) error {
+	contentType, params, _ := e.Header.ContentType()
+
+	// The sender encrypted the whole message, the API keeps it as is.
+	if contentType == "multipart/encrypted" {
+		return p.walkEncrypted(e)
+	}
+
+	if mr := e.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && !message.IsUnknownCharset(err) {
+				return err
+			}
+
+			if err := p.walk(part, contentType == "multipart/alternative"); err != nil {
+				return err
+			}
+		}
+	}
+
+	body, err := ioutil.ReadAll(e.Body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispParams, _ := e.Header.ContentDisposition()
+
+	isText := contentType == "text/plain" || contentType == "text/html"
+	if isText && disposition != pmapi.DispositionAttachment && (p.body == "" || (alternative && p.alternative)) {
+		p.body, p.mimeType, p.alternative = string(body), contentType, alternative
+		return nil
+	}
+
+	name := dispParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+
+	if disposition != pmapi.DispositionInline {
+		disposition = pmapi.DispositionAttachment
+	}
+
+	var enc *crypto.PGPMessage
+
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte(pmapi.MessageHeader)) {
+		if enc, err = crypto.NewPGPMessageFromArmored(string(body)); err != nil {
+			return err
+		}
+	} else {
+		enc = crypto.NewPGPMessage(body)
+	}
+
+	split, err := enc.SplitMessage()
+	if err != nil {
+		return errors.Wrapf(err, "attachment %q is not encrypted", name)
+	}
+
+	p.attachments = append(p.attachments, &parsedAttachment{
+		Attachment: &pmapi.Attachment{
+			Name:        name,
+			Size:        int64(len(split.DataPacket)),
+			MIMEType:    contentType,
+			ContentID:   strings.Trim(e.Header.Get("Content-Id"), "<>"),
+			Disposition: disposition,
+			KeyPackets:  base64.StdEncoding.EncodeToString(split.KeyPacket),
+			Header:      textproto.MIMEHeader{},
+		},
+		data: split.DataPacket,
+	})
+
+	return nil
+}
+
+// walkEncrypted takes the second part of a PGP/MIME message as the body.
+func (p *parser) walkEncrypted(e *message.Entity) error {
+	mr := e.MultipartReader()
+	if mr == nil {
+		return errors.New("invalid encrypted message")
+	}
+
+	for i := 0; i < 2; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			return errors.Wrap(err, "invalid encrypted message")
+		}
+
+		if i == 1 {
+			body, err := ioutil.ReadAll(part.Body)
+			if err != nil {
+				return err
+			}
+
+			p.body, p.mimeType = string(body), "multipart/mixed"
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+// systemFolders are the system labels a message can be in only one of.
+var systemFolders = map[string]bool{ //nolint:gochecknoglobals
+	pmapi.InboxLabel:   true,
+	pmapi.TrashLabel:   true,
+	pmapi.SpamLabel:    true,
+	pmapi.ArchiveLabel: true,
+	pmapi.SentLabel:    true,
+	pmapi.DraftLabel:   true,
+}
+
+func (u *user) labelByID(id string) *pmapi.Label {
+	for _, l := range u.labels {
+		if l.ID == id {
+			return l
+		}
+	}
+	return nil
+}
+
+func (u *user) labelByName(name string) *pmapi.Label {
+	for _, l := range u.labels {
+		if strings.EqualFold(l.Name, name) {
+			return l
+		}
+	}
+	return nil
+}
+
+func (u *user) isLabel(id string) bool {
+	return pmapi.IsSystemLabel(id) || u.labelByID(id) != nil
+}
+
+// isFolder returns whether the label is exclusive, i.e., a message can be in
+// only one such label.
+func (u *user) isFolder(id string) bool {
+	if l := u.labelByID(id); l != nil {
+		return bool(l.Exclusive)
+	}
+	return systemFolders[id]
+}
+
+// labelToAPI returns the label as the given version of the API serves it;
+// the first one tells the folders by the exclusive flag, the fourth one by
+// the type.
+func labelToAPI(l *pmapi.Label, v4 bool) *pmapi.Label {
+	res := *l
+	res.Type = pmapi.LabelTypeMailBox
+	if v4 && bool(l.Exclusive) {
+		res.Type = pmapi.LabelTypeV4Folder
+	}
+	return &res
+}
+
+func (s *Server) listLabels(w http.ResponseWriter, r *request, u *user, v4 bool) {
+	labelType, err := strconv.Atoi(r.URL.Query().Get("Type"))
+	if err != nil {
+		labelType = pmapi.LabelTypeMailBox
+	}
+
+	labels := []*pmapi.Label{}
+	for _, l := range u.labels {
+		res := labelToAPI(l, v4)
+		if res.Type == labelType {
+			labels = append(labels, res)
+		}
+	}
+
+	writeJSON(w, response{"Labels": labels})
+}
+
+func (s *Server) createLabel(w http.ResponseWriter, r *request, u *user, v4 bool) {
+	var req pmapi.Label
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if req.Name == "" {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "Label name is required")
+		return
+	}
+
+	if u.labelByName(req.Name) != nil {
+		writeError(w, http.StatusUnprocessableEntity, codeAlreadyExists, "A label or folder with this name already exists")
+		return
+	}
+
+	if v4 {
+		req.Exclusive = req.Type == pmapi.LabelTypeV4Folder
+	}
+
+	if req.Color == "" {
+		req.Color = pmapi.LabelColors[len(u.labels)%len(pmapi.LabelColors)]
+	}
+
+	l := &pmapi.Label{
+		ID:        s.newID("label"),
+		Name:      req.Name,
+		Path:      req.Name,
+		Color:     req.Color,
+		Order:     len(u.labels) + 1,
+		Exclusive: req.Exclusive,
+		Type:      pmapi.LabelTypeMailBox,
+		Notify:    req.Notify,
+	}
+	u.labels = append(u.labels, l)
+
+	s.pushEvent(u, &event{Labels: []*pmapi.EventLabel{{
+		EventItem: pmapi.EventItem{ID: l.ID, Action: pmapi.EventCreate},
+		Label:     labelToAPI(l, false),
+	}}})
+
+	writeJSON(w, response{"Label": labelToAPI(l, v4)})
+}
+
+func (s *Server) updateLabel(w http.ResponseWriter, r *request, u *user, labelID string, v4 bool) {
+	l := u.labelByID(labelID)
+	if l == nil {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Label does not exist")
+		return
+	}
+
+	var req pmapi.Label
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if other := u.labelByName(req.Name); req.Name == "" || (other != nil && other != l) {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "Invalid label name")
+		return
+	}
+
+	l.Name = req.Name
+	l.Path = req.Name
+	if req.Color != "" {
+		l.Color = req.Color
+	}
+
+	s.pushEvent(u, &event{Labels: []*pmapi.EventLabel{{
+		EventItem: pmapi.EventItem{ID: l.ID, Action: pmapi.EventUpdate},
+		Label:     labelToAPI(l, false),
+	}}})
+
+	writeJSON(w, response{"Label": labelToAPI(l, v4)})
+}
+
+func (s *Server) deleteLabel(w http.ResponseWriter, u *user, labelID string) {
+	ev := &event{}
+
+	for i, l := range u.labels {
+		if l.ID != labelID {
+			continue
+		}
+
+		u.labels = append(u.labels[:i], u.labels[i+1:]...)
+
+		for _, m := range u.sortedMessages() {
+			if m.HasLabelID(labelID) {
+				m.LabelIDs = removeLabel(m.LabelIDs, labelID)
+				ev.Messages = append(ev.Messages, messageUpdated(m))
+			}
+		}
+
+		ev.Labels = append(ev.Labels, &pmapi.EventLabel{
+			EventItem: pmapi.EventItem{ID: labelID, Action: pmapi.EventDelete},
+		})
+		s.pushEvent(u, ev)
+
+		writeJSON(w, response{})
+		return
+	}
+
+	writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Label does not exist")
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 150
+)
+
+// storedAttachment is the data packet of an attachment; the key packets are
+// part of the attachment metadata of each message.
+type storedAttachment struct {
+	user *user
+	data []byte
+}
+
+func (u *user) sortedMessages() []*pmapi.Message {
+	msgs := make([]*pmapi.Message, 0, len(u.messages))
+	for _, m := range u.messages {
+		msgs = append(msgs, m)
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+
+	return msgs
+}
+
+// metadata returns the message without the body and the attachments, the way
+// the message lists and the events carry it.
+func metadata(m *pmapi.Message) *pmapi.Message {
+	res := copyMessage(m)
+	res.Body = ""
+	res.Attachments = nil
+	return res
+}
+
+func copyMessage(m *pmapi.Message) *pmapi.Message {
+	res := *m
+	res.LabelIDs = append([]string{}, m.LabelIDs...)
+	res.Attachments = append([]*pmapi.Attachment{}, m.Attachments...)
+	return &res
+}
+
+func messageCreated(m *pmapi.Message) *pmapi.EventMessage {
+	return &pmapi.EventMessage{
+		EventItem: pmapi.EventItem{ID: m.ID, Action: pmapi.EventCreate},
+		Created:   metadata(m),
+	}
+}
+
+func messageUpdated(m *pmapi.Message) *pmapi.EventMessage {
+	m = metadata(m)
+
+	return &pmapi.EventMessage{
+		EventItem: pmapi.EventItem{ID: m.ID, Action: pmapi.EventUpdate},
+		Updated: &pmapi.EventMessageUpdated{
+			ID:       m.ID,
+			Subject:  &m.Subject,
+			Unread:   &m.Unread,
+			Flags:    &m.Flags,
+			Sender:   m.Sender,
+			ToList:   &m.ToList,
+			CCList:   &m.CCList,
+			BCCList:  &m.BCCList,
+			Time:     m.Time,
+			LabelIDs: m.LabelIDs,
+		},
+	}
+}
+
+func messageDeleted(messageID string) *pmapi.EventMessage {
+	return &pmapi.EventMessage{
+		EventItem: pmapi.EventItem{ID: messageID, Action: pmapi.EventDelete},
+	}
+}
+
+func addLabel(labelIDs []string, labelID string) []string {
+	for _, id := range labelIDs {
+		if id == labelID {
+			return labelIDs
+		}
+	}
+	return append(labelIDs, labelID)
+}
+
+func removeLabel(labelIDs []string, labelID string) []string {
+	res := []string{}
+	for _, id := range labelIDs {
+		if id != labelID {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// filterMessages returns the messages matching the query of the message
+// list, sorted the way it asks for.
+func (u *user) filterMessages(q url.Values) []*pmapi.Message { //nolint:gocyclo
+	ids := make(map[string]bool)
+	for _, id := range q["ID[]"] {
+		ids[id] = true
+	}
+
+	begin, _ := strconv.ParseInt(q.Get("Begin"), 10, 64)
+	end, _ := strconv.ParseInt(q.Get("End"), 10, 64)
+
+	var msgs []*pmapi.Message
+
+	for _, m := range u.sortedMessages() {
+		switch {
+		case q.Get("LabelID") != "" && !m.HasLabelID(q.Get("LabelID")),
+			q.Get("AddressID") != "" && m.AddressID != q.Get("AddressID"),
+			q.Get("BeginID") != "" && m.ID < q.Get("BeginID"),
+			q.Get("EndID") != "" && m.ID > q.Get("EndID"),
+			begin != 0 && m.Time < begin,
+			end != 0 && m.Time > end,
+			len(ids) != 0 && !ids[m.ID],
+			q.Get("Unread") != "" && bool(m.Unread) != (q.Get("Unread") == "1"),
+			q.Get("ExternalID") != "" && m.ExternalID != q.Get("ExternalID"),
+			q.Get("Subject") != "" && !strings.Contains(strings.ToLower(m.Subject), strings.ToLower(q.Get("Subject"))):
+			continue
+		}
+
+		msgs = append(msgs, m)
+	}
+
+	less := func(i, j int) bool {
+		if msgs[i].Time != msgs[j].Time {
+			return msgs[i].Time < msgs[j].Time
+		}
+		return msgs[i].ID < msgs[j].ID
+	}
+
+	if q.Get("Sort") == "ID" {
+		less = func(i, j int) bool { return msgs[i].ID < msgs[j].ID }
+	}
+
+	// The newest messages come first unless asked otherwise.
+	if q.Get("Desc") != "0" {
+		sort.SliceStable(msgs, func(i, j int) bool { return less(j, i) })
+	} else {
+		sort.SliceStable(msgs, less)
+	}
+
+	return msgs
+}
+
+func (s *Server) listMessages(w http.ResponseWriter, r *request, u *user) {
+	q := r.URL.Query()
+	msgs := u.filterMessages(q)
+	total := len(msgs)
+
+	page, _ := strconv.Atoi(q.Get("Page"))
+	pageSize, _ := strconv.Atoi(q.Get("PageSize"))
+	if pageSize <= 0 || pageSize > maxPageSize {
+		pageSize = defaultPageSize
+	}
+
+	first := page * pageSize
+	if first > len(msgs) {
+		first = len(msgs)
+	}
+
+	last := first + pageSize
+	if last > len(msgs) {
+		last = len(msgs)
+	}
+
+	if limit, _ := strconv.Atoi(q.Get("Limit")); limit > 0 && last-first > limit {
+		last = first + limit
+	}
+
+	res := make([]*pmapi.Message, 0, last-first)
+	for _, m := range msgs[first:last] {
+		res = append(res, metadata(m))
+	}
+
+	writeJSON(w, response{"Messages": res, "Total": total})
+}
+
+// countMessages returns the number of all and unread messages in each label
+// of the given address or all of them.
+func (u *user) countMessages(addressID string) []*pmapi.MessagesCount {
+	counts := make(map[string]*pmapi.MessagesCount)
+
+	labelIDs := []string{
+		pmapi.InboxLabel, pmapi.AllDraftsLabel, pmapi.AllSentLabel, pmapi.TrashLabel, pmapi.SpamLabel,
+		pmapi.AllMailLabel, pmapi.ArchiveLabel, pmapi.SentLabel, pmapi.DraftLabel, pmapi.StarredLabel,
+		pmapi.ScheduledLabel,
+	}
+	for _, l := range u.labels {
+		labelIDs = append(labelIDs, l.ID)
+	}
+
+	res := make([]*pmapi.MessagesCount, 0, len(labelIDs))
+	for _, labelID := range labelIDs {
+		counts[labelID] = &pmapi.MessagesCount{LabelID: labelID}
+		res = append(res, counts[labelID])
+	}
+
+	for _, m := range u.messages {
+		if addressID != "" && m.AddressID != addressID {
+			continue
+		}
+
+		for _, labelID := range m.LabelIDs {
+			if count, ok := counts[labelID]; ok {
+				count.Total++
+				if m.Unread {
+					count.Unread++
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+func (s *Server) countMessages(w http.ResponseWriter, r *request, u *user) {
+	writeJSON(w, response{"Counts": u.countMessages(r.URL.Query().Get("AddressID"))})
+}
+
+func (s *Server) getMessage(w http.ResponseWriter, u *user, messageID string) {
+	m, ok := u.messages[messageID]
+	if !ok {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Message does not exist")
+		return
+	}
+
+	writeJSON(w, response{"Message": copyMessage(m)})
+}
+
+func (s *Server) messagesAction(w http.ResponseWriter, r *request, u *user, action string) { //nolint:funlen
+	var req struct {
+		LabelID string
+		IDs     []string
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if (action == "label" || action == "unlabel") && !u.isLabel(req.LabelID) {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Label does not exist")
+		return
+	}
+
+	var apply func(m *pmapi.Message) bool
+
+	switch action {
+	case "read", "unread":
+		unread := pmapi.Boolean(action == "unread")
+		apply = func(m *pmapi.Message) bool {
+			m.Unread = unread
+			return true
+		}
+
+	case "label":
+		apply = func(m *pmapi.Message) bool {
+			if u.isFolder(req.LabelID) {
+				for _, labelID := range m.LabelIDs {
+					if u.isFolder(labelID) {
+						m.LabelIDs = removeLabel(m.LabelIDs, labelID)
+					}
+				}
+			}
+			m.LabelIDs = addLabel(m.LabelIDs, req.LabelID)
+			return true
+		}
+
+	case "unlabel":
+		apply = func(m *pmapi.Message) bool {
+			m.LabelIDs = removeLabel(m.LabelIDs, req.LabelID)
+			return true
+		}
+
+	case "delete":
+		apply = func(m *pmapi.Message) bool {
+			s.deleteMessage(u, m)
+			return false
+		}
+
+	case "undelete":
+		apply = func(m *pmapi.Message) bool { return false }
+
+	default:
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+		return
+	}
+
+	ev := &event{}
+	responses := []response{}
+
+	for _, id := range req.IDs {
+		m, ok := u.messages[id]
+		if !ok {
+			responses = append(responses, response{"ID": id, "Response": response{"Code": codeNotFound, "Error": "Message does not exist"}})
+			continue
+		}
+
+		if apply(m) {
+			ev.Messages = append(ev.Messages, messageUpdated(m))
+		} else if _, ok := u.messages[id]; !ok {
+			ev.Messages = append(ev.Messages, messageDeleted(id))
+		}
+
+		responses = append(responses, response{"ID": id, "Response": response{"Code": codeOK}})
+	}
+
+	if len(ev.Messages) != 0 {
+		s.pushEvent(u, ev)
+	}
+
+	writeJSON(w, response{"Code": codeMultiOK, "Responses": responses})
+}
+
+func (s *Server) deleteMessage(u *user, m *pmapi.Message) {
+	for _, att := range m.Attachments {
+		delete(s.attachments, att.ID)
+	}
+
+	delete(u.messages, m.ID)
+	delete(u.drafts, m.ID)
+}
+
+func (s *Server) emptyFolder(w http.ResponseWriter, r *request, u *user) {
+	q := r.URL.Query()
+
+	if !u.isLabel(q.Get("LabelID")) {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Label does not exist")
+		return
+	}
+
+	ev := &event{}
+
+	for _, m := range u.sortedMessages() {
+		if !m.HasLabelID(q.Get("LabelID")) || (q.Get("AddressID") != "" && m.AddressID != q.Get("AddressID")) {
+			continue
+		}
+
+		s.deleteMessage(u, m)
+		ev.Messages = append(ev.Messages, messageDeleted(m.ID))
+	}
+
+	if len(ev.Messages) != 0 {
+		s.pushEvent(u, ev)
+	}
+
+	writeJSON(w, response{})
+}
+
+func (s *Server) getAttachment(w http.ResponseWriter, u *user, attachmentID string) {
+	att, ok := s.attachments[attachmentID]
+	if !ok || att.user != u {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Attachment does not exist")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(att.data); err != nil {
+		log.WithError(err).Warn("Failed to write the attachment")
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+// draft remembers what a draft answers to until it is sent.
+type draft struct {
+	parentID string
+	action   int
+}
+
+// delivery is a sent message on its way to a recipient of the simulator.
+type delivery struct {
+	user        *user
+	message     *pmapi.Message
+	attachments []*parsedAttachment
+}
+
+func (s *Server) createDraft(w http.ResponseWriter, r *request, u *user) {
+	var req pmapi.DraftReq
+	if !decode(w, r, &req) {
+		return
+	}
+
+	m := req.Message
+	if m == nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Missing message")
+		return
+	}
+
+	addr := u.addressByID(m.AddressID)
+	if addr == nil {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "Invalid address")
+		return
+	}
+
+	if req.ParentID != "" && u.messages[req.ParentID] == nil {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Parent message does not exist")
+		return
+	}
+
+	m.ID = s.newID("message")
+	m.Flags &^= pmapi.FlagReceived | pmapi.FlagSent
+	m.Unread = false
+	m.Time = time.Now().Unix()
+	m.LabelIDs = []string{pmapi.AllDraftsLabel, pmapi.AllMailLabel, pmapi.DraftLabel}
+	m.Attachments = nil
+	m.NumAttachments = 0
+	m.Size = int64(len(m.Body))
+
+	if m.Sender == nil {
+		m.Sender = &mail.Address{Address: addr.email}
+	}
+
+	for _, list := range []*[]*mail.Address{&m.ToList, &m.CCList, &m.BCCList, &m.ReplyTos} {
+		if *list == nil {
+			*list = []*mail.Address{}
+		}
+	}
+
+	u.messages[m.ID] = m
+	u.drafts[m.ID] = &draft{parentID: req.ParentID, action: req.Action}
+
+	s.pushEvent(u, &event{Messages: []*pmapi.EventMessage{messageCreated(m)}})
+
+	writeJSON(w, response{"Message": m})
+}
+
+func (s *Server) createAttachment(w http.ResponseWriter, r *request, u *user) {
+	if err := r.ParseMultipartForm(maxUpload); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Invalid request body")
+		return
+	}
+
+	m := u.messages[r.FormValue("MessageID")]
+	if m == nil || u.drafts[m.ID] == nil {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Draft does not exist")
+		return
+	}
+
+	f, _, err := r.FormFile("DataPacket")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Missing data packet")
+		return
+	}
+	defer f.Close() //nolint:errcheck
+
+	packets, err := ioutil.ReadAll(f)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Invalid data packet")
+		return
+	}
+
+	split, err := crypto.NewPGPMessage(packets).SplitMessage()
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "Attachment is not encrypted")
+		return
+	}
+
+	att := &pmapi.Attachment{
+		ID:          s.newID("attachment"),
+		MessageID:   m.ID,
+		Name:        r.FormValue("Filename"),
+		Size:        int64(len(split.DataPacket)),
+		MIMEType:    r.FormValue("MIMEType"),
+		ContentID:   r.FormValue("ContentID"),
+		Disposition: pmapi.DispositionAttachment,
+		KeyPackets:  base64.StdEncoding.EncodeToString(split.KeyPacket),
+		Header:      textproto.MIMEHeader{},
+	}
+
+	if att.ContentID != "" {
+		att.Disposition = pmapi.DispositionInline
+	}
+
+	s.attachments[att.ID] = &storedAttachment{user: u, data: split.DataPacket}
+
+	m.Attachments = append(m.Attachments, att)
+	m.NumAttachments = len(m.Attachments)
+	m.Size += att.Size
+
+	s.pushEvent(u, &event{Messages: []*pmapi.EventMessage{messageUpdated(m)}})
+
+	writeJSON(w, response{"Attachment": att})
+}
+
+// sendMessage delivers the draft to the recipients who live in the
+// simulator; the packages of the others are dropped. Scheduled messages stay
+// scheduled since the simulator does not run the clock.
+func (s *Server) sendMessage(w http.ResponseWriter, r *request, u *user, messageID string) { //nolint:funlen
+	m, d := u.messages[messageID], u.drafts[messageID]
+	if m == nil || d == nil {
+		writeError(w, http.StatusUnprocessableEntity, codeNotFound, "Draft does not exist")
+		return
+	}
+
+	var req pmapi.SendMessageReq
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if len(req.Packages) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "Missing packages")
+		return
+	}
+
+	now := time.Now().Unix()
+	scheduled := req.DeliveryTime > now
+
+	// The API stamps the message on its way out.
+	if m.ExternalID == "" {
+		m.ExternalID = s.newToken() + "@" + domain(u.addressByID(m.AddressID).email)
+	}
+
+	m.Header = make(mail.Header)
+	m.Header["Date"] = []string{time.Unix(now, 0).UTC().Format(time.RFC1123Z)}
+	m.Header["Message-Id"] = []string{"<" + m.ExternalID + ">"}
+
+	var deliveries []*delivery
+
+	for _, pkg := range req.Packages {
+		for email, msgAddr := range pkg.Addresses {
+			rcpt, addr := s.addressByEmail(email)
+			if addr == nil {
+				log.WithField("recipient", email).Info("Dropping the package of an external recipient")
+				continue
+			}
+
+			if scheduled {
+				continue
+			}
+
+			dlv, err := s.newDelivery(m, pkg, msgAddr, addr)
+			if err != nil {
+				writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, err.Error())
+				return
+			}
+
+			dlv.user = rcpt
+			deliveries = append(deliveries, dlv)
+		}
+	}
+
+	delete(u.drafts, m.ID)
+
+	m.Flags |= pmapi.FlagSent
+	m.Time = now
+	m.LabelIDs = removeLabel(removeLabel(m.LabelIDs, pmapi.AllDraftsLabel), pmapi.DraftLabel)
+	m.LabelIDs = addLabel(m.LabelIDs, pmapi.AllSentLabel)
+
+	if scheduled {
+		m.Time = req.DeliveryTime
+		m.LabelIDs = addLabel(m.LabelIDs, pmapi.ScheduledLabel)
+	} else {
+		m.LabelIDs = addLabel(m.LabelIDs, pmapi.SentLabel)
+	}
+
+	switch {
+	case req.ExpirationTime != 0:
+		m.ExpirationTime = req.ExpirationTime
+	case req.ExpiresIn != 0:
+		m.ExpirationTime = now + req.ExpiresIn
+	}
+
+	ev := &event{Messages: []*pmapi.EventMessage{messageUpdated(m)}}
+
+	var parent *pmapi.Message
+
+	if parent = u.messages[d.parentID]; parent != nil {
+		switch d.action {
+		case pmapi.DraftActionReply:
+			parent.Flags |= pmapi.FlagReplied
+		case pmapi.DraftActionReplyAll:
+			parent.Flags |= pmapi.FlagRepliedAll
+		case pmapi.DraftActionForward:
+			parent.Flags |= pmapi.FlagForwarded
+		}
+
+		ev.Messages = append(ev.Messages, messageUpdated(parent))
+	}
+
+	s.pushEvent(u, ev)
+
+	for _, dlv := range deliveries {
+		s.deliver(dlv)
+	}
+
+	writeJSON(w, response{"Sent": m, "Parent": parent})
+}
+
+func domain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
+
+// newDelivery builds the message received from the package by the address.
+func (s *Server) newDelivery(
+	m *pmapi.Message,
+	pkg *pmapi.MessagePackage,
+	msgAddr *pmapi.MessageAddress,
+	addr *address,
+) (*delivery, error) {
+	kr := addr.key.keyRing
+
+	dataPacket, err := base64.StdEncoding.DecodeString(pkg.EncryptedBody)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid body")
+	}
+
+	keyPacket, err := packageKey(kr, msgAddr.EncryptedBodyKeyPacket, pkg.DecryptedBodyKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid body key")
+	}
+
+	body, err := crypto.NewPGPSplitMessage(keyPacket, dataPacket).GetPGPMessage().GetArmored()
+	if err != nil {
+		return nil, err
+	}
+
+	received := copyMessage(m)
+	received.AddressID = addr.id
+	received.Body = body
+	received.MIMEType = pkg.MIMEType
+	received.BCCList = []*mail.Address{}
+	received.Attachments = nil
+	received.Size = int64(len(body))
+
+	dlv := &delivery{message: received}
+
+	// A MIME body carries the attachments with it.
+	if pkg.MIMEType == pmapi.ContentTypeMultipartMixed {
+		return dlv, nil
+	}
+
+	for _, att := range m.Attachments {
+		var attKey *pmapi.AlgoKey
+		if key, ok := pkg.DecryptedAttachmentKeys[att.ID]; ok {
+			attKey = &key
+		}
+
+		keyPacket, err := packageKey(kr, msgAddr.EncryptedAttachmentKeyPackets[att.ID], attKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key of attachment %s", att.ID)
+		}
+
+		copied := *att
+		copied.KeyPackets = base64.StdEncoding.EncodeToString(keyPacket)
+
+		dlv.attachments = append(dlv.attachments, &parsedAttachment{
+			Attachment: &copied,
+			data:       s.attachments[att.ID].data,
+		})
+	}
+
+	return dlv, nil
+}
+
+// packageKey returns the key packet of the recipient, which the sender
+// either encrypted or left to the API to encrypt.
+func packageKey(kr *crypto.KeyRing, encrypted string, decrypted *pmapi.AlgoKey) ([]byte, error) {
+	if encrypted != "" {
+		return base64.StdEncoding.DecodeString(encrypted)
+	}
+
+	if decrypted == nil {
+		return nil, errors.New("missing key")
+	}
+
+	token, err := base64.StdEncoding.DecodeString(decrypted.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return kr.EncryptSessionKey(crypto.NewSessionKeyFromToken(token, decrypted.Algorithm))
+}
+
+func (s *Server) deliver(dlv *delivery) {
+	m := dlv.message
+
+	m.ID = s.newID("message")
+	m.Flags = pmapi.FlagReceived | pmapi.FlagInternal | pmapi.FlagE2E
+	m.Unread = true
+	m.Time = time.Now().Unix()
+	m.LabelIDs = []string{pmapi.InboxLabel, pmapi.AllMailLabel}
+
+	for _, att := range dlv.attachments {
+		att.ID = s.newID("attachment")
+		att.MessageID = m.ID
+
+		s.attachments[att.ID] = &storedAttachment{user: dlv.user, data: att.data}
+
+		m.Attachments = append(m.Attachments, att.Attachment)
+		m.Size += att.Size
+	}
+
+	m.NumAttachments = len(m.Attachments)
+	dlv.user.messages[m.ID] = m
+
+	s.pushEvent(dlv.user, &event{Messages: []*pmapi.EventMessage{messageCreated(m)}})
+}
+
+func (s *Server) cancelSend(w http.ResponseWriter, u *user, messageID string) {
+	m := u.messages[messageID]
+	if m == nil || !m.HasLabelID(pmapi.ScheduledLabel) {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "Message is not scheduled")
+		return
+	}
+
+	m.Flags &^= pmapi.FlagSent
+	m.LabelIDs = removeLabel(removeLabel(m.LabelIDs, pmapi.ScheduledLabel), pmapi.AllSentLabel)
+	m.LabelIDs = addLabel(addLabel(m.LabelIDs, pmapi.AllDraftsLabel), pmapi.DraftLabel)
+
+	u.drafts[m.ID] = &draft{}
+
+	s.pushEvent(u, &event{Messages: []*pmapi.EventMessage{messageUpdated(m)}})
+
+	writeJSON(w, response{})
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package simulator implements an in-memory stand-in for the ProtonMail API.
+// It speaks the subset of the API used by pmapi well enough to run peroxide
+// end-to-end without a real account.
+package simulator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("pkg", "simulator") //nolint:gochecknoglobals
+
+// Error codes of the API.
+const (
+	codeOK               = 1000
+	codeMultiOK          = 1001
+	codeInvalidValue     = 2001
+	codeAlreadyExists    = 2500
+	codeNotFound         = 2501
+	codePasswordWrong    = 8002
+	codeInvalidRefresh   = 10013
+	codeUnauthorizedUser = 401
+)
+
+// Server is an in-memory ProtonMail API. Its state lives as long as the
+// server does.
+type Server struct {
+	lock sync.Mutex
+
+	users       map[string]*user
+	logins      map[string]*login
+	sessions    map[string]*session
+	attachments map[string]*storedAttachment
+	lastID      int
+
+	// now returns the current time; tests replace it.
+	now func() time.Time
+}
+
+// New creates a server without users; they are added with AddUser and
+// AddFixtures.
+func New() *Server {
+	s := &Server{
+		users:       make(map[string]*user),
+		logins:      make(map[string]*login),
+		sessions:    make(map[string]*session),
+		attachments: make(map[string]*storedAttachment),
+		now:         time.Now,
+	}
+
+	return s
+}
+
+// newID returns a new ID of the given kind. The IDs of the same kind sort in
+// the order they were created, which the message sync relies on.
+func (s *Server) newID(kind string) string {
+	s.lastID++
+	return fmt.Sprintf("%s-%08d", kind, s.lastID)
+}
+
+// response is the body of a successful response; the code is added when the
+// response is written.
+type response map[string]interface{}
+
+type request struct {
+	*http.Request
+	path []string
+}
+
+func (r *request) route(method string, prefix ...string) bool {
+	if r.Method != method || len(r.path) != len(prefix) {
+		return false
+	}
+	for i, p := range prefix {
+		if p != "" && r.path[i] != p {
+			return false
+		}
+	}
+	return true
+}
+
+// ServeHTTP routes the requests. The auth routes are open, the others need
+// a session:
+//
+//	GET    /tests/ping
+//	POST   /auth/info
+//	POST   /auth
+//	POST   /auth/refresh
+//	GET    /auth/modulus
+//	DELETE /auth
+//	POST   /auth/2fa
+//	GET    /users
+//	GET    /keys
+//	GET    /keys/salts
+//	GET    /addresses
+//	PUT    /addresses/order
+//	GET    /events/{id}
+//	GET    /labels
+//	POST   /labels
+//	PUT    /labels/{id}
+//	DELETE /labels/{id}
+//	GET    /core/v4/labels
+//	POST   /core/v4/labels
+//	PUT    /core/v4/labels/{id}
+//	DELETE /core/v4/labels/{id}
+//	GET    /mail/v4/settings
+//	GET    /mail/v4/messages
+//	GET    /mail/v4/messages/count
+//	GET    /mail/v4/messages/{id}
+//	POST   /mail/v4/messages
+//	POST   /mail/v4/messages/import
+//	POST   /mail/v4/messages/{id}
+//	PUT    /mail/v4/messages/{read,unread,delete,undelete,label,unlabel}
+//	PUT    /mail/v4/messages/{id}/cancel_send
+//	DELETE /mail/v4/messages/empty
+//	GET    /mail/v4/attachments/{id}
+//	POST   /mail/v4/attachments
+//	GET    /contacts/v4/emails
+//	GET    /contacts/v4/{id}
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	log.WithField("method", r.Method).WithField("path", r.URL.Path).Debug("Request")
+
+	req := &request{Request: r, path: strings.Split(strings.Trim(r.URL.Path, "/"), "/")}
+
+	switch {
+	case req.route(http.MethodGet, "tests", "ping"):
+		writeJSON(w, response{})
+	case req.route(http.MethodPost, "auth", "info"):
+		s.authInfo(w, req)
+	case req.route(http.MethodPost, "auth"):
+		s.auth(w, req)
+	case req.route(http.MethodPost, "auth", "refresh"):
+		s.authRefresh(w, req)
+	case req.route(http.MethodGet, "auth", "modulus"):
+		writeJSON(w, response{"Modulus": signedModulus, "ModulusID": modulusID})
+	default:
+		sess := s.authorize(r)
+		if sess == nil {
+			writeError(w, http.StatusUnauthorized, codeUnauthorizedUser, "Invalid access token")
+			return
+		}
+		s.serveUser(w, req, sess)
+	}
+}
+
+func (s *Server) serveUser(w http.ResponseWriter, req *request, sess *session) { //nolint:funlen,gocyclo
+	u := sess.user
+	path := req.path
+
+	switch {
+	case req.route(http.MethodDelete, "auth"):
+		delete(s.sessions, sess.uid)
+		writeJSON(w, response{})
+	case req.route(http.MethodPost, "auth", "2fa"):
+		writeJSON(w, response{})
+	case req.route(http.MethodGet, "users"):
+		writeJSON(w, response{"User": u.toAPI()})
+	case req.route(http.MethodGet, "keys"):
+		s.getPublicKeys(w, req)
+	case req.route(http.MethodGet, "keys", "salts"):
+		writeJSON(w, response{"KeySalts": []response{{"ID": u.key.id, "KeySalt": u.keySalt}}})
+	case req.route(http.MethodGet, "addresses"):
+		writeJSON(w, response{"Addresses": u.addressesToAPI()})
+	case req.route(http.MethodPut, "addresses", "order"):
+		s.reorderAddresses(w, req, u)
+	case req.route(http.MethodGet, "events", ""):
+		s.getEvent(w, u, path[1])
+
+	case req.route(http.MethodGet, "labels"):
+		s.listLabels(w, req, u, false)
+	case req.route(http.MethodPost, "labels"):
+		s.createLabel(w, req, u, false)
+	case req.route(http.MethodPut, "labels", ""):
+		s.updateLabel(w, req, u, path[1], false)
+	case req.route(http.MethodDelete, "labels", ""):
+		s.deleteLabel(w, u, path[1])
+	case req.route(http.MethodGet, "core", "v4", "labels"):
+		s.listLabels(w, req, u, true)
+	case req.route(http.MethodPost, "core", "v4", "labels"):
+		s.createLabel(w, req, u, true)
+	case req.route(http.MethodPut, "core", "v4", "labels", ""):
+		s.updateLabel(w, req, u, path[3], true)
+	case req.route(http.MethodDelete, "core", "v4", "labels", ""):
+		s.deleteLabel(w, u, path[3])
+
+	case req.route(http.MethodGet, "mail", "v4", "settings"):
+		writeJSON(w, response{"MailSettings": u.settings})
+	case req.route(http.MethodGet, "mail", "v4", "messages"):
+		s.listMessages(w, req, u)
+	case req.route(http.MethodGet, "mail", "v4", "messages", "count"):
+		s.countMessages(w, req, u)
+	case req.route(http.MethodGet, "mail", "v4", "messages", ""):
+		s.getMessage(w, u, path[3])
+	case req.route(http.MethodPost, "mail", "v4", "messages"):
+		s.createDraft(w, req, u)
+	case req.route(http.MethodPost, "mail", "v4", "messages", "import"):
+		s.importMessages(w, req, u)
+	case req.route(http.MethodPost, "mail", "v4", "messages", ""):
+		s.sendMessage(w, req, u, path[3])
+	case req.route(http.MethodPut, "mail", "v4", "messages", ""):
+		s.messagesAction(w, req, u, path[3])
+	case req.route(http.MethodPut, "mail", "v4", "messages", "", "cancel_send"):
+		s.cancelSend(w, u, path[3])
+	case req.route(http.MethodDelete, "mail", "v4", "messages", "empty"):
+		s.emptyFolder(w, req, u)
+	case req.route(http.MethodGet, "mail", "v4", "attachments", ""):
+		s.getAttachment(w, u, path[3])
+	case req.route(http.MethodPost, "mail", "v4", "attachments"):
+		s.createAttachment(w, req, u)
+
+	case req.route(http.MethodGet, "contacts", "v4", "emails"):
+		s.getContactEmails(w, req, u)
+	case req.route(http.MethodGet, "contacts", "v4", ""):
+		s.getContact(w, u, path[2])
+
+	default:
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+	}
+}
+
+func (s *Server) newToken() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func decode(w http.ResponseWriter, r *request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidValue, "Invalid request body")
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, res response) {
+	if _, ok := res["Code"]; !ok {
+		res["Code"] = codeOK
+	}
+
+	encode(w, http.StatusOK, res)
+}
+
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	encode(w, status, response{"Code": code, "Error": message})
+}
+
+func encode(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Failed to write the response")
+	}
+}
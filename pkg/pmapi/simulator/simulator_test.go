@@ -0,0 +1,349 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+const testLiteral = "From: Bob <bob@example.com>\r\n" +
+	"To: Alice <alice@example.com>\r\n" +
+	"Subject: =?UTF-8?Q?Hello_th=C3=A9re?=\r\n" +
+	"Message-Id: <first@example.com>\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello Alice\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=data.bin\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAECAw==\r\n" +
+	"--b--\r\n"
+
+func newTestManager(t *testing.T) (*Server, pmapi.Manager, func()) {
+	sim := New()
+
+	_, err := sim.AddUser("alice", "alice-password", "alice@example.com")
+	require.NoError(t, err)
+
+	_, err = sim.AddUser("bob", "bob-password", "bob@example.com", "robert@example.com")
+	require.NoError(t, err)
+
+	server := httptest.NewServer(sim)
+
+	cfg := pmapi.NewConfig()
+	cfg.HostURL = server.URL
+
+	return sim, pmapi.New(cfg), server.Close
+}
+
+func loginUser(t *testing.T, m pmapi.Manager, name, password string) (pmapi.Client, *pmapi.Auth) {
+	ctx := context.Background()
+
+	c, auth, err := m.NewClientWithLogin(ctx, name, []byte(password))
+	require.NoError(t, err)
+
+	salt, err := c.AuthSalt(ctx)
+	require.NoError(t, err)
+
+	passphrase, err := pmapi.HashMailboxPassword([]byte(password), salt)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Unlock(ctx, passphrase))
+
+	return c, auth
+}
+
+func TestLogin(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	_, m, done := newTestManager(t)
+	defer done()
+
+	_, _, err := m.NewClientWithLogin(ctx, "alice", []byte("bob-password"))
+	r.Equal(pmapi.ErrPasswordWrong, err)
+
+	c, auth := loginUser(t, m, "robert@example.com", "bob-password")
+
+	user, err := c.CurrentUser(ctx)
+	r.NoError(err)
+	r.Equal("bob", user.Name)
+	r.Equal([]string{"bob@example.com", "robert@example.com"}, c.Addresses().ActiveEmails())
+
+	_, refresh, err := m.NewClientWithRefresh(ctx, auth.UID, auth.RefreshToken)
+	r.NoError(err)
+	r.NotEqual(auth.RefreshToken, refresh.RefreshToken)
+
+	_, _, err = m.NewClientWithRefresh(ctx, auth.UID, auth.RefreshToken)
+	r.True(pmapi.IsFailedAuth(err))
+}
+
+func TestLoginExpires(t *testing.T) {
+	r := require.New(t)
+
+	sim := New()
+	_, err := sim.AddFixtures(fixturesDir)
+	r.NoError(err)
+
+	now := time.Now()
+	sim.now = func() time.Time { return now }
+
+	authInfo := func() string {
+		w := httptest.NewRecorder()
+		sim.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth/info", strings.NewReader(`{"Username":"jason"}`)))
+		r.Equal(http.StatusOK, w.Code)
+
+		var res struct{ SRPSession string }
+		r.NoError(json.NewDecoder(w.Body).Decode(&res))
+
+		return res.SRPSession
+	}
+
+	stale := authInfo()
+
+	// The exchanges which are never finished are forgotten.
+	now = now.Add(loginLifetime)
+	id := authInfo()
+	r.Len(sim.logins, 1)
+	r.NotContains(sim.logins, stale)
+
+	// An exchange cannot be finished once it has expired.
+	now = now.Add(loginLifetime)
+
+	w := httptest.NewRecorder()
+	sim.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(`{"Username":"jason","SRPSession":"`+id+`"}`)))
+	r.Equal(http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestLabels(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	_, m, done := newTestManager(t)
+	defer done()
+
+	c, _ := loginUser(t, m, "alice", "alice-password")
+
+	latest, err := c.GetEvent(ctx, "")
+	r.NoError(err)
+
+	folder, err := c.CreateLabelV4(ctx, &pmapi.Label{Name: "Work", Type: pmapi.LabelTypeV4Folder})
+	r.NoError(err)
+
+	_, err = c.CreateLabel(ctx, &pmapi.Label{Name: "Work"})
+	r.Error(err)
+
+	folders, err := c.ListFoldersOnly(ctx)
+	r.NoError(err)
+	r.Len(folders, 1)
+	r.Equal(folder.ID, folders[0].ID)
+
+	labels, err := c.ListLabelsOnly(ctx)
+	r.NoError(err)
+	r.Empty(labels)
+
+	ev, err := c.GetEvent(ctx, latest.EventID)
+	r.NoError(err)
+	r.Len(ev.Labels, 1)
+	r.Equal(pmapi.EventCreate, ev.Labels[0].Action)
+	r.Equal("Work", ev.Labels[0].Label.Name)
+}
+
+func TestImport(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	_, m, done := newTestManager(t)
+	defer done()
+
+	c, _ := loginUser(t, m, "alice", "alice-password")
+	addr := c.Addresses().ByEmail("alice@example.com")
+
+	kr, err := c.KeyRingForAddressID(addr.ID)
+	r.NoError(err)
+
+	literal, err := message.EncryptRFC822(kr, strings.NewReader(testLiteral))
+	r.NoError(err)
+
+	res, err := c.Import(ctx, pmapi.ImportMsgReqs{{
+		Metadata: &pmapi.ImportMetadata{
+			AddressID: addr.ID,
+			Unread:    true,
+			LabelIDs:  []string{pmapi.InboxLabel},
+		},
+		Message: literal,
+	}})
+	r.NoError(err)
+	r.Len(res, 1)
+	r.NoError(res[0].Error)
+
+	msgs, total, err := c.ListMessages(ctx, &pmapi.MessagesFilter{LabelID: pmapi.InboxLabel})
+	r.NoError(err)
+	r.Equal(1, total)
+	r.Equal(res[0].MessageID, msgs[0].ID)
+	r.Equal("Hello thére", msgs[0].Subject)
+	r.Equal("first@example.com", msgs[0].ExternalID)
+	r.Equal(1, msgs[0].NumAttachments)
+
+	msg, err := c.GetMessage(ctx, msgs[0].ID)
+	r.NoError(err)
+	r.Equal("text/plain", msg.MIMEType)
+
+	body, err := msg.Decrypt(kr)
+	r.NoError(err)
+	r.Equal("Hello Alice", strings.TrimSpace(string(body)))
+
+	r.Len(msg.Attachments, 1)
+	r.Equal("data.bin", msg.Attachments[0].Name)
+
+	data := getAttachment(t, c, kr, msg.Attachments[0])
+	r.Equal([]byte{0, 1, 2, 3}, data)
+
+	counts, err := c.CountMessages(ctx, "")
+	r.NoError(err)
+
+	for _, count := range counts {
+		if count.LabelID == pmapi.InboxLabel {
+			r.Equal(1, count.Total)
+			r.Equal(1, count.Unread)
+		}
+	}
+
+	r.NoError(c.MarkMessagesRead(ctx, []string{msg.ID}))
+	r.NoError(c.DeleteMessages(ctx, []string{msg.ID}))
+
+	_, err = c.GetMessage(ctx, msg.ID)
+	r.Error(err)
+}
+
+func TestSend(t *testing.T) {
+	r := require.New(t)
+	ctx := context.Background()
+
+	_, m, done := newTestManager(t)
+	defer done()
+
+	alice, _ := loginUser(t, m, "alice", "alice-password")
+	bob, _ := loginUser(t, m, "bob", "bob-password")
+
+	latest, err := bob.GetEvent(ctx, "")
+	r.NoError(err)
+
+	aliceAddr := alice.Addresses().ByEmail("alice@example.com")
+
+	aliceKR, err := alice.KeyRingForAddressID(aliceAddr.ID)
+	r.NoError(err)
+
+	bobKR, err := bob.KeyRingForAddressID(bob.Addresses().ByEmail("robert@example.com").ID)
+	r.NoError(err)
+
+	keys, internal, err := alice.GetPublicKeysForEmail(ctx, "robert@example.com")
+	r.NoError(err)
+	r.True(internal)
+	r.Len(keys, 1)
+
+	draft := &pmapi.Message{
+		AddressID: aliceAddr.ID,
+		Subject:   "Lunch",
+		ToList:    []*mail.Address{{Address: "robert@example.com"}},
+		MIMEType:  "text/plain",
+		Body:      "Noon?",
+	}
+	r.NoError(draft.Encrypt(aliceKR, nil))
+
+	draft, err = alice.CreateDraft(ctx, draft, "", pmapi.DraftActionReply)
+	r.NoError(err)
+	r.True(draft.IsDraft())
+
+	att := &pmapi.Attachment{MessageID: draft.ID, Name: "menu.txt", MIMEType: "text/plain"}
+
+	enc, err := att.Encrypt(aliceKR, bytes.NewReader([]byte("soup")))
+	r.NoError(err)
+
+	sig, err := att.DetachedSign(aliceKR, bytes.NewReader([]byte("soup")))
+	r.NoError(err)
+
+	att, err = alice.CreateAttachment(ctx, att, enc, sig)
+	r.NoError(err)
+
+	keyPackets, err := base64.StdEncoding.DecodeString(att.KeyPackets)
+	r.NoError(err)
+
+	attKey, err := aliceKR.DecryptSessionKey(keyPackets)
+	r.NoError(err)
+
+	req := pmapi.NewSendMessageReq(aliceKR, "", "Noon?", "", map[string]*crypto.SessionKey{att.ID: attKey})
+	r.NoError(req.AddRecipient("robert@example.com", pmapi.InternalPackage, bobKR, pmapi.SignatureDetached, "text/plain", true))
+	req.PreparePackages()
+
+	sent, _, err := alice.SendMessage(ctx, draft.ID, req)
+	r.NoError(err)
+	r.True(sent.HasLabelID(pmapi.SentLabel))
+	r.False(sent.IsDraft())
+
+	ev, err := bob.GetEvent(ctx, latest.EventID)
+	r.NoError(err)
+	r.Len(ev.Messages, 1)
+	r.Equal(pmapi.EventCreate, ev.Messages[0].Action)
+
+	msg, err := bob.GetMessage(ctx, ev.Messages[0].ID)
+	r.NoError(err)
+	r.True(msg.HasLabelID(pmapi.InboxLabel))
+	r.True(bool(msg.Unread))
+
+	body, err := msg.Decrypt(bobKR)
+	r.NoError(err)
+	r.Equal("Noon?", string(body))
+
+	r.Len(msg.Attachments, 1)
+	r.Equal([]byte("soup"), getAttachment(t, bob, bobKR, msg.Attachments[0]))
+}
+
+func getAttachment(t *testing.T, c pmapi.Client, kr *crypto.KeyRing, att *pmapi.Attachment) []byte {
+	rc, err := c.GetAttachment(context.Background(), att.ID)
+	require.NoError(t, err)
+	defer rc.Close() //nolint:errcheck
+
+	dec, err := att.Decrypt(rc, kr)
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(dec)
+	require.NoError(t, err)
+
+	return data
+}
@@ -0,0 +1,363 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package simulator
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/go-srp"
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+// maxUpload is the biggest message the users may send.
+const maxUpload = 25 * 1024 * 1024
+
+type user struct {
+	id, name string
+
+	auth     *pmapi.PasswordAuth
+	verifier []byte
+	keySalt  string
+	key      *key
+
+	addresses []*address
+	labels    []*pmapi.Label
+	messages  map[string]*pmapi.Message
+	drafts    map[string]*draft
+	contacts  []*pmapi.Contact
+	events    []*event
+	settings  pmapi.MailSettings
+}
+
+type address struct {
+	id, email string
+	key       *key
+}
+
+// key is a private key locked with the mailbox passphrase of its user.
+type key struct {
+	id, fingerprint string
+	armored         string
+	publicKey       string
+	keyRing         *crypto.KeyRing
+}
+
+// AddUser creates a user who logs in with the name and password and owns the
+// given email addresses. It returns the ID of the user.
+func (s *Server) AddUser(name, password string, emails ...string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	salt, err := srp.RandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	keySalt := base64.StdEncoding.EncodeToString(salt)
+
+	passphrase, err := pmapi.HashMailboxPassword([]byte(password), keySalt)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := s.addUser(name, password, keySalt, func(email string) (*key, error) {
+		return s.newKey(name, email, passphrase)
+	}, emails...)
+	if err != nil {
+		return "", err
+	}
+
+	return u.id, nil
+}
+
+// addUser creates a user whose keys, one for the user and one for each
+// address, are made by newKey for the given email.
+func (s *Server) addUser(name, password, keySalt string, newKey func(email string) (*key, error), emails ...string) (*user, error) {
+	if len(emails) == 0 {
+		return nil, errors.New("user needs an address")
+	}
+
+	if s.userByName(name) != nil {
+		return nil, errors.Errorf("user %s already exists", name)
+	}
+
+	for _, email := range emails {
+		if _, addr := s.addressByEmail(email); addr != nil {
+			return nil, errors.Errorf("address %s already exists", email)
+		}
+	}
+
+	auth, err := pmapi.NewPasswordAuth(&pmapi.AuthModulus{Modulus: signedModulus, ModulusID: modulusID}, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := base64.StdEncoding.DecodeString(auth.Verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &user{
+		id:       s.newID("user"),
+		name:     name,
+		auth:     auth,
+		verifier: verifier,
+		keySalt:  keySalt,
+		messages: make(map[string]*pmapi.Message),
+		drafts:   make(map[string]*draft),
+		settings: pmapi.MailSettings{
+			DisplayName:     name,
+			PGPScheme:       pmapi.PGPMIMEPackage,
+			DraftMIMEType:   "text/html",
+			ReceiveMIMEType: "text/html",
+			ShowMIMEType:    "text/html",
+		},
+	}
+
+	if u.key, err = newKey(emails[0]); err != nil {
+		return nil, err
+	}
+
+	// The address keys are locked with the mailbox passphrase too, which is
+	// how the API served them before the address key tokens.
+	for _, email := range emails {
+		addrKey, err := newKey(email)
+		if err != nil {
+			return nil, err
+		}
+
+		u.addresses = append(u.addresses, &address{id: s.newID("address"), email: email, key: addrKey})
+	}
+
+	s.users[u.id] = u
+	s.pushEvent(u, &event{})
+
+	return u, nil
+}
+
+func (s *Server) newKey(name, email string, passphrase []byte) (*key, error) {
+	unlocked, err := crypto.GenerateKey(name, email, "x25519", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := unlocked.Lock(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	armored, err := locked.Armor()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.armoredKey(armored)
+}
+
+// armoredKey returns the key of the armored private key, which is locked.
+func (s *Server) armoredKey(armored string) (*key, error) {
+	private, err := crypto.NewKeyFromArmored(armored)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := private.GetArmoredPublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	public, err := crypto.NewKeyFromArmored(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyRing, err := crypto.NewKeyRing(public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{
+		id:          s.newID("key"),
+		fingerprint: private.GetFingerprint(),
+		armored:     armored,
+		publicKey:   publicKey,
+		keyRing:     keyRing,
+	}, nil
+}
+
+func (s *Server) userByName(name string) *user {
+	for _, u := range s.users {
+		if u.hasName(name) {
+			return u
+		}
+	}
+	return nil
+}
+
+// hasName returns whether the user logs in with the name, which is either
+// the username or one of the addresses.
+func (u *user) hasName(name string) bool {
+	if strings.EqualFold(u.name, name) {
+		return true
+	}
+	return u.addressByEmail(name) != nil
+}
+
+func (s *Server) addressByEmail(email string) (*user, *address) {
+	for _, u := range s.users {
+		if addr := u.addressByEmail(email); addr != nil {
+			return u, addr
+		}
+	}
+	return nil, nil
+}
+
+func (u *user) addressByEmail(email string) *address {
+	email = pmapi.SanitizeEmail(email)
+	for _, addr := range u.addresses {
+		if strings.EqualFold(addr.email, email) {
+			return addr
+		}
+	}
+	return nil
+}
+
+func (u *user) addressByID(id string) *address {
+	for _, addr := range u.addresses {
+		if addr.id == id {
+			return addr
+		}
+	}
+	return nil
+}
+
+func (u *user) toAPI() response {
+	return response{
+		"ID":        u.id,
+		"Name":      u.name,
+		"UsedSpace": u.usedSpace(),
+		"MaxSpace":  1024 * 1024 * 1024,
+		"MaxUpload": maxUpload,
+		"Role":      pmapi.FreeUserRole,
+		"Private":   1,
+		"Services":  1,
+		"Keys":      []response{u.key.toAPI()},
+	}
+}
+
+func (u *user) usedSpace() int64 {
+	var used int64
+	for _, m := range u.messages {
+		used += m.Size
+	}
+	return used
+}
+
+func (u *user) addressesToAPI() []response {
+	addrs := make([]response, 0, len(u.addresses))
+	for i, addr := range u.addresses {
+		addrs = append(addrs, addr.toAPI(i+1))
+	}
+	return addrs
+}
+
+func (addr *address) toAPI(order int) response {
+	return response{
+		"ID":          addr.id,
+		"Email":       addr.email,
+		"Send":        pmapi.MainSendAddress,
+		"Receive":     1,
+		"Status":      pmapi.EnabledAddress,
+		"Order":       order,
+		"Type":        pmapi.OriginalAddress,
+		"DisplayName": strings.SplitN(addr.email, "@", 2)[0],
+		"HasKeys":     pmapi.KeysPresent,
+		"Keys":        []response{addr.key.toAPI()},
+	}
+}
+
+// toAPI serializes the key the way pmapi.PMKey reads it, which it cannot
+// write itself.
+func (k *key) toAPI() response {
+	return response{
+		"ID":          k.id,
+		"Version":     3,
+		"Flags":       pmapi.UseToVerifyFlag | pmapi.UseToEncryptFlag,
+		"Fingerprint": k.fingerprint,
+		"PrivateKey":  k.armored,
+		"Primary":     1,
+		"Active":      1,
+	}
+}
+
+func (s *Server) getPublicKeys(w http.ResponseWriter, r *request) {
+	_, addr := s.addressByEmail(r.URL.Query().Get("Email"))
+	if addr == nil {
+		writeJSON(w, response{"Keys": []pmapi.PublicKey{}, "RecipientType": pmapi.RecipientTypeExternal})
+		return
+	}
+
+	writeJSON(w, response{
+		"Keys": []pmapi.PublicKey{{
+			Flags:     pmapi.UseToVerifyFlag | pmapi.UseToEncryptFlag,
+			PublicKey: addr.key.publicKey,
+		}},
+		"RecipientType": pmapi.RecipientTypeInternal,
+	})
+}
+
+func (s *Server) reorderAddresses(w http.ResponseWriter, r *request, u *user) {
+	var req struct {
+		AddressIDs []string
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if len(req.AddressIDs) != len(u.addresses) {
+		writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "All addresses need to be ordered")
+		return
+	}
+
+	addrs := make([]*address, 0, len(u.addresses))
+	for _, id := range req.AddressIDs {
+		addr := u.addressByID(id)
+		if addr == nil {
+			writeError(w, http.StatusUnprocessableEntity, codeInvalidValue, "Unknown address")
+			return
+		}
+		addrs = append(addrs, addr)
+	}
+
+	u.addresses = addrs
+
+	ev := &event{}
+	for i, addr := range u.addresses {
+		ev.Addresses = append(ev.Addresses, &eventAddress{
+			EventItem: pmapi.EventItem{ID: addr.id, Action: pmapi.EventUpdate},
+			Address:   addr.toAPI(i + 1),
+		})
+	}
+	s.pushEvent(u, ev)
+
+	writeJSON(w, response{})
+}
@@ -29,37 +29,76 @@ type DoneFunc func()
 
 type Pool struct {
 	jobCh *pchan.PChan
+	work  WorkFunc
+
+	lock    sync.Mutex
+	size    int
+	workers int
 }
 
 func New(size int, work WorkFunc) *Pool {
-	jobCh := pchan.New()
-
-	for i := 0; i < size; i++ {
-		go func() {
-			for {
-				val, prio, ok := jobCh.Pop()
-				if !ok {
-					return
-				}
-
-				job, ok := val.(*Job)
-				if !ok {
-					panic("bad result type")
-				}
-
-				res, err := work(job.req, prio)
-				if err != nil {
-					job.postFailure(err)
-				} else {
-					job.postSuccess(res)
-				}
-
-				job.waitDone()
-			}
-		}()
+	pool := &Pool{
+		jobCh: pchan.New(),
+		work:  work,
 	}
 
-	return &Pool{jobCh: jobCh}
+	pool.Resize(size)
+
+	return pool
+}
+
+// Resize changes the number of workers. Extra workers are started
+// immediately; superfluous ones stop once they finish their current job.
+func (pool *Pool) Resize(size int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.size = size
+
+	for ; pool.workers < size; pool.workers++ {
+		go pool.worker()
+	}
+}
+
+// retire tells a worker whether it should stop because the pool shrank.
+func (pool *Pool) retire() bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.workers > pool.size {
+		pool.workers--
+		return true
+	}
+
+	return false
+}
+
+func (pool *Pool) worker() {
+	for !pool.retire() {
+		val, prio, ok := pool.jobCh.Pop()
+		if !ok {
+			return
+		}
+
+		job, ok := val.(*Job)
+		if !ok {
+			panic("bad result type")
+		}
+
+		res, err := pool.work(job.req, prio)
+		if err != nil {
+			job.postFailure(err)
+		} else {
+			job.postSuccess(res)
+		}
+
+		job.waitDone()
+	}
+}
+
+// Pending returns the number of jobs waiting for a worker.
+func (pool *Pool) Pending() int {
+	return pool.jobCh.Len()
 }
 
 func (pool *Pool) NewJob(req interface{}, prio int) (*Job, DoneFunc) {
@@ -43,3 +43,31 @@ func TestPool(t *testing.T) {
 	assert.Equal(t, "echo", res1)
 	assert.Equal(t, "this", res2)
 }
+
+func TestPoolResize(t *testing.T) {
+	release := make(chan struct{})
+	pool := pool.New(1, func(req interface{}, prio int) (interface{}, error) {
+		<-release
+		return req, nil
+	})
+
+	job1, done1 := pool.NewJob("echo", 1)
+	defer done1()
+
+	job2, done2 := pool.NewJob("this", 1)
+	defer done2()
+
+	// With a single blocked worker, the second job can only run on a new one.
+	pool.Resize(2)
+	release <- struct{}{}
+	release <- struct{}{}
+
+	res1, err := job1.GetResult()
+	require.NoError(t, err)
+
+	res2, err := job2.GetResult()
+	require.NoError(t, err)
+
+	assert.Equal(t, "echo", res1)
+	assert.Equal(t, "this", res2)
+}
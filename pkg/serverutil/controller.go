@@ -21,6 +21,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/listener"
@@ -31,6 +32,8 @@ import (
 // users are disconnected.
 type Controller interface {
 	ListenAndServe()
+	Rebind()
+	StopListening()
 	Close()
 }
 
@@ -62,6 +65,9 @@ type controller struct {
 	log     *logrus.Entry
 
 	closeDisconnectUsers chan void
+
+	lock     sync.Mutex
+	listener *rebindableListener
 }
 
 func (c *controller) Close() {
@@ -79,27 +85,68 @@ func (c *controller) ListenAndServe() {
 	l := c.log.WithField("useSSL", c.server.UseSSL()).
 		WithField("address", c.server.Address())
 
-	var listener net.Listener
-	var err error
-
-	if c.server.UseSSL() {
-		listener, err = tls.Listen("tcp", c.server.Address(), c.server.TLSConfig())
-	} else {
-		listener, err = net.Listen("tcp", c.server.Address())
-	}
-
+	listener, err := c.listen()
 	if err != nil {
 		l.WithError(err).Error("Cannot start listner.")
 		return
 	}
 
+	c.lock.Lock()
+	c.listener = newRebindableListener(listener)
+	c.lock.Unlock()
+
 	// When starting the Bridge, we don't want to retry to notify user
 	// quickly about the issue. Very probably retry will not help anyway.
 	l.Info("Starting server")
-	err = c.server.Serve(&connListener{listener, c.server})
+	err = c.server.Serve(&connListener{c.listener, c.server})
 	l.WithError(err).Debug("GoSMTP not serving")
 }
 
+// Rebind starts listening on the current address of the server and stops
+// listening on the previous one. The connections accepted so far stay open.
+func (c *controller) Rebind() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	l := c.log.WithField("address", c.server.Address())
+
+	if c.listener == nil {
+		l.Warn("Cannot rebind a server that is not listening")
+		return
+	}
+
+	listener, err := c.listen()
+	if err != nil {
+		l.WithError(err).Error("Cannot start listener, keeping the previous one")
+		return
+	}
+
+	c.listener.rebind(listener)
+	l.Info("Server rebound")
+}
+
+// StopListening stops accepting new connections. The connections accepted so
+// far stay open until the controller is closed.
+func (c *controller) StopListening() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.listener == nil {
+		return
+	}
+
+	if err := c.listener.Close(); err != nil {
+		c.log.WithError(err).Warn("Issue when closing listener")
+	}
+}
+
+func (c *controller) listen() (net.Listener, error) {
+	if c.server.UseSSL() {
+		return tls.Listen("tcp", c.server.Address(), c.server.TLSConfig())
+	}
+	return net.Listen("tcp", c.server.Address())
+}
+
 func monitorDisconnectedUsers(s Server, l listener.Listener, done <-chan void) {
 	ch := make(chan string)
 	l.Add(events.CloseConnectionEvent, ch)
@@ -18,12 +18,22 @@
 package serverutil
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+var errListenerClosed = errors.New("listener closed")
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
 // connListener sets debug loggers on server containing fields with local
 // and remote addresses right after new connection is accepted.
 type connListener struct {
@@ -57,3 +67,129 @@ func (l *connListener) Accept() (net.Conn, error) {
 
 	return conn, err
 }
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// rebindableListener accepts connections from an underlying listener that can
+// be replaced while serving. Replacing it stops accepting on the old address
+// but does not affect the connections accepted so far.
+type rebindableListener struct {
+	lock    sync.Mutex
+	current net.Listener
+
+	conns     chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newRebindableListener(l net.Listener) *rebindableListener {
+	rl := &rebindableListener{
+		conns:  make(chan acceptResult),
+		closed: make(chan struct{}),
+	}
+	rl.rebind(l)
+	return rl
+}
+
+func (rl *rebindableListener) rebind(l net.Listener) {
+	rl.lock.Lock()
+	old := rl.current
+	rl.current = l
+	rl.lock.Unlock()
+
+	go rl.acceptLoop(l)
+
+	if old != nil {
+		_ = old.Close()
+	}
+}
+
+func (rl *rebindableListener) acceptLoop(l net.Listener) {
+	var delay time.Duration
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			rl.lock.Lock()
+			replaced := rl.current != l
+			rl.lock.Unlock()
+
+			// Errors of a replaced listener are expected: it has been closed.
+			if replaced {
+				return
+			}
+
+			// The servers stop serving on any error, so temporary ones, such
+			// as running out of file descriptors, are retried here instead.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = nextAcceptDelay(delay)
+				logrus.WithError(err).WithField("retry", delay).Warn("Temporary accept error")
+
+				select {
+				case <-time.After(delay):
+					continue
+				case <-rl.closed:
+					return
+				}
+			}
+		}
+		delay = 0
+
+		select {
+		case rl.conns <- acceptResult{conn: conn, err: err}:
+		case <-rl.closed:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// nextAcceptDelay doubles the delay before accepting again, the same way
+// net/http does.
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	if delay *= 2; delay > maxAcceptDelay {
+		return maxAcceptDelay
+	}
+	return delay
+}
+
+func (rl *rebindableListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-rl.conns:
+		return res.conn, res.err
+	case <-rl.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (rl *rebindableListener) Close() error {
+	var err error
+	rl.closeOnce.Do(func() {
+		close(rl.closed)
+
+		rl.lock.Lock()
+		defer rl.lock.Unlock()
+
+		err = rl.current.Close()
+	})
+	return err
+}
+
+func (rl *rebindableListener) Addr() net.Addr {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	return rl.current.Addr()
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package serverutil
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// scriptedListener returns the given accept results in order and then blocks
+// until it is closed.
+type scriptedListener struct {
+	net.Listener
+
+	results chan acceptResult
+	closed  chan struct{}
+}
+
+func newScriptedListener(results ...acceptResult) *scriptedListener {
+	l := &scriptedListener{
+		results: make(chan acceptResult, len(results)),
+		closed:  make(chan struct{}),
+	}
+	for _, res := range results {
+		l.results <- res
+	}
+	return l
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	select {
+	case res := <-l.results:
+		return res.conn, res.err
+	case <-l.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (l *scriptedListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func TestRebindableListenerRetriesTemporaryErrors(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+
+	l := newScriptedListener(
+		acceptResult{err: temporaryError{}},
+		acceptResult{err: temporaryError{}},
+		acceptResult{conn: server},
+	)
+
+	rl := newRebindableListener(l)
+	defer rl.Close() //nolint:errcheck
+
+	conn, err := rl.Accept()
+	require.NoError(t, err)
+	require.Equal(t, server, conn)
+}
+
+func TestRebindableListenerForwardsPermanentErrors(t *testing.T) {
+	permanent := errors.New("permanent")
+
+	rl := newRebindableListener(newScriptedListener(acceptResult{err: permanent}))
+	defer rl.Close() //nolint:errcheck
+
+	_, err := rl.Accept()
+	require.Equal(t, permanent, err)
+}
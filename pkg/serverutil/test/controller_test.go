@@ -24,6 +24,7 @@ import (
 
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/ports"
 	"github.com/ljanyst/peroxide/pkg/serverutil"
 	"github.com/stretchr/testify/require"
 )
@@ -134,3 +135,35 @@ func TestDebugBoth(t *testing.T) {
 	c.Close()
 	r.Eventually(s.portIsFree, time.Second, 50*time.Millisecond)
 }
+
+func TestControllerRebind(t *testing.T) {
+	r, s, _, c := setup(t)
+
+	go c.ListenAndServe()
+	r.Eventually(s.portIsOccupied, time.Second, 50*time.Millisecond)
+	r.NoError(s.ping())
+
+	oldPort := s.port
+	s.port++
+	r.True(s.portIsFree())
+
+	c.Rebind()
+	r.True(s.portIsOccupied())
+	r.NoError(s.ping())
+	r.Eventually(func() bool { return ports.IsPortFree(oldPort) }, time.Second, 50*time.Millisecond)
+
+	c.Close()
+	r.Eventually(s.portIsFree, time.Second, 50*time.Millisecond)
+}
+
+func TestControllerStopListening(t *testing.T) {
+	r, s, _, c := setup(t)
+
+	go c.ListenAndServe()
+	r.Eventually(s.portIsOccupied, time.Second, 50*time.Millisecond)
+
+	c.StopListening()
+	r.Eventually(s.portIsFree, time.Second, 50*time.Millisecond)
+
+	c.Close()
+}
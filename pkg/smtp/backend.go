@@ -19,19 +19,29 @@ package smtp
 
 import (
 	"strings"
+	"sync"
 	"time"
 
 	goSMTPBackend "github.com/emersion/go-smtp"
 	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/users"
-	"github.com/pkg/errors"
 )
 
 type smtpBackend struct {
 	eventListener listener.Listener
 	users         *users.Users
 	bccSelf       bool
+	bccSelfLock   sync.RWMutex
 	sendRecorder  *sendRecorder
+
+	sessionsLock sync.Mutex
+	sessions     map[*smtpUser]struct{}
+
+	sendingLock sync.Mutex
+	sending     int
+	draining    bool
+	drained     chan struct{}
 }
 
 // NewSMTPBackend returns struct implementing go-smtp/backend interface.
@@ -45,22 +55,39 @@ func NewSMTPBackend(
 		users:         users,
 		bccSelf:       bccSelf,
 		sendRecorder:  newSendRecorder(),
+		sessions:      map[*smtpUser]struct{}{},
+		drained:       make(chan struct{}),
+	}
+}
+
+// NewSession returns a session which is not authenticated yet.
+func (sb *smtpBackend) NewSession(conn *goSMTPBackend.Conn) (goSMTPBackend.Session, error) {
+	su := &smtpUser{
+		eventListener: sb.eventListener,
+		backend:       sb,
+		conn:          conn,
 	}
+
+	sb.sessionsLock.Lock()
+	sb.sessions[su] = struct{}{}
+	sb.sessionsLock.Unlock()
+
+	return su, nil
 }
 
-// Login authenticates a user.
-func (sb *smtpBackend) Login(_ *goSMTPBackend.ConnectionState, username, password string) (goSMTPBackend.Session, error) {
+// login authenticates the user of the session.
+func (sb *smtpBackend) login(su *smtpUser, username, password string) error {
 	username = strings.ToLower(username)
 	username, slot := users.DecodeLogin(username)
 
 	user, err := sb.users.GetUser(username)
 	if err != nil {
 		log.Warn("Cannot get user: ", err)
-		return nil, err
+		return err
 	}
 
 	if err := user.BringOnline(slot, password); err != nil {
-		return nil, err
+		return err
 	}
 
 	if err := user.CheckCredentials(slot, password); err != nil {
@@ -68,15 +95,111 @@ func (sb *smtpBackend) Login(_ *goSMTPBackend.ConnectionState, username, passwor
 		// Apple Mail sometimes generates a lot of requests very quickly. It's good practice
 		// to have a timeout after bad logins so that we can slow those requests down a little bit.
 		time.Sleep(10 * time.Second)
-		return nil, err
+		return err
 	}
 
 	// AddressID is only for split mode--it has to be empty for combined mode.
 	addressID := ""
+	if !user.IsCombinedAddressMode() {
+		if addressID, err = user.GetAddressID(username); err != nil {
+			return err
+		}
+	}
+
+	sb.bccSelfLock.RLock()
+	bccSelf := sb.bccSelf
+	sb.bccSelfLock.RUnlock()
+
+	if err := su.setUser(user, username, addressID, bccSelf); err != nil {
+		return err
+	}
+
+	metrics.Connected("smtp", user.ID())
+
+	return nil
+}
+
+// endSession forgets the session once its connection is closed.
+func (sb *smtpBackend) endSession(su *smtpUser) {
+	sb.sessionsLock.Lock()
+	defer sb.sessionsLock.Unlock()
+
+	delete(sb.sessions, su)
+}
+
+// closeSessions closes the connections of all authenticated sessions.
+func (sb *smtpBackend) closeSessions() {
+	sb.sessionsLock.Lock()
+	sessions := make([]*smtpUser, 0, len(sb.sessions))
+	for su := range sb.sessions {
+		sessions = append(sessions, su)
+	}
+	sb.sessionsLock.Unlock()
 
-	return newSMTPUser(sb.eventListener, sb, user, username, addressID, sb.bccSelf)
+	for _, su := range sessions {
+		if !su.isAuthenticated() {
+			continue
+		}
+		if err := su.conn.Close(); err != nil {
+			log.WithError(err).Error("Failed to close the connection")
+		}
+	}
+}
+
+// SetBCCSelf changes whether the sessions opened from now on add the sender to BCC.
+func (sb *smtpBackend) SetBCCSelf(bccSelf bool) {
+	sb.bccSelfLock.Lock()
+	defer sb.bccSelfLock.Unlock()
+
+	sb.bccSelf = bccSelf
+}
+
+// beginSend registers a message being sent. It returns false if the backend
+// is draining and no new messages are accepted.
+func (sb *smtpBackend) beginSend() bool {
+	sb.sendingLock.Lock()
+	defer sb.sendingLock.Unlock()
+
+	if sb.draining {
+		return false
+	}
+
+	sb.sending++
+	return true
 }
 
-func (sb *smtpBackend) AnonymousLogin(_ *goSMTPBackend.ConnectionState) (goSMTPBackend.Session, error) {
-	return nil, errors.New("anonymous login not supported")
+func (sb *smtpBackend) endSend() {
+	sb.sendingLock.Lock()
+	defer sb.sendingLock.Unlock()
+
+	sb.sending--
+	if sb.draining && sb.sending == 0 {
+		close(sb.drained)
+	}
+}
+
+// Drain stops accepting new messages and waits for the messages being sent,
+// at most for the given timeout. It returns whether all of them finished.
+func (sb *smtpBackend) Drain(timeout time.Duration) bool {
+	sb.sendingLock.Lock()
+	if sb.draining {
+		sb.sendingLock.Unlock()
+		return false
+	}
+
+	sb.draining = true
+	sending := sb.sending
+	if sending == 0 {
+		close(sb.drained)
+	}
+	sb.sendingLock.Unlock()
+
+	log.WithField("messages", sending).Info("Waiting for messages being sent")
+
+	select {
+	case <-sb.drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
@@ -0,0 +1,99 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	goSMTPBackend "github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendDrainIdle(t *testing.T) {
+	sb := NewSMTPBackend(nil, nil, false)
+
+	assert.True(t, sb.Drain(time.Second))
+	assert.False(t, sb.beginSend())
+}
+
+func TestBackendDrainWaitsForSends(t *testing.T) {
+	sb := NewSMTPBackend(nil, nil, false)
+
+	assert.True(t, sb.beginSend())
+	assert.True(t, sb.beginSend())
+
+	go func() {
+		sb.endSend()
+		time.Sleep(50 * time.Millisecond)
+		sb.endSend()
+	}()
+
+	assert.True(t, sb.Drain(time.Second))
+}
+
+func TestBackendDrainTimeout(t *testing.T) {
+	sb := NewSMTPBackend(nil, nil, false)
+
+	assert.True(t, sb.beginSend())
+	assert.False(t, sb.Drain(10*time.Millisecond))
+
+	// A send finishing after the timeout does not panic.
+	sb.endSend()
+}
+
+func TestServerAdvertisesDSN(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &Server{backend: NewSMTPBackend(nil, nil, false)}
+	s.server = newGoSMTPServer(s)
+	go func() { _ = s.server.Serve(l) }()
+	defer func() { _ = s.server.Close() }()
+
+	c, err := goSMTPBackend.Dial(l.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = c.Close() }()
+
+	require.NoError(t, c.Hello("localhost"))
+	ok, _ := c.Extension("DSN")
+	assert.True(t, ok)
+
+	// The parameters are accepted; the command fails only for the missing login.
+	err = c.Mail("me@example.com", &goSMTPBackend.MailOptions{Return: goSMTPBackend.DSNReturnFull, EnvelopeID: "QQ314159"})
+	var smtpErr *goSMTPBackend.SMTPError
+	require.True(t, errors.As(err, &smtpErr))
+	assert.Equal(t, goSMTPBackend.ErrAuthRequired.Code, smtpErr.Code)
+}
+
+func TestBackendTracksSessions(t *testing.T) {
+	sb := NewSMTPBackend(nil, nil, false)
+
+	session, err := sb.NewSession(nil)
+	require.NoError(t, err)
+	assert.Len(t, sb.sessions, 1)
+
+	// Closing the sessions skips the ones which have not logged in.
+	sb.closeSessions()
+
+	require.NoError(t, session.Logout())
+	assert.Empty(t, sb.sessions)
+}
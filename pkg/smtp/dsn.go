@@ -0,0 +1,297 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	goSMTPBackend "github.com/emersion/go-smtp"
+	pkgMsg "github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/pkg/errors"
+)
+
+// The NOTIFY keywords of the delivery status notification requests (RFC 3461).
+const (
+	notifyNever   = "NEVER"
+	notifySuccess = "SUCCESS"
+	notifyFailure = "FAILURE"
+	notifyDelay   = "DELAY"
+)
+
+// dsnReturnFull is the RET keyword asking for the whole message to be returned.
+const dsnReturnFull = string(goSMTPBackend.DSNReturnFull)
+
+// dsnSender is the sender of the delivery status notifications.
+const dsnSender = "Mail Delivery System <MAILER-DAEMON@localhost>"
+
+// dsnEvent is what a delivery status notification reports.
+type dsnEvent struct {
+	notify  string // The NOTIFY keyword asking for the report.
+	action  string // The action of the recipients (RFC 3464).
+	subject string
+}
+
+var (
+	dsnFailed  = dsnEvent{notify: notifyFailure, action: "failed", subject: "Undelivered Mail Returned to Sender"} //nolint[gochecknoglobals]
+	dsnDelayed = dsnEvent{notify: notifyDelay, action: "delayed", subject: "Delayed Mail (still being retried)"}   //nolint[gochecknoglobals]
+	dsnRelayed = dsnEvent{notify: notifySuccess, action: "relayed", subject: "Successful Mail Delivery Report"}    //nolint[gochecknoglobals]
+)
+
+// newDSNRequest returns the delivery status notification request of the
+// recipient given to RCPT TO by its NOTIFY and ORCPT parameters. The request
+// is nil if there are no parameters.
+func newDSNRequest(opts *goSMTPBackend.RcptOptions) *store.DSNRequest {
+	if opts == nil || (len(opts.Notify) == 0 && opts.OriginalRecipient == "") {
+		return nil
+	}
+
+	dsn := &store.DSNRequest{}
+	for _, keyword := range opts.Notify {
+		dsn.Notify = append(dsn.Notify, string(keyword))
+	}
+	if opts.OriginalRecipient != "" {
+		// The address types are case insensitive; the reports spell them in lower case.
+		dsn.OriginalRecipient = strings.ToLower(string(opts.OriginalRecipientType)) + ";" + opts.OriginalRecipient
+	}
+
+	return dsn
+}
+
+// dsnRecipients returns the recipients of the message which asked for the
+// report of the event. Without a request, only failures are reported.
+func dsnRecipients(msg store.QueuedMessage, event dsnEvent) []string {
+	recipients := []string{}
+
+	for _, to := range msg.To {
+		notify := msg.DSN[to].Notify
+		if len(notify) == 0 {
+			notify = []string{notifyFailure}
+		}
+
+		for _, keyword := range notify {
+			if keyword == event.notify {
+				recipients = append(recipients, to)
+				break
+			}
+		}
+	}
+
+	return recipients
+}
+
+// notify imports a delivery status notification about the queued message
+// into the Inbox of the sender, if any of the recipients asked for it.
+func (su *smtpUser) notify(msg store.QueuedMessage, literal []byte, event dsnEvent, cause error, now time.Time) error {
+	recipients := dsnRecipients(msg, event)
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	addressID := msg.AddressID
+	if addressID == "" {
+		addr := su.client().Addresses().ByEmailOrCatchAll(msg.ReturnPath)
+		if addr == nil {
+			return errors.New("notification: return path not owned by user")
+		}
+		addressID = addr.ID
+	}
+
+	kr, err := su.client().KeyRingForAddressID(addressID)
+	if err != nil {
+		return err
+	}
+
+	report, err := buildDSN(msg, recipients, literal, event, cause, now)
+	if err != nil {
+		return err
+	}
+
+	enc, err := pkgMsg.EncryptRFC822(kr, bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+
+	res, err := su.client().Import(context.TODO(), pmapi.ImportMsgReqs{{
+		Metadata: &pmapi.ImportMetadata{
+			AddressID: addressID,
+			Unread:    pmapi.Boolean(true),
+			Time:      now.Unix(),
+			Flags:     pmapi.FlagReceived,
+			LabelIDs:  []string{pmapi.InboxLabel},
+		},
+		Message: append(enc, "\r\n"...),
+	}})
+	if err != nil {
+		return err
+	}
+
+	if len(res) == 0 {
+		return errors.New("no import response")
+	}
+
+	return res[0].Error
+}
+
+// dsnStatus returns the status code (RFC 3463) reported for the event.
+func dsnStatus(event dsnEvent, cause error) string {
+	switch {
+	case event == dsnRelayed:
+		return "2.0.0"
+	case event == dsnDelayed:
+		return "4.0.0"
+	case isPermanentSendError(cause):
+		return "5.0.0"
+	default:
+		// Messages which were not refused but could not be sent in time
+		// report a persistent transient failure.
+		return "4.4.7"
+	}
+}
+
+// buildDSN builds the multipart/report delivery status notification
+// (RFC 3464) about the queued message for the given recipients. It carries
+// the headers of the original message or the whole message if the sender
+// asked for it.
+func buildDSN(msg store.QueuedMessage, recipients []string, literal []byte, event dsnEvent, cause error, now time.Time) ([]byte, error) {
+	status := dsnStatus(event, cause)
+	queued := msg.Queued.Format(time.RFC1123Z)
+	retryUntil := msg.Queued.Add(outboxExpiry).Format(time.RFC1123Z)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	b := new(bytes.Buffer)
+	w := multipart.NewWriter(b)
+
+	fmt.Fprintf(b, "From: %s\r\n", dsnSender)
+	fmt.Fprintf(b, "To: <%s>\r\n", msg.ReturnPath)
+	fmt.Fprintf(b, "Subject: %s\r\n", event.subject)
+	fmt.Fprintf(b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(b, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", w.Boundary())
+	fmt.Fprintf(b, "\r\n")
+
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	switch event {
+	case dsnRelayed:
+		fmt.Fprintf(text, "Your message queued on %s was sent to the following recipients:\r\n\r\n", queued)
+	case dsnDelayed:
+		fmt.Fprintf(text, "Your message queued on %s could not be sent yet to the following recipients.\r\n", queued)
+		fmt.Fprintf(text, "It will be tried again until %s.\r\n\r\n", retryUntil)
+	default:
+		fmt.Fprintf(text, "Your message queued on %s could not be sent to the following recipients:\r\n\r\n", queued)
+	}
+	for _, to := range recipients {
+		fmt.Fprintf(text, "    %s\r\n", to)
+	}
+	if cause != nil {
+		fmt.Fprintf(text, "\r\nThe error was: %s\r\n", cause)
+	}
+
+	dsn, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	if msg.DSNEnvelope.EnvelopeID != "" {
+		fmt.Fprintf(dsn, "Original-Envelope-Id: %s\r\n", msg.DSNEnvelope.EnvelopeID)
+	}
+	fmt.Fprintf(dsn, "Reporting-MTA: dns; %s\r\n", hostname)
+	fmt.Fprintf(dsn, "Arrival-Date: %s\r\n", queued)
+	for _, to := range recipients {
+		fmt.Fprintf(dsn, "\r\n")
+		if orcpt := msg.DSN[to].OriginalRecipient; orcpt != "" {
+			fmt.Fprintf(dsn, "Original-Recipient: %s\r\n", orcpt)
+		}
+		fmt.Fprintf(dsn, "Final-Recipient: rfc822; %s\r\n", to)
+		fmt.Fprintf(dsn, "Action: %s\r\n", event.action)
+		fmt.Fprintf(dsn, "Status: %s\r\n", status)
+		if cause != nil {
+			fmt.Fprintf(dsn, "Diagnostic-Code: smtp; %s\r\n", strings.ReplaceAll(cause.Error(), "\n", " "))
+		}
+		if event == dsnDelayed {
+			fmt.Fprintf(dsn, "Will-Retry-Until: %s\r\n", retryUntil)
+		}
+	}
+
+	// The whole message is only returned with failures and when asked for
+	// with RET=FULL (RFC 3461, section 4.3).
+	if len(literal) != 0 {
+		content := messageHeaders(literal)
+		contentType := "text/rfc822-headers"
+		if event == dsnFailed && msg.DSNEnvelope.Return == dsnReturnFull {
+			content = append(content, literal[headerLength(literal):]...)
+			contentType = "message/rfc822"
+		}
+
+		returned, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := returned.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// headerLength returns the length of the header section of the message
+// literal including the empty line ending it.
+func headerLength(literal []byte) int {
+	end := len(literal)
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(literal, []byte(sep)); i >= 0 && i+len(sep) < end {
+			end = i + len(sep)
+		}
+	}
+	return end
+}
+
+// messageHeaders returns the header section of the message literal without
+// the password the message may be protected with.
+func messageHeaders(literal []byte) []byte {
+	var headers []byte
+	var skipping bool
+	for _, line := range bytes.SplitAfter(literal[:headerLength(literal)], []byte("\n")) {
+		if len(line) > 0 && line[0] != ' ' && line[0] != '\t' {
+			skipping = bytes.HasPrefix(bytes.ToLower(line), []byte(strings.ToLower(passwordHeader)+":"))
+		}
+		if !skipping {
+			headers = append(headers, line...)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"testing"
+	"time"
+
+	goSMTPBackend "github.com/emersion/go-smtp"
+	"github.com/ljanyst/peroxide/pkg/store"
+	r "github.com/stretchr/testify/require"
+)
+
+func TestNewDSNRequest(t *testing.T) {
+	r.Nil(t, newDSNRequest(nil))
+	r.Nil(t, newDSNRequest(&goSMTPBackend.RcptOptions{}))
+
+	r.Equal(t, &store.DSNRequest{Notify: []string{"SUCCESS", "FAILURE"}, OriginalRecipient: "rfc822;you+tag@example.org"}, newDSNRequest(&goSMTPBackend.RcptOptions{
+		Notify:                []goSMTPBackend.DSNNotify{goSMTPBackend.DSNNotifySuccess, goSMTPBackend.DSNNotifyFailure},
+		OriginalRecipientType: goSMTPBackend.DSNAddressTypeRFC822,
+		OriginalRecipient:     "you+tag@example.org",
+	}))
+
+	r.Equal(t, &store.DSNRequest{Notify: []string{"NEVER"}}, newDSNRequest(&goSMTPBackend.RcptOptions{
+		Notify: []goSMTPBackend.DSNNotify{goSMTPBackend.DSNNotifyNever},
+	}))
+}
+
+func TestRcptKeepsDSNRequest(t *testing.T) {
+	su := &smtpUser{}
+
+	r.NoError(t, su.Rcpt("you@example.org", &goSMTPBackend.RcptOptions{Notify: []goSMTPBackend.DSNNotify{goSMTPBackend.DSNNotifyDelayed}}))
+	r.NoError(t, su.Rcpt("them@example.org", &goSMTPBackend.RcptOptions{}))
+	r.Equal(t, []string{"you@example.org", "them@example.org"}, su.to)
+	r.Equal(t, map[string]store.DSNRequest{"you@example.org": {Notify: []string{"DELAY"}}}, su.dsn)
+
+	su.dsnEnvelope = store.DSNEnvelope{Return: "HDRS", EnvelopeID: "id"}
+
+	su.Reset()
+	r.Empty(t, su.to)
+	r.Nil(t, su.dsn)
+	r.Zero(t, su.dsnEnvelope)
+}
+
+func TestDSNRecipients(t *testing.T) {
+	msg := store.QueuedMessage{
+		To: []string{"a@example.org", "b@example.org", "c@example.org"},
+		DSN: map[string]store.DSNRequest{
+			"b@example.org": {Notify: []string{"NEVER"}},
+			"c@example.org": {Notify: []string{"SUCCESS", "DELAY"}},
+		},
+	}
+
+	r.Equal(t, []string{"a@example.org"}, dsnRecipients(msg, dsnFailed))
+	r.Equal(t, []string{"c@example.org"}, dsnRecipients(msg, dsnDelayed))
+	r.Equal(t, []string{"c@example.org"}, dsnRecipients(msg, dsnRelayed))
+}
+
+func readReport(t *testing.T, report []byte) (*mail.Message, []string, []string) {
+	m, err := mail.ReadMessage(bytes.NewReader(report))
+	r.NoError(t, err)
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	r.NoError(t, err)
+	r.Equal(t, "multipart/report", mediaType)
+	r.Equal(t, "delivery-status", params["report-type"])
+
+	var parts, bodies []string
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, err := ioutil.ReadAll(p)
+		r.NoError(t, err)
+		parts = append(parts, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+
+	return m, parts, bodies
+}
+
+func TestBuildDSN(t *testing.T) {
+	queued := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg := store.QueuedMessage{
+		ID:         "1",
+		ReturnPath: "me@example.com",
+		To:         []string{"you@example.org", "them@example.org"},
+		Queued:     queued,
+		DSN:        map[string]store.DSNRequest{"you@example.org": {OriginalRecipient: "rfc822;you+tag@example.org"}},
+	}
+	literal := []byte("Subject: Hello\r\nTo: you@example.org\r\n\r\nSecret body\r\n")
+
+	report, err := buildDSN(msg, msg.To, literal, dsnFailed, permanentError{errors.New("invalid recipient")}, queued.Add(time.Minute))
+	r.NoError(t, err)
+
+	m, parts, bodies := readReport(t, report)
+	r.Equal(t, "<me@example.com>", m.Header.Get("To"))
+	r.Equal(t, dsnFailed.subject, m.Header.Get("Subject"))
+	r.Equal(t, []string{"text/plain; charset=utf-8", "message/delivery-status", "text/rfc822-headers"}, parts)
+	r.Contains(t, bodies[1], "Original-Recipient: rfc822;you+tag@example.org\r\nFinal-Recipient: rfc822; you@example.org\r\nAction: failed\r\nStatus: 5.0.0\r\n")
+	r.Contains(t, bodies[1], "\r\nFinal-Recipient: rfc822; them@example.org\r\n")
+	r.Contains(t, bodies[1], "Diagnostic-Code: smtp; invalid recipient\r\n")
+	r.Equal(t, "Subject: Hello\r\nTo: you@example.org\r\n\r\n", bodies[2])
+}
+
+func TestBuildDSNReturnsFullMessage(t *testing.T) {
+	queued := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg := store.QueuedMessage{
+		ReturnPath:  "me@example.com",
+		To:          []string{"you@example.org"},
+		Queued:      queued,
+		DSNEnvelope: store.DSNEnvelope{Return: "FULL", EnvelopeID: "QQ314159"},
+	}
+	literal := []byte("Subject: Hello\r\nX-Peroxide-Password: s3cret\r\n\r\nSecret body\r\n")
+
+	report, err := buildDSN(msg, msg.To, literal, dsnFailed, permanentError{errors.New("invalid recipient")}, queued.Add(time.Minute))
+	r.NoError(t, err)
+
+	_, parts, bodies := readReport(t, report)
+	r.Equal(t, []string{"text/plain; charset=utf-8", "message/delivery-status", "message/rfc822"}, parts)
+	r.Contains(t, bodies[1], "Original-Envelope-Id: QQ314159\r\nReporting-MTA: ")
+	r.Equal(t, "Subject: Hello\r\n\r\nSecret body\r\n", bodies[2])
+
+	// Only the failures return the whole message.
+	report, err = buildDSN(msg, msg.To, literal, dsnRelayed, nil, queued.Add(time.Minute))
+	r.NoError(t, err)
+
+	_, parts, _ = readReport(t, report)
+	r.Equal(t, "text/rfc822-headers", parts[2])
+}
+
+func TestBuildDSNOfExpiredMessage(t *testing.T) {
+	msg := store.QueuedMessage{ReturnPath: "me@example.com", To: []string{"you@example.org"}}
+
+	report, err := buildDSN(msg, msg.To, nil, dsnFailed, errors.New("no internet connection"), time.Now())
+	r.NoError(t, err)
+	r.Contains(t, string(report), "Status: 4.4.7\r\n")
+	r.NotContains(t, string(report), "text/rfc822-headers")
+}
+
+func TestBuildDSNOfDelayedAndRelayedMessage(t *testing.T) {
+	queued := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg := store.QueuedMessage{ReturnPath: "me@example.com", To: []string{"you@example.org"}, Queued: queued}
+
+	report, err := buildDSN(msg, msg.To, nil, dsnDelayed, errors.New("no internet connection"), queued.Add(5*time.Hour))
+	r.NoError(t, err)
+	_, _, bodies := readReport(t, report)
+	r.Contains(t, bodies[1], "Action: delayed\r\nStatus: 4.0.0\r\n")
+	r.Contains(t, bodies[1], "Will-Retry-Until: Thu, 03 Jun 2021 12:00:00 +0000\r\n")
+
+	report, err = buildDSN(msg, msg.To, nil, dsnRelayed, nil, queued.Add(time.Minute))
+	r.NoError(t, err)
+	_, _, bodies = readReport(t, report)
+	r.Contains(t, bodies[1], "Action: relayed\r\nStatus: 2.0.0\r\n")
+	r.NotContains(t, bodies[1], "Diagnostic-Code")
+}
+
+func TestMessageHeadersHidePassword(t *testing.T) {
+	literal := "Subject: Secret\r\nX-Peroxide-Password: s3cret\r\n folded\r\nx-peroxide-password-hint: the usual\r\n\r\nHello\r\n"
+
+	r.Equal(t, "Subject: Secret\r\nx-peroxide-password-hint: the usual\r\n\r\n", string(messageHeaders([]byte(literal))))
+}
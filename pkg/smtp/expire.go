@@ -0,0 +1,158 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"context"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/message/parser"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	// expiresHeader asks for the message to be deleted after the given
+	// duration, like 90m, 12h, 7d or 2w.
+	expiresHeader = "X-Peroxide-Expires"
+
+	// passwordHeader asks for the message to be encrypted with the password
+	// for the recipients who have no key; passwordHintHeader goes with it.
+	passwordHeader     = "X-Peroxide-Password"
+	passwordHintHeader = "X-Peroxide-Password-Hint"
+
+	// outsideExpiry is the expiry of password protected messages which do
+	// not ask for one, the longest ProtonMail allows for them.
+	outsideExpiry = 28 * 24 * time.Hour
+)
+
+// messageProtection holds how long a message lives and the password which
+// protects it.
+type messageProtection struct {
+	expiresIn      time.Duration
+	password, hint string
+}
+
+// takeProtection returns the expiry and the password the message asks for
+// and removes the headers so that the recipients do not see them.
+func takeProtection(message *pmapi.Message, root *parser.Part) (messageProtection, error) {
+	var protection messageProtection
+
+	expires := takeHeader(message, root, expiresHeader)
+	password := takeHeader(message, root, passwordHeader)
+	hint := takeHeader(message, root, passwordHintHeader)
+
+	if expires != "" {
+		expiresIn, err := parseExpiry(expires)
+		if err != nil {
+			return protection, permanentError{errors.Wrap(err, "invalid "+expiresHeader+" header")}
+		}
+		protection.expiresIn = expiresIn
+	}
+
+	if password != "" {
+		protection.password = password
+		protection.hint = hint
+
+		if protection.expiresIn == 0 {
+			protection.expiresIn = outsideExpiry
+		}
+	}
+
+	return protection, nil
+}
+
+// takeHeader removes the header from the message and returns its decoded value.
+func takeHeader(message *pmapi.Message, root *parser.Part, key string) string {
+	value := strings.TrimSpace(message.Header.Get(key))
+
+	delete(message.Header, key)
+	root.Header.Del(key)
+
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+		value = decoded
+	}
+
+	return value
+}
+
+// parseExpiry parses a positive duration, which besides the units known to
+// time.ParseDuration may be given in days or weeks.
+func parseExpiry(value string) (time.Duration, error) {
+	var expiry time.Duration
+
+	switch {
+	case strings.HasSuffix(value, "d"), strings.HasSuffix(value, "w"):
+		n, err := strconv.Atoi(value[:len(value)-1])
+		if err != nil {
+			return 0, err
+		}
+
+		expiry = time.Duration(n) * 24 * time.Hour
+		if strings.HasSuffix(value, "w") {
+			expiry *= 7
+		}
+
+	default:
+		var err error
+		if expiry, err = time.ParseDuration(value); err != nil {
+			return 0, err
+		}
+	}
+
+	if expiry <= 0 {
+		return 0, errors.New("expiry must be positive")
+	}
+
+	return expiry, nil
+}
+
+// outsidePreferences returns how to send the message encrypted with the
+// password to a recipient who has no key.
+func outsidePreferences(messageMIMEType string) SendPreferences {
+	mimeType := pmapi.ContentTypeHTML
+	if messageMIMEType == pmapi.ContentTypePlainText {
+		mimeType = pmapi.ContentTypePlainText
+	}
+
+	return SendPreferences{
+		Encrypt:  true,
+		Sign:     true,
+		Scheme:   pmapi.EncryptedOutsidePackage,
+		MIMEType: mimeType,
+	}
+}
+
+// setOutsidePassword lets the request encrypt the message with the password.
+func (su *smtpUser) setOutsidePassword(req *pmapi.SendMessageReq, protection messageProtection) error {
+	modulus, err := su.client().GetAuthModulus(context.TODO())
+	if err != nil {
+		return err
+	}
+
+	password := []byte(protection.password)
+
+	auth, err := pmapi.NewPasswordAuth(modulus, password)
+	if err != nil {
+		return err
+	}
+
+	return req.SetOutsidePassword(password, protection.hint, auth)
+}
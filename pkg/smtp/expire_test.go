@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	pkgMsg "github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/message/parser"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	r "github.com/stretchr/testify/require"
+)
+
+func takeTestProtection(t *testing.T, headers string) (messageProtection, error) {
+	literal := "From: me@example.com\r\nTo: you@example.org\r\nSubject: Secret\r\n" + headers
+	literal += "Content-Type: text/plain\r\n\r\nHello\r\n"
+
+	p, err := parser.New(strings.NewReader(literal))
+	r.NoError(t, err)
+	m, _, _, err := pkgMsg.ParserWithParser(p)
+	r.NoError(t, err)
+
+	protection, err := takeProtection(m, p.Root())
+
+	// The headers, the password above all, never reach the recipients.
+	mimeBody, buildErr := pkgMsg.BuildMIMEBody(p)
+	r.NoError(t, buildErr)
+	r.False(t, bytes.Contains(bytes.ToLower([]byte(mimeBody)), []byte("x-peroxide")))
+	for key := range m.Header {
+		r.False(t, strings.HasPrefix(strings.ToLower(key), "x-peroxide"), key)
+	}
+
+	return protection, err
+}
+
+func TestTakeProtection(t *testing.T) {
+	protection, err := takeTestProtection(t, "")
+	r.NoError(t, err)
+	r.Equal(t, messageProtection{}, protection)
+
+	protection, err = takeTestProtection(t, "X-Peroxide-Expires: 7d\r\n")
+	r.NoError(t, err)
+	r.Equal(t, messageProtection{expiresIn: 7 * 24 * time.Hour}, protection)
+
+	protection, err = takeTestProtection(t, "X-Peroxide-Password: s3cret\r\nX-Peroxide-Password-Hint: =?utf-8?q?caf=C3=A9?=\r\n")
+	r.NoError(t, err)
+	r.Equal(t, messageProtection{expiresIn: outsideExpiry, password: "s3cret", hint: "café"}, protection)
+
+	protection, err = takeTestProtection(t, "X-Peroxide-Password: s3cret\r\nX-Peroxide-Expires: 36h\r\n")
+	r.NoError(t, err)
+	r.Equal(t, messageProtection{expiresIn: 36 * time.Hour, password: "s3cret"}, protection)
+
+	_, err = takeTestProtection(t, "X-Peroxide-Password: s3cret\r\nX-Peroxide-Expires: soon\r\n")
+	r.True(t, isPermanentSendError(err))
+}
+
+func TestParseExpiry(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"90m": 90 * time.Minute,
+		"12h": 12 * time.Hour,
+		"1d":  24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+	} {
+		expiry, err := parseExpiry(value)
+		r.NoError(t, err, value)
+		r.Equal(t, want, expiry, value)
+	}
+
+	for _, value := range []string{"", "d", "0d", "-1h", "week"} {
+		_, err := parseExpiry(value)
+		r.Error(t, err, value)
+	}
+}
+
+func TestOutsidePreferences(t *testing.T) {
+	r.Equal(t, pmapi.ContentTypePlainText, outsidePreferences(pmapi.ContentTypePlainText).MIMEType)
+	r.Equal(t, pmapi.ContentTypeHTML, outsidePreferences(pmapi.ContentTypeHTML).MIMEType)
+	r.Equal(t, pmapi.ContentTypeHTML, outsidePreferences(pmapi.ContentTypeMultipartMixed).MIMEType)
+	r.Equal(t, pmapi.EncryptedOutsidePackage, outsidePreferences(pmapi.ContentTypeHTML).Scheme)
+}
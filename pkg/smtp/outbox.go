@@ -0,0 +1,199 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// outboxInterval is how often the outbox is checked for due messages
+	// when nothing is queued in between.
+	outboxInterval = 30 * time.Second
+
+	// outboxMinDelay and outboxMaxDelay bound the delay between two attempts
+	// to send a queued message. The delay doubles with every attempt.
+	outboxMinDelay = time.Minute
+	outboxMaxDelay = time.Hour
+
+	// outboxExpiry is how long a queued message is retried before it bounces.
+	outboxExpiry = 48 * time.Hour
+
+	// outboxDelayWarning is how long a queued message waits before the
+	// recipients who asked for it are reported as delayed.
+	outboxDelayWarning = 4 * time.Hour
+)
+
+var errStillSending = errors.New("original message is still being sent") //nolint[gochecknoglobals]
+
+// permanentError marks the send errors which do not go away by retrying.
+type permanentError struct {
+	error
+}
+
+// isPermanentSendError returns whether the queued message failed for good
+// and should bounce.
+func isPermanentSendError(err error) bool {
+	if _, ok := err.(permanentError); ok {
+		return true
+	}
+
+	cause := errors.Cause(err)
+	return pmapi.IsUnprocessableEntity(cause) || pmapi.IsBadRequest(cause)
+}
+
+// outboxDelay returns how long to wait before the next attempt to send
+// a message which failed the given number of times.
+func outboxDelay(attempts int) time.Duration {
+	delay := outboxMinDelay
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > outboxMaxDelay {
+		return outboxMaxDelay
+	}
+
+	return delay
+}
+
+// RunOutbox sends the queued messages of all users in the background until
+// the backend is drained. The ready channel is signalled when new messages
+// are queued or the outbox is flushed.
+func (sb *smtpBackend) RunOutbox(ready <-chan struct{}) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ready:
+		case <-ticker.C:
+		}
+
+		// The messages being sent hold the drain back like the ones being
+		// queued; nothing is sent once the backend is draining.
+		if !sb.beginSend() {
+			return
+		}
+
+		for _, user := range sb.users.GetUsers() {
+			sb.sendQueued(user, time.Now())
+		}
+
+		sb.endSend()
+	}
+}
+
+func (sb *smtpBackend) sendQueued(user *users.User, now time.Time) {
+	storeUser := user.GetStore()
+	if storeUser == nil {
+		return
+	}
+
+	messages, err := storeUser.QueuedMessages()
+	if err != nil {
+		log.WithError(err).Error("Cannot list the queued messages")
+		return
+	}
+
+	for _, msg := range messages {
+		if !msg.IsDue(now) {
+			continue
+		}
+
+		// The messages wait until the server is reachable again.
+		if storeUser.IsOffline() {
+			return
+		}
+
+		su := &smtpUser{
+			eventListener: sb.eventListener,
+			backend:       sb,
+			user:          user,
+			storeUser:     storeUser,
+			username:      user.Username(),
+			addressID:     msg.AddressID,
+		}
+		su.sendQueuedMessage(msg, now)
+	}
+}
+
+// sendQueuedMessage sends the message from the outbox. The message is removed
+// once it is sent or it bounces; otherwise it is tried again later.
+func (su *smtpUser) sendQueuedMessage(msg store.QueuedMessage, now time.Time) {
+	l := log.WithFields(logrus.Fields{
+		"queued":   msg.ID,
+		"attempts": msg.Attempts,
+	})
+
+	literal, err := su.storeUser.QueuedMessageLiteral(msg.ID)
+	if err == nil {
+		err = su.Send(msg.ReturnPath, msg.To, bytes.NewReader(literal))
+	}
+
+	switch {
+	case err == nil:
+		l.Info("Queued message was sent")
+		if err := su.notify(msg, literal, dsnRelayed, nil, now); err != nil {
+			l.WithError(err).Error("Delivery report could not be delivered")
+		}
+
+	case isPermanentSendError(err), now.Sub(msg.Queued) > outboxExpiry:
+		l.WithError(err).Warn("Queued message cannot be sent, bouncing")
+		if err := su.notify(msg, literal, dsnFailed, err, now); err != nil {
+			l.WithError(err).Error("Bounce could not be delivered")
+		}
+
+	default:
+		next := now.Add(outboxDelay(msg.Attempts + 1))
+		l.WithError(err).WithField("next", next).Warn("Queued message was not sent, trying again later")
+		if err := su.storeUser.DeferQueuedMessage(msg.ID, err, next); err != nil {
+			l.WithError(err).Error("Cannot defer the queued message")
+		}
+
+		if !msg.DelayReported && now.Sub(msg.Queued) > outboxDelayWarning {
+			su.reportDelay(msg, literal, err, now)
+		}
+		return
+	}
+
+	if err := su.storeUser.RemoveQueuedMessage(msg.ID); err != nil {
+		l.WithError(err).Error("Cannot remove the queued message")
+	}
+}
+
+// reportDelay notifies the sender that the queued message is delayed, for the
+// recipients which asked for it. It is done once per message.
+func (su *smtpUser) reportDelay(msg store.QueuedMessage, literal []byte, cause error, now time.Time) {
+	l := log.WithField("queued", msg.ID)
+
+	if err := su.notify(msg, literal, dsnDelayed, cause, now); err != nil {
+		l.WithError(err).Error("Delay report could not be delivered")
+		return
+	}
+
+	if err := su.storeUser.ReportQueuedMessageDelay(msg.ID); err != nil {
+		l.WithError(err).Error("Cannot record the delay report")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	r "github.com/stretchr/testify/require"
+)
+
+type lockedOutbox struct {
+	storeUserProvider
+
+	deferred map[string]time.Time
+	removed  []string
+}
+
+func (lockedOutbox) QueuedMessageLiteral(string) ([]byte, error) {
+	return nil, pmapi.ErrNoKeyringAvailable
+}
+
+func (o *lockedOutbox) DeferQueuedMessage(id string, _ error, next time.Time) error {
+	o.deferred[id] = next
+	return nil
+}
+
+func (o *lockedOutbox) RemoveQueuedMessage(id string) error {
+	o.removed = append(o.removed, id)
+	return nil
+}
+
+func TestOutboxDelay(t *testing.T) {
+	r.Equal(t, time.Minute, outboxDelay(1))
+	r.Equal(t, 2*time.Minute, outboxDelay(2))
+	r.Equal(t, 32*time.Minute, outboxDelay(6))
+	r.Equal(t, time.Hour, outboxDelay(7))
+	r.Equal(t, time.Hour, outboxDelay(100))
+}
+
+func TestIsPermanentSendError(t *testing.T) {
+	r.True(t, isPermanentSendError(permanentError{errors.New("invalid recipient")}))
+	r.True(t, isPermanentSendError(pmapi.ErrUnprocessableEntity{OriginalError: errors.New("recipient does not exist")}))
+	r.False(t, isPermanentSendError(pmapi.ErrNoConnection))
+	r.False(t, isPermanentSendError(errStillSending))
+}
+
+func TestSendQueuedMessageIsDeferred(t *testing.T) {
+	outbox := &lockedOutbox{deferred: map[string]time.Time{}}
+	su := &smtpUser{storeUser: outbox}
+
+	now := time.Now()
+	su.sendQueuedMessage(store.QueuedMessage{ID: "1", Queued: now, Attempts: 2}, now)
+
+	r.Equal(t, map[string]time.Time{"1": now.Add(4 * time.Minute)}, outbox.deferred)
+	r.Empty(t, outbox.removed)
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/message/parser"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+// deliverAtHeader asks for the message to be delivered later. It holds the
+// time of the delivery as an RFC 5322 or RFC 3339 date, or as a Unix time.
+const deliverAtHeader = "X-Peroxide-Deliver-At"
+
+// takeDeliveryTime returns the time at which the message asks to be delivered
+// and removes the header so that the recipients do not see it. The zero time
+// is returned when the message should be delivered right away.
+func takeDeliveryTime(message *pmapi.Message, root *parser.Part, now time.Time) (time.Time, error) {
+	value := takeHeader(message, root, deliverAtHeader)
+
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	deliverAt, err := parseDeliveryTime(value)
+	if err != nil {
+		return time.Time{}, permanentError{errors.Wrap(err, "invalid "+deliverAtHeader+" header")}
+	}
+
+	if !deliverAt.After(now) {
+		return time.Time{}, nil
+	}
+
+	return deliverAt, nil
+}
+
+func parseDeliveryTime(value string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return mail.ParseDate(value)
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package smtp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	pkgMsg "github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/message/parser"
+	r "github.com/stretchr/testify/require"
+)
+
+func takeTestDeliveryTime(t *testing.T, deliverAt string, now time.Time) (time.Time, error) {
+	literal := "From: me@example.com\r\nTo: you@example.org\r\nSubject: Later\r\n"
+	if deliverAt != "" {
+		literal += "x-peroxide-deliver-at: " + deliverAt + "\r\n"
+	}
+	literal += "Content-Type: text/plain\r\n\r\nHello\r\n"
+
+	p, err := parser.New(strings.NewReader(literal))
+	r.NoError(t, err)
+	m, _, _, err := pkgMsg.ParserWithParser(p)
+	r.NoError(t, err)
+
+	deliveryTime, err := takeDeliveryTime(m, p.Root(), now)
+
+	// The header never reaches the recipients.
+	r.Empty(t, m.Header.Get(deliverAtHeader))
+	mimeBody, buildErr := pkgMsg.BuildMIMEBody(p)
+	r.NoError(t, buildErr)
+	r.False(t, bytes.Contains(bytes.ToLower([]byte(mimeBody)), []byte("deliver-at")))
+
+	return deliveryTime, err
+}
+
+func TestTakeDeliveryTime(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	later := time.Date(2021, 6, 2, 8, 30, 0, 0, time.UTC)
+
+	for _, value := range []string{
+		"Wed, 02 Jun 2021 08:30:00 +0000",
+		"2021-06-02T10:30:00+02:00",
+		"1622622600",
+	} {
+		deliverAt, err := takeTestDeliveryTime(t, value, now)
+		r.NoError(t, err, value)
+		r.True(t, later.Equal(deliverAt), value)
+	}
+
+	deliverAt, err := takeTestDeliveryTime(t, "", now)
+	r.NoError(t, err)
+	r.True(t, deliverAt.IsZero())
+
+	// The past means now.
+	deliverAt, err = takeTestDeliveryTime(t, "Mon, 31 May 2021 08:30:00 +0000", now)
+	r.NoError(t, err)
+	r.True(t, deliverAt.IsZero())
+
+	_, err = takeTestDeliveryTime(t, "tomorrow", now)
+	r.True(t, isPermanentSendError(err))
+}
@@ -22,21 +22,25 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/emersion/go-sasl"
 	goSMTP "github.com/emersion/go-smtp"
 	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/oauth"
 	"github.com/ljanyst/peroxide/pkg/serverutil"
 )
 
 // Server is Bridge SMTP server implementation.
 type Server struct {
-	backend goSMTP.Backend
-	debug   bool
-	useSSL  bool
-	address string
-	port    int
-	tls     *tls.Config
+	backend     *smtpBackend
+	debug       bool
+	useSSL      bool
+	addressLock sync.RWMutex
+	address     string
+	port        int
+	tls         *tls.Config
+	tokens      *oauth.TokenStore
 
 	server     *goSMTP.Server
 	controller serverutil.Controller
@@ -49,7 +53,8 @@ func NewSMTPServer(
 	port int,
 	useSSL bool,
 	tls *tls.Config,
-	smtpBackend goSMTP.Backend,
+	smtpBackend *smtpBackend,
+	tokens *oauth.TokenStore,
 	eventListener listener.Listener,
 ) *Server {
 	server := &Server{
@@ -59,6 +64,7 @@ func NewSMTPServer(
 		address: address,
 		port:    port,
 		tls:     tls,
+		tokens:  tokens,
 	}
 
 	server.server = newGoSMTPServer(server)
@@ -74,18 +80,35 @@ func newGoSMTPServer(s *Server) *goSMTP.Server {
 	newSMTP.ErrorLog = serverutil.NewServerErrorLogger(serverutil.SMTP)
 	newSMTP.AllowInsecureAuth = true
 	newSMTP.MaxLineLength = 1 << 16
+	newSMTP.EnableDSN = true
+
+	login := func(conn *goSMTP.Conn) func(address, password string) error {
+		return func(address, password string) error {
+			return conn.Session().AuthPlain(address, password)
+		}
+	}
 
 	newSMTP.EnableAuth(sasl.Login, func(conn *goSMTP.Conn) sasl.Server {
-		return sasl.NewLoginServer(func(address, password string) error {
-			user, err := conn.Server().Backend.Login(nil, address, password)
-			if err != nil {
-				return err
-			}
-
-			conn.SetSession(user)
-			return nil
-		})
+		return sasl.NewLoginServer(login(conn))
 	})
+
+	if s.tokens != nil {
+		newSMTP.EnableAuth(sasl.OAuthBearer, func(conn *goSMTP.Conn) sasl.Server {
+			return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+				if err := s.tokens.Authenticate(opts.Username, opts.Token, login(conn)); err != nil {
+					log.WithError(err).Warn("OAUTHBEARER authentication failed")
+					return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+				}
+				return nil
+			})
+		})
+
+		newSMTP.EnableAuth(oauth.XOAuth2, func(conn *goSMTP.Conn) sasl.Server {
+			return oauth.NewXOAuth2Server(func(username, token string) error {
+				return s.tokens.Authenticate(username, token, login(conn))
+			})
+		})
+	}
 	return newSMTP
 }
 
@@ -95,12 +118,34 @@ func (s *Server) ListenAndServe() { s.controller.ListenAndServe() }
 // Close turns off server and monitors.
 func (s *Server) Close() { s.controller.Close() }
 
+// StopListening stops accepting connections. The sessions in progress continue
+// until the server is closed.
+func (s *Server) StopListening() { s.controller.StopListening() }
+
+// Rebind makes the server listen on a new address without closing the
+// connections it has already accepted.
+func (s *Server) Rebind(address string, port int) {
+	s.addressLock.Lock()
+	s.address = address
+	s.port = port
+	s.addressLock.Unlock()
+
+	s.controller.Rebind()
+}
+
+// Address returns the address the server listens on.
+func (s *Server) Address() string {
+	s.addressLock.RLock()
+	defer s.addressLock.RUnlock()
+
+	return fmt.Sprintf("%s:%d", s.address, s.port)
+}
+
 // Implements servertutil.Server interface.
 
-func (Server) Protocol() serverutil.Protocol { return serverutil.SMTP }
-func (s *Server) UseSSL() bool               { return s.useSSL }
-func (s *Server) Address() string            { return fmt.Sprintf("%s:%d", s.address, s.port) }
-func (s *Server) TLSConfig() *tls.Config     { return s.tls }
+func (*Server) Protocol() serverutil.Protocol { return serverutil.SMTP }
+func (s *Server) UseSSL() bool                { return s.useSSL }
+func (s *Server) TLSConfig() *tls.Config      { return s.tls }
 
 func (s *Server) DebugServer() bool { return s.debug }
 func (s *Server) DebugClient() bool { return s.debug }
@@ -109,14 +154,7 @@ func (s *Server) SetLoggers(localDebug, remoteDebug io.Writer) { s.server.Debug
 
 func (s *Server) DisconnectUser(address string) {
 	log.Info("Disconnecting all open SMTP connections for ", address)
-	s.server.ForEachConn(func(conn *goSMTP.Conn) {
-		connUser := conn.Session()
-		if connUser != nil {
-			if err := conn.Close(); err != nil {
-				log.WithError(err).Error("Failed to close the connection")
-			}
-		}
-	})
+	s.backend.closeSessions()
 }
 
 func (s *Server) Serve(l net.Listener) error { return s.server.Serve(l) }
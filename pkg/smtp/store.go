@@ -19,9 +19,11 @@ package smtp
 
 import (
 	"io"
+	"time"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
 )
 
 type storeUserProvider interface {
@@ -33,5 +35,14 @@ type storeUserProvider interface {
 		attachedPublicKeyName string,
 		parentID string) (*pmapi.Message, []*pmapi.Attachment, error)
 	SendMessage(messageID string, req *pmapi.SendMessageReq) error
+	SetMessageIdentity(messageID, identity string) error
 	GetMaxUpload() (int64, error)
+	IsOffline() bool
+
+	QueueMessage(addressID, returnPath string, to []string, dsnEnvelope store.DSNEnvelope, dsn map[string]store.DSNRequest, literal []byte) (string, error)
+	QueuedMessages() ([]store.QueuedMessage, error)
+	QueuedMessageLiteral(id string) ([]byte, error)
+	DeferQueuedMessage(id string, cause error, next time.Time) error
+	ReportQueuedMessageDelay(id string) error
+	RemoveQueuedMessage(id string) error
 }
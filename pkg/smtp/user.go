@@ -25,9 +25,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/mail"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
@@ -35,7 +37,9 @@ import (
 	"github.com/ljanyst/peroxide/pkg/listener"
 	pkgMsg "github.com/ljanyst/peroxide/pkg/message"
 	"github.com/ljanyst/peroxide/pkg/message/parser"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
 	"github.com/ljanyst/peroxide/pkg/users"
 	"github.com/pkg/errors"
 )
@@ -43,39 +47,56 @@ import (
 type smtpUser struct {
 	eventListener listener.Listener
 	backend       *smtpBackend
-	user          *users.User
-	storeUser     storeUserProvider
-	username      string
-	addressID     string
-	bccSelf       bool
-
-	returnPath string
-	to         []string
+	conn          *goSMTPBackend.Conn
+
+	// userLock guards the user of the session, which is set once it is
+	// authenticated.
+	userLock  sync.RWMutex
+	user      *users.User
+	storeUser storeUserProvider
+	username  string
+	addressID string
+	bccSelf   bool
+
+	returnPath  string
+	to          []string
+	dsn         map[string]store.DSNRequest
+	dsnEnvelope store.DSNEnvelope
 }
 
-// newSMTPUser returns struct implementing go-smtp/session interface.
-func newSMTPUser(
-	eventListener listener.Listener,
-	smtpBackend *smtpBackend,
+// setUser authenticates the session as the given user.
+func (su *smtpUser) setUser(
 	user *users.User,
 	username string,
 	addressID string,
 	bccSelf bool,
-) (goSMTPBackend.Session, error) {
+) error {
 	storeUser := user.GetStore()
 	if storeUser == nil {
-		return nil, errors.New("user database is not initialized")
-	}
-
-	return &smtpUser{
-		eventListener: eventListener,
-		backend:       smtpBackend,
-		user:          user,
-		storeUser:     storeUser,
-		username:      username,
-		addressID:     addressID,
-		bccSelf:       bccSelf,
-	}, nil
+		return errors.New("user database is not initialized")
+	}
+
+	su.userLock.Lock()
+	defer su.userLock.Unlock()
+
+	su.user = user
+	su.storeUser = storeUser
+	su.username = username
+	su.addressID = addressID
+	su.bccSelf = bccSelf
+	return nil
+}
+
+func (su *smtpUser) isAuthenticated() bool {
+	su.userLock.RLock()
+	defer su.userLock.RUnlock()
+
+	return su.user != nil
+}
+
+// AuthPlain authenticates the session with the PLAIN mechanism.
+func (su *smtpUser) AuthPlain(username, password string) error {
+	return su.backend.login(su, username, password)
 }
 
 // This method should eventually no longer be necessary. Everything should go via store.
@@ -158,12 +179,18 @@ func (su *smtpUser) Reset() {
 	log.Trace("Resetting the session")
 	su.returnPath = ""
 	su.to = []string{}
+	su.dsn = nil
+	su.dsnEnvelope = store.DSNEnvelope{}
 }
 
 // Set return path for currently processed message.
-func (su *smtpUser) Mail(returnPath string, opts goSMTPBackend.MailOptions) error {
+func (su *smtpUser) Mail(returnPath string, opts *goSMTPBackend.MailOptions) error {
 	log.WithField("returnPath", returnPath).WithField("opts", opts).Trace("Setting mail from")
 
+	if !su.isAuthenticated() {
+		return goSMTPBackend.ErrAuthRequired
+	}
+
 	// REQUIRETLS and SMTPUTF8 have to be announced to be used by client.
 	// Bridge does not use those extensions so this should not happen.
 	if opts.RequireTLS {
@@ -178,28 +205,53 @@ func (su *smtpUser) Mail(returnPath string, opts goSMTPBackend.MailOptions) erro
 	}
 
 	if returnPath != "" {
-		addr := su.client().Addresses().ByEmail(returnPath)
+		addr := su.client().Addresses().ByEmailOrCatchAll(returnPath)
 		if addr == nil {
 			return errors.New("backend: invalid return path: not owned by user")
 		}
+
+		// In split mode, the session can only send from the address it logged in with.
+		if su.addressID != "" && addr.ID != su.addressID {
+			return errors.New("backend: invalid return path: not the address of this session")
+		}
 	}
 
 	su.returnPath = returnPath
+	su.dsnEnvelope = store.DSNEnvelope{
+		Return:     string(opts.Return),
+		EnvelopeID: opts.EnvelopeID,
+	}
 	return nil
 }
 
 // Add recipient for currently processed message.
-func (su *smtpUser) Rcpt(to string) error {
-	log.WithField("to", to).Trace("Adding recipient")
-	if to != "" {
-		su.to = append(su.to, to)
+func (su *smtpUser) Rcpt(to string, opts *goSMTPBackend.RcptOptions) error {
+	log.WithField("to", to).WithField("opts", opts).Trace("Adding recipient")
+
+	su.to = append(su.to, to)
+
+	if dsn := newDSNRequest(opts); dsn != nil {
+		if su.dsn == nil {
+			su.dsn = map[string]store.DSNRequest{}
+		}
+		su.dsn[to] = *dsn
 	}
+
 	return nil
 }
 
-// Set currently processed message contents and send it.
+// Set currently processed message contents and queue it to be sent.
 func (su *smtpUser) Data(r io.Reader) error {
-	log.Trace("Sending the message")
+	log.Trace("Queueing the message")
+	if !su.backend.beginSend() {
+		return &goSMTPBackend.SMTPError{
+			Code:         421,
+			EnhancedCode: goSMTPBackend.EnhancedCode{4, 3, 2},
+			Message:      "Server is shutting down",
+		}
+	}
+	defer su.backend.endSend()
+
 	if su.returnPath == "" {
 		return errors.New("missing return path")
 	}
@@ -219,7 +271,25 @@ func (su *smtpUser) Data(r io.Reader) error {
 		su.to = append(su.to, su.returnPath)
 	}
 
-	return su.Send(su.returnPath, su.to, r)
+	literal, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// The message is sent in the background so that slow API does not make
+	// the client time out and send the message again.
+	id, err := su.storeUser.QueueMessage(su.addressID, su.returnPath, su.to, su.dsnEnvelope, su.dsn, literal)
+	if err != nil {
+		log.WithError(err).Error("Message could not be queued")
+		return &goSMTPBackend.SMTPError{
+			Code:         451,
+			EnhancedCode: goSMTPBackend.EnhancedCode{4, 3, 0},
+			Message:      "Message could not be queued, try again later",
+		}
+	}
+
+	log.WithField("queued", id).Info("Message was queued")
+	return nil
 }
 
 // Send sends an email from the given address to the given addresses with the given body.
@@ -233,40 +303,63 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 		return err
 	}
 
-	returnPathAddr := su.client().Addresses().ByEmail(returnPath)
+	returnPathAddr := su.client().Addresses().ByEmailOrCatchAll(returnPath)
 	if returnPathAddr == nil {
-		err = errors.New("backend: invalid return path: not owned by user")
+		err = permanentError{errors.New("backend: invalid return path: not owned by user")}
 		return
 	}
 
 	parser, err := parser.New(messageReader)
 	if err != nil {
-		err = errors.Wrap(err, "failed to create new parser")
+		err = permanentError{errors.Wrap(err, "failed to create new parser")}
 		return
 	}
 	message, plainBody, attReaders, err := pkgMsg.ParserWithParser(parser)
 	if err != nil {
 		log.WithError(err).Error("Failed to parse message")
+		err = permanentError{err}
 		return
 	}
 	richBody := message.Body
 
+	deliverAt, err := takeDeliveryTime(message, parser.Root(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	protection, err := takeProtection(message, parser.Root())
+	if err != nil {
+		return err
+	}
+
 	externalID := message.Header.Get("Message-Id")
 	externalID = strings.Trim(externalID, "<>")
 
 	draftID, parentID := su.handleReferencesHeader(message)
 
 	if err = su.handleSenderAndRecipients(message, returnPathAddr, returnPath, to); err != nil {
-		return err
+		return permanentError{err}
 	}
 
-	addr := su.client().Addresses().ByEmail(message.Sender.Address)
+	addr := su.client().Addresses().ByEmailOrCatchAll(message.Sender.Address)
 	if addr == nil {
-		err = errors.New("backend: invalid email address: not owned by user")
+		err = permanentError{errors.New("backend: invalid email address: not owned by user")}
 		return
 	}
 
-	message.Sender.Address = pmapi.ConstructAddress(message.Sender.Address, addr.Email)
+	if su.addressID != "" && addr.ID != su.addressID {
+		err = permanentError{errors.New("backend: invalid email address: not the address of this session")}
+		return
+	}
+
+	sentAsCatchAll := addr.IsCatchAllFor(message.Sender.Address)
+	if sentAsCatchAll {
+		// The message keeps the sender the client asked for but it is signed
+		// by the catch-all address, which the sent copy records.
+		log.WithField("sender", message.Sender.Address).WithField("identity", addr.Email).Debug("Sending through catch-all address")
+	} else {
+		message.Sender.Address = pmapi.ConstructAddress(message.Sender.Address, addr.Email)
+	}
 
 	kr, err := su.client().KeyRingForAddressID(addr.ID)
 	if err != nil {
@@ -310,24 +403,15 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 	// the IMAP through the bridge user.
 	message.ExternalID = externalID
 
-	// If Outlook does not get a response quickly, it will try to send the message again, leading
-	// to sending the same message multiple times. In case we detect the same message is in the
-	// sending queue, we wait a minute to finish the first request. If the message is still being
-	// sent after the timeout, we return an error back to the client. The UX is not the best,
-	// but it's better than sending the message many times. If the message was sent, we simply return
-	// nil to indicate it's OK.
+	// A client may still queue the same message twice, for example when the
+	// connection dropped before it got the response. In case we detect the
+	// same message is being sent, the queued one is tried again later. If the
+	// message was sent, we simply return nil so that it leaves the queue.
 	sendRecorderMessageHash := su.backend.sendRecorder.getMessageHash(message)
 	isSending, wasSent := su.backend.sendRecorder.isSendingOrSent(su.client(), sendRecorderMessageHash)
-
-	startTime := time.Now()
-	for isSending && time.Since(startTime) < 90*time.Second {
-		log.Warn("Message is still in send queue, waiting for a bit")
-		time.Sleep(15 * time.Second)
-		isSending, wasSent = su.backend.sendRecorder.isSendingOrSent(su.client(), sendRecorderMessageHash)
-	}
 	if isSending {
-		log.Warn("Message is still in send queue, returning error to prevent client from adding it to the sent folder prematurely")
-		return errors.New("original message is still being sent")
+		log.Warn("Message is still being sent, trying again later")
+		return errStillSending
 	}
 	if wasSent {
 		log.Warn("Message was already sent")
@@ -344,6 +428,14 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 	su.backend.sendRecorder.setMessageID(sendRecorderMessageHash, message.ID)
 	log.WithField("messageID", message.ID).Debug("Draft was created successfully")
 
+	// The identity is only recorded locally so that it does not reach the
+	// recipients.
+	if sentAsCatchAll {
+		if err := su.storeUser.SetMessageIdentity(message.ID, addr.Email); err != nil {
+			log.WithError(err).Warn("Cannot record the identity of the sent message")
+		}
+	}
+
 	// We always have to create a new draft even if there already is one,
 	// because clients don't necessarily save the draft before sending, which
 	// can lead to sending the wrong message. Also clients do not necessarily
@@ -371,10 +463,16 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 	req := pmapi.NewSendMessageReq(kr, mimeBody, plainBody, richBody, attkeys)
 	containsUnencryptedRecipients := false
 
+	if protection.password != "" {
+		if err := su.setOutsidePassword(req, protection); err != nil {
+			return errors.Wrap(err, "failed to set password")
+		}
+	}
+
 	for _, recipient := range message.Recipients() {
 		email := recipient.Address
 		if !looksLikeEmail(email) {
-			return errors.New(`"` + email + `" is not a valid recipient.`)
+			return permanentError{errors.New(`"` + email + `" is not a valid recipient.`)}
 		}
 
 		sendPreferences, err := su.getSendPreferences(email, message.MIMEType, mailSettings)
@@ -385,6 +483,12 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 			return err
 		}
 
+		// Recipients without a key read the message protected by the
+		// password on the web instead of getting it in clear.
+		if protection.password != "" && !sendPreferences.Encrypt {
+			sendPreferences = outsidePreferences(message.MIMEType)
+		}
+
 		var signature pmapi.SignatureFlag
 		if sendPreferences.Sign {
 			signature = pmapi.SignatureDetached
@@ -405,6 +509,16 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 		}
 	}
 
+	if protection.expiresIn != 0 {
+		log.WithField("expiresIn", protection.expiresIn).Info("Setting the message to expire")
+		req.ExpiresIn = int64(protection.expiresIn.Seconds())
+	}
+
+	if !deliverAt.IsZero() {
+		log.WithField("deliverAt", deliverAt).Info("Scheduling the message")
+		req.DeliveryTime = deliverAt.Unix()
+	}
+
 	req.PreparePackages()
 
 	dumpMessageData(b.Bytes(), message.Subject)
@@ -459,7 +573,9 @@ func (su *smtpUser) handleReferencesHeader(m *pmapi.Message) (draftID, parentID
 }
 
 func (su *smtpUser) handleSenderAndRecipients(m *pmapi.Message, returnPathAddr *pmapi.Address, returnPath string, to []string) (err error) {
-	returnPath = pmapi.ConstructAddress(returnPath, returnPathAddr.Email)
+	if !returnPathAddr.IsCatchAllFor(returnPath) {
+		returnPath = pmapi.ConstructAddress(returnPath, returnPathAddr.Email)
+	}
 
 	// Check sender.
 	if m.Sender == nil {
@@ -515,6 +631,13 @@ func (su *smtpUser) handleSenderAndRecipients(m *pmapi.Message, returnPathAddr *
 
 // Logout is called when this User will no longer be used.
 func (su *smtpUser) Logout() error {
+	su.backend.endSession(su)
+
+	if !su.isAuthenticated() {
+		return nil
+	}
+
 	log.Debug("SMTP client logged out user ", su.addressID)
+	metrics.Disconnected("smtp", su.user.ID())
 	return nil
 }
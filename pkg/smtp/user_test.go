@@ -0,0 +1,71 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	r "github.com/stretchr/testify/require"
+)
+
+type offlineStore struct {
+	storeUserProvider
+
+	queued [][]byte
+}
+
+func (*offlineStore) IsOffline() bool { return true }
+
+func (s *offlineStore) QueueMessage(_, _ string, _ []string, _ store.DSNEnvelope, _ map[string]store.DSNRequest, literal []byte) (string, error) {
+	s.queued = append(s.queued, literal)
+	return "1", nil
+}
+
+func TestHandleSenderKeepsCatchAllAddress(t *testing.T) {
+	su := &smtpUser{}
+	catchAll := &pmapi.Address{ID: "1", Email: "me@example.com", Type: pmapi.CustomAddress, CatchAll: true}
+
+	m := &pmapi.Message{}
+	r.NoError(t, su.handleSenderAndRecipients(m, catchAll, "shop@example.com", []string{"you@example.org"}))
+	r.Equal(t, "shop@example.com", m.Sender.Address)
+
+	m = &pmapi.Message{}
+	r.NoError(t, su.handleSenderAndRecipients(m, catchAll, "ME+tag@example.com", []string{"you@example.org"}))
+	r.Equal(t, "me+tag@example.com", m.Sender.Address)
+
+	m = &pmapi.Message{Sender: &mail.Address{Address: "news@example.com"}}
+	r.NoError(t, su.handleSenderAndRecipients(m, catchAll, "shop@example.com", []string{"you@example.org"}))
+	r.Equal(t, "news@example.com", m.Sender.Address)
+}
+
+func TestDataWhileOfflineIsQueued(t *testing.T) {
+	offline := &offlineStore{}
+	su := &smtpUser{
+		storeUser:  offline,
+		backend:    &smtpBackend{},
+		returnPath: "me@example.com",
+		to:         []string{"you@example.org"},
+	}
+
+	r.NoError(t, su.Data(strings.NewReader("Subject: offline\r\n\r\nbody")))
+	r.Equal(t, [][]byte{[]byte("Subject: offline\r\n\r\nbody")}, offline.queued)
+}
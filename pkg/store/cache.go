@@ -19,9 +19,12 @@ package store
 
 import (
 	"context"
+	"io"
+	"io/ioutil"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/store/cache"
 	bolt "go.etcd.io/bbolt"
@@ -110,10 +113,13 @@ func SetBuildAndCacheJobLimit(maxJobs int) {
 	buildAndCacheJobs = make(chan struct{}, maxJobs)
 }
 
-func (store *Store) getCachedMessage(messageID string) ([]byte, error) {
+// getCachedMessage returns the literal of the message, read from the cache or
+// built and written to the cache. The literal must be closed after use.
+func (store *Store) getCachedMessage(messageID string) (*message.Literal, error) {
 	if store.IsCached(messageID) {
-		literal, err := store.cache.Get(store.user.ID(), messageID)
+		literal, err := store.readCachedMessage(messageID)
 		if err == nil {
+			metrics.CacheHit()
 			return literal, nil
 		}
 		store.log.
@@ -122,6 +128,13 @@ func (store *Store) getCachedMessage(messageID string) ([]byte, error) {
 			Warn("Message is cached but cannot be retrieved")
 	}
 
+	metrics.CacheMiss()
+
+	// Only the cached messages can be served offline.
+	if store.IsOffline() {
+		return nil, ErrOffline
+	}
+
 	job, done := store.newBuildJob(context.Background(), messageID, message.ForegroundPriority)
 	defer done()
 
@@ -132,6 +145,8 @@ func (store *Store) getCachedMessage(messageID string) ([]byte, error) {
 	}
 
 	if !store.isMessageADraft(messageID) {
+		store.saveBuiltLiteralInfo(messageID, literal)
+
 		if err := store.writeToCacheUnlockIfFails(messageID, literal); err != nil {
 			store.log.WithError(err).Error("Failed to cache message")
 		}
@@ -142,7 +157,116 @@ func (store *Store) getCachedMessage(messageID string) ([]byte, error) {
 	return literal, nil
 }
 
-func (store *Store) writeToCacheUnlockIfFails(messageID string, literal []byte) error {
+// readCachedMessage returns the cached message streamed from the cache. Its
+// body structure and size come from the database; they are only parsed from
+// the cached message when the database does not have them.
+func (store *Store) readCachedMessage(messageID string) (*message.Literal, error) {
+	open := func() (io.ReadCloser, error) {
+		return store.cache.Get(store.user.ID(), messageID)
+	}
+
+	bs, size, ok := store.getLiteralInfo(messageID)
+	if !ok {
+		var err error
+
+		if bs, size, err = store.parseCachedMessage(messageID, open); err != nil {
+			return nil, err
+		}
+	}
+
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	return message.NewStreamedLiteral(rc, open, size, bs), nil
+}
+
+// getLiteralInfo returns the body structure and the size of the message
+// recorded in the database.
+func (store *Store) getLiteralInfo(messageID string) (*message.BodyStructure, int64, bool) {
+	var rawBS, rawSize []byte
+
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		rawBS = tx.Bucket(bodystructureBucket).Get([]byte(messageID))
+		rawSize = tx.Bucket(sizeBucket).Get([]byte(messageID))
+		return nil
+	}); err != nil || len(rawBS) == 0 || len(rawSize) == 0 {
+		return nil, 0, false
+	}
+
+	bs, err := message.DeserializeBodyStructure(rawBS)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	return bs, int64(btoi(rawSize)), true
+}
+
+// parseCachedMessage reads the body structure and the size of the cached
+// message and records them in the database.
+func (store *Store) parseCachedMessage(messageID string, open func() (io.ReadCloser, error)) (*message.BodyStructure, int64, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rc.Close() //nolint:errcheck
+
+	r := &countingReader{r: rc}
+
+	bs, err := message.NewBodyStructure(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The parser may stop before the end of the message.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, 0, err
+	}
+
+	store.saveLiteralInfo(messageID, bs, r.n)
+
+	return bs, r.n, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// getMessageSections returns the cached message or, if it is not cached, a
+// literal built with only the attachments within the given sections. The
+// second return value tells whether the literal is the whole message. The
+// literal must be closed after use.
+func (store *Store) getMessageSections(messageID string, sections [][]int) (*message.Literal, bool, error) {
+	if sections == nil || store.IsCached(messageID) {
+		literal, err := store.getCachedMessage(messageID)
+		return literal, err == nil, err
+	}
+
+	if store.IsOffline() {
+		return nil, false, ErrOffline
+	}
+
+	job, done := store.newSectionsBuildJob(context.Background(), messageID, sections, message.ForegroundPriority)
+	defer done()
+
+	literal, err := job.GetResult()
+	if err != nil {
+		store.checkAndRemoveDeletedMessage(err, messageID)
+		return nil, false, err
+	}
+
+	return literal, false, nil
+}
+
+func (store *Store) writeToCacheUnlockIfFails(messageID string, literal cache.Literal) error {
 	err := store.cache.Set(store.user.ID(), messageID, literal)
 	if err == nil && err != cache.ErrCacheNeedsUnlock {
 		return err
@@ -177,7 +301,8 @@ func (store *Store) BuildAndCacheMessage(ctx context.Context, messageID string)
 	buildAndCacheJobs <- struct{}{}
 	defer func() { <-buildAndCacheJobs }()
 
-	if store.isMessageADraft(messageID) {
+	// A client may have fetched the message while it was waiting.
+	if store.isMessageADraft(messageID) || store.IsCached(messageID) {
 		return nil
 	}
 
@@ -189,10 +314,69 @@ func (store *Store) BuildAndCacheMessage(ctx context.Context, messageID string)
 		store.checkAndRemoveDeletedMessage(err, messageID)
 		return err
 	}
+	defer literal.Close() //nolint:errcheck
+
+	store.saveBuiltLiteralInfo(messageID, literal)
 
 	return store.cache.Set(store.user.ID(), messageID, literal)
 }
 
+// saveBuiltLiteralInfo records the body structure and the size of a freshly
+// built message, both computed while it was built, so that answering FETCH
+// BODYSTRUCTURE or RFC822.SIZE, or streaming the message from the cache later
+// does not require parsing it again.
+func (store *Store) saveBuiltLiteralInfo(messageID string, literal *message.Literal) {
+	bs, err := literal.Structure()
+	if err != nil {
+		store.log.WithField("msg", messageID).WithError(err).Warn("Failed to parse body structure")
+		return
+	}
+
+	store.saveLiteralInfo(messageID, bs, literal.Size())
+}
+
+func (store *Store) saveLiteralInfo(messageID string, bs *message.BodyStructure, size int64) {
+	raw, err := bs.Serialize()
+	if err != nil {
+		store.log.WithField("msg", messageID).WithError(err).Warn("Failed to serialize body structure")
+		return
+	}
+
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bodystructureBucket).Put([]byte(messageID), raw); err != nil {
+			return err
+		}
+
+		return tx.Bucket(sizeBucket).Put([]byte(messageID), itob(uint32(size)))
+	}); err != nil {
+		store.log.WithField("msg", messageID).WithError(err).Warn("Failed to save body structure")
+	}
+}
+
+// VerifyCache reads every cached message of the user. The cached messages
+// which are not in the local database are removed and the ones which cannot
+// be read are queued to be built and cached again.
+func (store *Store) VerifyCache() (*cache.VerifyReport, error) {
+	report, err := cache.Verify(store.cache, store.user.ID(), store.getAllMessageIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, messageID := range report.Corrupted {
+		if msg, err := store.getMessageFromDB(messageID); err == nil {
+			store.msgCachePool.newJob(messageID, cachePriority(msg))
+		}
+	}
+
+	store.log.
+		WithField("checked", report.Checked).
+		WithField("corrupted", len(report.Corrupted)).
+		WithField("orphans", report.Orphans).
+		Info("Message cache verified")
+
+	return report, nil
+}
+
 func (store *Store) checkAndRemoveDeletedMessage(err error, msgID string) {
 	if !pmapi.IsUnprocessableEntity(err) {
 		return
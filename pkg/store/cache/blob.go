@@ -0,0 +1,491 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// A cached message is stored as a blob made of a header, a nonce prefix and
+// the compressed literal encrypted with AES-GCM in segments of
+// blobSegmentSize bytes, so that it is written and read without holding it in
+// memory. The nonce of each segment is the prefix followed by the index of the
+// segment and whether it is the last one, so that the segments cannot be
+// reordered or the blob truncated. The header holds the magic, the version of
+// the format, the function deriving the key and the compressor. The messages
+// compressed with a Zstandard dictionary have the ID of the dictionary
+// appended to the header, so that they are decompressed with the same one.
+// The key is derived from the passphrase of the user with HKDF. The header,
+// the user ID and the message ID are authenticated with each segment, so that
+// a blob cannot be passed off as another message or as the blob of another
+// user.
+//
+// The blobs written before the format had a version have no header and were
+// encrypted with the SHA-256 of the passphrase, without binding them to their
+// message. They are not read; the on-disk cache removes them once, when it is
+// opened for the first time after the upgrade.
+const (
+	blobVersion = 1
+
+	blobKDFHKDFSHA256 = 1
+
+	blobNoCompression = 0
+	blobGZip          = 1
+	blobZstd          = 2
+	blobZstdDict      = 3
+)
+
+// Compressing the messages made mostly of already compressed attachments
+// costs time but saves little space. Before compressing a large message, a
+// sample from its middle is compressed; if it does not shrink to at most
+// compressedRatio of its size, the message is stored without compression.
+// The smaller messages are compressed in memory and stored without
+// compression if they do not get smaller.
+const (
+	largeMessage    = 256 << 10
+	compressSample  = 64 << 10
+	compressedRatio = 0.7
+)
+
+const (
+	blobSegmentSize    = 64 << 10
+	blobNoncePrefixLen = 7
+)
+
+var (
+	blobMagic = []byte("PXC") //nolint:gochecknoglobals
+
+	blobKeyInfo = []byte("peroxide message cache v1") //nolint:gochecknoglobals
+
+	errUnknownCompressor = errors.New("unknown compressor")
+	errUnknownDictionary = errors.New("unknown compression dictionary")
+)
+
+const (
+	blobHeaderLen     = 6
+	blobDictHeaderLen = blobHeaderLen + 4
+)
+
+// blobCipher encrypts the cached messages of one user.
+type blobCipher struct {
+	userID string
+	aead   cipher.AEAD
+}
+
+// newBlobCipher returns the cipher which encrypts the cached messages of
+// the user with the given passphrase.
+func newBlobCipher(userID string, passphrase []byte) (*blobCipher, error) {
+	key := make([]byte, 32)
+
+	if _, err := io.ReadFull(hkdf.New(sha256.New, passphrase, []byte(userID), blobKeyInfo), key); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobCipher{userID: userID, aead: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	aes, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(aes)
+}
+
+// seal compresses and encrypts the message literal and writes the blob to w.
+func (c *blobCipher) seal(cmp Compressor, messageID string, literal Literal, w io.Writer) error {
+	cmp, compressed, err := compress(cmp, literal)
+	if err != nil {
+		return err
+	}
+
+	cmpID, err := compressorID(cmp)
+	if err != nil {
+		return err
+	}
+
+	header := append(append([]byte{}, blobMagic...), blobVersion, blobKDFHKDFSHA256, cmpID)
+
+	if cmpID == blobZstdDict {
+		dictID := make([]byte, 4)
+		binary.BigEndian.PutUint32(dictID, cmp.(*ZstdCompressor).dictID)
+		header = append(header, dictID...)
+	}
+
+	prefix := make([]byte, blobNoncePrefixLen)
+
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(append([]byte{}, header...), prefix...)); err != nil {
+		return err
+	}
+
+	sw := &segmentWriter{
+		aead:   c.aead,
+		prefix: prefix,
+		ad:     c.additionalData(header, messageID),
+		w:      w,
+		buf:    make([]byte, 0, blobSegmentSize),
+	}
+
+	if compressed != nil {
+		if _, err := sw.Write(compressed); err != nil {
+			return err
+		}
+	} else {
+		cw, err := cmp.NewWriter(sw)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(cw, io.NewSectionReader(literal, 0, literal.Size())); err != nil {
+			return err
+		}
+
+		if err := cw.Close(); err != nil {
+			return err
+		}
+	}
+
+	return sw.Close()
+}
+
+// open reads the header of the blob and returns a reader of the message
+// literal. The first segment is checked right away, so that a blob of another
+// message or user is refused here; a blob damaged further on fails to read
+// with ErrMsgCorrupted.
+func (c *blobCipher) open(zstd *ZstdCompressor, messageID string, r io.Reader) (io.ReadCloser, error) {
+	header := make([]byte, blobHeaderLen)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrMsgCorrupted
+		}
+		return nil, err
+	}
+
+	if !isBlob(header) || header[3] != blobVersion || header[4] != blobKDFHKDFSHA256 {
+		return nil, ErrMsgCorrupted
+	}
+
+	dictID := uint32(0)
+
+	if header[5] == blobZstdDict {
+		id := make([]byte, 4)
+
+		if _, err := io.ReadFull(r, id); err != nil {
+			return nil, ErrMsgCorrupted
+		}
+
+		header, dictID = append(header, id...), binary.BigEndian.Uint32(id)
+	}
+
+	cmp, err := compressorByID(header[5], dictID, zstd)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, blobNoncePrefixLen)
+
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, ErrMsgCorrupted
+	}
+
+	sr := &segmentReader{
+		aead:   c.aead,
+		prefix: prefix,
+		ad:     c.additionalData(header, messageID),
+		r:      r,
+		buf:    make([]byte, blobSegmentSize+c.aead.Overhead()+1),
+	}
+
+	if err := sr.next(); err != nil {
+		return nil, err
+	}
+
+	return cmp.NewReader(sr)
+}
+
+// isBlob returns whether the blob starts with the header of a versioned
+// format.
+func isBlob(blob []byte) bool {
+	return len(blob) >= blobHeaderLen && bytes.HasPrefix(blob, blobMagic)
+}
+
+// blobReader reads the message from the opened blob and closes both.
+type blobReader struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+func (r *blobReader) Close() error {
+	err := r.ReadCloser.Close()
+
+	if blobErr := r.blob.Close(); err == nil {
+		err = blobErr
+	}
+
+	return err
+}
+
+// segmentWriter encrypts what is written to it in segments.
+type segmentWriter struct {
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+	w      io.Writer
+
+	buf, out []byte
+	index    uint32
+}
+
+func (sw *segmentWriter) Write(p []byte) (int, error) {
+	var n int
+
+	for len(p) > 0 {
+		// The segment is only written once there is more, as the last one
+		// is sealed differently.
+		if len(sw.buf) == blobSegmentSize {
+			if err := sw.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		k := copy(sw.buf[len(sw.buf):blobSegmentSize], p)
+		sw.buf = sw.buf[:len(sw.buf)+k]
+
+		p = p[k:]
+		n += k
+	}
+
+	return n, nil
+}
+
+// Close writes the last segment, which may be empty.
+func (sw *segmentWriter) Close() error {
+	return sw.flush(true)
+}
+
+func (sw *segmentWriter) flush(last bool) error {
+	sw.out = sw.aead.Seal(sw.out[:0], segmentNonce(sw.prefix, sw.index, last), sw.buf, sw.ad)
+	sw.buf = sw.buf[:0]
+	sw.index++
+
+	_, err := sw.w.Write(sw.out)
+
+	return err
+}
+
+// segmentReader decrypts the segments written by segmentWriter.
+type segmentReader struct {
+	aead   cipher.AEAD
+	prefix []byte
+	ad     []byte
+	r      io.Reader
+
+	buf          []byte // A segment and the first byte of the next one.
+	n            int    // The number of bytes in buf.
+	plain, clear []byte
+	index        uint32
+	done         bool
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	for len(sr.plain) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+
+		if err := sr.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.plain)
+	sr.plain = sr.plain[n:]
+
+	return n, nil
+}
+
+// next decrypts the next segment. It is the last one if the blob ends before
+// the first byte of another segment.
+func (sr *segmentReader) next() error {
+	segLen := len(sr.buf) - 1
+
+	n, err := io.ReadFull(sr.r, sr.buf[sr.n:])
+	sr.n += n
+
+	var last bool
+
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		last, segLen = true, sr.n
+	default:
+		return err
+	}
+
+	plain, err := sr.aead.Open(sr.clear[:0], segmentNonce(sr.prefix, sr.index, last), sr.buf[:segLen], sr.ad)
+	if err != nil {
+		return ErrMsgCorrupted
+	}
+
+	sr.plain, sr.clear = plain, plain
+	sr.index++
+
+	if last {
+		sr.done = true
+	} else {
+		sr.buf[0], sr.n = sr.buf[segLen], 1
+	}
+
+	return nil
+}
+
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, blobNoncePrefixLen+5)
+
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[blobNoncePrefixLen:], index)
+
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// additionalData binds the blob to its header, the user and the message.
+func (c *blobCipher) additionalData(header []byte, messageID string) []byte {
+	data := append([]byte{}, header...)
+	data = append(data, c.userID...)
+	data = append(data, 0)
+
+	return append(data, messageID...)
+}
+
+// compress decides whether the literal is compressed. A small literal is
+// compressed in memory and returned unless it does not get smaller; a large
+// one is left to be compressed while it is written, unless it does not
+// compress well. It returns the compressor the literal is actually
+// compressed with.
+func compress(cmp Compressor, literal Literal) (Compressor, []byte, error) {
+	if id, err := compressorID(cmp); err != nil || id == blobNoCompression {
+		return cmp, nil, err
+	}
+
+	if literal.Size() < largeMessage {
+		plain := make([]byte, literal.Size())
+
+		if _, err := literal.ReadAt(plain, 0); err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, err
+		}
+
+		compressed, err := cmp.Compress(plain)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(compressed) >= len(plain) {
+			return NoopCompressor{}, plain, nil
+		}
+
+		return cmp, compressed, nil
+	}
+
+	sample := make([]byte, compressSample)
+
+	if _, err := literal.ReadAt(sample, (literal.Size()-compressSample)/2); err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+
+	compressed, err := cmp.Compress(sample)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if float64(len(compressed)) > compressedRatio*compressSample {
+		return NoopCompressor{}, nil, nil
+	}
+
+	return cmp, nil, nil
+}
+
+func compressorID(cmp Compressor) (byte, error) {
+	switch cmp := cmp.(type) {
+	case NoopCompressor, *NoopCompressor:
+		return blobNoCompression, nil
+
+	case GZipCompressor, *GZipCompressor:
+		return blobGZip, nil
+
+	case *ZstdCompressor:
+		if cmp.dictID != 0 {
+			return blobZstdDict, nil
+		}
+		return blobZstd, nil
+
+	default:
+		return 0, errUnknownCompressor
+	}
+}
+
+// compressorByID returns the compressor which reads the blobs written with
+// the given one and dictionary. The blobs compressed with Zstandard are read
+// with zstd, which holds all the known dictionaries, whatever compressor
+// writes the new blobs. A nil zstd reads no blob compressed with Zstandard.
+func compressorByID(id byte, dictID uint32, zstd *ZstdCompressor) (Compressor, error) {
+	switch id {
+	case blobNoCompression:
+		return NoopCompressor{}, nil
+
+	case blobGZip:
+		return GZipCompressor{}, nil
+
+	case blobZstd:
+		if zstd != nil {
+			return zstd, nil
+		}
+		return nil, errUnknownCompressor
+
+	case blobZstdDict:
+		if zstd != nil && zstd.hasDictionary(dictID) {
+			return zstd, nil
+		}
+		return nil, errUnknownDictionary
+
+	default:
+		return nil, errUnknownCompressor
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sealBlob(t *testing.T, c *blobCipher, cmp Compressor, messageID string, literal []byte) []byte {
+	blob := new(bytes.Buffer)
+	require.NoError(t, c.seal(cmp, messageID, bytes.NewReader(literal), blob))
+
+	return blob.Bytes()
+}
+
+func openBlob(c *blobCipher, zstd *ZstdCompressor, messageID string, blob []byte) ([]byte, error) {
+	literal, err := c.open(zstd, messageID, bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+	defer literal.Close() //nolint:errcheck
+
+	return ioutil.ReadAll(literal)
+}
+
+func TestBlobRoundTrip(t *testing.T) {
+	c, err := newBlobCipher("userID1", []byte("my secret passphrase"))
+	require.NoError(t, err)
+
+	secret := bytes.Repeat([]byte("some secret "), 10)
+
+	blob := sealBlob(t, c, &GZipCompressor{}, "messageID1", secret)
+	assert.Equal(t, []byte{'P', 'X', 'C', blobVersion, blobKDFHKDFSHA256, blobGZip}, blob[:blobHeaderLen])
+
+	// The blob records its compressor.
+	literal, err := openBlob(c, nil, "messageID1", blob)
+	require.NoError(t, err)
+	assert.Equal(t, secret, literal)
+}
+
+func TestBlobSkipsCompressionOfCompressedData(t *testing.T) {
+	c, err := newBlobCipher("userID1", []byte("my secret passphrase"))
+	require.NoError(t, err)
+
+	cmp, err := NewZstdCompressor(nil)
+	require.NoError(t, err)
+
+	attachment := make([]byte, 3*largeMessage/4)
+	_, err = rand.Read(attachment)
+	require.NoError(t, err)
+
+	large := []byte(base64.StdEncoding.EncodeToString(attachment))
+
+	blob := sealBlob(t, c, cmp, "messageID1", large)
+	assert.Equal(t, byte(blobNoCompression), blob[5])
+
+	text := bytes.Repeat([]byte("Subject: Hello\r\n\r\nSome text.\r\n"), largeMessage/16)
+
+	blob = sealBlob(t, c, cmp, "messageID2", text)
+	assert.Equal(t, byte(blobZstd), blob[5])
+	assert.Less(t, len(blob), len(text)/10)
+}
+
+func TestBlobReadsAfterCompressorChange(t *testing.T) {
+	c, err := newBlobCipher("userID1", []byte("my secret passphrase"))
+	require.NoError(t, err)
+
+	zstd, err := NewZstdCompressor(nil)
+	require.NoError(t, err)
+
+	secret := bytes.Repeat([]byte("some secret "), 10)
+
+	// The blobs are read with the compressor they record.
+	reader, err := newZstdReader(&GZipCompressor{}, nil)
+	require.NoError(t, err)
+
+	for _, cmp := range []Compressor{&NoopCompressor{}, &GZipCompressor{}, zstd} {
+		literal, err := openBlob(c, reader, "messageID1", sealBlob(t, c, cmp, "messageID1", secret))
+		require.NoError(t, err)
+		assert.Equal(t, secret, literal)
+	}
+}
+
+func readTestDictionary(t *testing.T, name string) []byte {
+	dict, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+
+	return dict
+}
+
+func TestBlobRecordsDictionary(t *testing.T) {
+	c, err := newBlobCipher("userID1", []byte("my secret passphrase"))
+	require.NoError(t, err)
+
+	dict1, dict2 := readTestDictionary(t, "mail1.dict"), readTestDictionary(t, "mail2.dict")
+
+	withDict1, err := NewZstdCompressor(dict1)
+	require.NoError(t, err)
+
+	secret := []byte("From: user1@example.com\r\nSubject: project report meeting\r\n\r\nhello team please review the attached report\r\n")
+
+	blob := sealBlob(t, c, withDict1, "messageID1", secret)
+	assert.Equal(t, []byte{'P', 'X', 'C', blobVersion, blobKDFHKDFSHA256, blobZstdDict, 0, 0, 0x03, 0xe9}, blob[:blobDictHeaderLen])
+
+	// The blob is read whenever the dictionary is known, whatever compressor
+	// writes the new blobs.
+	withDict2, err := NewZstdCompressor(dict2)
+	require.NoError(t, err)
+
+	for _, cmp := range []Compressor{withDict1, withDict2, &GZipCompressor{}, &NoopCompressor{}} {
+		reader, err := newZstdReader(cmp, [][]byte{dict1})
+		require.NoError(t, err)
+
+		literal, err := openBlob(c, reader, "messageID1", blob)
+		require.NoError(t, err)
+		assert.Equal(t, secret, literal)
+	}
+
+	// It is not otherwise.
+	for _, cmp := range []Compressor{withDict2, &GZipCompressor{}} {
+		reader, err := newZstdReader(cmp, nil)
+		require.NoError(t, err)
+
+		_, err = openBlob(c, reader, "messageID1", blob)
+		assert.Equal(t, errUnknownDictionary, err)
+	}
+
+	// The dictionary ID is authenticated.
+	reader, err := newZstdReader(withDict2, [][]byte{dict1})
+	require.NoError(t, err)
+
+	blob[blobDictHeaderLen-1] = 0xea
+	_, err = openBlob(c, reader, "messageID1", blob)
+	assert.Error(t, err)
+}
+
+func TestOnDiskCacheReadsDictionaryAfterCompressorChange(t *testing.T) {
+	path := t.TempDir()
+	opts := Options{ConcurrentRead: 1, ConcurrentWrite: 1}
+	passphrase := []byte("my secret passphrase")
+	dict1 := readTestDictionary(t, "mail1.dict")
+	secret := "From: user1@example.com\r\nSubject: project report meeting\r\n\r\nhello team please review the attached report\r\n"
+
+	withDict1, err := NewZstdCompressor(dict1)
+	require.NoError(t, err)
+
+	cache, err := NewOnDiskCache(path, withDict1, opts)
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", passphrase))
+	require.NoError(t, cache.Set("userID1", "messageID1", literal(secret)))
+
+	// The cache now compresses with gzip and still knows the dictionary.
+	cache, err = NewOnDiskCache(path, &GZipCompressor{}, opts, dict1)
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", passphrase))
+	getCachedMessage(t, cache, "userID1", "messageID1", secret)
+}
+
+func TestLoadDictionariesKeepsOldOnes(t *testing.T) {
+	dir := t.TempDir()
+	dict1, dict2 := readTestDictionary(t, "mail1.dict"), readTestDictionary(t, "mail2.dict")
+
+	dicts, err := loadDictionaries(dir, dict1)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{dict1}, dicts)
+
+	dicts, err = loadDictionaries(dir, dict2)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, [][]byte{dict1, dict2}, dicts)
+
+	// They are loaded without a dictionary too, for example after switching to
+	// another compressor.
+	dicts, err = loadDictionaries(dir, nil)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, [][]byte{dict1, dict2}, dicts)
+
+	// A different dictionary reusing an ID would make the old messages
+	// unreadable.
+	changed := append([]byte{}, dict1...)
+	changed[len(changed)-1]++
+	_, err = loadDictionaries(dir, changed)
+	assert.EqualError(t, err, "another zstd dictionary with ID 1001 was used before")
+}
+
+func TestBlobCannotBeSwapped(t *testing.T) {
+	c1, err := newBlobCipher("userID1", []byte("my secret passphrase"))
+	require.NoError(t, err)
+
+	c2, err := newBlobCipher("userID2", []byte("my secret passphrase"))
+	require.NoError(t, err)
+
+	blob := sealBlob(t, c1, &NoopCompressor{}, "messageID1", []byte("some secret"))
+
+	_, err = openBlob(c1, nil, "messageID2", blob)
+	assert.Error(t, err)
+
+	_, err = openBlob(c2, nil, "messageID1", blob)
+	assert.Error(t, err)
+
+	// The header is authenticated too.
+	blob[5] = blobGZip
+	_, err = openBlob(c1, nil, "messageID1", blob)
+	assert.Error(t, err)
+}
+
+func TestBlobSegments(t *testing.T) {
+	c, err := newBlobCipher("userID1", []byte("my secret passphrase"))
+	require.NoError(t, err)
+
+	secret := make([]byte, 2*blobSegmentSize+100)
+	_, err = rand.Read(secret)
+	require.NoError(t, err)
+
+	for _, size := range []int{0, 1, blobSegmentSize, len(secret)} {
+		literal, err := openBlob(c, nil, "messageID1", sealBlob(t, c, &NoopCompressor{}, "messageID1", secret[:size]))
+		require.NoError(t, err)
+		assert.Equal(t, secret[:size], literal)
+	}
+
+	blob := sealBlob(t, c, &NoopCompressor{}, "messageID1", secret)
+	headerLen := blobHeaderLen + blobNoncePrefixLen
+	segLen := blobSegmentSize + c.aead.Overhead()
+
+	// The blob cannot be truncated, even after a whole segment.
+	for _, end := range []int{headerLen + segLen, headerLen + 2*segLen, len(blob) - 1} {
+		_, err := openBlob(c, nil, "messageID1", blob[:end])
+		assert.Equal(t, ErrMsgCorrupted, err)
+	}
+
+	// Nor can its segments be reordered.
+	swapped := append([]byte{}, blob[:headerLen]...)
+	swapped = append(swapped, blob[headerLen+segLen:headerLen+2*segLen]...)
+	swapped = append(swapped, blob[headerLen:headerLen+segLen]...)
+	swapped = append(swapped, blob[headerLen+2*segLen:]...)
+
+	_, err = openBlob(c, nil, "messageID1", swapped)
+	assert.Equal(t, ErrMsgCorrupted, err)
+}
+
+// sealLegacyBlob encrypts the literal the way the cache did before the blob
+// format had a version.
+func sealLegacyBlob(t *testing.T, passphrase, literal []byte) []byte {
+	key := sha256.Sum256(passphrase)
+
+	gcm, err := newGCM(key[:])
+	require.NoError(t, err)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+
+	return gcm.Seal(nonce, nonce, literal, nil)
+}
+
+func TestOnDiskCacheRemovesLegacyBlobsOnce(t *testing.T) {
+	path := t.TempDir()
+	opts := Options{ConcurrentRead: 1, ConcurrentWrite: 1}
+	passphrase := []byte("my secret passphrase")
+
+	// A cache written before the blob format had a version.
+	dc := &onDiskCache{path: path}
+	require.NoError(t, os.MkdirAll(dc.getUserPath("userID1"), 0700))
+	legacyPath := dc.getMessagePath("userID1", "messageID1")
+	require.NoError(t, writeFileAtomic(legacyPath, sealLegacyBlob(t, passphrase, []byte("some secret"))))
+
+	cache, err := NewOnDiskCache(path, &NoopCompressor{}, opts)
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", passphrase))
+
+	assert.False(t, cache.Has("userID1", "messageID1"))
+	getSetCachedMessage(t, cache, "userID1", "messageID2", "other secret")
+
+	assert.Len(t, cache.(*onDiskCache).usage.files, 1)
+
+	// Legacy blobs appearing later are neither removed nor read, so they
+	// cannot pass for the message they were copied over.
+	require.NoError(t, writeFileAtomic(legacyPath, sealLegacyBlob(t, passphrase, []byte("some secret"))))
+
+	cache, err = NewOnDiskCache(path, &NoopCompressor{}, opts)
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", passphrase))
+
+	assert.True(t, cache.Has("userID1", "messageID1"))
+	_, err = cache.Get("userID1", "messageID1")
+	assert.Equal(t, ErrMsgCorrupted, err)
+
+	getCachedMessage(t, cache, "userID1", "messageID2", "other secret")
+}
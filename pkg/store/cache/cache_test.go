@@ -18,8 +18,15 @@
 package cache
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -39,10 +46,177 @@ func TestOnDiskCacheGZipCompression(t *testing.T) {
 	testCache(t, cache)
 }
 
+func TestOnDiskCacheZstdCompression(t *testing.T) {
+	cmp, err := NewZstdCompressor(nil)
+	require.NoError(t, err)
+
+	cache, err := NewOnDiskCache(t.TempDir(), cmp, Options{ConcurrentRead: runtime.NumCPU(), ConcurrentWrite: runtime.NumCPU()})
+	require.NoError(t, err)
+
+	testCache(t, cache)
+}
+
 func TestInMemoryCache(t *testing.T) {
 	testCache(t, NewInMemoryCache(1<<20))
 }
 
+func TestOnDiskCacheSetOptions(t *testing.T) {
+	cache, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{ConcurrentRead: 1, ConcurrentWrite: 1})
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	// Require more free space than any disk has, new messages are not cached.
+	cache.(*onDiskCache).setOptions(Options{MinFreeRat: 1.1, ConcurrentRead: 2, ConcurrentWrite: 2})
+	assert.NoError(t, cache.Set("userID1", "messageID1", literal("some secret")))
+	assert.False(t, cache.Has("userID1", "messageID1"))
+
+	cache.(*onDiskCache).setOptions(Options{ConcurrentRead: 2, ConcurrentWrite: 2})
+	getSetCachedMessage(t, cache, "userID1", "messageID1", "some secret")
+	assert.True(t, cache.Has("userID1", "messageID1"))
+}
+
+// testLiteral is a message which takes 128 bytes once encrypted without
+// compression.
+func testLiteral(n int) string {
+	return fmt.Sprintf("%099d", n)
+}
+
+func literal(s string) Literal {
+	return strings.NewReader(s)
+}
+
+func TestOnDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{UserQuota: 300, ConcurrentRead: 1, ConcurrentWrite: 1})
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+	require.NoError(t, cache.Unlock("userID2", []byte("my other passphrase")))
+
+	require.NoError(t, cache.Set("userID2", "messageID1", literal(testLiteral(0))))
+	require.NoError(t, cache.Set("userID1", "messageID1", literal(testLiteral(1))))
+	require.NoError(t, cache.Set("userID1", "messageID2", literal(testLiteral(2))))
+
+	room, limited := Room(cache, "userID1")
+	assert.True(t, limited)
+	assert.Equal(t, int64(300-2*128), room)
+
+	// Reading the first message makes the second one the least recently used.
+	getCachedMessage(t, cache, "userID1", "messageID1", (testLiteral(1)))
+	require.NoError(t, cache.Set("userID1", "messageID3", literal(testLiteral(3))))
+
+	assert.True(t, cache.Has("userID1", "messageID1"))
+	assert.False(t, cache.Has("userID1", "messageID2"))
+	assert.True(t, cache.Has("userID1", "messageID3"))
+
+	// The quota of one user does not evict the messages of others.
+	assert.True(t, cache.Has("userID2", "messageID1"))
+
+	// Replacing a message does not evict others.
+	require.NoError(t, cache.Set("userID1", "messageID3", literal(testLiteral(4))))
+	assert.True(t, cache.Has("userID1", "messageID1"))
+
+	// A message bigger than the quota is not cached and evicts nothing.
+	require.NoError(t, cache.Set("userID1", "messageID4", bytes.NewReader(make([]byte, 400))))
+	assert.False(t, cache.Has("userID1", "messageID4"))
+	assert.True(t, cache.Has("userID1", "messageID1"))
+	assert.True(t, cache.Has("userID1", "messageID3"))
+}
+
+func TestOnDiskCacheConcurrentSetsStayWithinQuota(t *testing.T) {
+	cache, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{UserQuota: 300, ConcurrentRead: 4, ConcurrentWrite: 4})
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, cache.Set("userID1", fmt.Sprintf("messageID%d", i), literal(testLiteral(i))))
+		}(i)
+	}
+	wg.Wait()
+
+	// The space is reserved before writing, so the concurrent writes do not
+	// overshoot the quota, and the files on disk are the ones accounted for.
+	dc := cache.(*onDiskCache)
+	assert.LessOrEqual(t, dc.usage.total, int64(300))
+
+	files, err := os.ReadDir(dc.getUserPath("userID1"))
+	require.NoError(t, err)
+
+	var onDisk int64
+	for _, file := range files {
+		info, err := file.Info()
+		require.NoError(t, err)
+		onDisk += info.Size()
+	}
+	assert.Equal(t, dc.usage.total, onDisk)
+}
+
+func TestOnDiskCacheQuotaEvictsAnyUser(t *testing.T) {
+	cache, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{Quota: 300, ConcurrentRead: 1, ConcurrentWrite: 1})
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+	require.NoError(t, cache.Unlock("userID2", []byte("my other passphrase")))
+
+	require.NoError(t, cache.Set("userID2", "messageID1", literal(testLiteral(0))))
+	require.NoError(t, cache.Set("userID1", "messageID1", literal(testLiteral(1))))
+	require.NoError(t, cache.Set("userID1", "messageID2", literal(testLiteral(2))))
+
+	assert.False(t, cache.Has("userID2", "messageID1"))
+	assert.True(t, cache.Has("userID1", "messageID1"))
+	assert.True(t, cache.Has("userID1", "messageID2"))
+
+	room, limited := Room(cache, "userID2")
+	assert.True(t, limited)
+	assert.Equal(t, int64(300-2*128), room)
+}
+
+func TestOnDiskCacheKeepsAccessOrderAcrossRestarts(t *testing.T) {
+	path := t.TempDir()
+	opts := Options{UserQuota: 300, ConcurrentRead: 1, ConcurrentWrite: 1}
+
+	cache, err := NewOnDiskCache(path, &NoopCompressor{}, opts)
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+	require.NoError(t, cache.Set("userID1", "messageID1", literal(testLiteral(1))))
+	require.NoError(t, cache.Set("userID1", "messageID2", literal(testLiteral(2))))
+
+	// The first message was read after the second one was written.
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(cache.(*onDiskCache).getMessagePath("userID1", "messageID2"), old, old))
+
+	cache, err = NewOnDiskCache(path, &NoopCompressor{}, opts)
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+	require.NoError(t, cache.Set("userID1", "messageID3", literal(testLiteral(3))))
+
+	assert.True(t, cache.Has("userID1", "messageID1"))
+	assert.False(t, cache.Has("userID1", "messageID2"))
+	assert.True(t, cache.Has("userID1", "messageID3"))
+}
+
+func TestOnDiskCacheShrinksToLowerQuota(t *testing.T) {
+	cache, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{ConcurrentRead: 1, ConcurrentWrite: 1})
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	for _, messageID := range []string{"messageID1", "messageID2", "messageID3"} {
+		require.NoError(t, cache.Set("userID1", messageID, literal(testLiteral(1))))
+	}
+
+	_, limited := Room(cache, "userID1")
+	assert.False(t, limited)
+
+	cache.(*onDiskCache).setOptions(Options{UserQuota: 200, ConcurrentRead: 1, ConcurrentWrite: 1})
+
+	assert.Eventually(t, func() bool {
+		return !cache.Has("userID1", "messageID2")
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, cache.Has("userID1", "messageID1"))
+	assert.True(t, cache.Has("userID1", "messageID3"))
+}
+
 func testCache(t *testing.T, cache Cache) {
 	assert.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
 	assert.NoError(t, cache.Unlock("userID2", []byte("my other passphrase")))
@@ -64,10 +238,17 @@ func testCache(t *testing.T, cache Cache) {
 }
 
 func getSetCachedMessage(t *testing.T, cache Cache, userID, messageID, secret string) {
-	assert.NoError(t, cache.Set(userID, messageID, []byte(secret)))
+	assert.NoError(t, cache.Set(userID, messageID, literal(secret)))
+
+	getCachedMessage(t, cache, userID, messageID, secret)
+}
 
+func getCachedMessage(t *testing.T, cache Cache, userID, messageID, secret string) {
 	data, err := cache.Get(userID, messageID)
-	assert.NoError(t, err)
+	require.NoError(t, err)
+	defer data.Close() //nolint:errcheck
 
-	assert.Equal(t, []byte(secret), data)
+	b, err := ioutil.ReadAll(data)
+	assert.NoError(t, err)
+	assert.Equal(t, secret, string(b))
 }
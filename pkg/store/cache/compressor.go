@@ -17,9 +17,19 @@
 
 package cache
 
+import (
+	"io"
+	"io/ioutil"
+)
+
+// Compressor compresses the cached messages, either in one piece or as they
+// are written and read.
 type Compressor interface {
 	Compress([]byte) ([]byte, error)
 	Decompress([]byte) ([]byte, error)
+
+	NewWriter(io.Writer) (io.WriteCloser, error)
+	NewReader(io.Reader) (io.ReadCloser, error)
 }
 
 type NoopCompressor struct{}
@@ -31,3 +41,19 @@ func (NoopCompressor) Compress(dec []byte) ([]byte, error) {
 func (NoopCompressor) Decompress(cmp []byte) ([]byte, error) {
 	return cmp, nil
 }
+
+func (NoopCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (NoopCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
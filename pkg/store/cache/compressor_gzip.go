@@ -20,6 +20,7 @@ package cache
 import (
 	"bytes"
 	"compress/gzip"
+	"io"
 )
 
 type GZipCompressor struct{}
@@ -58,3 +59,11 @@ func (GZipCompressor) Decompress(cmp []byte) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+func (GZipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (GZipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdCompressor compresses with Zstandard, optionally with a dictionary
+// trained on mail, for example with `zstd --train`.
+type ZstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+
+	encOpts []zstd.EOption
+	decOpts []zstd.DOption
+
+	dict    []byte              // The dictionary compressing, if any.
+	dictID  uint32              // Its ID, 0 if none.
+	dictIDs map[uint32]struct{} // The dictionaries decompressing.
+}
+
+var errInvalidDictionary = errors.New("invalid zstd dictionary")
+
+// NewZstdCompressor returns a Zstandard compressor using the dictionary if it
+// is not empty. The old dictionaries are only used to decompress the messages
+// compressed with them.
+func NewZstdCompressor(dict []byte, oldDicts ...[]byte) (*ZstdCompressor, error) {
+	var (
+		encOpts []zstd.EOption
+		decOpts []zstd.DOption
+	)
+
+	c := &ZstdCompressor{dictIDs: make(map[uint32]struct{})}
+
+	for _, old := range oldDicts {
+		id, err := dictionaryID(old)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := c.dictIDs[id]; ok {
+			continue
+		}
+
+		c.dictIDs[id] = struct{}{}
+		decOpts = append(decOpts, zstd.WithDecoderDicts(old))
+	}
+
+	if len(dict) > 0 {
+		id, err := dictionaryID(dict)
+		if err != nil {
+			return nil, err
+		}
+
+		c.dict, c.dictID = dict, id
+		encOpts = append(encOpts, zstd.WithEncoderDict(dict))
+
+		if _, ok := c.dictIDs[id]; !ok {
+			c.dictIDs[id] = struct{}{}
+			decOpts = append(decOpts, zstd.WithDecoderDicts(dict))
+		}
+	}
+
+	c.encOpts, c.decOpts = encOpts, decOpts
+
+	var err error
+
+	if c.enc, err = zstd.NewWriter(nil, encOpts...); err != nil {
+		return nil, err
+	}
+
+	if c.dec, err = zstd.NewReader(nil, decOpts...); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// dictionaryID returns the ID stored in the header of the dictionary.
+func dictionaryID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || !bytes.Equal(dict[:4], zstdDictMagic) {
+		return 0, errInvalidDictionary
+	}
+
+	id := binary.LittleEndian.Uint32(dict[4:8])
+	if id == 0 {
+		return 0, errInvalidDictionary
+	}
+
+	return id, nil
+}
+
+// hasDictionary returns whether the compressor can decompress the messages
+// compressed with the given dictionary.
+func (c *ZstdCompressor) hasDictionary(id uint32) bool {
+	_, ok := c.dictIDs[id]
+	return ok
+}
+
+func (c *ZstdCompressor) Compress(dec []byte) ([]byte, error) {
+	return c.enc.EncodeAll(dec, nil), nil
+}
+
+func (c *ZstdCompressor) Decompress(cmp []byte) ([]byte, error) {
+	return c.dec.DecodeAll(cmp, nil)
+}
+
+// NewWriter returns a stream encoder. Each stream has its own, working in the
+// calling goroutine only.
+func (c *ZstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, append(c.encOpts, zstd.WithEncoderConcurrency(1))...)
+}
+
+// NewReader returns a stream decoder. Each stream has its own, working in the
+// calling goroutine only.
+func (c *ZstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, append(c.decOpts, zstd.WithDecoderConcurrency(1))...)
+	if err != nil {
+		return nil, err
+	}
+
+	return dec.IOReadCloser(), nil
+}
+
+var zstdDictMagic = []byte{0x37, 0xa4, 0x30, 0xec} //nolint:gochecknoglobals
+
+// newZstdReader returns the compressor which decompresses the messages
+// compressed with Zstandard without a dictionary, with one of the given
+// dictionaries or with the one cmp compresses with.
+func newZstdReader(cmp Compressor, dicts [][]byte) (*ZstdCompressor, error) {
+	if cmp, ok := cmp.(*ZstdCompressor); ok && len(cmp.dict) > 0 {
+		dicts = append([][]byte{cmp.dict}, dicts...)
+	}
+
+	return NewZstdCompressor(nil, dicts...)
+}
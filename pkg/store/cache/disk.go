@@ -18,17 +18,17 @@
 package cache
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/semaphore"
 	"github.com/ricochet2200/go-disk-usage/du"
 )
@@ -36,6 +36,10 @@ import (
 var ErrMsgCorrupted = errors.New("ecrypted file was corrupted")
 var ErrLowSpace = errors.New("not enough free space left on device")
 
+// cacheVersionFile records the version of the blob format in the cache
+// directory.
+const cacheVersionFile = "version"
+
 // IsOnDiskCache will return true if Cache is type of onDiskCache.
 func IsOnDiskCache(c Cache) bool {
 	_, ok := c.(*onDiskCache)
@@ -46,10 +50,12 @@ type onDiskCache struct {
 	path string
 	opts Options
 
-	gcm        map[string]cipher.AEAD
+	gcm        map[string]*blobCipher
 	cmp        Compressor
-	rsem, wsem semaphore.Semaphore
+	zstd       *ZstdCompressor
+	rsem, wsem *semaphore.Semaphore
 	pending    *pending
+	usage      *diskUsage
 
 	diskSize uint64
 	diskFree uint64
@@ -57,7 +63,15 @@ type onDiskCache struct {
 	lock     sync.Mutex
 }
 
-func NewOnDiskCache(path string, cmp Compressor, opts Options) (Cache, error) {
+// NewOnDiskCache creates a new cache in the directory. The new messages are
+// compressed with cmp; the cached ones are read with the compressor and the
+// dictionary they record, which must be among dicts unless cmp has it.
+func NewOnDiskCache(path string, cmp Compressor, opts Options, dicts ...[]byte) (Cache, error) {
+	zstd, err := newZstdReader(cmp, dicts)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return nil, err
 	}
@@ -74,23 +88,39 @@ func NewOnDiskCache(path string, cmp Compressor, opts Options) (Cache, error) {
 		return nil, fmt.Errorf("cannot write to target: %w", err)
 	}
 
+	if err := removeLegacyBlobs(path); err != nil {
+		return nil, fmt.Errorf("cannot remove messages cached in the legacy format: %w", err)
+	}
+
+	cached, err := loadDiskUsage(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list cached messages: %w", err)
+	}
+
 	usage := du.NewDiskUsage(path)
+	metrics.CacheDisk(usage.Size(), usage.Available())
 
 	// NOTE(GODT-1158): use Available() or Free()?
-	return &onDiskCache{
+	c := &onDiskCache{
 		path: path,
 		opts: opts,
 
-		gcm:     make(map[string]cipher.AEAD),
+		gcm:     make(map[string]*blobCipher),
 		cmp:     cmp,
-		rsem:    semaphore.New(opts.ConcurrentRead),
-		wsem:    semaphore.New(opts.ConcurrentWrite),
+		zstd:    zstd,
+		rsem:    newSemaphore(opts.ConcurrentRead),
+		wsem:    newSemaphore(opts.ConcurrentWrite),
 		pending: newPending(),
+		usage:   cached,
 
 		diskSize: usage.Size(),
 		diskFree: usage.Available(),
 		once:     &sync.Once{},
-	}, nil
+	}
+
+	go c.shrink()
+
+	return c, nil
 }
 
 func (c *onDiskCache) Lock(userID string) {
@@ -98,18 +128,7 @@ func (c *onDiskCache) Lock(userID string) {
 }
 
 func (c *onDiskCache) Unlock(userID string, passphrase []byte) error {
-	hash := sha256.New()
-
-	if _, err := hash.Write(passphrase); err != nil {
-		return err
-	}
-
-	aes, err := aes.NewCipher(hash.Sum(nil))
-	if err != nil {
-		return err
-	}
-
-	gcm, err := cipher.NewGCM(aes)
+	gcm, err := newBlobCipher(userID, passphrase)
 	if err != nil {
 		return err
 	}
@@ -126,6 +145,10 @@ func (c *onDiskCache) Unlock(userID string, passphrase []byte) error {
 func (c *onDiskCache) Delete(userID string) error {
 	defer c.update()
 
+	c.lock.Lock()
+	c.usage.removeUser(c.getUserPath(userID))
+	c.lock.Unlock()
+
 	return os.RemoveAll(c.getUserPath(userID))
 }
 
@@ -133,8 +156,9 @@ func (c *onDiskCache) Delete(userID string) error {
 func (c *onDiskCache) Has(userID, messageID string) bool {
 	c.pending.wait(c.getMessagePath(userID, messageID))
 
-	c.rsem.Lock()
-	defer c.rsem.Unlock()
+	rsem, _ := c.semaphores()
+	rsem.Lock()
+	defer rsem.Unlock()
 
 	_, err := os.Stat(c.getMessagePath(userID, messageID))
 
@@ -152,74 +176,82 @@ func (c *onDiskCache) Has(userID, messageID string) bool {
 	}
 }
 
-func (c *onDiskCache) Get(userID, messageID string) ([]byte, error) {
+// Get returns a reader of the message. Only opening the message counts
+// towards the concurrent reads; the reader holds the file open, so the message
+// can still be read if it is evicted meanwhile.
+func (c *onDiskCache) Get(userID, messageID string) (io.ReadCloser, error) {
 	gcm, ok := c.gcm[userID]
 	if !ok || gcm == nil {
 		return nil, ErrCacheNeedsUnlock
 	}
 
-	enc, err := c.readFile(c.getMessagePath(userID, messageID))
+	path := c.getMessagePath(userID, messageID)
+
+	file, literal, err := c.openFile(gcm, messageID, path)
 	if err != nil {
 		return nil, err
 	}
 
-	// Data stored in file must larger than NonceSize.
-	if len(enc) <= gcm.NonceSize() {
-		return nil, ErrMsgCorrupted
-	}
+	c.lock.Lock()
+	c.usage.touch(path)
+	c.lock.Unlock()
 
-	cmp, err := gcm.Open(nil, enc[:gcm.NonceSize()], enc[gcm.NonceSize():], nil)
-	if err != nil {
-		return nil, err
-	}
+	touchFile(path)
 
-	return c.cmp.Decompress(cmp)
+	return &blobReader{ReadCloser: literal, blob: file}, nil
 }
 
-func (c *onDiskCache) Set(userID, messageID string, literal []byte) error {
+// Set writes the message to a temporary file first. Once its size is known,
+// room is made for it and it replaces the message, if any.
+func (c *onDiskCache) Set(userID, messageID string, literal Literal) error {
 	gcm, ok := c.gcm[userID]
 	if !ok {
 		return ErrCacheNeedsUnlock
 	}
-	nonce := make([]byte, gcm.NonceSize())
-
-	if _, err := rand.Read(nonce); err != nil {
-		return err
-	}
-
-	cmp, err := c.cmp.Compress(literal)
-	if err != nil {
-		return err
-	}
-
-	// NOTE(GODT-1158, GODT-1488): Need to properly handle low space. Don't
-	// return error, that's bad. Send event and clean least used message.
-	if !c.hasSpace(len(cmp)) {
-		return nil
-	}
 
-	return c.writeFile(c.getMessagePath(userID, messageID), gcm.Seal(nonce, nonce, cmp, nil))
+	return c.writeFile(c.getUserPath(userID), c.getMessagePath(userID, messageID), func(w io.Writer) error {
+		return gcm.seal(c.cmp, messageID, literal, w)
+	})
 }
 
 func (c *onDiskCache) Rem(userID, messageID string) error {
 	defer c.update()
 
-	return os.Remove(c.getMessagePath(userID, messageID))
+	path := c.getMessagePath(userID, messageID)
+
+	c.lock.Lock()
+	c.usage.remove(path)
+	c.lock.Unlock()
+
+	return os.Remove(path)
 }
 
-func (c *onDiskCache) readFile(path string) ([]byte, error) {
-	c.rsem.Lock()
-	defer c.rsem.Unlock()
+func (c *onDiskCache) openFile(gcm *blobCipher, messageID, path string) (*os.File, io.ReadCloser, error) {
+	rsem, _ := c.semaphores()
+	rsem.Lock()
+	defer rsem.Unlock()
 
 	// Wait before reading in case the file is currently being written.
 	c.pending.wait(path)
 
-	return ioutil.ReadFile(filepath.Clean(path))
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	literal, err := gcm.open(c.zstd, messageID, bufio.NewReader(file))
+	if err != nil {
+		file.Close() //nolint:errcheck,gosec
+		return nil, nil, err
+	}
+
+	return file, literal, nil
 }
 
-func (c *onDiskCache) writeFile(path string, b []byte) error {
-	c.wsem.Lock()
-	defer c.wsem.Unlock()
+func (c *onDiskCache) writeFile(user, path string, write func(io.Writer) error) error {
+	_, wsem := c.semaphores()
+	wsem.Lock()
+	defer wsem.Unlock()
 
 	// Mark the file as currently being written.
 	// If it's already being written, wait for it to be done and return nil.
@@ -230,37 +262,364 @@ func (c *onDiskCache) writeFile(path string, b []byte) error {
 	}
 	defer c.pending.done(path)
 
-	// Reduce the approximate free space (update it exactly later).
+	// Update the diskFree eventually.
+	defer c.update()
+
+	tmp, size, err := writeTempFile(filepath.Dir(path), write)
+	if err != nil {
+		return err
+	}
+
+	// The message is not cached if it cannot fit even after evicting others.
+	if !c.makeRoom(user, path, size) {
+		os.Remove(tmp) //nolint:errcheck,gosec
+		return nil
+	}
+
+	if err := os.Rename(tmp, filepath.Clean(path)); err != nil {
+		os.Remove(tmp) //nolint:errcheck,gosec
+		c.release(user, path)
+		return err
+	}
+
 	c.lock.Lock()
-	c.diskFree -= uint64(len(b))
+	c.usage.written(path)
 	c.lock.Unlock()
 
-	// Update the diskFree eventually.
-	defer c.update()
+	return nil
+}
+
+// writeTempFile writes a file under a temporary name in the directory and
+// returns its name and size. The temporary files are not counted in the
+// usage of the cache.
+func writeTempFile(dir string, write func(io.Writer) error) (string, int64, error) {
+	file, err := ioutil.TempFile(dir, "tmp")
+	if err != nil {
+		return "", 0, err
+	}
+
+	w := &countingWriter{w: bufio.NewWriter(file)}
+
+	err = write(w)
+	if err == nil {
+		err = w.w.Flush()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name()) //nolint:errcheck,gosec
+		return "", 0, err
+	}
+
+	return file.Name(), w.n, nil
+}
+
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
 
-	// NOTE(GODT-1158): What happens when this fails? Should be fixed eventually.
-	return ioutil.WriteFile(filepath.Clean(path), b, 0600)
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
 }
 
-func (c *onDiskCache) hasSpace(size int) bool {
+// writeFileAtomic writes the file under a temporary name and renames it, so
+// that the readers, including other servers sharing the cache directory,
+// never see a partially written file.
+func writeFileAtomic(path string, b []byte) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), "tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(b); err != nil {
+		file.Close()           //nolint:errcheck,gosec
+		os.Remove(file.Name()) //nolint:errcheck,gosec
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name()) //nolint:errcheck,gosec
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// removeLegacyBlobs removes the messages cached before the blob format had
+// a version, once per cache directory. They are not bound to their message,
+// so they cannot be told apart from a file copied over another message and
+// are downloaded again instead. The version file records that it was done.
+func removeLegacyBlobs(path string) error {
+	versionPath := filepath.Join(path, cacheVersionFile)
+
+	if _, err := os.Stat(versionPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	userDirs, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, userDir := range userDirs {
+		if !userDir.IsDir() {
+			continue
+		}
+
+		user := filepath.Join(path, userDir.Name())
+
+		files, err := ioutil.ReadDir(user)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), "tmp") {
+				continue
+			}
+
+			header, err := readHeader(filepath.Join(user, file.Name()))
+			if err != nil {
+				return err
+			}
+
+			if !isBlob(header) {
+				if err := os.Remove(filepath.Join(user, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return writeFileAtomic(versionPath, []byte(fmt.Sprintf("%d\n", blobVersion)))
+}
+
+// readHeader reads as much of the file as a blob header takes.
+func readHeader(path string) ([]byte, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint:errcheck,gosec
+
+	header := make([]byte, blobHeaderLen)
+
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return header[:n], nil
+}
+
+func newSemaphore(max int) *semaphore.Semaphore {
+	sem := semaphore.New(max)
+	return &sem
+}
+
+// semaphores returns the semaphores limiting concurrent reads and writes. They
+// are replaced when the options change; the operations in progress release the
+// ones they acquired.
+func (c *onDiskCache) semaphores() (rsem, wsem *semaphore.Semaphore) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if c.opts.MinFreeAbs > 0 {
-		if c.diskFree-uint64(size) < c.opts.MinFreeAbs {
-			return false
+	return c.rsem, c.wsem
+}
+
+// setOptions changes the free space limits and the concurrency.
+func (c *onDiskCache) setOptions(opts Options) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if opts.ConcurrentRead != c.opts.ConcurrentRead {
+		c.rsem = newSemaphore(opts.ConcurrentRead)
+	}
+
+	if opts.ConcurrentWrite != c.opts.ConcurrentWrite {
+		c.wsem = newSemaphore(opts.ConcurrentWrite)
+	}
+
+	c.opts = opts
+
+	// Lower quotas take effect right away.
+	go c.shrink()
+}
+
+// makeRoom evicts the least recently used messages until a message of the
+// given size fits. The messages of the user are evicted when the user is over
+// the quota, the messages of anyone when the whole cache is over the quota or
+// the disk is getting full. The message at the path does not count because
+// it is being replaced. If the message cannot fit, nothing is evicted;
+// otherwise its space is reserved right away, so that concurrent writes
+// cannot take the same room.
+func (c *onDiskCache) makeRoom(user, path string, size int64) bool {
+	c.lock.Lock()
+
+	freedUser := c.usage.size(path)
+	freedAll := freedUser
+
+	var victims []*diskFile
+
+	for elem := c.usage.order.Back(); elem != nil; elem = elem.Prev() {
+		userFits, allFits := c.fitsUser(user, size, freedUser), c.fitsAll(size, freedAll)
+		if userFits && allFits {
+			break
+		}
+
+		file := elem.Value.(*diskFile)
+		if file.path == path || file.writing || (allFits && file.user != user) {
+			continue
+		}
+
+		victims = append(victims, file)
+		freedAll += file.size
+		if file.user == user {
+			freedUser += file.size
 		}
 	}
 
-	if c.opts.MinFreeRat > 0 {
-		if float64(c.diskFree-uint64(size))/float64(c.diskSize) < c.opts.MinFreeRat {
-			return false
+	if !c.fitsUser(user, size, freedUser) || !c.fitsAll(size, freedAll) {
+		c.lock.Unlock()
+		return false
+	}
+
+	for _, file := range victims {
+		c.usage.remove(file.path)
+		c.diskFree += uint64(file.size)
+	}
+
+	if size > 0 {
+		c.usage.reserve(path, user, size)
+
+		// Reduce the approximate free space (update it exactly later).
+		if reserved := uint64(size); reserved < c.diskFree {
+			c.diskFree -= reserved
+		} else {
+			c.diskFree = 0
 		}
 	}
 
+	c.lock.Unlock()
+
+	for _, file := range victims {
+		os.Remove(file.path) //nolint:errcheck,gosec
+	}
+
+	if len(victims) > 0 {
+		metrics.CacheEvicted(len(victims))
+		c.update()
+	}
+
 	return true
 }
 
+// release gives back the space reserved for a message which could not be
+// written. The message it was going to replace, if any, is still there.
+func (c *onDiskCache) release(user, path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if info, err := os.Stat(path); err == nil {
+		c.usage.add(path, user, info.Size())
+	} else {
+		c.usage.remove(path)
+	}
+}
+
+// shrink evicts the least recently used messages of the users over the quota
+// and, if the whole cache is over the quota or the disk is getting full, of
+// anyone.
+func (c *onDiskCache) shrink() {
+	c.lock.Lock()
+	users := make([]string, 0, len(c.usage.users))
+	for user := range c.usage.users {
+		users = append(users, user)
+	}
+	c.lock.Unlock()
+
+	for _, user := range users {
+		c.makeRoom(user, "", 0)
+	}
+}
+
+// fitsUser returns whether the user stays within the quota with a new message
+// of the given size once the given size of their messages is freed.
+func (c *onDiskCache) fitsUser(user string, size, freed int64) bool {
+	return c.opts.UserQuota == 0 || c.usage.users[user]-freed+size <= int64(c.opts.UserQuota)
+}
+
+// fitsAll returns whether the cache stays within the quota and leaves enough
+// free space on the disk with a new message of the given size once the given
+// size of messages is freed.
+func (c *onDiskCache) fitsAll(size, freed int64) bool {
+	if c.opts.Quota > 0 && c.usage.total-freed+size > int64(c.opts.Quota) {
+		return false
+	}
+
+	free := int64(c.diskFree) + freed - size
+
+	if c.opts.MinFreeAbs > 0 && free < int64(c.opts.MinFreeAbs) {
+		return false
+	}
+
+	if c.opts.MinFreeRat > 0 && float64(free)/float64(c.diskSize) < c.opts.MinFreeRat {
+		return false
+	}
+
+	return true
+}
+
+// room returns how many bytes of new messages of the user fit without
+// evicting anything, or false if there is no limit.
+func (c *onDiskCache) room(userID string) (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var limits []int64
+
+	if c.opts.UserQuota > 0 {
+		limits = append(limits, int64(c.opts.UserQuota)-c.usage.users[c.getUserPath(userID)])
+	}
+
+	if c.opts.Quota > 0 {
+		limits = append(limits, int64(c.opts.Quota)-c.usage.total)
+	}
+
+	if c.opts.MinFreeAbs > 0 {
+		limits = append(limits, int64(c.diskFree)-int64(c.opts.MinFreeAbs))
+	}
+
+	if c.opts.MinFreeRat > 0 {
+		limits = append(limits, int64(c.diskFree)-int64(c.opts.MinFreeRat*float64(c.diskSize)))
+	}
+
+	if len(limits) == 0 {
+		return 0, false
+	}
+
+	room := limits[0]
+	for _, limit := range limits[1:] {
+		if limit < room {
+			room = limit
+		}
+	}
+
+	if room < 0 {
+		return 0, true
+	}
+
+	return room, true
+}
+
 func (c *onDiskCache) update() {
 	go func() {
 		c.once.Do(func() {
@@ -269,6 +628,7 @@ func (c *onDiskCache) update() {
 
 			// Update the free space.
 			c.diskFree = du.NewDiskUsage(c.path).Available()
+			metrics.CacheDisk(c.diskSize, c.diskFree)
 
 			// Reset the Once object (so we can update again).
 			c.once = &sync.Once{}
@@ -0,0 +1,175 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// diskUsage tracks the size and the order of the last access of the cached
+// messages so that the least recently used ones can be evicted.
+type diskUsage struct {
+	total int64
+	users map[string]int64
+	order *list.List // The most recently used message is at the front.
+	files map[string]*list.Element
+}
+
+type diskFile struct {
+	path, user string
+	size       int64
+	writing    bool // The space is reserved but the file is not written yet.
+}
+
+func newDiskUsage() *diskUsage {
+	return &diskUsage{
+		users: make(map[string]int64),
+		order: list.New(),
+		files: make(map[string]*list.Element),
+	}
+}
+
+// loadDiskUsage finds the messages cached in the directory. The modification
+// time of the files, which is updated when they are read, gives their order.
+func loadDiskUsage(path string) (*diskUsage, error) {
+	type cachedFile struct {
+		diskFile
+		modTime time.Time
+	}
+
+	var found []cachedFile
+
+	userDirs, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, userDir := range userDirs {
+		if !userDir.IsDir() {
+			continue
+		}
+
+		user := filepath.Join(path, userDir.Name())
+
+		files, err := ioutil.ReadDir(user)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			// Skip the files left behind by interrupted writes.
+			if file.IsDir() || strings.HasPrefix(file.Name(), "tmp") {
+				continue
+			}
+
+			found = append(found, cachedFile{
+				diskFile: diskFile{path: filepath.Join(user, file.Name()), user: user, size: file.Size()},
+				modTime:  file.ModTime(),
+			})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.Before(found[j].modTime) })
+
+	usage := newDiskUsage()
+
+	for _, file := range found {
+		usage.add(file.path, file.user, file.size)
+	}
+
+	return usage, nil
+}
+
+// add records the message as the most recently used one.
+func (u *diskUsage) add(path, user string, size int64) {
+	u.remove(path)
+
+	u.files[path] = u.order.PushFront(&diskFile{path: path, user: user, size: size})
+	u.users[user] += size
+	u.total += size
+}
+
+// reserve records the space of a message which is about to be written as
+// the most recently used one. It cannot be evicted until it is written.
+func (u *diskUsage) reserve(path, user string, size int64) {
+	u.add(path, user, size)
+	u.files[path].Value.(*diskFile).writing = true
+}
+
+// written records that the reserved message was written.
+func (u *diskUsage) written(path string) {
+	if elem, ok := u.files[path]; ok {
+		elem.Value.(*diskFile).writing = false
+	}
+}
+
+// touch records the message as the most recently used one.
+func (u *diskUsage) touch(path string) {
+	if elem, ok := u.files[path]; ok {
+		u.order.MoveToFront(elem)
+	}
+}
+
+func (u *diskUsage) size(path string) int64 {
+	if elem, ok := u.files[path]; ok {
+		return elem.Value.(*diskFile).size
+	}
+
+	return 0
+}
+
+func (u *diskUsage) remove(path string) {
+	elem, ok := u.files[path]
+	if !ok {
+		return
+	}
+
+	file := elem.Value.(*diskFile)
+
+	u.order.Remove(elem)
+	delete(u.files, path)
+	u.users[file.user] -= file.size
+	u.total -= file.size
+
+	if u.users[file.user] == 0 {
+		delete(u.users, file.user)
+	}
+}
+
+func (u *diskUsage) removeUser(user string) {
+	for path, elem := range u.files {
+		if elem.Value.(*diskFile).user == user {
+			u.remove(path)
+		}
+	}
+
+	delete(u.users, user)
+}
+
+// touchFile updates the modification time of the file, which orders the
+// messages after a restart.
+func touchFile(path string) {
+	now := time.Now()
+
+	_ = os.Chtimes(path, now, now)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// lru keeps blobs up to the given total size, evicting the least recently
+// used ones to make room for new ones.
+type lru struct {
+	lock        sync.Mutex
+	size, limit int
+	order       *list.List
+	items       map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	value []byte
+}
+
+func newLRU(limit int) *lru {
+	return &lru{
+		limit: limit,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) get(key string) ([]byte, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	l.order.MoveToFront(elem)
+
+	return elem.Value.(*lruItem).value, true
+}
+
+// has returns whether the key is stored without marking it as recently used.
+func (l *lru) has(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, ok := l.items[key]
+
+	return ok
+}
+
+// set stores the value unless it is bigger than the whole limit.
+func (l *lru) set(key string, value []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.remove(key)
+
+	if len(value) > l.limit {
+		return
+	}
+
+	for l.size+len(value) > l.limit {
+		l.remove(l.order.Back().Value.(*lruItem).key)
+	}
+
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value})
+	l.size += len(value)
+}
+
+func (l *lru) rem(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.remove(key)
+}
+
+// remPrefix removes all values with keys starting with the prefix.
+func (l *lru) remPrefix(prefix string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for key := range l.items {
+		if strings.HasPrefix(key, prefix) {
+			l.remove(key)
+		}
+	}
+}
+
+func (l *lru) remove(key string) {
+	elem, ok := l.items[key]
+	if !ok {
+		return
+	}
+
+	l.order.Remove(elem)
+	delete(l.items, key)
+	l.size -= len(elem.Value.(*lruItem).value)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newLRU(10)
+
+	l.set("a", []byte("aaaa"))
+	l.set("b", []byte("bbbb"))
+
+	// Reading a makes b the least recently used.
+	_, ok := l.get("a")
+	assert.True(t, ok)
+
+	l.set("c", []byte("cccc"))
+
+	_, ok = l.get("b")
+	assert.False(t, ok)
+
+	value, ok := l.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("aaaa"), value)
+
+	value, ok = l.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("cccc"), value)
+	assert.Equal(t, 8, l.size)
+}
+
+func TestLRUHasDoesNotTouch(t *testing.T) {
+	l := newLRU(10)
+
+	l.set("a", []byte("aaaa"))
+	l.set("b", []byte("bbbb"))
+
+	// Checking a keeps it the least recently used.
+	assert.True(t, l.has("a"))
+
+	l.set("c", []byte("cccc"))
+
+	assert.False(t, l.has("a"))
+	assert.True(t, l.has("b"))
+	assert.True(t, l.has("c"))
+}
+
+func TestLRUSkipsOversizedValues(t *testing.T) {
+	l := newLRU(4)
+
+	l.set("a", []byte("aaaa"))
+	l.set("b", []byte("bbbbb"))
+
+	_, ok := l.get("b")
+	assert.False(t, ok)
+
+	_, ok = l.get("a")
+	assert.True(t, ok)
+}
+
+func TestLRURemove(t *testing.T) {
+	l := newLRU(100)
+
+	l.set("user1/a", []byte("a"))
+	l.set("user1/b", []byte("b"))
+	l.set("user2/a", []byte("a"))
+
+	l.rem("user1/a")
+	_, ok := l.get("user1/a")
+	assert.False(t, ok)
+
+	l.remPrefix("user1/")
+	_, ok = l.get("user1/b")
+	assert.False(t, ok)
+
+	_, ok = l.get("user2/a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, l.size)
+}
@@ -18,28 +18,42 @@
 package cache
 
 import (
+	"bytes"
 	"errors"
+	"io"
 	"sync"
 )
 
+var errNoSuchMessage = errors.New("no such message in cache")
+
+// inMemoryCache keeps the messages encrypted in memory, like onDiskCache keeps
+// them on disk, evicting the least recently used ones to stay within the limit.
 type inMemoryCache struct {
-	lock        sync.RWMutex
-	data        map[string]map[string][]byte
-	size, limit int
+	lock  sync.RWMutex
+	gcm   map[string]*blobCipher
+	blobs *lru
 }
 
 // NewInMemoryCache creates a new in memory cache which stores up to the given
 // number of bytes of cached data.
-// NOTE(GODT-1158): Make this threadsafe.
 func NewInMemoryCache(limit int) Cache {
 	return &inMemoryCache{
-		data:  make(map[string]map[string][]byte),
-		limit: limit,
+		gcm:   make(map[string]*blobCipher),
+		blobs: newLRU(limit),
 	}
 }
 
 func (c *inMemoryCache) Unlock(userID string, passphrase []byte) error {
-	c.data[userID] = make(map[string][]byte)
+	gcm, err := newBlobCipher(userID, passphrase)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gcm[userID] = gcm
+
 	return nil
 }
 
@@ -47,95 +61,79 @@ func (c *inMemoryCache) Lock(userID string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	for _, message := range c.data[userID] {
-		c.size -= len(message)
-	}
-
-	delete(c.data, userID)
+	delete(c.gcm, userID)
 }
 
 func (c *inMemoryCache) Delete(userID string) error {
 	c.Lock(userID)
+
+	c.blobs.remPrefix(c.getUserKey(userID))
+
 	return nil
 }
 
-// Has returns whether the given message exists in the cache.
+// Has returns whether the given message exists in the cache. As with
+// onDiskCache, the message of a locked user exists, but Get returns
+// ErrCacheNeedsUnlock until the user is unlocked again. Checking a message
+// does not count as using it, so it does not delay its eviction.
 func (c *inMemoryCache) Has(userID, messageID string) bool {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	if !c.isUserUnlocked(userID) {
-		// This might look counter intuitive but in order to be able to test
-		// "re-unlocking" mechanism we need to return true here.
-		//
-		// The situation is the same as it would happen for onDiskCache with
-		// locked user. Later during `Get` cache would return proper error
-		// `ErrCacheNeedsUnlock`. It is expected that store would then try to
-		// re-unlock.
-		//
-		// In order to do proper behaviour we should implement
-		// encryption for inMemoryCache.
-		return true
-	}
-
-	_, ok := c.data[userID][messageID]
-	return ok
+	return c.blobs.has(c.getMessageKey(userID, messageID))
 }
 
-func (c *inMemoryCache) Get(userID, messageID string) ([]byte, error) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-
-	if !c.isUserUnlocked(userID) {
+func (c *inMemoryCache) Get(userID, messageID string) (io.ReadCloser, error) {
+	gcm, ok := c.getCipher(userID)
+	if !ok {
 		return nil, ErrCacheNeedsUnlock
 	}
 
-	literal, ok := c.data[userID][messageID]
+	enc, ok := c.blobs.get(c.getMessageKey(userID, messageID))
 	if !ok {
-		return nil, errors.New("no such message in cache")
+		return nil, errNoSuchMessage
 	}
 
-	return literal, nil
+	return gcm.open(nil, messageID, bytes.NewReader(enc))
 }
 
-func (c *inMemoryCache) isUserUnlocked(userID string) bool {
-	_, ok := c.data[userID]
-	return ok
-}
-
-// Set saves the message literal to memory for further usage.
-//
-// NOTE(GODT-1158, GODT-1488): Once memory limit is reached we should do proper
-// rotation based on usage frequency.
-func (c *inMemoryCache) Set(userID, messageID string, literal []byte) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	if !c.isUserUnlocked(userID) {
+// Set saves the message literal to memory for further usage. The least
+// recently used messages are evicted to make room for it; a message bigger
+// than the whole limit is not cached.
+func (c *inMemoryCache) Set(userID, messageID string, literal Literal) error {
+	gcm, ok := c.getCipher(userID)
+	if !ok {
 		return ErrCacheNeedsUnlock
 	}
 
-	if c.size+len(literal) > c.limit {
-		return nil
+	enc := new(bytes.Buffer)
+
+	// The messages are not compressed to keep reading them fast.
+	if err := gcm.seal(NoopCompressor{}, messageID, literal, enc); err != nil {
+		return err
 	}
 
-	c.size += len(literal)
-	c.data[userID][messageID] = literal
+	c.blobs.set(c.getMessageKey(userID, messageID), enc.Bytes())
 
 	return nil
 }
 
 func (c *inMemoryCache) Rem(userID, messageID string) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	c.blobs.rem(c.getMessageKey(userID, messageID))
 
-	if !c.isUserUnlocked(userID) {
-		return nil
-	}
+	return nil
+}
+
+func (c *inMemoryCache) getCipher(userID string) (*blobCipher, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 
-	c.size -= len(c.data[userID][messageID])
+	gcm, ok := c.gcm[userID]
 
-	delete(c.data[userID], messageID)
+	return gcm, ok
+}
 
-	return nil
+func (c *inMemoryCache) getUserKey(userID string) string {
+	return getHash(userID) + "/"
+}
+
+func (c *inMemoryCache) getMessageKey(userID, messageID string) string {
+	return c.getUserKey(userID) + messageID
 }
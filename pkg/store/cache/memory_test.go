@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryCacheEncrypted(t *testing.T) {
+	cache := NewInMemoryCache(1 << 20)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	getSetCachedMessage(t, cache, "userID1", "messageID1", "some secret")
+
+	enc, ok := cache.(*inMemoryCache).blobs.get(cache.(*inMemoryCache).getMessageKey("userID1", "messageID1"))
+	require.True(t, ok)
+	assert.NotContains(t, string(enc), "some secret")
+}
+
+func TestInMemoryCacheLock(t *testing.T) {
+	cache := NewInMemoryCache(1 << 20)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	getSetCachedMessage(t, cache, "userID1", "messageID1", "some secret")
+
+	// The messages of a locked user are kept but cannot be read.
+	cache.Lock("userID1")
+	assert.True(t, cache.Has("userID1", "messageID1"))
+
+	_, err := cache.Get("userID1", "messageID1")
+	assert.Equal(t, ErrCacheNeedsUnlock, err)
+	assert.Equal(t, ErrCacheNeedsUnlock, cache.Set("userID1", "messageID2", literal("other")))
+
+	// A wrong passphrase cannot open the message.
+	require.NoError(t, cache.Unlock("userID1", []byte("wrong passphrase")))
+	_, err = cache.Get("userID1", "messageID1")
+	assert.Error(t, err)
+
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+	getCachedMessage(t, cache, "userID1", "messageID1", "some secret")
+
+	require.NoError(t, cache.Delete("userID1"))
+	assert.False(t, cache.Has("userID1", "messageID1"))
+}
+
+func TestInMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewInMemoryCache(300)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	require.NoError(t, cache.Set("userID1", "messageID1", literal(testLiteral(1))))
+	require.NoError(t, cache.Set("userID1", "messageID2", literal(testLiteral(2))))
+
+	getCachedMessage(t, cache, "userID1", "messageID1", (testLiteral(1)))
+	require.NoError(t, cache.Set("userID1", "messageID3", literal(testLiteral(3))))
+
+	assert.True(t, cache.Has("userID1", "messageID1"))
+	assert.False(t, cache.Has("userID1", "messageID2"))
+	assert.True(t, cache.Has("userID1", "messageID3"))
+
+	// A message bigger than the limit is not cached and evicts nothing.
+	require.NoError(t, cache.Set("userID1", "messageID4", bytes.NewReader(make([]byte, 400))))
+	assert.False(t, cache.Has("userID1", "messageID4"))
+	assert.True(t, cache.Has("userID1", "messageID1"))
+}
+
+func TestInMemoryCacheConcurrent(t *testing.T) {
+	cache := NewInMemoryCache(1 << 20)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			userID := fmt.Sprintf("userID%d", i%2)
+			messageID := fmt.Sprintf("messageID%d", i)
+
+			require.NoError(t, cache.Unlock(userID, []byte("my secret passphrase")))
+
+			for j := 0; j < 100; j++ {
+				if err := cache.Set(userID, messageID, literal(testLiteral(j))); err == nil {
+					_, _ = cache.Get(userID, messageID)
+				}
+
+				cache.Has(userID, messageID)
+				_ = cache.Rem(userID, messageID)
+
+				if j%10 == 0 {
+					cache.Lock(userID)
+					require.NoError(t, cache.Unlock(userID, []byte("my secret passphrase")))
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
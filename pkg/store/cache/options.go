@@ -20,6 +20,8 @@ package cache
 type Options struct {
 	MinFreeAbs      uint64
 	MinFreeRat      float64
+	UserQuota       uint64 // The most bytes the messages of one user take; 0 means no limit.
+	Quota           uint64 // The most bytes the messages of all users take; 0 means no limit.
 	ConcurrentRead  int
 	ConcurrentWrite int
 }
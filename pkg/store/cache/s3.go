@@ -0,0 +1,369 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// IsS3Cache will return true if Cache is type of s3Cache.
+func IsS3Cache(c Cache) bool {
+	_, ok := c.(*s3Cache)
+	return ok
+}
+
+// s3Cache keeps the encrypted messages in an S3-compatible object store and
+// the most recently used of them in memory, so that the messages read over
+// and over again do not have to be downloaded each time. The large messages
+// are streamed instead. The keys of the
+// stored objects are listed once per user and kept up to date afterwards, so
+// that checking for a message does not need a request.
+type s3Cache struct {
+	client *s3Client
+	cmp    Compressor
+	zstd   *ZstdCompressor
+	front  *lru
+
+	gcm  map[string]*blobCipher
+	lock sync.RWMutex
+
+	index     map[string]map[string]struct{}
+	changes   map[string]map[string]bool
+	indexLock sync.Mutex
+}
+
+// NewS3Cache creates a new cache in the bucket of an S3-compatible object
+// store with a front tier keeping up to frontLimit bytes in memory. The new
+// messages are compressed with cmp; the cached ones are read with the
+// compressor and the dictionary they record, which must be among dicts unless
+// cmp has it.
+func NewS3Cache(opts S3Options, cmp Compressor, frontLimit int, dicts ...[]byte) (Cache, error) {
+	zstd, err := newZstdReader(cmp, dicts)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newS3Client(opts)
+
+	if err := client.put("tmp", []byte("test-write")); err != nil {
+		return nil, fmt.Errorf("cannot write to bucket: %w", err)
+	}
+
+	if err := client.delete("tmp"); err != nil {
+		return nil, fmt.Errorf("cannot delete from bucket: %w", err)
+	}
+
+	return &s3Cache{
+		client:  client,
+		cmp:     cmp,
+		zstd:    zstd,
+		front:   newLRU(frontLimit),
+		gcm:     make(map[string]*blobCipher),
+		index:   make(map[string]map[string]struct{}),
+		changes: make(map[string]map[string]bool),
+	}, nil
+}
+
+func (c *s3Cache) Lock(userID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.gcm, userID)
+}
+
+func (c *s3Cache) Unlock(userID string, passphrase []byte) error {
+	gcm, err := newBlobCipher(userID, passphrase)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gcm[userID] = gcm
+
+	return nil
+}
+
+func (c *s3Cache) Delete(userID string) error {
+	userKey := c.getUserKey(userID)
+
+	c.front.remPrefix(userKey)
+
+	// The index is listed again the next time it is needed.
+	c.indexLock.Lock()
+	delete(c.index, userKey)
+	delete(c.changes, userKey)
+	c.indexLock.Unlock()
+
+	keys, err := c.client.list(userKey)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := c.client.delete(key); err != nil && !errors.Is(err, errNoSuchObject) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Has returns whether the given message exists in the cache. When the object
+// store cannot tell, the message is reported missing and cached again.
+func (c *s3Cache) Has(userID, messageID string) bool {
+	key := c.getMessageKey(userID, messageID)
+
+	if c.front.has(key) {
+		return true
+	}
+
+	if has, ok := c.indexHas(userID, key); ok {
+		return has
+	}
+
+	return c.client.head(key) == nil
+}
+
+// Get streams the message from the object store unless it is in the front
+// tier. The small messages are kept there once read.
+func (c *s3Cache) Get(userID, messageID string) (io.ReadCloser, error) {
+	gcm, ok := c.getCipher(userID)
+	if !ok {
+		return nil, ErrCacheNeedsUnlock
+	}
+
+	key := c.getMessageKey(userID, messageID)
+
+	if enc, ok := c.front.get(key); ok {
+		return gcm.open(c.zstd, messageID, bytes.NewReader(enc))
+	}
+
+	body, size, err := c.client.getReader(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if size >= 0 && size < largeMessage {
+		enc, err := ioutil.ReadAll(body)
+		body.Close() //nolint:errcheck,gosec
+		if err != nil {
+			return nil, err
+		}
+
+		c.front.set(key, enc)
+
+		return gcm.open(c.zstd, messageID, bytes.NewReader(enc))
+	}
+
+	literal, err := gcm.open(c.zstd, messageID, bufio.NewReader(body))
+	if err != nil {
+		body.Close() //nolint:errcheck,gosec
+		return nil, err
+	}
+
+	return &blobReader{ReadCloser: literal, blob: body}, nil
+}
+
+// Set uploads the message. Its size and hash are signed before it is sent,
+// so a large message is written to a temporary file first; only the small
+// ones are kept in the front tier.
+func (c *s3Cache) Set(userID, messageID string, literal Literal) error {
+	gcm, ok := c.getCipher(userID)
+	if !ok {
+		return ErrCacheNeedsUnlock
+	}
+
+	key := c.getMessageKey(userID, messageID)
+
+	if literal.Size() < largeMessage {
+		enc := new(bytes.Buffer)
+
+		if err := gcm.seal(c.cmp, messageID, literal, enc); err != nil {
+			return err
+		}
+
+		if err := c.client.put(key, enc.Bytes()); err != nil {
+			return err
+		}
+
+		c.front.set(key, enc.Bytes())
+	} else {
+		if err := c.putLarge(gcm, key, messageID, literal); err != nil {
+			return err
+		}
+
+		c.front.rem(key)
+	}
+
+	c.indexUpdate(userID, key, true)
+
+	return nil
+}
+
+func (c *s3Cache) putLarge(gcm *blobCipher, key, messageID string, literal Literal) error {
+	file, err := ioutil.TempFile("", "peroxide-s3-")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		file.Close()           //nolint:errcheck,gosec
+		os.Remove(file.Name()) //nolint:errcheck,gosec
+	}()
+
+	hash := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(file, hash))
+
+	if err := gcm.seal(c.cmp, messageID, literal, w); err != nil {
+		return err
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	// The request must not close the file before it is removed.
+	return c.client.putReader(key, ioutil.NopCloser(file), size, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func (c *s3Cache) Rem(userID, messageID string) error {
+	key := c.getMessageKey(userID, messageID)
+
+	c.front.rem(key)
+
+	if err := c.client.delete(key); err != nil {
+		return err
+	}
+
+	c.indexUpdate(userID, key, false)
+
+	return nil
+}
+
+// indexHas looks the key up in the index of the user, listing the objects of
+// the user first if it has not been done yet. It returns false as the second
+// value if the objects cannot be listed.
+func (c *s3Cache) indexHas(userID, key string) (bool, bool) {
+	userKey := c.getUserKey(userID)
+
+	c.indexLock.Lock()
+	if keys, ok := c.index[userKey]; ok {
+		_, has := keys[key]
+		c.indexLock.Unlock()
+		return has, true
+	}
+
+	// The keys stored or removed while the objects are listed may be missing
+	// from the listing; they are recorded until it is merged.
+	if _, ok := c.changes[userKey]; !ok {
+		c.changes[userKey] = make(map[string]bool)
+	}
+	c.indexLock.Unlock()
+
+	list, err := c.client.list(userKey)
+	if err != nil {
+		return false, false
+	}
+
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	// Another lookup may have listed the objects meanwhile.
+	keys, ok := c.index[userKey]
+	if !ok {
+		keys = make(map[string]struct{}, len(list))
+		for _, key := range list {
+			keys[key] = struct{}{}
+		}
+
+		for key, stored := range c.changes[userKey] {
+			if stored {
+				keys[key] = struct{}{}
+			} else {
+				delete(keys, key)
+			}
+		}
+
+		c.index[userKey] = keys
+		delete(c.changes, userKey)
+	}
+
+	_, has := keys[key]
+
+	return has, true
+}
+
+// indexUpdate records that the key was stored or removed. Indexes which have
+// not been listed yet are left alone; the listing will include the change.
+func (c *s3Cache) indexUpdate(userID, key string, stored bool) {
+	c.indexLock.Lock()
+	defer c.indexLock.Unlock()
+
+	userKey := c.getUserKey(userID)
+
+	if changes, ok := c.changes[userKey]; ok {
+		changes[key] = stored
+	}
+
+	keys, ok := c.index[userKey]
+	if !ok {
+		return
+	}
+
+	if stored {
+		keys[key] = struct{}{}
+	} else {
+		delete(keys, key)
+	}
+}
+
+func (c *s3Cache) getCipher(userID string) (*blobCipher, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	gcm, ok := c.gcm[userID]
+
+	return gcm, ok
+}
+
+func (c *s3Cache) getUserKey(userID string) string {
+	return getHash(userID) + "/"
+}
+
+func (c *s3Cache) getMessageKey(userID, messageID string) string {
+	return c.getUserKey(userID) + getHash(messageID)
+}
@@ -0,0 +1,324 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errNoSuchObject = errors.New("no such object")
+
+// S3Options tell where the S3-compatible object store is and how to sign in
+// to it.
+type S3Options struct {
+	Endpoint  string // Like https://s3.eu-central-1.amazonaws.com or http://localhost:9000.
+	Region    string
+	Bucket    string
+	Prefix    string // Prepended to the names of all objects.
+	AccessKey string
+	SecretKey string
+}
+
+// s3Client talks to an S3-compatible object store. It addresses the bucket
+// in the path, which is what self-hosted stores support best, and signs the
+// requests with AWS Signature Version 4. The objects are streamed, so only
+// waiting for the responses times out, not reading them.
+type s3Client struct {
+	opts S3Options
+	http *http.Client
+	now  func() time.Time
+}
+
+func newS3Client(opts S3Options) *s3Client {
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert
+	transport.ResponseHeaderTimeout = time.Minute
+
+	return &s3Client{
+		opts: opts,
+		http: &http.Client{Transport: transport},
+		now:  time.Now,
+	}
+}
+
+func (c *s3Client) put(key string, body []byte) error {
+	payloadHash := sha256.Sum256(body)
+
+	return c.putReader(key, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(payloadHash[:]))
+}
+
+// putReader uploads the object read from the body. Its size and SHA-256 are
+// signed, so they have to be known before.
+func (c *s3Client) putReader(key string, body io.Reader, size int64, payloadHash string) error {
+	res, err := c.send(http.MethodPut, key, nil, body, size, payloadHash)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// getReader returns the body of the object and its size, or -1 if the size
+// is unknown.
+func (c *s3Client) getReader(key string) (io.ReadCloser, int64, error) {
+	res, err := c.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return res.Body, res.ContentLength, nil
+}
+
+func (c *s3Client) head(key string) error {
+	res, err := c.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+func (c *s3Client) delete(key string) error {
+	res, err := c.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns the keys of all objects starting with the prefix.
+func (c *s3Client) list(prefix string) ([]string, error) {
+	var keys []string
+
+	query := map[string]string{"list-type": "2", "prefix": c.opts.Prefix + prefix}
+
+	for {
+		res, err := c.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close() //nolint:errcheck,gosec
+		if err != nil {
+			return nil, err
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(content.Key, c.opts.Prefix))
+		}
+
+		if !result.IsTruncated {
+			return keys, nil
+		}
+
+		query["continuation-token"] = result.NextContinuationToken
+	}
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func (err s3Error) Error() string {
+	return fmt.Sprintf("s3: %v: %v", err.Code, err.Message)
+}
+
+// do sends a signed request for the object with the given key or for the
+// bucket itself if the key is empty. Responses other than 2xx are returned
+// as errors; errNoSuchObject stands for a missing object.
+func (c *s3Client) do(method, key string, query map[string]string, body []byte) (*http.Response, error) {
+	payloadHash := sha256.Sum256(body)
+
+	return c.send(method, key, query, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(payloadHash[:]))
+}
+
+// send is like do but reads the body of the request from a reader.
+func (c *s3Client) send(method, key string, query map[string]string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	endpoint, err := url.Parse(c.opts.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	path := strings.TrimSuffix(endpoint.Path, "/") + "/" + c.opts.Bucket
+	if key != "" {
+		path += "/" + c.opts.Prefix + key
+	}
+
+	endpoint.Path = path
+	endpoint.RawPath = s3Escape(path, false)
+	endpoint.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > 0 {
+		req.ContentLength = size
+	}
+
+	signV4(req, payloadHash, c.opts, c.now().UTC())
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+
+	defer res.Body.Close() //nolint:errcheck
+
+	// The responses to HEAD requests have no body to tell why they failed.
+	var s3Err s3Error
+	_ = xml.NewDecoder(res.Body).Decode(&s3Err)
+
+	switch {
+	case res.StatusCode == http.StatusNotFound && key != "" && (s3Err.Code == "" || s3Err.Code == "NoSuchKey"):
+		return nil, errNoSuchObject
+
+	case s3Err.Code == "":
+		return nil, fmt.Errorf("s3: unexpected response: %v", res.Status)
+
+	default:
+		return nil, s3Err
+	}
+}
+
+// signV4 adds the AWS Signature Version 4 of the request to its headers. It
+// signs the host and all headers already set.
+func signV4(req *http.Request, payloadHash string, opts S3Options, now time.Time) {
+	date := now.Format("20060102")
+	scope := date + "/" + opts.Region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+opts.SecretKey), date)
+	key = hmacSHA256(key, opts.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		opts.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data)) //nolint:errcheck,gosec
+	return mac.Sum(nil)
+}
+
+// s3Query returns the query sorted and escaped the way it is signed.
+func s3Query(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]string, 0, len(names))
+	for _, name := range names {
+		params = append(params, s3Escape(name, true)+"="+s3Escape(query[name], true))
+	}
+
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters and,
+// unless asked for, the slashes.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
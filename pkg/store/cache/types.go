@@ -17,7 +17,10 @@
 
 package cache
 
-import "errors"
+import (
+	"errors"
+	"io"
+)
 
 var ErrCacheNeedsUnlock = errors.New("cache needs to be unlocked")
 
@@ -27,7 +30,14 @@ type Cache interface {
 	Delete(userID string) error
 
 	Has(userID, messageID string) bool
-	Get(userID, messageID string) ([]byte, error)
-	Set(userID, messageID string, literal []byte) error
+	Get(userID, messageID string) (io.ReadCloser, error)
+	Set(userID, messageID string, literal Literal) error
 	Rem(userID, messageID string) error
 }
+
+// Literal is a message literal to be cached. It is read as many times as
+// needed rather than held in memory.
+type Literal interface {
+	io.ReaderAt
+	Size() int64
+}
@@ -18,6 +18,10 @@
 package cache
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	"github.com/ljanyst/peroxide/pkg/config/settings"
@@ -35,33 +39,179 @@ func LoadMessageCache(s *settings.Settings) (Cache, error) {
 		return NewInMemoryCache(inMemoryCacheLimnit), nil
 	}
 
-	var compressor Compressor
+	// The cached messages record their compressor and dictionary, so changing
+	// the settings only affects the messages written from now on.
+	compressor, err := loadCompressor(s)
+	if err != nil {
+		return NewInMemoryCache(inMemoryCacheLimnit), err
+	}
 
-	// NOTE(GODT-1158): Changing compression is not an option currently
-	// available for user but, if user changes compression setting we have
-	// to nuke the cache.
-	if s.GetBool(settings.CacheCompressionKey) {
-		compressor = &GZipCompressor{}
-	} else {
-		compressor = &NoopCompressor{}
+	var dict []byte
+	if zstd, ok := compressor.(*ZstdCompressor); ok {
+		dict = zstd.dict
 	}
 
-	path := filepath.Join(s.Get(settings.CacheDir), "messages")
+	dicts, err := loadDictionaries(filepath.Join(s.Get(settings.CacheDir), "dictionaries"), dict)
+	if err != nil {
+		return NewInMemoryCache(inMemoryCacheLimnit), err
+	}
 
 	// To prevent memory peaks we set maximal write concurency for store
 	// build jobs.
 	//	store.SetBuildAndCacheJobLimit(s.GetInt(settings.CacheConcurrencyWrite))
 
-	messageCache, err := NewOnDiskCache(path, compressor, Options{
+	var messageCache Cache
+
+	switch s.Get(settings.CacheBackendKey) {
+	case "s3":
+		messageCache, err = NewS3Cache(loadS3Options(s), compressor, s.GetInt(settings.CacheFrontSizeKey), dicts...)
+
+	default:
+		path := filepath.Join(s.Get(settings.CacheDir), "messages")
+		messageCache, err = NewOnDiskCache(path, compressor, loadOptions(s), dicts...)
+	}
+
+	if err != nil {
+		return NewInMemoryCache(inMemoryCacheLimnit), err
+	}
+
+	return messageCache, nil
+}
+
+// loadCompressor returns the configured compressor.
+func loadCompressor(s *settings.Settings) (Compressor, error) {
+	if !s.GetBool(settings.CacheCompressionKey) {
+		return &NoopCompressor{}, nil
+	}
+
+	if s.Get(settings.CacheCompressorKey) != "zstd" {
+		return &GZipCompressor{}, nil
+	}
+
+	var dict []byte
+
+	if path := s.Get(settings.CacheDictionaryKey); path != "" {
+		var err error
+
+		if dict, err = ioutil.ReadFile(filepath.Clean(path)); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewZstdCompressor(dict)
+}
+
+// loadDictionaries keeps a copy of the Zstandard dictionary, if any, in the
+// directory and returns all the dictionaries kept there, so that the messages
+// compressed with them stay readable after the dictionary or the compressor
+// is changed.
+func loadDictionaries(dir string, dict []byte) ([][]byte, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if len(dict) > 0 {
+		id, err := dictionaryID(dict)
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("%d.dict", id))
+
+		kept, err := ioutil.ReadFile(filepath.Clean(path))
+		switch {
+		case os.IsNotExist(err):
+			if err := writeFileAtomic(path, dict); err != nil {
+				return nil, err
+			}
+
+		case err != nil:
+			return nil, err
+
+		// The messages compressed with the kept one could not be read.
+		case !bytes.Equal(kept, dict):
+			return nil, fmt.Errorf("another zstd dictionary with ID %d was used before", id)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dicts [][]byte
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".dict" {
+			continue
+		}
+
+		kept, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		dicts = append(dicts, kept)
+	}
+
+	return dicts, nil
+}
+
+func loadOptions(s *settings.Settings) Options {
+	return Options{
 		MinFreeAbs:      uint64(s.GetInt(settings.CacheMinFreeAbsKey)),
 		MinFreeRat:      s.GetFloat64(settings.CacheMinFreeRatKey),
+		UserQuota:       uint64(s.GetInt(settings.CacheUserQuotaKey)),
+		Quota:           uint64(s.GetInt(settings.CacheQuotaKey)),
 		ConcurrentRead:  s.GetInt(settings.CacheConcurrencyRead),
 		ConcurrentWrite: s.GetInt(settings.CacheConcurrencyWrite),
-	})
+	}
+}
 
-	if err != nil {
-		return NewInMemoryCache(inMemoryCacheLimnit), err
+// loadS3Options reads where the S3 cache is. The credentials not given in
+// settings are taken from the environment, like the AWS tools do.
+func loadS3Options(s *settings.Settings) S3Options {
+	opts := S3Options{
+		Endpoint:  s.Get(settings.CacheS3EndpointKey),
+		Region:    s.Get(settings.CacheS3RegionKey),
+		Bucket:    s.Get(settings.CacheS3BucketKey),
+		Prefix:    s.Get(settings.CacheS3PrefixKey),
+		AccessKey: s.Get(settings.CacheS3AccessKeyKey),
+		SecretKey: s.Get(settings.CacheS3SecretKeyKey),
 	}
 
-	return messageCache, nil
+	if opts.AccessKey == "" {
+		opts.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	if opts.SecretKey == "" {
+		opts.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	return opts
+}
+
+// IsPersistentCache returns true if the cache keeps the messages across
+// restarts, so it is worth filling it in the background.
+func IsPersistentCache(c Cache) bool {
+	return IsOnDiskCache(c) || IsS3Cache(c)
+}
+
+// Room returns how many bytes of new messages of the user the cache takes
+// before it starts evicting others, or false if there is no limit.
+func Room(c Cache, userID string) (int64, bool) {
+	if c, ok := c.(*onDiskCache); ok {
+		return c.room(userID)
+	}
+
+	return 0, false
+}
+
+// UpdateOptions applies the free space limits, the quotas and the concurrency
+// configured in settings to a running on-disk cache. The in-memory cache has
+// no options.
+func UpdateOptions(c Cache, s *settings.Settings) {
+	if c, ok := c.(*onDiskCache); ok {
+		c.setOptions(loadOptions(s))
+	}
 }
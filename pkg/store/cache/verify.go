@@ -0,0 +1,235 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrNotVerifiable = errors.New("only the persistent caches can be verified")
+
+// VerifyReport tells what Verify found in the cache of a user.
+type VerifyReport struct {
+	// Checked is the number of the cached messages which were read.
+	Checked int
+
+	// Corrupted are the IDs of the messages which could not be read.
+	Corrupted []string
+
+	// Orphans is the number of the cached messages which are not known.
+	Orphans int
+}
+
+// verifier is implemented by the caches which can list what they hold.
+type verifier interface {
+	// entries returns the names under which the messages of the user are
+	// stored, i.e. the hashes of their IDs.
+	entries(userID string) ([]string, error)
+
+	// check reads and decrypts the message without recording its use.
+	check(userID, messageID string) error
+
+	// remEntry removes the entry of the given name.
+	remEntry(userID, name string) error
+}
+
+// Verify reads every message of the user in the cache. The entries of the
+// messages which are not among the IDs returned by getMessageIDs, like the
+// deleted ones, are removed as orphans. The messages which cannot be read are
+// removed as well and reported as corrupted, so that they can be cached again.
+//
+// The entries are listed before the message IDs are taken, so that a message
+// cached in the meantime is not mistaken for an orphan.
+func Verify(c Cache, userID string, getMessageIDs func() ([]string, error)) (*VerifyReport, error) {
+	v, ok := c.(verifier)
+	if !ok {
+		return nil, ErrNotVerifiable
+	}
+
+	names, err := v.entries(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	messageIDs, err := getMessageIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]string, len(messageIDs))
+	for _, messageID := range messageIDs {
+		known[getHash(messageID)] = messageID
+	}
+
+	report := &VerifyReport{}
+
+	for _, name := range names {
+		messageID, ok := known[name]
+		if !ok {
+			if err := v.remEntry(userID, name); err != nil {
+				return nil, err
+			}
+
+			report.Orphans++
+
+			continue
+		}
+
+		err := v.check(userID, messageID)
+
+		switch {
+		case err == nil:
+			report.Checked++
+
+		case errors.Is(err, ErrCacheNeedsUnlock):
+			return nil, err
+
+		// The message was removed meanwhile.
+		case os.IsNotExist(err), errors.Is(err, errNoSuchObject):
+
+		default:
+			if err := c.Rem(userID, messageID); err != nil {
+				return nil, err
+			}
+
+			report.Checked++
+			report.Corrupted = append(report.Corrupted, messageID)
+		}
+	}
+
+	return report, nil
+}
+
+func (c *onDiskCache) entries(userID string) ([]string, error) {
+	files, err := ioutil.ReadDir(c.getUserPath(userID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, file := range files {
+		// Skip the files which are still being written.
+		if file.IsDir() || strings.HasPrefix(file.Name(), "tmp") {
+			continue
+		}
+
+		names = append(names, file.Name())
+	}
+
+	return names, nil
+}
+
+func (c *onDiskCache) check(userID, messageID string) error {
+	gcm, ok := c.gcm[userID]
+	if !ok || gcm == nil {
+		return ErrCacheNeedsUnlock
+	}
+
+	file, literal, err := c.openFile(gcm, messageID, c.getMessagePath(userID, messageID))
+	if err != nil {
+		return err
+	}
+
+	return readAll(&blobReader{ReadCloser: literal, blob: file})
+}
+
+func (c *onDiskCache) remEntry(userID, name string) error {
+	defer c.update()
+
+	path := filepath.Join(c.getUserPath(userID), name)
+
+	c.lock.Lock()
+	c.usage.remove(path)
+	c.lock.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (c *s3Cache) entries(userID string) ([]string, error) {
+	keys, err := c.client.list(c.getUserKey(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(keys))
+
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, c.getUserKey(userID)))
+	}
+
+	return names, nil
+}
+
+// check reads the message from the object store, not the front tier, as it is
+// the stored copy which may be damaged.
+func (c *s3Cache) check(userID, messageID string) error {
+	gcm, ok := c.getCipher(userID)
+	if !ok {
+		return ErrCacheNeedsUnlock
+	}
+
+	body, _, err := c.client.getReader(c.getMessageKey(userID, messageID))
+	if err != nil {
+		return err
+	}
+
+	literal, err := gcm.open(c.zstd, messageID, bufio.NewReader(body))
+	if err != nil {
+		body.Close() //nolint:errcheck,gosec
+		return err
+	}
+
+	return readAll(&blobReader{ReadCloser: literal, blob: body})
+}
+
+// readAll reads the whole message, which checks all of it, and closes it.
+func readAll(literal io.ReadCloser) error {
+	_, err := io.Copy(ioutil.Discard, literal)
+
+	if closeErr := literal.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (c *s3Cache) remEntry(userID, name string) error {
+	key := c.getUserKey(userID) + name
+
+	c.front.rem(key)
+
+	if err := c.client.delete(key); err != nil && !errors.Is(err, errNoSuchObject) {
+		return err
+	}
+
+	c.indexUpdate(userID, key, false)
+
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package cache
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyOnDiskCache(t *testing.T) {
+	cache, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{ConcurrentRead: 1, ConcurrentWrite: 1})
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+	require.NoError(t, cache.Unlock("userID2", []byte("my other passphrase")))
+
+	for _, messageID := range []string{"messageID1", "messageID2", "messageID3"} {
+		require.NoError(t, cache.Set("userID1", messageID, literal("some secret")))
+	}
+	require.NoError(t, cache.Set("userID2", "messageID4", literal("some secret")))
+
+	// A truncated file and a file which holds another message.
+	path := cache.(*onDiskCache).getMessagePath("userID1", "messageID2")
+	require.NoError(t, ioutil.WriteFile(path, []byte("damaged"), 0o600))
+
+	enc, err := ioutil.ReadFile(cache.(*onDiskCache).getMessagePath("userID1", "messageID1"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(cache.(*onDiskCache).getMessagePath("userID1", "messageID3"), enc, 0o600))
+
+	report, err := Verify(cache, "userID1", messageIDs("messageID2", "messageID3", "messageID5"))
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Checked)
+	assert.ElementsMatch(t, []string{"messageID2", "messageID3"}, report.Corrupted)
+	assert.Equal(t, 1, report.Orphans)
+
+	for _, messageID := range []string{"messageID1", "messageID2", "messageID3"} {
+		assert.False(t, cache.Has("userID1", messageID))
+	}
+
+	// The messages of other users are left alone.
+	assert.True(t, cache.Has("userID2", "messageID4"))
+
+	_, err = Verify(NewInMemoryCache(1<<20), "userID1", messageIDs())
+	assert.Equal(t, ErrNotVerifiable, err)
+}
+
+func TestVerifyKeepsMessagesCachedMeanwhile(t *testing.T) {
+	cache, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{ConcurrentRead: 1, ConcurrentWrite: 1})
+	require.NoError(t, err)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	require.NoError(t, cache.Set("userID1", "messageID1", literal("some secret")))
+
+	// The message is synced and cached after the entries are listed.
+	report, err := Verify(cache, "userID1", func() ([]string, error) {
+		if err := cache.Set("userID1", "messageID2", literal("some secret")); err != nil {
+			return nil, err
+		}
+
+		return []string{"messageID1", "messageID2"}, nil
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, report.Checked)
+	assert.Equal(t, 0, report.Orphans)
+	assert.True(t, cache.Has("userID1", "messageID2"))
+}
+
+func messageIDs(messageIDs ...string) func() ([]string, error) {
+	return func() ([]string, error) {
+		return messageIDs, nil
+	}
+}
+
+func TestVerifyS3Cache(t *testing.T) {
+	s3, cache := newTestS3Cache(t, 1<<20)
+	require.NoError(t, cache.Unlock("userID1", []byte("my secret passphrase")))
+
+	require.NoError(t, cache.Set("userID1", "messageID1", literal("some secret")))
+	require.NoError(t, cache.Set("userID1", "messageID2", literal("some secret")))
+	require.NoError(t, cache.Set("userID1", "messageID3", literal("some secret")))
+
+	// The removed entries are dropped from the index listed beforehand.
+	assert.True(t, cache.Has("userID1", "messageID3"))
+
+	// The stored copy is damaged while the front tier still holds it.
+	s3.lock.Lock()
+	s3.objects["peroxide/"+cache.(*s3Cache).getMessageKey("userID1", "messageID2")] = []byte("damaged")
+	s3.lock.Unlock()
+
+	report, err := Verify(cache, "userID1", messageIDs("messageID1", "messageID2"))
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, report.Checked)
+	assert.Equal(t, []string{"messageID2"}, report.Corrupted)
+	assert.Equal(t, 1, report.Orphans)
+
+	getCachedMessage(t, cache, "userID1", "messageID1", "some secret")
+	assert.False(t, cache.Has("userID1", "messageID2"))
+	assert.False(t, cache.Has("userID1", "messageID3"))
+}
@@ -18,11 +18,18 @@
 package store
 
 import (
+	"bytes"
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/message"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store/cache"
+	storemocks "github.com/ljanyst/peroxide/pkg/store/mocks"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestIsCachedCrashRecovers(t *testing.T) {
@@ -43,6 +50,18 @@ func TestIsCachedCrashRecovers(t *testing.T) {
 
 var wantLiteral = []byte("Mime-Version: 1.0\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Type: \r\nReferences:  <msg1@protonmail.internalid>\r\nX-Pm-Date: Thu, 01 Jan 1970 00:00:00 +0000\r\nX-Pm-External-Id: <>\r\nX-Pm-Internal-Id: msg1\r\nX-Original-Date: Mon, 01 Jan 0001 00:00:00 +0000\r\nDate: Fri, 13 Aug 1982 00:00:00 +0000\r\nMessage-Id: <msg1@protonmail.internalid>\r\nSubject: subject\r\n\r\n")
 
+// getCachedLiteral reads and closes the literal of the given message.
+func getCachedLiteral(t *testing.T, m *mocksForStore, messageID string) []byte {
+	literal, err := m.store.getCachedMessage(messageID)
+	require.NoError(t, err)
+	defer literal.Close() //nolint:errcheck
+
+	b, err := ioutil.ReadAll(literal.NewReader())
+	require.NoError(t, err)
+
+	return b
+}
+
 func TestGetCachedMessageOK(t *testing.T) {
 	r := require.New(t)
 	m, clear := initMocks(t)
@@ -63,19 +82,126 @@ func TestGetCachedMessageOK(t *testing.T) {
 		Return(testPrivateKeyRing, nil).
 		Times(1)
 
-	haveLiteral, err := m.store.getCachedMessage(messageID)
-	r.NoError(err)
-	r.Equal(wantLiteral, haveLiteral)
+	r.Equal(wantLiteral, getCachedLiteral(t, m, messageID))
 
 	r.True(m.store.IsCached(messageID))
 
 	// No build job
-	haveLiteral, err = m.store.getCachedMessage(messageID)
-	r.NoError(err)
-	r.Equal(wantLiteral, haveLiteral)
+	r.Equal(wantLiteral, getCachedLiteral(t, m, messageID))
 	r.True(m.store.IsCached(messageID))
 }
 
+func TestGetCachedMessageSavesLiteralInfo(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	messageID := "msg1"
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      messageID,
+		Subject: "subject",
+		Flags:   pmapi.FlagReceived,
+		Body:    "body",
+	})
+
+	m.client.EXPECT().
+		KeyRingForAddressID(gomock.Any()).
+		Return(testPrivateKeyRing, nil).
+		Times(1)
+
+	getCachedLiteral(t, m, messageID)
+
+	var raw, size []byte
+
+	r.NoError(m.store.db.View(func(tx *bolt.Tx) error {
+		raw = tx.Bucket(bodystructureBucket).Get([]byte(messageID))
+		size = tx.Bucket(sizeBucket).Get([]byte(messageID))
+		return nil
+	}))
+
+	r.NotEmpty(raw)
+	r.Equal(uint32(len(wantLiteral)), btoi(size))
+}
+
+func TestGetCachedMessageParsesLiteralInfo(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	messageID := "msg1"
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      messageID,
+		Subject: "subject",
+		Flags:   pmapi.FlagReceived,
+		Body:    "body",
+	})
+
+	m.client.EXPECT().
+		KeyRingForAddressID(gomock.Any()).
+		Return(testPrivateKeyRing, nil).
+		Times(1)
+
+	getCachedLiteral(t, m, messageID)
+
+	// A message cached without its body structure and size is parsed once.
+	r.NoError(m.store.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bodystructureBucket).Delete([]byte(messageID)); err != nil {
+			return err
+		}
+		return tx.Bucket(sizeBucket).Delete([]byte(messageID))
+	}))
+
+	r.Equal(wantLiteral, getCachedLiteral(t, m, messageID))
+
+	bs, size, ok := m.store.getLiteralInfo(messageID)
+	r.True(ok)
+	r.Equal(int64(len(wantLiteral)), size)
+
+	want, err := message.NewBodyStructure(bytes.NewReader(wantLiteral))
+	r.NoError(err)
+
+	wantRaw, err := want.Serialize()
+	r.NoError(err)
+
+	haveRaw, err := bs.Serialize()
+	r.NoError(err)
+	r.Equal(wantRaw, haveRaw)
+}
+
+func TestGetMessageSectionsSkipsAttachments(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      "msg1",
+		Subject: "subject",
+		Flags:   pmapi.FlagReceived,
+		Body:    "body",
+		Attachments: []*pmapi.Attachment{
+			{ID: "att1", Name: "file.png", MIMEType: "image/png", Disposition: pmapi.DispositionAttachment},
+		},
+	})
+
+	m.client.EXPECT().
+		KeyRingForAddressID(gomock.Any()).
+		Return(testPrivateKeyRing, nil).
+		Times(1)
+
+	// The attachment is not downloaded and the partial literal is not cached.
+	literal, complete, err := m.store.getMessageSections("msg1", [][]int{})
+	r.NoError(err)
+	r.False(complete)
+	defer literal.Close() //nolint:errcheck
+
+	b, err := ioutil.ReadAll(literal.NewReader())
+	r.NoError(err)
+	r.Contains(string(b), "Subject: subject")
+	r.False(m.store.IsCached("msg1"))
+}
+
 func TestGetCachedMessageCacheLocked(t *testing.T) {
 	r := require.New(t)
 	m, clear := initMocks(t)
@@ -95,9 +221,7 @@ func TestGetCachedMessageCacheLocked(t *testing.T) {
 		KeyRingForAddressID(gomock.Any()).
 		Return(testPrivateKeyRing, nil).
 		Times(1)
-	haveLiteral, err := m.store.getCachedMessage(messageID)
-	r.NoError(err)
-	r.Equal(wantLiteral, haveLiteral)
+	r.Equal(wantLiteral, getCachedLiteral(t, m, messageID))
 	r.True(m.store.IsCached(messageID))
 
 	// Lock cache
@@ -109,14 +233,124 @@ func TestGetCachedMessageCacheLocked(t *testing.T) {
 		Return(testPrivateKeyRing, nil).
 		Times(1)
 
-	haveLiteral, err = m.store.getCachedMessage(messageID)
-	r.NoError(err)
-	r.Equal(wantLiteral, haveLiteral)
+	r.Equal(wantLiteral, getCachedLiteral(t, m, messageID))
 	r.True(m.store.IsCached(messageID))
 
 	// No build job
-	haveLiteral, err = m.store.getCachedMessage(messageID)
-	r.NoError(err)
-	r.Equal(wantLiteral, haveLiteral)
+	r.Equal(wantLiteral, getCachedLiteral(t, m, messageID))
 	r.True(m.store.IsCached(messageID))
 }
+
+func TestCacheRecentMessagesWithinQuota(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true,
+		&pmapi.Message{ID: "old", Subject: "old", Time: 1, Size: 400},
+		&pmapi.Message{ID: "newest", Subject: "newest", Time: 3, Size: 400},
+		&pmapi.Message{ID: "newer", Subject: "newer", Time: 2, Size: 400},
+	)
+
+	msgs, err := m.store.getMessagesByRecency()
+	r.NoError(err)
+	r.Len(msgs, 3)
+	r.Equal([]string{"newest", "newer", "old"}, []string{msgs[0].ID, msgs[1].ID, msgs[2].ID})
+	r.Equal(int64(400), msgs[0].Size)
+
+	diskCache, err := cache.NewOnDiskCache(t.TempDir(), &cache.NoopCompressor{}, cache.Options{UserQuota: 1000, ConcurrentRead: 1, ConcurrentWrite: 1})
+	r.NoError(err)
+	r.NoError(diskCache.Unlock("userID", []byte("passphrase")))
+	m.store.cache = diskCache
+
+	// Only the newest messages which fit in the quota are cached.
+	storer := storemocks.NewMockStorer(m.ctrl)
+	storer.EXPECT().IsCached(gomock.Any()).Return(false).AnyTimes()
+	storer.EXPECT().BuildAndCacheMessage(gomock.Any(), "newest").Return(nil)
+	storer.EXPECT().BuildAndCacheMessage(gomock.Any(), "newer").Return(nil)
+
+	m.store.msgCachePool = newMsgCachePool(storer)
+	m.store.msgCachePool.start()
+
+	m.store.cacheRecentMessages(msgs, 0)
+	m.store.msgCachePool.stop()
+}
+
+func TestCacheRecentMessagesDoesNotEvict(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true,
+		&pmapi.Message{ID: "oldest", Subject: "oldest", Time: 1, Size: 400},
+		&pmapi.Message{ID: "old", Subject: "old", Time: 2, Size: 400},
+		&pmapi.Message{ID: "newer", Subject: "newer", Time: 3, Size: 400},
+	)
+
+	msgs, err := m.store.getMessagesByRecency()
+	r.NoError(err)
+
+	diskCache, err := cache.NewOnDiskCache(t.TempDir(), &cache.NoopCompressor{}, cache.Options{UserQuota: 1100, ConcurrentRead: 1, ConcurrentWrite: 1})
+	r.NoError(err)
+	r.NoError(diskCache.Unlock("userID", []byte("passphrase")))
+	m.store.cache = diskCache
+
+	// The old messages fill the quota.
+	r.NoError(diskCache.Set("userID", "oldest", bytes.NewReader(make([]byte, 450))))
+	r.NoError(diskCache.Set("userID", "old", bytes.NewReader(make([]byte, 450))))
+
+	// The newer message is left to be cached when it is read.
+	storer := storemocks.NewMockStorer(m.ctrl)
+	storer.EXPECT().IsCached(gomock.Any()).Return(false).AnyTimes()
+
+	m.store.msgCachePool = newMsgCachePool(storer)
+	m.store.msgCachePool.start()
+
+	m.store.cacheRecentMessages(msgs, 0)
+	m.store.msgCachePool.stop()
+
+	r.True(m.store.IsCached("oldest"))
+	r.True(m.store.IsCached("old"))
+}
+
+func TestVerifyCacheRequeuesCorruptedMessages(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true,
+		&pmapi.Message{ID: "msg1", Subject: "msg1"},
+		&pmapi.Message{ID: "msg2", Subject: "msg2"},
+	)
+
+	diskCache, err := cache.NewOnDiskCache(t.TempDir(), &cache.NoopCompressor{}, cache.Options{ConcurrentRead: 1, ConcurrentWrite: 1})
+	r.NoError(err)
+	r.NoError(diskCache.Unlock("userID", []byte("passphrase")))
+	r.NoError(diskCache.Set("userID", "msg1", strings.NewReader("literal")))
+	r.NoError(diskCache.Set("userID", "deleted", strings.NewReader("literal")))
+
+	// The second message was cached with another passphrase.
+	r.NoError(diskCache.Unlock("userID", []byte("other passphrase")))
+	r.NoError(diskCache.Set("userID", "msg2", strings.NewReader("literal")))
+	r.NoError(diskCache.Unlock("userID", []byte("passphrase")))
+
+	m.store.cache = diskCache
+
+	storer := storemocks.NewMockStorer(m.ctrl)
+	storer.EXPECT().IsCached("msg2").Return(false)
+	storer.EXPECT().BuildAndCacheMessage(gomock.Any(), "msg2").Return(nil)
+
+	m.store.msgCachePool = newMsgCachePool(storer)
+	m.store.msgCachePool.start()
+
+	report, err := m.store.VerifyCache()
+	r.NoError(err)
+	r.Equal(2, report.Checked)
+	r.Equal([]string{"msg2"}, report.Corrupted)
+	r.Equal(1, report.Orphans)
+
+	m.store.msgCachePool.stop()
+
+	r.True(diskCache.Has("userID", "msg1"))
+	r.False(diskCache.Has("userID", "deleted"))
+}
@@ -19,13 +19,17 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"sort"
 	"time"
 
+	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/store/cache"
+	bolt "go.etcd.io/bbolt"
 )
 
 func (store *Store) StartWatcher() {
-	if !cache.IsOnDiskCache(store.cache) {
+	if !cache.IsPersistentCache(store.cache) {
 		return
 	}
 
@@ -41,16 +45,12 @@ func (store *Store) StartWatcher() {
 
 		for {
 			// NOTE(GODT-1158): Race condition here? What if DB was already closed?
-			messageIDs, err := store.getAllMessageIDs()
+			messages, err := store.getMessagesByRecency()
 			if err != nil {
 				return
 			}
 
-			for _, messageID := range messageIDs {
-				if !store.IsCached(messageID) {
-					store.msgCachePool.newJob(messageID)
-				}
-			}
+			store.cacheRecentMessages(messages, 0)
 
 			select {
 			case <-store.done:
@@ -62,6 +62,100 @@ func (store *Store) StartWatcher() {
 	}()
 }
 
+// selectedMailboxBoost is added to the cache priority of the messages of
+// a mailbox a client has selected, so that they are cached before all others.
+const selectedMailboxBoost = 1 << 40
+
+// cachePriority returns the priority with which the message is cached in the
+// background: the newer the message, the sooner.
+func cachePriority(msg *pmapi.Message) int {
+	return int(msg.Time)
+}
+
+// cacheRecentMessages queues the messages which are not cached yet, newest
+// first. If the cache is limited, it stops at the first message which the
+// room left in the cache is not likely to take, going by the size of the
+// message in the API, so that prefetching old mail does not evict the mail
+// read recently. Only the cache evicts messages, when a message it is given
+// does not fit.
+func (store *Store) cacheRecentMessages(messages []*pmapi.Message, boost int) {
+	room, limited := cache.Room(store.cache, store.user.ID())
+
+	for _, msg := range messages {
+		if store.IsCached(msg.ID) {
+			continue
+		}
+
+		if limited {
+			if msg.Size > room {
+				store.log.WithField("room", room).Debug("Message cache is full, not caching older messages")
+				return
+			}
+
+			room -= msg.Size
+		}
+
+		store.msgCachePool.newJob(msg.ID, cachePriority(msg)+boost)
+	}
+}
+
+// PrefetchMessages queues the messages of the mailbox which are not cached yet
+// to be cached before the messages of other mailboxes, newest first. It is
+// called when a client selects the mailbox as it is likely to read them next.
+func (storeMailbox *Mailbox) PrefetchMessages() {
+	if !cache.IsPersistentCache(storeMailbox.store.cache) {
+		return
+	}
+
+	go func() {
+		messages, err := storeMailbox.getMessagesByRecency()
+		if err != nil {
+			storeMailbox.log.WithError(err).Warn("Cannot prefetch messages")
+			return
+		}
+
+		storeMailbox.store.cacheRecentMessages(messages, selectedMailboxBoost)
+	}()
+}
+
+// getMessagesByRecency returns the metadata of the messages in the mailbox,
+// newest first.
+func (storeMailbox *Mailbox) getMessagesByRecency() (msgs []*pmapi.Message, err error) {
+	err = storeMailbox.db().View(func(tx *bolt.Tx) error {
+		return storeMailbox.txGetIMAPIDsBucket(tx).ForEach(func(_, apiID []byte) error {
+			msg, err := storeMailbox.store.txGetMessage(tx, string(apiID))
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+			return nil
+		})
+	})
+
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Time > msgs[j].Time })
+
+	return
+}
+
+// getMessagesByRecency returns the metadata of all messages in the local
+// database, newest first.
+func (store *Store) getMessagesByRecency() (msgs []*pmapi.Message, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metadataBucket).ForEach(func(k, v []byte) error {
+			msg := &pmapi.Message{}
+			if err := json.Unmarshal(v, msg); err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+			return nil
+		})
+	})
+
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].Time > msgs[j].Time })
+
+	return
+}
+
 func (store *Store) stopWatcher() {
 	if store.done == nil {
 		return
@@ -21,12 +21,15 @@ import (
 	"context"
 	"sync"
 
+	"github.com/ljanyst/peroxide/pkg/pchan"
 	"github.com/sirupsen/logrus"
 )
 
 type MsgCachePool struct {
 	storer  Storer
-	jobs    chan string
+	queue   *pchan.PChan
+	queued  map[string]*pchan.Item
+	lock    sync.Mutex
 	done    chan struct{}
 	started bool
 	wg      *sync.WaitGroup
@@ -41,15 +44,18 @@ type Storer interface {
 func newMsgCachePool(storer Storer) *MsgCachePool {
 	return &MsgCachePool{
 		storer: storer,
-		jobs:   make(chan string),
+		queue:  pchan.New(),
+		queued: make(map[string]*pchan.Item),
 		done:   make(chan struct{}),
 		wg:     &sync.WaitGroup{},
 		ctx:    context.Background(),
 	}
 }
 
-// newJob sends a new job to the cacher if it's running.
-func (cacher *MsgCachePool) newJob(messageID string) {
+// newJob queues the message to be cached if the cacher is running. The
+// messages of higher priority are cached first. A message which is already
+// queued is only given the higher of the two priorities.
+func (cacher *MsgCachePool) newJob(messageID string, prio int) {
 	if !cacher.started {
 		return
 	}
@@ -59,13 +65,26 @@ func (cacher *MsgCachePool) newJob(messageID string) {
 		return
 
 	default:
+		cacher.lock.Lock()
+		defer cacher.lock.Unlock()
+
+		if item, ok := cacher.queued[messageID]; ok {
+			if item.GetPriority() < prio {
+				item.SetPriority(prio)
+			}
+
+			return
+		}
+
 		if !cacher.storer.IsCached(messageID) {
 			cacher.wg.Add(1)
-			go func() { cacher.jobs <- messageID }()
+			cacher.queued[messageID] = cacher.queue.Push(messageID, prio)
 		}
 	}
 }
 
+// start starts as many workers as there may be background build jobs, so that
+// the queued messages wait in the order of their priority.
 func (cacher *MsgCachePool) start() {
 	if cacher.started {
 		return
@@ -73,17 +92,24 @@ func (cacher *MsgCachePool) start() {
 
 	cacher.started = true
 
-	go func() {
-		for {
-			select {
-			case messageID := <-cacher.jobs:
-				go cacher.handleJob(messageID)
+	for i := 0; i < cap(buildAndCacheJobs); i++ {
+		go func() {
+			for {
+				val, _, ok := cacher.queue.Pop()
+				if !ok {
+					return
+				}
 
-			case <-cacher.done:
-				return
+				messageID := val.(string) //nolint:forcetypeassert
+
+				cacher.lock.Lock()
+				delete(cacher.queued, messageID)
+				cacher.lock.Unlock()
+
+				cacher.handleJob(messageID)
 			}
-		}
-	}()
+		}()
+	}
 }
 
 func (cacher *MsgCachePool) handleJob(messageID string) {
@@ -107,5 +133,6 @@ func (cacher *MsgCachePool) stop() {
 
 	default:
 		close(cacher.done)
+		cacher.queue.Close()
 	}
 }
@@ -18,6 +18,7 @@
 package store
 
 import (
+	"context"
 	"testing"
 
 	storemocks "github.com/ljanyst/peroxide/pkg/store/mocks"
@@ -47,7 +48,7 @@ func TestCacher(t *testing.T) {
 	withTestCacher(t, func(storer *storemocks.MockStorer, cacher *MsgCachePool) {
 		storer.EXPECT().IsCached("messageID").Return(false)
 		storer.EXPECT().BuildAndCacheMessage(cacher.ctx, "messageID").Return(nil)
-		cacher.newJob("messageID")
+		cacher.newJob("messageID", 0)
 	})
 }
 
@@ -55,7 +56,7 @@ func TestCacherAlreadyCached(t *testing.T) {
 	// If the message is already cached, we should not try to build it.
 	withTestCacher(t, func(storer *storemocks.MockStorer, cacher *MsgCachePool) {
 		storer.EXPECT().IsCached("messageID").Return(true)
-		cacher.newJob("messageID")
+		cacher.newJob("messageID", 0)
 	})
 }
 
@@ -64,7 +65,42 @@ func TestCacherFail(t *testing.T) {
 	withTestCacher(t, func(storer *storemocks.MockStorer, cacher *MsgCachePool) {
 		storer.EXPECT().IsCached("messageID").Return(false)
 		storer.EXPECT().BuildAndCacheMessage(cacher.ctx, "messageID").Return(errors.New("failed to build message"))
-		cacher.newJob("messageID")
+		cacher.newJob("messageID", 0)
+	})
+}
+
+func TestCacherPriority(t *testing.T) {
+	// With one worker, the jobs queued while it is busy run by priority.
+	SetBuildAndCacheJobLimit(1)
+	defer SetBuildAndCacheJobLimit(16)
+
+	withTestCacher(t, func(storer *storemocks.MockStorer, cacher *MsgCachePool) {
+		started, release := make(chan struct{}), make(chan struct{})
+
+		storer.EXPECT().IsCached(gomock.Any()).Return(false).AnyTimes()
+		gomock.InOrder(
+			storer.EXPECT().BuildAndCacheMessage(cacher.ctx, "busy").DoAndReturn(func(context.Context, string) error {
+				close(started)
+				<-release
+				return nil
+			}),
+			storer.EXPECT().BuildAndCacheMessage(cacher.ctx, "selected").Return(nil),
+			storer.EXPECT().BuildAndCacheMessage(cacher.ctx, "newer").Return(nil),
+			storer.EXPECT().BuildAndCacheMessage(cacher.ctx, "older").Return(nil),
+		)
+
+		cacher.newJob("busy", 0)
+		<-started
+
+		cacher.newJob("older", 1)
+		cacher.newJob("selected", 1)
+		cacher.newJob("newer", 2)
+
+		// Queuing a message again only raises its priority.
+		cacher.newJob("selected", 1+selectedMailboxBoost)
+		cacher.newJob("selected", 0)
+
+		close(release)
 	})
 }
 
@@ -84,16 +120,16 @@ func TestCacherStop(t *testing.T) {
 	// Send a job -- this should succeed.
 	storer.EXPECT().IsCached("messageID").Return(false)
 	storer.EXPECT().BuildAndCacheMessage(cacher.ctx, "messageID").Return(nil)
-	cacher.newJob("messageID")
+	cacher.newJob("messageID", 0)
 
 	// Stop the cacher.
 	cacher.stop()
 
 	// Send more jobs -- these should all be dropped.
-	cacher.newJob("messageID2")
-	cacher.newJob("messageID3")
-	cacher.newJob("messageID4")
-	cacher.newJob("messageID5")
+	cacher.newJob("messageID2", 0)
+	cacher.newJob("messageID3", 0)
+	cacher.newJob("messageID4", 0)
+	cacher.newJob("messageID5", 0)
 
 	// Stopping the cacher multiple times is safe.
 	cacher.stop()
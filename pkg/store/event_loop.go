@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -196,6 +197,12 @@ func (loop *eventLoop) loop() {
 			return
 		}
 
+		// The changes done offline are replayed once all the events which
+		// happened meanwhile were processed and the conflicts resolved.
+		if !more && loop.store.replayJournal() {
+			more = true
+		}
+
 		if more {
 			go loop.pollNow()
 		}
@@ -268,6 +275,8 @@ func (loop *eventLoop) processNextEvent() (more bool, err error) { // nolint[fun
 		return false, errors.Wrap(err, "failed to process event")
 	}
 
+	metrics.EventPolled(loop.user.ID())
+
 	if loop.currentEventID != event.EventID {
 		l.WithField("newID", event.EventID).Info("New event processed")
 		// In case new event ID cannot be saved to cache, we update it in event loop
@@ -415,6 +424,8 @@ func (loop *eventLoop) processMessages(eventLog *logrus.Entry, messages []*pmapi
 	for _, message := range messages {
 		msgLog := eventLog.WithField("msgID", message.ID)
 
+		pending := loop.store.resolveJournalConflict(message)
+
 		switch message.Action {
 		case pmapi.EventCreate:
 			msgLog.Debug("Processing EventCreate for message")
@@ -424,9 +435,15 @@ func (loop *eventLoop) processMessages(eventLog *logrus.Entry, messages []*pmapi
 				continue
 			}
 
+			if !loop.store.keepsMessage(message.Created) {
+				msgLog.Debug("Skipping message excluded by the sync policy")
+				continue
+			}
+
 			if err = loop.store.createOrUpdateMessageEvent(message.Created); err != nil {
 				return errors.Wrap(err, "failed to put message into DB")
 			}
+			loop.store.rebaseJournal(pending)
 
 		case pmapi.EventUpdate, pmapi.EventUpdateFlags:
 			msgLog.Debug("Processing EventUpdate(Flags) for message")
@@ -437,8 +454,10 @@ func (loop *eventLoop) processMessages(eventLog *logrus.Entry, messages []*pmapi
 			}
 
 			var msg *pmapi.Message
+			inDB := true
 
 			if msg, err = loop.store.getMessageFromDB(message.ID); err != nil {
+				inDB = false
 				if err != ErrNoSuchAPIID {
 					return errors.Wrap(err, "failed to get message from DB for updating")
 				}
@@ -458,10 +477,18 @@ func (loop *eventLoop) processMessages(eventLog *logrus.Entry, messages []*pmapi
 
 			updateMessage(msgLog, msg, message.Updated)
 
+			// Messages already in the DB are kept even if they no longer
+			// match the sync policy until the next full sync.
+			if !inDB && !loop.store.keepsMessage(msg) {
+				msgLog.Debug("Skipping update of message excluded by the sync policy")
+				continue
+			}
+
 			loop.removeLabelFromMessageWait(message.Updated.LabelIDsRemoved)
 			if err = loop.store.createOrUpdateMessageEvent(msg); err != nil {
 				return errors.Wrap(err, "failed to update message in DB")
 			}
+			loop.store.rebaseJournal(pending)
 
 		case pmapi.EventDelete:
 			msgLog.Debug("Processing EventDelete for message")
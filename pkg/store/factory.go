@@ -28,11 +28,13 @@ import (
 )
 
 type StoreFactory struct {
-	settings *settings.Settings
-	listener listener.Listener
-	events   *Events
-	cache    cache.Cache
-	builder  *message.Builder
+	settings     *settings.Settings
+	listener     listener.Listener
+	events       *Events
+	cache        cache.Cache
+	builder      *message.Builder
+	connectivity *Connectivity
+	outboxReady  chan struct{}
 }
 
 func NewStoreFactory(
@@ -48,12 +50,15 @@ func NewStoreFactory(
 		events:   NewEvents(eventsCachePath),
 		cache:    cache,
 		builder:  builder,
+
+		connectivity: &Connectivity{},
+		outboxReady:  make(chan struct{}, 1),
 	}
 }
 
 // New creates new store for given user.
 func (f *StoreFactory) New(user BridgeUser, connected bool) (*Store, error) {
-	return New(
+	store, err := New(
 		user,
 		f.listener,
 		f.cache,
@@ -62,6 +67,18 @@ func (f *StoreFactory) New(user BridgeUser, connected bool) (*Store, error) {
 		f.events,
 		connected,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	store.SetConnectivity(f.connectivity)
+	store.outboxReady = f.outboxReady
+	return store, nil
+}
+
+// Connectivity returns the connectivity followed by all the stores made by the factory.
+func (f *StoreFactory) Connectivity() *Connectivity {
+	return f.connectivity
 }
 
 // Remove removes all store files for given user.
@@ -77,3 +94,9 @@ func (f *StoreFactory) Remove(userID string) error {
 func getUserStorePath(storeDir string, userID string) (path string) {
 	return filepath.Join(storeDir, fmt.Sprintf("mailbox-%v.db", userID))
 }
+
+// OutboxReady returns the channel signalled when any of the stores made by the
+// factory has messages to be sent.
+func (f *StoreFactory) OutboxReady() <-chan struct{} {
+	return f.outboxReady
+}
@@ -102,6 +102,7 @@ func getSystemFolders() []*mailboxCounts {
 		{pmapi.TrashLabel, "Trash", "#000", -6, true, 0, 0},
 		{pmapi.AllMailLabel, "All Mail", "#000", -5, true, 0, 0},
 		{pmapi.DraftLabel, "Drafts", "#000", -4, true, 0, 0},
+		{pmapi.ScheduledLabel, "Scheduled", "#000", -3, true, 0, 0},
 	}
 }
 
@@ -60,15 +60,16 @@ func TestSortByOrder(t *testing.T) {
 
 func TestMailboxNames(t *testing.T) {
 	want := map[string]string{
-		pmapi.InboxLabel:   "INBOX",
-		pmapi.SentLabel:    "Sent",
-		pmapi.ArchiveLabel: "Archive",
-		pmapi.SpamLabel:    "Spam",
-		pmapi.TrashLabel:   "Trash",
-		pmapi.AllMailLabel: "All Mail",
-		pmapi.DraftLabel:   "Drafts",
-		"labelID1":         "Labels/Label1",
-		"folderID1":        "Folders/Folder1",
+		pmapi.InboxLabel:     "INBOX",
+		pmapi.SentLabel:      "Sent",
+		pmapi.ArchiveLabel:   "Archive",
+		pmapi.SpamLabel:      "Spam",
+		pmapi.TrashLabel:     "Trash",
+		pmapi.AllMailLabel:   "All Mail",
+		pmapi.DraftLabel:     "Drafts",
+		pmapi.ScheduledLabel: "Scheduled",
+		"labelID1":           "Labels/Label1",
+		"folderID1":          "Folders/Folder1",
 	}
 
 	foldersAndLabels := []*pmapi.Label{
@@ -91,7 +92,7 @@ func TestMailboxNames(t *testing.T) {
 func TestAddSystemLabels(t *testing.T) {}
 
 func checkCounts(t testing.TB, wantCounts []*pmapi.MessagesCount, haveStore *Store) {
-	nSystemFolders := 7
+	nSystemFolders := 8
 	haveCounts, err := haveStore.getOnAPICounts()
 	a.NoError(t, err)
 	a.Len(t, haveCounts, len(wantCounts)+nSystemFolders)
@@ -28,6 +28,10 @@ import (
 // operation on All Mail folder.
 var ErrAllMailOpNotAllowed = errors.New("operation not allowed for 'All Mail' folder")
 
+// ErrScheduledOpNotAllowed is error used when user tries to put messages in
+// the Scheduled folder. Messages are only scheduled when they are sent.
+var ErrScheduledOpNotAllowed = errors.New("operation not allowed for 'Scheduled' folder")
+
 // GetMessage returns the `pmapi.Message` struct wrapped in `StoreMessage`
 // tied to this mailbox.
 func (storeMailbox *Mailbox) GetMessage(apiID string) (*Message, error) {
@@ -41,6 +45,10 @@ func (storeMailbox *Mailbox) GetMessage(apiID string) (*Message, error) {
 // FetchMessage fetches the message with the given `apiID`, stores it in the database, and returns a new store message
 // wrapping it.
 func (storeMailbox *Mailbox) FetchMessage(apiID string) (*Message, error) {
+	if storeMailbox.store.IsOffline() {
+		return nil, ErrOffline
+	}
+
 	msg, err := storeMailbox.client().GetMessage(exposeContextForIMAP(), apiID)
 	if err != nil {
 		return nil, err
@@ -49,6 +57,14 @@ func (storeMailbox *Mailbox) FetchMessage(apiID string) (*Message, error) {
 }
 
 func (storeMailbox *Mailbox) ImportMessage(enc []byte, seen bool, labelIDs []string, flags, time int64) (string, error) {
+	if storeMailbox.store.IsOffline() {
+		return "", ErrOffline
+	}
+
+	if storeMailbox.labelID == pmapi.ScheduledLabel {
+		return "", ErrScheduledOpNotAllowed
+	}
+
 	defer storeMailbox.pollNow()
 
 	if storeMailbox.labelID != pmapi.AllMailLabel {
@@ -95,8 +111,11 @@ func (storeMailbox *Mailbox) LabelMessages(apiIDs []string) error {
 	if storeMailbox.labelID == pmapi.AllMailLabel {
 		return ErrAllMailOpNotAllowed
 	}
+	if storeMailbox.labelID == pmapi.ScheduledLabel {
+		return ErrScheduledOpNotAllowed
+	}
 	defer storeMailbox.pollNow()
-	return storeMailbox.client().LabelMessages(exposeContextForIMAP(), apiIDs, storeMailbox.labelID)
+	return storeMailbox.store.runMessageOp(journalEntry{Op: opLabel, MessageIDs: apiIDs, LabelID: storeMailbox.labelID})
 }
 
 // UnlabelMessages removes the label by calling an API.
@@ -109,7 +128,11 @@ func (storeMailbox *Mailbox) UnlabelMessages(apiIDs []string) error {
 		return ErrAllMailOpNotAllowed
 	}
 	defer storeMailbox.pollNow()
-	return storeMailbox.client().UnlabelMessages(exposeContextForIMAP(), apiIDs, storeMailbox.labelID)
+	// Moving a message out of Scheduled, e.g. to Trash, cancels it.
+	if storeMailbox.labelID == pmapi.ScheduledLabel {
+		return storeMailbox.cancelScheduled(apiIDs)
+	}
+	return storeMailbox.store.runMessageOp(journalEntry{Op: opUnlabel, MessageIDs: apiIDs, LabelID: storeMailbox.labelID})
 }
 
 // MarkMessagesRead marks the message read by calling an API.
@@ -136,7 +159,7 @@ func (storeMailbox *Mailbox) MarkMessagesRead(apiIDs []string) error {
 	if len(ids) == 0 {
 		return nil
 	}
-	return storeMailbox.client().MarkMessagesRead(exposeContextForIMAP(), ids)
+	return storeMailbox.store.runMessageOp(journalEntry{Op: opRead, MessageIDs: ids})
 }
 
 // MarkMessagesUnread marks the message unread by calling an API.
@@ -148,7 +171,7 @@ func (storeMailbox *Mailbox) MarkMessagesUnread(apiIDs []string) error {
 		"mailbox":  storeMailbox.Name,
 	}).Trace("Marking messages as unread")
 	defer storeMailbox.pollNow()
-	return storeMailbox.client().MarkMessagesUnread(exposeContextForIMAP(), apiIDs)
+	return storeMailbox.store.runMessageOp(journalEntry{Op: opUnread, MessageIDs: apiIDs})
 }
 
 // MarkMessagesStarred adds the Starred label by calling an API.
@@ -161,7 +184,7 @@ func (storeMailbox *Mailbox) MarkMessagesStarred(apiIDs []string) error {
 		"mailbox":  storeMailbox.Name,
 	}).Trace("Marking messages as starred")
 	defer storeMailbox.pollNow()
-	return storeMailbox.client().LabelMessages(exposeContextForIMAP(), apiIDs, pmapi.StarredLabel)
+	return storeMailbox.store.runMessageOp(journalEntry{Op: opLabel, MessageIDs: apiIDs, LabelID: pmapi.StarredLabel})
 }
 
 // MarkMessagesUnstarred removes the Starred label by calling an API.
@@ -174,7 +197,7 @@ func (storeMailbox *Mailbox) MarkMessagesUnstarred(apiIDs []string) error {
 		"mailbox":  storeMailbox.Name,
 	}).Trace("Marking messages as unstarred")
 	defer storeMailbox.pollNow()
-	return storeMailbox.client().UnlabelMessages(exposeContextForIMAP(), apiIDs, pmapi.StarredLabel)
+	return storeMailbox.store.runMessageOp(journalEntry{Op: opUnlabel, MessageIDs: apiIDs, LabelID: pmapi.StarredLabel})
 }
 
 // MarkMessagesDeleted adds local flag \Deleted. This is not propagated to API
@@ -258,17 +281,41 @@ func (storeMailbox *Mailbox) RemoveDeleted(apiIDs []string) error {
 		}
 	case pmapi.DraftLabel:
 		storeMailbox.log.WithField("ids", apiIDs).Warn("Deleting drafts")
-		if err := storeMailbox.client().DeleteMessages(exposeContextForIMAP(), apiIDs); err != nil {
+		if err := storeMailbox.store.runMessageOp(journalEntry{Op: opDelete, MessageIDs: apiIDs}); err != nil {
+			return err
+		}
+	case pmapi.ScheduledLabel:
+		storeMailbox.log.WithField("ids", apiIDs).Info("Cancelling scheduled messages")
+		if err := storeMailbox.cancelScheduled(apiIDs); err != nil {
+			return err
+		}
+		if err := storeMailbox.store.runMessageOp(journalEntry{Op: opDelete, MessageIDs: apiIDs}); err != nil {
 			return err
 		}
 	default:
-		if err := storeMailbox.client().UnlabelMessages(exposeContextForIMAP(), apiIDs, storeMailbox.labelID); err != nil {
+		if err := storeMailbox.store.runMessageOp(journalEntry{Op: opUnlabel, MessageIDs: apiIDs, LabelID: storeMailbox.labelID}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// cancelScheduled cancels the scheduled delivery of the messages, which
+// turns them back into drafts.
+func (storeMailbox *Mailbox) cancelScheduled(apiIDs []string) error {
+	if storeMailbox.store.IsOffline() {
+		return ErrOffline
+	}
+
+	for _, apiID := range apiIDs {
+		if err := storeMailbox.client().CancelSend(exposeContextForIMAP(), apiID); err != nil {
+			return errors.Wrap(err, "cannot cancel scheduled message")
+		}
+	}
+
+	return nil
+}
+
 // deleteFromTrashOrSpam will remove messages from API forever. If messages
 // still has some custom label the message will not be deleted. Instead it will
 // be removed from Trash or Spam.
@@ -300,13 +347,13 @@ func (storeMailbox *Mailbox) deleteFromTrashOrSpam(apiIDs []string) error {
 		}
 	}
 	if len(messageIDsToUnlabel) > 0 {
-		if err := storeMailbox.client().UnlabelMessages(exposeContextForIMAP(), messageIDsToUnlabel, storeMailbox.labelID); err != nil {
+		if err := storeMailbox.store.runMessageOp(journalEntry{Op: opUnlabel, MessageIDs: messageIDsToUnlabel, LabelID: storeMailbox.labelID}); err != nil {
 			l.WithError(err).Warning("Cannot unlabel before deleting")
 		}
 	}
 	if len(messageIDsToDelete) > 0 {
 		storeMailbox.log.WithField("ids", messageIDsToDelete).Warn("Deleting messages")
-		if err := storeMailbox.client().DeleteMessages(exposeContextForIMAP(), messageIDsToDelete); err != nil {
+		if err := storeMailbox.store.runMessageOp(journalEntry{Op: opDelete, MessageIDs: messageIDsToDelete}); err != nil {
 			return err
 		}
 	}
@@ -174,8 +174,9 @@ func (message *Message) GetBodyStructure() (*pkgMsg.BodyStructure, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer literal.Close() //nolint:errcheck
 
-	bs, err := pkgMsg.NewBodyStructure(bytes.NewReader(literal))
+	bs, err := literal.Structure()
 	if err != nil {
 		return nil, err
 	}
@@ -198,11 +199,20 @@ func (message *Message) GetBodyStructure() (*pkgMsg.BodyStructure, error) {
 	return bs, nil
 }
 
-// GetRFC822 returns the raw message literal.
-func (message *Message) GetRFC822() ([]byte, error) {
+// GetRFC822 returns the raw message literal. It must be closed after use.
+func (message *Message) GetRFC822() (*pkgMsg.Literal, error) {
 	return message.store.getCachedMessage(message.ID())
 }
 
+// GetRFC822Sections returns the raw message literal if it is cached.
+// Otherwise it builds a literal in which only the attachments within the given
+// sections are downloaded; such a literal is only good for reading these
+// sections and the MIME headers. The second return value tells whether the
+// literal is the whole message. The literal must be closed after use.
+func (message *Message) GetRFC822Sections(sections [][]int) (*pkgMsg.Literal, bool, error) {
+	return message.store.getMessageSections(message.ID(), sections)
+}
+
 // GetRFC822Size returns the size of the raw message literal.
 func (message *Message) GetRFC822Size() (uint32, error) {
 	var raw []byte
@@ -222,15 +232,18 @@ func (message *Message) GetRFC822Size() (uint32, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer literal.Close() //nolint:errcheck
+
+	size := uint32(literal.Size())
 
 	// Do not cache draft size
 	if !message.msg.IsDraft() {
 		if err := message.store.db.Update(func(tx *bolt.Tx) error {
-			return tx.Bucket(sizeBucket).Put([]byte(message.ID()), itob(uint32(len(literal))))
+			return tx.Bucket(sizeBucket).Put([]byte(message.ID()), itob(size))
 		}); err != nil {
 			return 0, err
 		}
 	}
 
-	return uint32(len(literal)), nil
+	return size, nil
 }
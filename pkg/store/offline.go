@@ -0,0 +1,420 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrOffline is returned by the operations which need the API while it is unreachable.
+var ErrOffline = errors.New("the server is unreachable, try again later") //nolint[gochecknoglobals]
+
+// Connectivity tells the stores whether the API is reachable. One instance is
+// shared by all the stores made by a factory.
+type Connectivity struct {
+	lock    sync.RWMutex
+	offline bool
+}
+
+// SetOffline switches the stores to and from the offline mode.
+func (c *Connectivity) SetOffline(offline bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.offline != offline {
+		log.WithField("offline", offline).Warn("Connectivity changed")
+	}
+	c.offline = offline
+}
+
+// IsOffline returns whether the API is unreachable. A nil connectivity is always online.
+func (c *Connectivity) IsOffline() bool {
+	if c == nil {
+		return false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.offline
+}
+
+// Message operations which can be journalled.
+const (
+	opLabel   = "label"
+	opUnlabel = "unlabel"
+	opRead    = "read"
+	opUnread  = "unread"
+	opDelete  = "delete"
+)
+
+// journalEntry is a message operation done while offline. Was keeps the
+// field changed by the operation as it was locally before, the unread flag or
+// whether the message had the label, to tell server changes of the same field.
+type journalEntry struct {
+	Op         string
+	MessageIDs []string
+	LabelID    string          `json:",omitempty"`
+	Was        map[string]bool `json:",omitempty"`
+}
+
+// IsOffline returns whether the store is in the offline mode, i.e., serves
+// the local data only and journals the changes.
+func (store *Store) IsOffline() bool {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.connectivity.IsOffline()
+}
+
+// SetConnectivity makes the store follow the connectivity.
+func (store *Store) SetConnectivity(connectivity *Connectivity) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.connectivity = connectivity
+}
+
+// PendingChanges returns the number of the operations journalled while offline
+// and not replayed yet.
+func (store *Store) PendingChanges() int {
+	pending := 0
+	_ = store.db.View(func(tx *bolt.Tx) error {
+		pending = tx.Bucket(journalBucket).Stats().KeyN
+		return nil
+	})
+	return pending
+}
+
+// runMessageOp calls the API or, in the offline mode or when the connection
+// was just lost, journals the operation and applies it to the local data.
+func (store *Store) runMessageOp(entry journalEntry) error {
+	if !store.IsOffline() {
+		err := store.callMessageOp(entry)
+		if errors.Cause(err) != pmapi.ErrNoConnection {
+			return err
+		}
+	}
+
+	store.recordJournalBase(&entry)
+	if err := store.journal(entry); err != nil {
+		return err
+	}
+
+	return store.applyMessageOp(entry)
+}
+
+func (store *Store) callMessageOp(entry journalEntry) error {
+	ctx := exposeContextForIMAP()
+
+	switch entry.Op {
+	case opLabel:
+		return store.client().LabelMessages(ctx, entry.MessageIDs, entry.LabelID)
+	case opUnlabel:
+		return store.client().UnlabelMessages(ctx, entry.MessageIDs, entry.LabelID)
+	case opRead:
+		return store.client().MarkMessagesRead(ctx, entry.MessageIDs)
+	case opUnread:
+		return store.client().MarkMessagesUnread(ctx, entry.MessageIDs)
+	case opDelete:
+		return store.client().DeleteMessages(ctx, entry.MessageIDs)
+	}
+
+	return errors.Errorf("unknown message operation %q", entry.Op)
+}
+
+func (store *Store) journal(entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	store.log.WithField("op", entry.Op).WithField("messages", len(entry.MessageIDs)).Info("Journalling offline change")
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(journalBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put(journalKey(seq), data)
+	})
+}
+
+// recordJournalBase remembers the local value of the field changed by the
+// operation for each message.
+func (store *Store) recordJournalBase(entry *journalEntry) {
+	if entry.Op == opDelete {
+		return
+	}
+
+	entry.Was = map[string]bool{}
+	for _, messageID := range entry.MessageIDs {
+		msg, err := store.getMessageFromDB(messageID)
+		if err != nil {
+			continue
+		}
+
+		switch entry.Op {
+		case opRead, opUnread:
+			entry.Was[messageID] = bool(msg.Unread)
+		case opLabel, opUnlabel:
+			entry.Was[messageID] = containsString(msg.LabelIDs, entry.LabelID)
+		}
+	}
+}
+
+// applyMessageOp changes the local data the way the events of the operation
+// would. The next events after getting back online override it.
+func (store *Store) applyMessageOp(entry journalEntry) error {
+	if entry.Op == opDelete {
+		return store.deleteMessagesEvent(entry.MessageIDs)
+	}
+
+	msgs := make([]*pmapi.Message, 0, len(entry.MessageIDs))
+	for _, messageID := range entry.MessageIDs {
+		msg, err := store.getMessageFromDB(messageID)
+		if err != nil {
+			continue
+		}
+
+		switch entry.Op {
+		case opLabel:
+			msg.LabelIDs = appendUnique(msg.LabelIDs, entry.LabelID)
+		case opUnlabel:
+			msg.LabelIDs = removeString(msg.LabelIDs, entry.LabelID)
+		case opRead:
+			msg.Unread = false
+		case opUnread:
+			msg.Unread = true
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return store.createOrUpdateMessagesEvent(msgs)
+}
+
+// resolveJournalConflict drops the journalled changes of the message which
+// conflict with its change on the server while offline; the change on the
+// server wins. An operation conflicts only with a change of the field it
+// changes, e.g., a label change on the server keeps a journalled read flag.
+// It returns the kept changes of the message so that they can be applied on
+// top of the server change with rebaseJournal.
+func (store *Store) resolveJournalConflict(event *pmapi.EventMessage) (kept []journalEntry) {
+	if store.PendingChanges() == 0 {
+		return nil
+	}
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(journalBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry journalEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+
+			remaining := removeString(entry.MessageIDs, event.ID)
+			if len(remaining) == len(entry.MessageIDs) {
+				continue
+			}
+
+			if !journalConflicts(entry, event) {
+				kept = append(kept, journalEntry{Op: entry.Op, MessageIDs: []string{event.ID}, LabelID: entry.LabelID})
+				continue
+			}
+
+			store.log.WithField("msgID", event.ID).WithField("op", entry.Op).Warn("Dropping offline change of message changed on the server")
+
+			if len(remaining) == 0 {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			entry.MessageIDs = remaining
+			delete(entry.Was, event.ID)
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, data); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		store.log.WithError(err).Error("Cannot resolve offline change conflicts")
+		return nil
+	}
+
+	return kept
+}
+
+// journalConflicts returns whether the message event changes the field the
+// journalled operation changes, i.e., whether the field on the server is no
+// longer what it was locally before the operation.
+func journalConflicts(entry journalEntry, event *pmapi.EventMessage) bool {
+	switch event.Action {
+	case pmapi.EventDelete:
+		return true
+	case pmapi.EventUpdate, pmapi.EventUpdateFlags:
+		if event.Updated == nil || entry.Op == opDelete {
+			return false
+		}
+
+		value, ok := journalledField(entry, event.Updated)
+		if !ok {
+			return false
+		}
+
+		was, known := entry.Was[event.ID]
+		return !known || value != was
+	}
+
+	return false
+}
+
+// journalledField returns the value of the field changed by the operation
+// after the update, and whether the update carries it: the unread flag for
+// the read operations and whether the message has the label for the label
+// operations.
+func journalledField(entry journalEntry, updated *pmapi.EventMessageUpdated) (value, ok bool) {
+	switch entry.Op {
+	case opRead, opUnread:
+		if updated.Unread == nil {
+			return false, false
+		}
+		return bool(*updated.Unread), true
+	case opLabel, opUnlabel:
+		switch {
+		case updated.LabelIDs != nil:
+			return containsString(updated.LabelIDs, entry.LabelID), true
+		case containsString(updated.LabelIDsAdded, entry.LabelID):
+			return true, true
+		case containsString(updated.LabelIDsRemoved, entry.LabelID):
+			return false, true
+		}
+	}
+
+	return false, false
+}
+
+// rebaseJournal applies the kept journalled changes of a message again after
+// the server change overwrote the local data.
+func (store *Store) rebaseJournal(kept []journalEntry) {
+	for _, entry := range kept {
+		if err := store.applyMessageOp(entry); err != nil {
+			store.log.WithError(err).WithField("op", entry.Op).Error("Cannot apply offline change on top of the server change")
+		}
+	}
+}
+
+// replayJournal sends the journalled changes to the API in order and returns
+// whether there were any. It stops when the connection is lost again; changes
+// refused by the API are dropped.
+func (store *Store) replayJournal() bool {
+	if store.IsOffline() || store.PendingChanges() == 0 {
+		return false
+	}
+
+	store.log.WithField("pending", store.PendingChanges()).Info("Replaying offline changes")
+
+	for {
+		var key []byte
+		var entry journalEntry
+
+		err := store.db.View(func(tx *bolt.Tx) error {
+			k, v := tx.Bucket(journalBucket).Cursor().First()
+			if k == nil {
+				return nil
+			}
+			key = append([]byte{}, k...)
+			return json.Unmarshal(v, &entry)
+		})
+		if err != nil {
+			store.log.WithError(err).Error("Cannot read offline changes")
+			return true
+		}
+
+		if key == nil {
+			return true
+		}
+
+		if err := store.callMessageOp(entry); err != nil {
+			if errors.Cause(err) == pmapi.ErrNoConnection {
+				store.log.WithError(err).Warn("Connection lost while replaying offline changes")
+				return true
+			}
+			store.log.WithError(err).WithField("op", entry.Op).Warn("Dropping offline change refused by the server")
+		}
+
+		if err := store.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(journalBucket).Delete(key)
+		}); err != nil {
+			store.log.WithError(err).Error("Cannot remove replayed offline change")
+			return true
+		}
+	}
+}
+
+func journalKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, i := range items {
+		if i == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(items []string, item string) []string {
+	result := make([]string, 0, len(items))
+	for _, i := range items {
+		if i != item {
+			result = append(result, i)
+		}
+	}
+	return result
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func goOffline(m *mocksForStore) *Connectivity {
+	connectivity := &Connectivity{}
+	connectivity.SetOffline(true)
+	m.store.SetConnectivity(connectivity)
+	return connectivity
+}
+
+func TestOfflineMessageOpsAreJournalled(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	insertMessage(t, m, "msg1", "Test message 1", addrID1, true, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+	insertMessage(t, m, "msg2", "Test message 2", addrID1, true, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+
+	goOffline(m)
+	r.True(m.store.IsOffline())
+
+	// No API call is expected by the mocks.
+	r.NoError(m.store.runMessageOp(journalEntry{Op: opRead, MessageIDs: []string{"msg1"}}))
+	r.NoError(m.store.runMessageOp(journalEntry{Op: opLabel, MessageIDs: []string{"msg1", "msg2"}, LabelID: pmapi.ArchiveLabel}))
+	r.NoError(m.store.runMessageOp(journalEntry{Op: opUnlabel, MessageIDs: []string{"msg1", "msg2"}, LabelID: pmapi.InboxLabel}))
+	r.Equal(3, m.store.PendingChanges())
+
+	msg, err := m.store.getMessageFromDB("msg1")
+	r.NoError(err)
+	r.False(bool(msg.Unread))
+	r.ElementsMatch([]string{pmapi.AllMailLabel, pmapi.ArchiveLabel}, msg.LabelIDs)
+
+	checkMailboxMessageIDs(t, m, pmapi.InboxLabel, []wantID{})
+	checkMailboxMessageIDs(t, m, pmapi.ArchiveLabel, []wantID{{"msg1", 1}, {"msg2", 2}})
+
+	// The deletion on the server wins over all changes.
+	m.store.resolveJournalConflict(&pmapi.EventMessage{EventItem: pmapi.EventItem{ID: "msg2", Action: pmapi.EventDelete}})
+	r.Equal(3, m.store.PendingChanges())
+	m.store.resolveJournalConflict(&pmapi.EventMessage{EventItem: pmapi.EventItem{ID: "msg1", Action: pmapi.EventDelete}})
+	r.Equal(0, m.store.PendingChanges())
+}
+
+func TestOfflineJournalConflictsOnChangedFieldOnly(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	insertMessage(t, m, "msg1", "Test message 1", addrID1, true, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+
+	goOffline(m)
+	r.NoError(m.store.runMessageOp(journalEntry{Op: opRead, MessageIDs: []string{"msg1"}}))
+	r.NoError(m.store.runMessageOp(journalEntry{Op: opLabel, MessageIDs: []string{"msg1"}, LabelID: pmapi.StarredLabel}))
+
+	// The server moved the message to the archive; the flag is as it was.
+	unread := pmapi.Boolean(true)
+	event := &pmapi.EventMessage{
+		EventItem: pmapi.EventItem{ID: "msg1", Action: pmapi.EventUpdateFlags},
+		Updated: &pmapi.EventMessageUpdated{
+			ID:       "msg1",
+			Unread:   &unread,
+			LabelIDs: []string{pmapi.AllMailLabel, pmapi.ArchiveLabel},
+		},
+	}
+	kept := m.store.resolveJournalConflict(event)
+	r.Equal(2, m.store.PendingChanges())
+	r.Len(kept, 2)
+
+	msg, err := m.store.getMessageFromDB("msg1")
+	r.NoError(err)
+	updateMessage(m.store.log, msg, event.Updated)
+	r.NoError(m.store.createOrUpdateMessageEvent(msg))
+	m.store.rebaseJournal(kept)
+
+	msg, err = m.store.getMessageFromDB("msg1")
+	r.NoError(err)
+	r.False(bool(msg.Unread))
+	r.ElementsMatch([]string{pmapi.AllMailLabel, pmapi.ArchiveLabel, pmapi.StarredLabel}, msg.LabelIDs)
+
+	// The server starred the message too; the flag stays.
+	event.Updated.LabelIDs = nil
+	event.Updated.LabelIDsAdded = []string{pmapi.StarredLabel}
+	kept = m.store.resolveJournalConflict(event)
+	r.Equal(1, m.store.PendingChanges())
+	r.Equal([]journalEntry{{Op: opRead, MessageIDs: []string{"msg1"}}}, kept)
+
+	// The server marked the message read; it no longer is what it was.
+	read := pmapi.Boolean(false)
+	event.Updated.Unread = &read
+	event.Updated.LabelIDsAdded = nil
+	r.Empty(m.store.resolveJournalConflict(event))
+	r.Equal(0, m.store.PendingChanges())
+}
+
+func TestOfflineJournalReplay(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	insertMessage(t, m, "msg1", "Test message 1", addrID1, true, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+
+	connectivity := goOffline(m)
+	r.NoError(m.store.runMessageOp(journalEntry{Op: opRead, MessageIDs: []string{"msg1"}}))
+	r.NoError(m.store.runMessageOp(journalEntry{Op: opLabel, MessageIDs: []string{"msg1"}, LabelID: pmapi.StarredLabel}))
+
+	// Nothing is replayed while offline.
+	r.False(m.store.replayJournal())
+
+	connectivity.SetOffline(false)
+
+	gomock.InOrder(
+		m.client.EXPECT().MarkMessagesRead(gomock.Any(), []string{"msg1"}).Return(nil),
+		m.client.EXPECT().LabelMessages(gomock.Any(), []string{"msg1"}, pmapi.StarredLabel).Return(pmapi.ErrNoConnection),
+	)
+	r.True(m.store.replayJournal())
+	r.Equal(1, m.store.PendingChanges())
+
+	m.client.EXPECT().LabelMessages(gomock.Any(), []string{"msg1"}, pmapi.StarredLabel).Return(nil)
+	r.True(m.store.replayJournal())
+	r.Equal(0, m.store.PendingChanges())
+	r.False(m.store.replayJournal())
+}
+
+func TestOfflineServesCachedMessagesOnly(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	insertMessage(t, m, "msg1", "Test message 1", addrID1, false, []string{pmapi.AllMailLabel})
+
+	goOffline(m)
+
+	_, err := m.store.getCachedMessage("msg1")
+	require.Equal(t, ErrOffline, err)
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNoSuchQueuedMessage when the outbox does not have the message.
+var ErrNoSuchQueuedMessage = errors.New("no such queued message") //nolint[gochecknoglobals]
+
+// QueuedMessage is a message accepted over SMTP which waits in the outbox
+// to be sent.
+type QueuedMessage struct {
+	ID          string
+	AddressID   string
+	ReturnPath  string
+	To          []string
+	Queued      time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+
+	// DSN holds the delivery status notifications requested for the
+	// recipients, by recipient address.
+	DSN map[string]DSNRequest `json:",omitempty"`
+
+	// DSNEnvelope holds the parameters of the notifications given for the
+	// whole message.
+	DSNEnvelope DSNEnvelope
+
+	// DelayReported is set once the sender was notified that the message
+	// is delayed.
+	DelayReported bool `json:",omitempty"`
+}
+
+// DSNEnvelope holds the RET and ENVID parameters (RFC 3461) of the delivery
+// status notifications of a queued message.
+type DSNEnvelope struct {
+	Return     string `json:",omitempty"`
+	EnvelopeID string `json:",omitempty"`
+}
+
+// DSNRequest is the delivery status notification request (RFC 3461) of one
+// recipient of a queued message.
+type DSNRequest struct {
+	Notify            []string `json:",omitempty"`
+	OriginalRecipient string   `json:",omitempty"`
+}
+
+// IsDue returns whether the message should be sent at the given time.
+func (msg *QueuedMessage) IsDue(now time.Time) bool {
+	return !msg.NextAttempt.After(now)
+}
+
+// outboxRecord is the queued message as stored in the database. The body is
+// encrypted with the user keyring.
+type outboxRecord struct {
+	QueuedMessage
+	Body []byte
+}
+
+// QueueMessage puts the message literal to the outbox and returns the ID of
+// the queued message. The literal is encrypted with the user keyring so that
+// only the public key is needed to queue a message.
+func (store *Store) QueueMessage(addressID, returnPath string, to []string, dsnEnvelope DSNEnvelope, dsn map[string]DSNRequest, literal []byte) (string, error) {
+	kr, err := store.client().GetUserKeyRing()
+	if err != nil {
+		return "", err
+	}
+
+	enc, err := kr.Encrypt(crypto.NewPlainMessage(literal), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encrypt queued message")
+	}
+
+	record := outboxRecord{
+		QueuedMessage: QueuedMessage{
+			AddressID:   addressID,
+			ReturnPath:  returnPath,
+			To:          to,
+			Queued:      time.Now(),
+			DSN:         dsn,
+			DSNEnvelope: dsnEnvelope,
+		},
+		Body: enc.GetBinary(),
+	}
+
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		record.ID = strconv.FormatUint(seq, 10)
+		return putOutboxRecord(b, &record)
+	}); err != nil {
+		return "", err
+	}
+
+	store.log.WithField("queued", record.ID).Debug("Message was queued")
+	store.notifyOutbox()
+
+	return record.ID, nil
+}
+
+// QueuedMessages returns the messages in the outbox in the order in which
+// they were queued.
+func (store *Store) QueuedMessages() ([]QueuedMessage, error) {
+	messages := []QueuedMessage{}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(_, v []byte) error {
+			var record outboxRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			messages = append(messages, record.QueuedMessage)
+			return nil
+		})
+	})
+
+	return messages, err
+}
+
+// QueuedMessageLiteral returns the decrypted literal of the queued message.
+func (store *Store) QueuedMessageLiteral(id string) ([]byte, error) {
+	var record outboxRecord
+
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		return getOutboxRecord(tx.Bucket(outboxBucket), id, &record)
+	}); err != nil {
+		return nil, err
+	}
+
+	kr, err := store.client().GetUserKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := kr.Decrypt(crypto.NewPGPMessage(record.Body), nil, crypto.GetUnixTime())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decrypt queued message")
+	}
+
+	return dec.GetBinary(), nil
+}
+
+// DeferQueuedMessage records the failed attempt to send the queued message
+// and when it should be tried again.
+func (store *Store) DeferQueuedMessage(id string, cause error, next time.Time) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+
+		var record outboxRecord
+		if err := getOutboxRecord(b, id, &record); err != nil {
+			return err
+		}
+
+		record.Attempts++
+		record.NextAttempt = next
+		if cause != nil {
+			record.LastError = cause.Error()
+		}
+
+		return putOutboxRecord(b, &record)
+	})
+}
+
+// ReportQueuedMessageDelay records that the sender was notified that the
+// queued message is delayed.
+func (store *Store) ReportQueuedMessageDelay(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+
+		var record outboxRecord
+		if err := getOutboxRecord(b, id, &record); err != nil {
+			return err
+		}
+
+		record.DelayReported = true
+		return putOutboxRecord(b, &record)
+	})
+}
+
+// RemoveQueuedMessage removes the message from the outbox.
+func (store *Store) RemoveQueuedMessage(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		key, err := outboxKey(id)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket(outboxBucket)
+		if b.Get(key) == nil {
+			return ErrNoSuchQueuedMessage
+		}
+
+		return b.Delete(key)
+	})
+}
+
+// FlushOutbox makes all the queued messages due now and returns how many
+// there are.
+func (store *Store) FlushOutbox() (int, error) {
+	count := 0
+
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+
+		records := []outboxRecord{}
+		if err := b.ForEach(func(_, v []byte) error {
+			var record outboxRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for i := range records {
+			records[i].NextAttempt = time.Time{}
+			if err := putOutboxRecord(b, &records[i]); err != nil {
+				return err
+			}
+		}
+
+		count = len(records)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if count > 0 {
+		store.notifyOutbox()
+	}
+
+	return count, nil
+}
+
+// notifyOutbox wakes up the sender of the queued messages, if any.
+func (store *Store) notifyOutbox() {
+	if store.outboxReady == nil {
+		return
+	}
+
+	select {
+	case store.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+func outboxKey(id string) ([]byte, error) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, ErrNoSuchQueuedMessage
+	}
+
+	return journalKey(seq), nil
+}
+
+func getOutboxRecord(b *bolt.Bucket, id string, record *outboxRecord) error {
+	key, err := outboxKey(id)
+	if err != nil {
+		return err
+	}
+
+	data := b.Get(key)
+	if data == nil {
+		return ErrNoSuchQueuedMessage
+	}
+
+	return json.Unmarshal(data, record)
+}
+
+func putOutboxRecord(b *bolt.Bucket, record *outboxRecord) error {
+	key, err := outboxKey(record.ID)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, data)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestOutboxQueueAndSend(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+
+	literal := []byte("Subject: Hello\r\n\r\nHello world\r\n")
+	dsn := map[string]DSNRequest{"you@example.org": {Notify: []string{"SUCCESS", "FAILURE"}}}
+	id1, err := m.store.QueueMessage(addrID1, "user@example.com", []string{"you@example.org"}, DSNEnvelope{Return: "FULL", EnvelopeID: "QQ314159"}, dsn, literal)
+	r.NoError(err)
+	id2, err := m.store.QueueMessage("", "user@example.com", []string{"them@example.org"}, DSNEnvelope{}, nil, []byte("Subject: Second\r\n\r\n"))
+	r.NoError(err)
+
+	messages, err := m.store.QueuedMessages()
+	r.NoError(err)
+	r.Len(messages, 2)
+	r.Equal(id1, messages[0].ID)
+	r.Equal(addrID1, messages[0].AddressID)
+	r.Equal([]string{"you@example.org"}, messages[0].To)
+	r.Equal(id2, messages[1].ID)
+	r.True(messages[0].IsDue(time.Now()))
+	r.Equal(dsn, messages[0].DSN)
+	r.Nil(messages[1].DSN)
+	r.Equal(DSNEnvelope{Return: "FULL", EnvelopeID: "QQ314159"}, messages[0].DSNEnvelope)
+
+	// The body is not stored in plain text.
+	r.NoError(m.store.db.View(func(tx *bolt.Tx) error {
+		r.NotContains(string(tx.Bucket(outboxBucket).Get(journalKey(1))), "Hello world")
+		return nil
+	}))
+
+	got, err := m.store.QueuedMessageLiteral(id1)
+	r.NoError(err)
+	r.Equal(literal, got)
+
+	next := time.Now().Add(time.Hour)
+	r.NoError(m.store.DeferQueuedMessage(id1, errors.New("no internet connection"), next))
+
+	messages, err = m.store.QueuedMessages()
+	r.NoError(err)
+	r.Equal(1, messages[0].Attempts)
+	r.Equal("no internet connection", messages[0].LastError)
+	r.False(messages[0].IsDue(time.Now()))
+	r.False(messages[0].DelayReported)
+
+	r.NoError(m.store.ReportQueuedMessageDelay(id1))
+	messages, err = m.store.QueuedMessages()
+	r.NoError(err)
+	r.True(messages[0].DelayReported)
+
+	flushed, err := m.store.FlushOutbox()
+	r.NoError(err)
+	r.Equal(2, flushed)
+
+	messages, err = m.store.QueuedMessages()
+	r.NoError(err)
+	r.True(messages[0].IsDue(time.Now()))
+	r.Equal(1, messages[0].Attempts)
+
+	r.NoError(m.store.RemoveQueuedMessage(id1))
+	r.Equal(ErrNoSuchQueuedMessage, m.store.RemoveQueuedMessage(id1))
+	r.Equal(ErrNoSuchQueuedMessage, m.store.DeferQueuedMessage("nope", nil, next))
+
+	messages, err = m.store.QueuedMessages()
+	r.NoError(err)
+	r.Len(messages, 1)
+	r.Equal(id2, messages[0].ID)
+}
+
+func TestOutboxNotifiesSender(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	m.store.outboxReady = make(chan struct{}, 1)
+
+	_, err := m.store.QueueMessage("", "user@example.com", []string{"you@example.org"}, DSNEnvelope{}, nil, []byte("Subject: Hello\r\n\r\n"))
+	r.NoError(err)
+	_, err = m.store.QueueMessage("", "user@example.com", []string{"you@example.org"}, DSNEnvelope{}, nil, []byte("Subject: Again\r\n\r\n"))
+	r.NoError(err)
+
+	// The signals do not block and they are merged.
+	r.Len(m.store.outboxReady, 1)
+	<-m.store.outboxReady
+
+	_, err = m.store.FlushOutbox()
+	r.NoError(err)
+	r.Len(m.store.outboxReady, 1)
+}
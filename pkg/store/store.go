@@ -28,6 +28,7 @@ import (
 	"github.com/hashicorp/go-multierror"
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/pool"
 	"github.com/ljanyst/peroxide/pkg/store/cache"
@@ -47,6 +48,10 @@ const (
 	UserFoldersMailboxName = "Folders"
 	// UserFoldersPrefix contains name with delimiter for IMAP.
 	UserFoldersPrefix = UserFoldersMailboxName + PathDelimiter
+
+	// identityHeader records in the sent copy which address signed a message
+	// sent as another address of a catch-all domain.
+	identityHeader = "X-Peroxide-Identity"
 )
 
 var (
@@ -61,6 +66,8 @@ var (
 	//   * {messageID} -> message body structure
 	// * size
 	//   * {messageID} -> uint32 value
+	// * identity
+	//   * {messageID} -> string address which signed a message sent as another address of a catch-all domain
 	// * counts
 	//   * {mailboxID} -> mailboxCounts: totalOnAPI, unreadOnAPI, labelName, labelColor, labelIsExclusive
 	// * address_info
@@ -75,6 +82,12 @@ var (
 	//   * sync_state -> string timestamp when it was last synced (when missing, sync should be ongoing)
 	//   * ids_ranges -> json array of groups with start and end message ID (when missing, there is no ongoing sync)
 	//   * ids_to_be_deleted -> json array of message IDs to be deleted after sync (when missing, there is no ongoing sync)
+	// * sync_policy
+	//   * policy -> json of the sync window and labels (when missing, everything is synced)
+	// * journal
+	//   * {sequence} -> json of a message operation done while offline
+	// * outbox
+	//   * {sequence} -> json of a message accepted over SMTP and waiting to be sent (body pgp encrypted)
 	// * mailboxes
 	//   * {addressID+mailboxID}
 	//     * imap_ids
@@ -87,11 +100,15 @@ var (
 	headersBucket         = []byte("headers")           //nolint[gochecknoglobals]
 	bodystructureBucket   = []byte("bodystructure")     //nolint[gochecknoglobals]
 	sizeBucket            = []byte("size")              //nolint[gochecknoglobals]
+	identityBucket        = []byte("identity")          //nolint[gochecknoglobals]
 	countsBucket          = []byte("counts")            //nolint[gochecknoglobals]
 	addressInfoBucket     = []byte("address_info")      //nolint[gochecknoglobals]
 	addressModeBucket     = []byte("address_mode")      //nolint[gochecknoglobals]
 	cachePassphraseBucket = []byte("cache_passphrase")  //nolint[gochecknoglobals]
 	syncStateBucket       = []byte("sync_state")        //nolint[gochecknoglobals]
+	syncPolicyBucket      = []byte("sync_policy")       //nolint[gochecknoglobals]
+	journalBucket         = []byte("journal")           //nolint[gochecknoglobals]
+	outboxBucket          = []byte("outbox")            //nolint[gochecknoglobals]
 	mailboxesBucket       = []byte("mailboxes")         //nolint[gochecknoglobals]
 	imapIDsBucket         = []byte("imap_ids")          //nolint[gochecknoglobals]
 	apiIDsBucket          = []byte("api_ids")           //nolint[gochecknoglobals]
@@ -139,7 +156,15 @@ type Store struct {
 
 	isSyncRunning bool
 	syncCooldown  cooldown
+	syncProgress  *syncProgress
 	addressMode   addressMode
+
+	syncPolicy       SyncPolicy
+	fetchedOnDemand  map[string]int64         // Label ID -> unix time since which the messages were fetched.
+	fetchingOnDemand map[string]chan struct{} // Label ID -> closed once the running fetch finishes.
+
+	connectivity *Connectivity
+	outboxReady  chan struct{}
 }
 
 // New creates or opens a store for the given `user`.
@@ -184,6 +209,10 @@ func New( // nolint[funlen]
 
 		builder: builder,
 		cache:   cache,
+
+		syncProgress:     newSyncProgress(l),
+		fetchedOnDemand:  map[string]int64{},
+		fetchingOnDemand: map[string]chan struct{}{},
 	}
 
 	// Create a new cacher. It's not started yet.
@@ -231,11 +260,15 @@ func openBoltDatabase(filePath string) (db *bolt.DB, err error) {
 			headersBucket,
 			bodystructureBucket,
 			sizeBucket,
+			identityBucket,
 			countsBucket,
 			addressInfoBucket,
 			addressModeBucket,
 			cachePassphraseBucket,
 			syncStateBucket,
+			syncPolicyBucket,
+			journalBucket,
+			outboxBucket,
 			mailboxesBucket,
 			mboxVersionBucket,
 		}
@@ -278,6 +311,10 @@ func (store *Store) init(firstInit bool) (err error) {
 		}
 	}
 
+	if err = store.loadSyncPolicy(); err != nil {
+		store.log.WithError(err).Error("Could not load sync policy, syncing everything")
+	}
+
 	store.log.WithField("mode", store.addressMode).Info("Initialising store")
 
 	labels, err := store.initCounts()
@@ -378,6 +415,17 @@ func (store *Store) addAddress(address, addressID string, labels []*pmapi.Label)
 
 // newBuildJob returns a new build job for the given message using the store's message builder.
 func (store *Store) newBuildJob(ctx context.Context, messageID string, priority int) (*message.Job, pool.DoneFunc) {
+	return store.newSectionsBuildJob(ctx, messageID, nil, priority)
+}
+
+// newSectionsBuildJob builds the message with only the attachments within the
+// given sections; nil sections build the whole message.
+func (store *Store) newSectionsBuildJob(ctx context.Context, messageID string, sections [][]int, priority int) (*message.Job, pool.DoneFunc) {
+	var headers map[string]string
+	if identity := store.getMessageIdentity(messageID); identity != "" {
+		headers = map[string]string{identityHeader: identity}
+	}
+
 	return store.builder.NewJobWithOptions(
 		ctx,
 		store.client(),
@@ -389,6 +437,8 @@ func (store *Store) newBuildJob(ctx context.Context, messageID string, priority
 			AddExternalID:          true, // Whether to include ExternalID as X-Pm-External-Id.
 			AddMessageDate:         true, // Whether to include message time as X-Pm-Date.
 			AddMessageIDReference:  true, // Whether to include the MessageID in References.
+			Sections:               sections,
+			Headers:                headers,
 		},
 		priority,
 	)
@@ -411,6 +461,8 @@ func (store *Store) CloseEventLoopAndCacher() {
 	store.stopWatcher()
 
 	store.msgCachePool.stop()
+
+	metrics.ForgetAccount(store.user.ID())
 }
 
 func (store *Store) close() error {
@@ -49,17 +49,28 @@ func syncAllMail(store storeSynchronizer, api messageLister, syncState *syncStat
 	// When the full sync starts (i.e. is not already in progress), we need to load
 	//  - all message IDs in database, so we can see which messages we need to remove at the end of the sync
 	//  - ID ranges which indicate how to split work into multiple workers
+	var total int
 	if !syncState.isIncomplete() {
 		if err := syncState.loadMessageIDsToBeDeleted(); err != nil {
 			return errors.Wrap(err, "failed to load message IDs")
 		}
 
-		if err := findIDRanges(labelID, api, syncState); err != nil {
+		var err error
+		if total, err = findIDRanges(labelID, api, syncState); err != nil {
 			return errors.Wrap(err, "failed to load IDs ranges")
 		}
 		syncState.save()
+	} else {
+		// The total is only needed for the progress, the sync itself can go on without it.
+		var err error
+		if _, total, err = getSplitIDAndCount(labelID, api, 0, syncState.policy.windowStart()); err != nil {
+			log.WithError(err).Warn("Cannot get message count of resumed sync")
+		}
 	}
 
+	syncState.progress.start(total, syncState.getFetched())
+	defer syncState.progress.stop()
+
 	wg := &sync.WaitGroup{}
 
 	shouldStop := 0 // Using integer to have it atomic.
@@ -90,14 +101,17 @@ func syncAllMail(store storeSynchronizer, api messageLister, syncState *syncStat
 	return resultError
 }
 
-func findIDRanges(labelID string, api messageLister, syncState *syncState) error {
-	_, count, err := getSplitIDAndCount(labelID, api, 0)
+// findIDRanges splits the work into ID ranges and returns the total number
+// of messages to sync.
+func findIDRanges(labelID string, api messageLister, syncState *syncState) (int, error) {
+	begin := syncState.policy.windowStart()
+	_, count, err := getSplitIDAndCount(labelID, api, 0, begin)
 	if err != nil {
-		return errors.Wrap(err, "failed to get first ID and count")
+		return 0, errors.Wrap(err, "failed to get first ID and count")
 	}
 	log.WithField("total", count).Debug("Finding ID ranges")
 	if count == 0 {
-		return nil
+		return 0, nil
 	}
 
 	syncState.initIDRanges()
@@ -109,7 +123,7 @@ func findIDRanges(labelID string, api messageLister, syncState *syncState) error
 	}
 
 	if workers == 1 {
-		return nil
+		return count, nil
 	}
 
 	step := int(math.Round(float64(pages) / float64(workers)))
@@ -119,9 +133,9 @@ func findIDRanges(labelID string, api messageLister, syncState *syncState) error
 	}
 
 	for page := step; page < pages; page += step {
-		splitID, _, err := getSplitIDAndCount(labelID, api, page)
+		splitID, _, err := getSplitIDAndCount(labelID, api, page, begin)
 		if err != nil {
-			return errors.Wrap(err, "failed to get IDs range")
+			return 0, errors.Wrap(err, "failed to get IDs range")
 		}
 		// Some messages were probably deleted and so the page does not exist anymore.
 		// Would be good to start this function again, but let's rather start the sync instead of
@@ -132,10 +146,12 @@ func findIDRanges(labelID string, api messageLister, syncState *syncState) error
 		syncState.addIDRange(splitID)
 	}
 
-	return nil
+	return count, nil
 }
 
-func getSplitIDAndCount(labelID string, api messageLister, page int) (string, int, error) {
+// getSplitIDAndCount returns the first message ID on the page and the number
+// of messages not older than begin (unix time, zero means all).
+func getSplitIDAndCount(labelID string, api messageLister, page int, begin int64) (string, int, error) {
 	sort := "ID"
 	desc := false
 	filter := &pmapi.MessagesFilter{
@@ -145,6 +161,7 @@ func getSplitIDAndCount(labelID string, api messageLister, page int) (string, in
 		PageSize: maxFilterPageSize,
 		Page:     page,
 		Limit:    1,
+		Begin:    begin,
 	}
 	// If the page does not exist, an empty page instead of an error is returned.
 	messages, total, err := api.ListMessages(context.Background(), filter)
@@ -185,6 +202,9 @@ func syncBatch( //nolint:funlen
 			// When message is completely removed, it still works as expected.
 			BeginID: idRange.StartID,
 			EndID:   idRange.StopID,
+
+			// Messages older than the sync window are skipped.
+			Begin: syncState.policy.windowStart(),
 		}
 
 		log.WithField("begin", filter.BeginID).WithField("end", filter.EndID).Debug("Fetching page")
@@ -198,16 +218,23 @@ func syncBatch( //nolint:funlen
 			break
 		}
 
-		for _, m := range messages {
+		// Messages without any synced label are not stored, and so they are
+		// removed at the end of the sync if they were stored before.
+		syncedMessages := syncState.policy.filter(messages)
+
+		for _, m := range syncedMessages {
 			syncState.doNotDeleteMessageID(m.ID)
 		}
 		syncState.save()
 
-		if err := store.createOrUpdateMessagesEvent(messages); err != nil {
-			return errors.Wrap(err, "failed to create or update messages")
+		if len(syncedMessages) != 0 {
+			if err := store.createOrUpdateMessagesEvent(syncedMessages); err != nil {
+				return errors.Wrap(err, "failed to create or update messages")
+			}
 		}
 
 		pageLastMessageID := messages[len(messages)-1].ID
+		idRange.addFetched(len(messages))
 		if !desc {
 			idRange.setStartID(pageLastMessageID)
 		} else {
@@ -0,0 +1,328 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+const syncPolicyKey = "policy"
+
+// ErrUnknownLabel is returned when a sync policy refers to a label the store does not know.
+var ErrUnknownLabel = errors.New("unknown label") //nolint[gochecknoglobals]
+
+// SyncPolicy limits the messages whose metadata the store keeps locally. The
+// zero value syncs everything. Messages outside of the policy can still be
+// fetched on demand, see `Mailbox.FetchOutsideSyncPolicy`.
+type SyncPolicy struct {
+	// Months is the size of the sync window. Older messages are not synced.
+	Months int
+
+	// LabelIDs restrict the sync to the messages having at least one of them.
+	LabelIDs []string
+}
+
+// SyncsAll returns whether the policy does not limit the sync at all.
+func (p SyncPolicy) SyncsAll() bool {
+	return p.Months <= 0 && len(p.LabelIDs) == 0
+}
+
+// windowStart returns the unix time of the oldest message within the sync
+// window or zero if there is no window.
+func (p SyncPolicy) windowStart() int64 {
+	if p.Months <= 0 {
+		return 0
+	}
+	return time.Now().AddDate(0, -p.Months, 0).Unix()
+}
+
+func (p SyncPolicy) includesLabel(labelID string) bool {
+	if len(p.LabelIDs) == 0 {
+		return true
+	}
+	for _, id := range p.LabelIDs {
+		if id == labelID {
+			return true
+		}
+	}
+	return false
+}
+
+// includesLabels returns whether any of the labels is synced.
+func (p SyncPolicy) includesLabels(labelIDs []string) bool {
+	for _, labelID := range labelIDs {
+		if p.includesLabel(labelID) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the messages matching the label set of the policy. The
+// sync window is applied by the API filter.
+func (p SyncPolicy) filter(messages []*pmapi.Message) []*pmapi.Message {
+	if len(p.LabelIDs) == 0 {
+		return messages
+	}
+
+	filtered := make([]*pmapi.Message, 0, len(messages))
+	for _, msg := range messages {
+		if p.includesLabels(msg.LabelIDs) {
+			filtered = append(filtered, msg)
+		}
+	}
+	return filtered
+}
+
+// SyncPolicy returns the sync policy of the store.
+func (store *Store) SyncPolicy() SyncPolicy {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.syncPolicy
+}
+
+// SetSyncPolicy stores the new sync policy and starts a full sync applying
+// it, i.e., fetching the newly included messages and removing the ones no
+// longer included.
+func (store *Store) SetSyncPolicy(policy SyncPolicy) error {
+	if policy.Months < 0 {
+		policy.Months = 0
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(syncPolicyBucket).Put([]byte(syncPolicyKey), data)
+	}); err != nil {
+		return errors.Wrap(err, "failed to save sync policy")
+	}
+
+	store.lock.Lock()
+	store.syncPolicy = policy
+	store.fetchedOnDemand = map[string]int64{}
+	store.lock.Unlock()
+
+	store.log.WithField("months", policy.Months).WithField("labels", policy.LabelIDs).Info("Sync policy changed")
+
+	store.TriggerSync()
+	return nil
+}
+
+// loadSyncPolicy reads the sync policy from the database. Stores without a
+// policy sync everything.
+func (store *Store) loadSyncPolicy() error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(syncPolicyBucket).Get([]byte(syncPolicyKey))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &store.syncPolicy)
+	})
+}
+
+// keepsMessage returns whether the message belongs to the local database,
+// i.e., it matches the labels of the sync policy or it has a label which was
+// fetched on demand. Messages handled by the event loop are recent, so the
+// sync window is not checked.
+func (store *Store) keepsMessage(msg *pmapi.Message) bool {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	if store.syncPolicy.includesLabels(msg.LabelIDs) {
+		return true
+	}
+	for _, labelID := range msg.LabelIDs {
+		if _, ok := store.fetchedOnDemand[labelID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveLabelIDs maps the mailbox names or label IDs to label IDs.
+func (store *Store) ResolveLabelIDs(names []string) ([]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	labelIDs := make([]string, 0, len(names))
+	for _, name := range names {
+		labelID, ok := store.resolveLabelID(name)
+		if !ok {
+			return nil, errors.Wrap(ErrUnknownLabel, name)
+		}
+		labelIDs = append(labelIDs, labelID)
+	}
+	return labelIDs, nil
+}
+
+// LabelNames maps the label IDs to mailbox names. Unknown labels keep their IDs.
+func (store *Store) LabelNames(labelIDs []string) []string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	names := make([]string, 0, len(labelIDs))
+	for _, labelID := range labelIDs {
+		name := labelID
+		for _, address := range store.addresses {
+			if mailbox, ok := address.mailboxes[labelID]; ok {
+				name = mailbox.Name()
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (store *Store) resolveLabelID(name string) (string, bool) {
+	for _, address := range store.addresses {
+		for labelID, mailbox := range address.mailboxes {
+			if labelID == name || strings.EqualFold(mailbox.Name(), name) {
+				return labelID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// FetchOutsideSyncPolicy makes sure the messages of the mailbox not older than
+// since are in the local database, fetching the ones excluded by the sync
+// policy from the API. A zero since means all messages. Each range is only
+// fetched once and only one fetch per label runs at a time; the messages are
+// removed again by the next full sync.
+func (storeMailbox *Mailbox) FetchOutsideSyncPolicy(since time.Time) error {
+	store := storeMailbox.storeAddress.store
+	labelID := storeMailbox.labelID
+
+	begin := int64(0)
+	if !since.IsZero() {
+		begin = since.Unix()
+	}
+
+	end, ok := store.startFetchOnDemand(labelID, begin)
+	if !ok {
+		return nil
+	}
+
+	fetched := false
+	defer func() { store.finishFetchOnDemand(labelID, begin, fetched) }()
+
+	log := store.log.WithField("label", labelID).WithField("begin", begin).WithField("end", end)
+	log.Info("Fetching messages outside of the sync policy")
+
+	desc := true
+	filter := &pmapi.MessagesFilter{
+		LabelID:  labelID,
+		Sort:     "ID",
+		Desc:     &desc,
+		PageSize: maxFilterPageSize,
+		Begin:    begin,
+		End:      end,
+	}
+
+	for {
+		messages, _, err := store.client().ListMessages(context.Background(), filter)
+		if err != nil {
+			return errors.Wrap(err, "failed to list messages")
+		}
+
+		if len(messages) != 0 {
+			if err := store.createOrUpdateMessagesEvent(messages); err != nil {
+				return errors.Wrap(err, "failed to create or update messages")
+			}
+		}
+
+		if len(messages) < maxFilterPageSize {
+			break
+		}
+		filter.Page++
+	}
+
+	fetched = true
+	return nil
+}
+
+// startFetchOnDemand marks the label as being fetched and returns the end of
+// the range to fetch. It waits for the running fetch of the label, if any, and
+// returns false when there is nothing left to fetch.
+func (store *Store) startFetchOnDemand(labelID string, begin int64) (int64, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for {
+		// Without the label, all messages since begin are missing. With the
+		// label, only the ones older than the sync window are.
+		end := int64(0)
+		if store.syncPolicy.includesLabel(labelID) {
+			end = store.syncPolicy.windowStart()
+			if end == 0 || begin >= end {
+				return 0, false
+			}
+		}
+
+		if fetched, ok := store.fetchedOnDemand[labelID]; ok && fetched <= begin {
+			return 0, false
+		}
+
+		running, ok := store.fetchingOnDemand[labelID]
+		if !ok {
+			store.fetchingOnDemand[labelID] = make(chan struct{})
+			return end, true
+		}
+
+		store.lock.Unlock()
+		<-running
+		store.lock.Lock()
+	}
+}
+
+// finishFetchOnDemand records the fetched range and wakes up the fetches of
+// the label waiting for this one.
+func (store *Store) finishFetchOnDemand(labelID string, begin int64, fetched bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if fetched {
+		if prev, ok := store.fetchedOnDemand[labelID]; !ok || begin < prev {
+			store.fetchedOnDemand[labelID] = begin
+		}
+	}
+
+	close(store.fetchingOnDemand[labelID])
+	delete(store.fetchingOnDemand, labelID)
+}
+
+// SyncWindowStart returns the time of the oldest message within the sync
+// window or zero time if the sync has no window.
+func (storeMailbox *Mailbox) SyncWindowStart() time.Time {
+	start := storeMailbox.storeAddress.store.SyncPolicy().windowStart()
+	if start == 0 {
+		return time.Time{}
+	}
+	return time.Unix(start, 0)
+}
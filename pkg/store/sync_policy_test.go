@@ -0,0 +1,87 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncPolicySyncsAll(t *testing.T) {
+	assert.True(t, SyncPolicy{}.SyncsAll())
+	assert.False(t, SyncPolicy{Months: 6}.SyncsAll())
+	assert.False(t, SyncPolicy{LabelIDs: []string{pmapi.InboxLabel}}.SyncsAll())
+}
+
+func TestSyncPolicyWindowStart(t *testing.T) {
+	assert.Zero(t, SyncPolicy{}.windowStart())
+
+	want := time.Now().AddDate(0, -6, 0).Unix()
+	assert.InDelta(t, want, SyncPolicy{Months: 6}.windowStart(), 1)
+}
+
+func TestSyncPolicyFilter(t *testing.T) {
+	inbox := &pmapi.Message{ID: "inbox", LabelIDs: []string{pmapi.AllMailLabel, pmapi.InboxLabel}}
+	archive := &pmapi.Message{ID: "archive", LabelIDs: []string{pmapi.AllMailLabel, pmapi.ArchiveLabel}}
+	messages := []*pmapi.Message{inbox, archive}
+
+	assert.Equal(t, messages, SyncPolicy{}.filter(messages))
+	assert.Equal(t, messages, SyncPolicy{Months: 6}.filter(messages))
+	assert.Equal(t, []*pmapi.Message{inbox}, SyncPolicy{LabelIDs: []string{pmapi.InboxLabel}}.filter(messages))
+	assert.Empty(t, SyncPolicy{LabelIDs: []string{pmapi.SentLabel}}.filter(messages))
+}
+
+func TestFetchOnDemandRunsOncePerLabel(t *testing.T) {
+	store := &Store{
+		lock:             &sync.RWMutex{},
+		syncPolicy:       SyncPolicy{LabelIDs: []string{pmapi.InboxLabel}},
+		fetchedOnDemand:  map[string]int64{},
+		fetchingOnDemand: map[string]chan struct{}{},
+	}
+
+	_, ok := store.startFetchOnDemand(pmapi.ArchiveLabel, 0)
+	assert.True(t, ok)
+
+	// A second fetch of the same label waits for the running one and finds
+	// the range already fetched.
+	second := make(chan bool)
+	go func() {
+		_, ok := store.startFetchOnDemand(pmapi.ArchiveLabel, 100)
+		second <- ok
+	}()
+
+	select {
+	case <-second:
+		t.Fatal("second fetch did not wait for the running one")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	store.finishFetchOnDemand(pmapi.ArchiveLabel, 0, true)
+	assert.False(t, <-second)
+
+	// A failed fetch lets the next one try again.
+	_, ok = store.startFetchOnDemand(pmapi.SentLabel, 0)
+	assert.True(t, ok)
+	store.finishFetchOnDemand(pmapi.SentLabel, 0, false)
+
+	_, ok = store.startFetchOnDemand(pmapi.SentLabel, 0)
+	assert.True(t, ok)
+}
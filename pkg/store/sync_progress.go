@@ -0,0 +1,148 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syncProgressLogInterval is how often a running sync logs its progress.
+const syncProgressLogInterval = 30 * time.Second
+
+// SyncProgress is a snapshot of the progress of the full sync of a store.
+type SyncProgress struct {
+	Running bool
+	Total   int
+	Fetched int
+	StartID string
+	StopID  string
+	Started time.Time
+	ETA     time.Duration
+}
+
+// Percent returns the share of the messages fetched so far.
+func (p SyncProgress) Percent() float64 {
+	if p.Total == 0 {
+		return 0
+	}
+	return 100 * float64(p.Fetched) / float64(p.Total)
+}
+
+func (p SyncProgress) String() string {
+	if !p.Running {
+		return "not running"
+	}
+
+	status := fmt.Sprintf("%d of %d messages (%.0f%%)", p.Fetched, p.Total, p.Percent())
+	if p.ETA > 0 {
+		status += fmt.Sprintf(", about %v left", p.ETA.Round(time.Second))
+	}
+	return status
+}
+
+// syncProgress tracks the progress of the running sync. The number of fetched
+// messages is kept in the ID ranges, so an interrupted sync resumes counting
+// from where it stopped; the ETA only accounts for the current run.
+type syncProgress struct {
+	lock sync.RWMutex
+	log  *logrus.Entry
+
+	running bool
+	total   int
+	fetched int
+	resumed int // Messages fetched before the current run.
+	startID string
+	stopID  string
+	started time.Time
+	logged  time.Time
+}
+
+func newSyncProgress(log *logrus.Entry) *syncProgress {
+	return &syncProgress{log: log}
+}
+
+func (p *syncProgress) start(total, fetched int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.running = true
+	p.total = total
+	p.fetched = fetched
+	p.resumed = fetched
+	p.startID = ""
+	p.stopID = ""
+	p.started = time.Now()
+	p.logged = p.started
+
+	p.log.WithField("total", total).WithField("fetched", fetched).Info("Sync progress started")
+}
+
+// add records that n messages of the range between startID and stopID were fetched.
+func (p *syncProgress) add(n int, startID, stopID string) {
+	p.lock.Lock()
+	p.fetched += n
+	p.startID = startID
+	p.stopID = stopID
+
+	shouldLog := time.Since(p.logged) >= syncProgressLogInterval
+	if shouldLog {
+		p.logged = time.Now()
+	}
+	p.lock.Unlock()
+
+	if shouldLog {
+		p.log.WithField("progress", p.snapshot().String()).Info("Sync in progress")
+	}
+}
+
+func (p *syncProgress) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.running = false
+}
+
+func (p *syncProgress) snapshot() SyncProgress {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	progress := SyncProgress{
+		Running: p.running,
+		Total:   p.total,
+		Fetched: p.fetched,
+		StartID: p.startID,
+		StopID:  p.stopID,
+		Started: p.started,
+	}
+
+	// The boundary messages of each page are fetched twice and new messages
+	// may arrive during the sync.
+	if progress.Fetched > progress.Total {
+		progress.Fetched = progress.Total
+	}
+
+	if progress.Running && p.fetched > p.resumed {
+		rate := float64(p.fetched-p.resumed) / float64(time.Since(p.started))
+		progress.ETA = time.Duration(float64(progress.Total-progress.Fetched) / rate)
+	}
+
+	return progress
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncProgress(t *testing.T) {
+	progress := newSyncProgress(log)
+	assert.Equal(t, "not running", progress.snapshot().String())
+
+	progress.start(1000, 200)
+	progress.started = time.Now().Add(-10 * time.Second)
+	progress.add(200, "100", "500")
+
+	snapshot := progress.snapshot()
+	assert.True(t, snapshot.Running)
+	assert.Equal(t, 1000, snapshot.Total)
+	assert.Equal(t, 400, snapshot.Fetched)
+	assert.Equal(t, "100", snapshot.StartID)
+	assert.Equal(t, "500", snapshot.StopID)
+	assert.Equal(t, 40.0, snapshot.Percent())
+
+	// 200 messages fetched in this run in ten seconds, 600 to go.
+	assert.InDelta(t, 30*time.Second, snapshot.ETA, float64(time.Second))
+
+	progress.stop()
+	snapshot = progress.snapshot()
+	assert.False(t, snapshot.Running)
+	assert.Zero(t, snapshot.ETA)
+}
+
+func TestSyncProgressFetchedAboveTotal(t *testing.T) {
+	progress := newSyncProgress(log)
+	progress.start(100, 0)
+	progress.add(150, "", "")
+
+	snapshot := progress.snapshot()
+	assert.Equal(t, 100, snapshot.Fetched)
+	assert.Zero(t, snapshot.ETA)
+}
@@ -46,6 +46,12 @@ type syncState struct {
 	// again. We do that because we don't want to remove everything on the
 	// beginning of the sync to keep client synced.
 	idsToBeDeletedMap map[string]bool
+
+	// progress is updated as the ID ranges are synced.
+	progress *syncProgress
+
+	// policy limits the messages which are synced.
+	policy SyncPolicy
 }
 
 func newSyncState(store storeSynchronizer, finishTime int64, idRanges []*syncIDRange, idsToBeDeleted []string) *syncState {
@@ -61,6 +67,7 @@ func newSyncState(store storeSynchronizer, finishTime int64, idRanges []*syncIDR
 		finishTime:        finishTime,
 		idRanges:          idRanges,
 		idsToBeDeletedMap: idsToBeDeletedMap,
+		progress:          newSyncProgress(log),
 	}
 
 	for _, idRange := range idRanges {
@@ -182,6 +189,18 @@ func (s *syncState) deleteMessagesToBeDeleted() error {
 	return nil
 }
 
+// getFetched returns the number of messages fetched by the ID ranges so far.
+func (s *syncState) getFetched() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fetched := 0
+	for _, idRange := range s.idRanges {
+		fetched += idRange.Fetched
+	}
+	return fetched
+}
+
 // getIDsToBeDeleted is helper to convert internal map for easier
 // manipulation to array.
 func (s *syncState) getIDsToBeDeleted() []string {
@@ -197,6 +216,9 @@ type syncIDRange struct {
 	syncState *syncState
 	StartID   string
 	StopID    string
+
+	// Fetched is the number of messages synced in this range so far.
+	Fetched int
 }
 
 func (r *syncIDRange) setStartID(startID string) {
@@ -209,6 +231,17 @@ func (r *syncIDRange) setStopID(stopID string) {
 	r.syncState.save()
 }
 
+// addFetched records n synced messages in the range and in the progress
+// of the sync.
+func (r *syncIDRange) addFetched(n int) {
+	r.syncState.lock.Lock()
+	r.Fetched += n
+	startID, stopID := r.StartID, r.StopID
+	r.syncState.lock.Unlock()
+
+	r.syncState.progress.add(n, startID, stopID)
+}
+
 // isFinished returns syncIDRange is finished when StartID and StopID
 // are the same. But it cannot be full range, full range cannot be
 // determined in other way than asking API.
@@ -33,6 +33,7 @@ import (
 type mockLister struct {
 	err        error
 	messageIDs []string
+	labelIDs   map[string][]string
 }
 
 func (m *mockLister) ListMessages(_ context.Context, filter *pmapi.MessagesFilter) (msgs []*pmapi.Message, total int, err error) {
@@ -62,7 +63,8 @@ func (m *mockLister) ListMessages(_ context.Context, filter *pmapi.MessagesFilte
 			continue
 		}
 		msgs = append(msgs, &pmapi.Message{
-			ID: messageID,
+			ID:       messageID,
+			LabelIDs: m.labelIDs[messageID],
 		})
 		if len(msgs) == filter.PageSize || len(msgs) == filter.Limit {
 			break
@@ -198,6 +200,15 @@ func TestSyncAllMail(t *testing.T) { //nolint:funlen
 			err := syncAllMail(store, api, syncState)
 			require.Nil(t, err)
 
+			progress := syncState.progress.snapshot()
+			assert.False(t, progress.Running)
+			assert.Equal(t, numberOfMessages, progress.Total)
+			if len(tc.idRanges) == 0 {
+				assert.Equal(t, numberOfMessages, progress.Fetched)
+			} else {
+				assert.Equal(t, syncState.getFetched(), progress.Fetched)
+			}
+
 			// Check all messages were created or updated.
 			updateMessageIDsMap := map[string]bool{}
 			for _, messageIDs := range store.createdMessageIDsByBatch {
@@ -260,6 +271,49 @@ func TestSyncAllMail_FailedCreateOrUpdateMessage(t *testing.T) {
 	require.EqualError(t, err, "failed to sync group: failed to create or update messages: error")
 }
 
+func TestSyncAllMail_LabelPolicy(t *testing.T) {
+	numberOfMessages := 1000
+
+	api := &mockLister{
+		messageIDs: generateIDs(1, numberOfMessages),
+		labelIDs:   map[string][]string{},
+	}
+	for idx, messageID := range api.messageIDs {
+		if idx%2 == 0 {
+			api.labelIDs[messageID] = []string{pmapi.AllMailLabel, pmapi.InboxLabel}
+		} else {
+			api.labelIDs[messageID] = []string{pmapi.AllMailLabel, pmapi.ArchiveLabel}
+		}
+	}
+
+	store := newSyncer()
+	store.allMessageIDs = api.messageIDs
+
+	syncState := newSyncState(store, 0, []*syncIDRange{}, []string{})
+	syncState.policy = SyncPolicy{LabelIDs: []string{pmapi.InboxLabel}}
+
+	err := syncAllMail(store, api, syncState)
+	require.Nil(t, err)
+
+	created := map[string]bool{}
+	for _, messageIDs := range store.createdMessageIDsByBatch {
+		for _, messageID := range messageIDs {
+			created[messageID] = true
+		}
+	}
+
+	idsToBeDeleted := map[string]bool{}
+	for _, messageID := range syncState.getIDsToBeDeleted() {
+		idsToBeDeleted[messageID] = true
+	}
+
+	for idx, messageID := range api.messageIDs {
+		inInbox := idx%2 == 0
+		assert.Equal(t, inInbox, created[messageID], "Message %s", messageID)
+		assert.Equal(t, !inInbox, idsToBeDeleted[messageID], "Message %s", messageID)
+	}
+}
+
 func TestFindIDRanges(t *testing.T) { //nolint:funlen
 	store := newSyncer()
 	syncState := newTestSyncState(store)
@@ -340,9 +394,10 @@ func TestFindIDRanges(t *testing.T) { //nolint:funlen
 				messageIDs: tc.messageIDs,
 			}
 
-			err := findIDRanges(pmapi.AllMailLabel, api, syncState)
+			total, err := findIDRanges(pmapi.AllMailLabel, api, syncState)
 
 			require.Nil(t, err)
+			require.Equal(t, len(tc.messageIDs), total)
 			require.Equal(t, len(tc.wantBatches), len(syncState.idRanges))
 			for idx, idRange := range syncState.idRanges {
 				want := tc.wantBatches[idx]
@@ -361,7 +416,7 @@ func TestFindIDRanges_FailedListing(t *testing.T) {
 
 	syncState := newTestSyncState(store)
 
-	err := findIDRanges(pmapi.AllMailLabel, api, syncState)
+	_, err := findIDRanges(pmapi.AllMailLabel, api, syncState)
 	require.EqualError(t, err, "failed to get first ID and count: failed to list messages: error")
 }
 
@@ -429,7 +484,7 @@ func TestGetSplitIDAndCount(t *testing.T) { //nolint:funlen
 				messageIDs: tc.messageIDs,
 			}
 
-			id, total, err := getSplitIDAndCount(pmapi.AllMailLabel, api, tc.page)
+			id, total, err := getSplitIDAndCount(pmapi.AllMailLabel, api, tc.page, 0)
 
 			if tc.wantErr == "" {
 				require.Nil(t, err)
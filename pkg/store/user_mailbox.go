@@ -28,6 +28,10 @@ import (
 // createMailbox creates the mailbox via the API.
 // The store mailbox is created later by processing an event.
 func (store *Store) createMailbox(name string) error {
+	if store.IsOffline() {
+		return ErrOffline
+	}
+
 	defer store.eventLoop.pollNow()
 
 	log.WithField("name", name).Debug("Creating mailbox")
@@ -123,6 +127,10 @@ func (store *Store) leastUsedColor() string {
 // updateMailbox updates the mailbox via the API.
 // The store mailbox is updated later by processing an event.
 func (store *Store) updateMailbox(labelID, newName, color string) error {
+	if store.IsOffline() {
+		return ErrOffline
+	}
+
 	defer store.eventLoop.pollNow()
 
 	_, err := store.client().UpdateLabel(exposeContextForIMAP(), &pmapi.Label{
@@ -136,6 +144,10 @@ func (store *Store) updateMailbox(labelID, newName, color string) error {
 // deleteMailbox deletes the mailbox via the API.
 // The store mailbox is deleted later by processing an event.
 func (store *Store) deleteMailbox(labelID, addressID string) error {
+	if store.IsOffline() {
+		return ErrOffline
+	}
+
 	defer store.eventLoop.pollNow()
 
 	if pmapi.IsSystemLabel(labelID) {
@@ -44,6 +44,10 @@ func (store *Store) CreateDraft(
 	attachedPublicKey,
 	attachedPublicKeyName string,
 	parentID string) (*pmapi.Message, []*pmapi.Attachment, error) {
+	if store.IsOffline() {
+		return nil, nil, ErrOffline
+	}
+
 	attachments := store.prepareDraftAttachments(message, attachmentReaders, attachedPublicKey, attachedPublicKeyName)
 
 	if err := encryptDraft(kr, message, attachments); err != nil {
@@ -182,6 +186,25 @@ func (store *Store) SendMessage(messageID string, req *pmapi.SendMessageReq) err
 	return err
 }
 
+// SetMessageIdentity records the address which signed the sent message when
+// it was sent as another address of a catch-all domain. The identity is added
+// to the local copy of the message only, never to the message being sent.
+func (store *Store) SetMessageIdentity(messageID, identity string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(identityBucket).Put([]byte(messageID), []byte(identity))
+	})
+}
+
+func (store *Store) getMessageIdentity(messageID string) (identity string) {
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		identity = string(tx.Bucket(identityBucket).Get([]byte(messageID)))
+		return nil
+	}); err != nil {
+		store.log.WithError(err).Warn("Cannot get message identity")
+	}
+	return
+}
+
 // getAllMessageIDs returns all API IDs of messages in the local database.
 func (store *Store) getAllMessageIDs() (apiIDs []string, err error) {
 	err = store.db.View(func(tx *bolt.Tx) error {
@@ -304,9 +327,9 @@ func (store *Store) createOrUpdateMessagesEvent(msgs []*pmapi.Message) error { /
 	}
 
 	// Notify the cacher that it should start caching messages.
-	if cache.IsOnDiskCache(store.cache) {
+	if cache.IsPersistentCache(store.cache) {
 		for _, msg := range msgs {
-			store.msgCachePool.newJob(msg.ID)
+			store.msgCachePool.newJob(msg.ID, cachePriority(msg))
 		}
 	}
 
@@ -377,6 +400,10 @@ func (store *Store) deleteMessagesEvent(apiIDs []string) error {
 				return err
 			}
 
+			if err := tx.Bucket(identityBucket).Delete([]byte(apiID)); err != nil {
+				return err
+			}
+
 			for _, a := range store.addresses {
 				if err := a.txDeleteMessage(tx, apiID); err != nil {
 					return err
@@ -229,3 +229,25 @@ func putBodystructureAndSizeToDB(m *mocksForStore, msgID string) (header textpro
 
 	return header, size
 }
+
+func TestDeleteScheduledMessageCancelsIt(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	m.client.EXPECT().GetEvent(gomock.Any(), gomock.Any()).Return(&pmapi.Event{EventID: "latestEventID"}, nil).AnyTimes()
+
+	insertMessage(t, m, "msg1", "Later", addrID1, false, []string{pmapi.AllMailLabel, pmapi.ScheduledLabel})
+	checkMailboxMessageIDs(t, m, pmapi.ScheduledLabel, []wantID{{"msg1", 1}})
+
+	storeMailbox := m.store.addresses[addrID1].mailboxes[pmapi.ScheduledLabel]
+	require.Equal(t, ErrScheduledOpNotAllowed, storeMailbox.LabelMessages([]string{"msg1"}))
+
+	gomock.InOrder(
+		m.client.EXPECT().CancelSend(gomock.Any(), "msg1"),
+		m.client.EXPECT().DeleteMessages(gomock.Any(), []string{"msg1"}),
+	)
+
+	require.NoError(t, storeMailbox.MarkMessagesDeleted([]string{"msg1"}))
+	require.NoError(t, storeMailbox.RemoveDeleted(nil))
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -118,6 +119,8 @@ func (store *Store) isSynced(countsOnAPI []*pmapi.MessagesCount) (bool, error) {
 //    `triggerSync` will reset it and start full sync again.
 func (store *Store) triggerSync() {
 	syncState := store.loadSyncState()
+	syncState.progress = store.syncProgress
+	syncState.policy = store.SyncPolicy()
 
 	// We first clear the last sync state in case this sync fails.
 	syncState.clearFinishTime()
@@ -151,18 +154,56 @@ func (store *Store) triggerSync() {
 
 		store.log.WithField("isIncomplete", syncState.isIncomplete()).Info("Store sync started")
 
-		err := syncAllMail(store, store.client(), syncState)
+		account := store.user.ID()
+		metrics.SyncStarted(account)
+		defer metrics.SyncFinished(account)
+
+		err := syncAllMail(&syncCounter{store, account}, store.client(), syncState)
 		if err != nil {
 			log.WithError(err).Error("Store sync failed")
+			store.lock.Lock()
 			store.syncCooldown.increaseWaitTime()
+			store.lock.Unlock()
 			return
 		}
 
+		store.lock.Lock()
 		store.syncCooldown.reset()
+		store.lock.Unlock()
 		syncState.setFinishTime()
 	}()
 }
 
+// syncCounter reports the messages stored by a sync to the metrics.
+type syncCounter struct {
+	storeSynchronizer
+	account string
+}
+
+func (c *syncCounter) createOrUpdateMessagesEvent(messages []*pmapi.Message) error {
+	if err := c.storeSynchronizer.createOrUpdateMessagesEvent(messages); err != nil {
+		return err
+	}
+
+	metrics.MessagesSynced(c.account, len(messages))
+	return nil
+}
+
+// TriggerSync starts a sync of the store on request, regardless of whether
+// the previous one finished.
+func (store *Store) TriggerSync() {
+	store.lock.Lock()
+	store.syncCooldown.reset()
+	store.lock.Unlock()
+
+	store.triggerSync()
+}
+
+// SyncProgress returns the progress of the running sync.
+func (store *Store) SyncProgress() SyncProgress {
+	return store.syncProgress.snapshot()
+}
+
 // isSyncFinished returns whether the database has finished a sync.
 func (store *Store) isSyncFinished() (isSynced bool) {
 	return store.loadSyncState().isFinished()
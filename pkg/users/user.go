@@ -126,6 +126,15 @@ func (u *User) connect(client pmapi.Client) error {
 	return nil
 }
 
+// Connect connects the user using an already authorised client, e.g. the one
+// obtained by logging in again while the user was loaded.
+func (u *User) Connect(client pmapi.Client) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.connect(client)
+}
+
 func (u *User) loadStore() error {
 	// Logged-out user keeps store running to access offline data.
 	// Therefore it is necessary to close it before re-init.
@@ -311,9 +320,47 @@ func (u *User) GetStoreAddresses() []string {
 	u.lock.RLock()
 	defer u.lock.RUnlock()
 
+	if u.store != nil && !u.store.IsCombinedMode() {
+		return u.creds.Emails
+	}
+
 	return u.creds.Emails[:1]
 }
 
+// IsCombinedAddressMode returns whether all addresses of the user share one
+// mailbox tree. Users without a store are reported as combined.
+func (u *User) IsCombinedAddressMode() bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	if u.store == nil {
+		return true
+	}
+
+	return u.store.IsCombinedMode()
+}
+
+// SetAddressMode switches between one mailbox tree shared by all addresses
+// (combined mode) and a mailbox tree per address (split mode). All IMAP and
+// SMTP connections of the user are closed so that the clients pick up the new
+// mailbox trees.
+func (u *User) SetAddressMode(combined bool) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.store == nil {
+		return ErrLoggedOutUser
+	}
+
+	if err := u.store.UseCombinedMode(combined); err != nil {
+		return errors.Wrap(err, "failed to switch address mode")
+	}
+
+	u.CloseAllConnections()
+
+	return nil
+}
+
 // GetAddresses returns list of all addresses.
 func (u *User) GetAddresses() []string {
 	u.lock.RLock()
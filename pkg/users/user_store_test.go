@@ -20,6 +20,9 @@ package users
 import (
 	"testing"
 
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
 	r "github.com/stretchr/testify/require"
 )
 
@@ -49,3 +52,41 @@ func TestClearStoreWithoutStore(t *testing.T) {
 	r.NotNil(t, user.store)
 	r.Nil(t, user.clearStore())
 }
+
+func TestSetAddressMode(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	user := testNewUser(t, m)
+	defer cleanUpUserData(user)
+
+	r.True(t, user.IsCombinedAddressMode())
+	r.Equal(t, user.GetAddresses()[:1], user.GetStoreAddresses())
+
+	// Switching the mode rebuilds the mailboxes and closes all connections.
+	m.pmapiClient.EXPECT().ListLabels(gomock.Any()).Return([]*pmapi.Label{}, nil).AnyTimes()
+	m.pmapiClient.EXPECT().CountMessages(gomock.Any(), "").Return([]*pmapi.MessagesCount{}, nil).AnyTimes()
+	m.pmapiClient.EXPECT().Addresses().Return([]*pmapi.Address{testPMAPIAddress}).AnyTimes()
+	m.eventListener.EXPECT().Emit(events.CloseConnectionEvent, gomock.Any()).AnyTimes()
+
+	r.NoError(t, user.SetAddressMode(false))
+	r.False(t, user.IsCombinedAddressMode())
+	r.Equal(t, user.GetAddresses(), user.GetStoreAddresses())
+
+	r.NoError(t, user.SetAddressMode(true))
+	r.True(t, user.IsCombinedAddressMode())
+}
+
+func TestSetAddressModeWithoutStore(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	user := testNewUser(t, m)
+	defer cleanUpUserData(user)
+
+	r.Nil(t, user.store.Close())
+	user.store = nil
+
+	r.True(t, user.IsCombinedAddressMode())
+	r.Equal(t, ErrLoggedOutUser, user.SetAddressMode(false))
+}
@@ -300,6 +300,19 @@ func (u *Users) DeleteUser(userID string, clearStore bool) error {
 	return errors.New("user " + userID + " not found")
 }
 
+// Close stops the event loops and the cache workers of all users and closes
+// their stores.
+func (u *Users) Close() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for _, user := range u.users {
+		if err := user.closeStore(); err != nil {
+			log.WithField("user", user.ID()).WithError(err).Error("Failed to close user store")
+		}
+	}
+}
+
 // ClearUsers deletes all users.
 func (u *Users) ClearUsers() error {
 	var result error